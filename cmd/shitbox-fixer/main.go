@@ -0,0 +1,18 @@
+// Command shitbox-fixer watches a Tuya cat litter box and resets it when it
+// gets stuck. See the README for its commands and settings; the detection,
+// reset and notification logic lives in the packages under pkg/.
+package main
+
+import "shitbox-fixer/internal/app"
+
+// Set at build time with -ldflags "-X main.Version=...".
+var (
+  Version   = "dev"
+  GitCommit = "unknown"
+  BuildDate = "unknown"
+)
+
+func main() {
+  app.Version, app.GitCommit, app.BuildDate = Version, GitCommit, BuildDate
+  app.Main()
+}
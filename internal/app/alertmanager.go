@@ -0,0 +1,66 @@
+package app
+
+import (
+  "fmt"
+  "time"
+)
+
+const alertName = "LitterBoxStuck"
+
+type alertmanagerAlert struct {
+  Status       string            `json:"status,omitempty"`
+  Labels       map[string]string `json:"labels"`
+  Annotations  map[string]string `json:"annotations"`
+  StartsAt     time.Time         `json:"startsAt"`
+  EndsAt       time.Time         `json:"endsAt"`
+  GeneratorURL string            `json:"generatorURL"`
+  Fingerprint  string            `json:"fingerprint,omitempty"`
+}
+
+type alertmanagerPayload struct {
+  Version           string              `json:"version"`
+  GroupKey          string              `json:"groupKey"`
+  TruncatedAlerts   int                 `json:"truncatedAlerts"`
+  Status            string              `json:"status"`
+  Receiver          string              `json:"receiver"`
+  GroupLabels       map[string]string   `json:"groupLabels"`
+  CommonLabels      map[string]string   `json:"commonLabels"`
+  CommonAnnotations map[string]string   `json:"commonAnnotations"`
+  ExternalURL       string              `json:"externalURL"`
+  Alerts            []alertmanagerAlert `json:"alerts"`
+}
+
+func newAlertmanagerAlert(incident Incident) alertmanagerAlert {
+  return alertmanagerAlert{
+    Status: incident.Status,
+    Labels: map[string]string{
+      "alertname": alertName,
+      "device_id": incident.DeviceID,
+      "severity":  "warning",
+      "service":   "shitbox-fixer",
+    },
+    Annotations: map[string]string{
+      "summary":     fmt.Sprintf("Litter box %s needs a reset", incident.DeviceID),
+      "description": incident.Reason,
+    },
+    StartsAt:    incident.StartsAt,
+    EndsAt:      incident.EndsAt,
+    Fingerprint: incident.Fingerprint(),
+  }
+}
+
+// alertmanagerWebhook wraps the incident in the payload Alertmanager sends
+// to webhook receivers, so existing receivers can consume it unchanged.
+func alertmanagerWebhook(incident Incident) alertmanagerPayload {
+  alert := newAlertmanagerAlert(incident)
+  return alertmanagerPayload{
+    Version:           "4",
+    GroupKey:          fmt.Sprintf("{}:{alertname=%q, device_id=%q}", alertName, incident.DeviceID),
+    Status:            incident.Status,
+    Receiver:          "shitbox-fixer",
+    GroupLabels:       map[string]string{"alertname": alertName, "device_id": incident.DeviceID},
+    CommonLabels:      alert.Labels,
+    CommonAnnotations: alert.Annotations,
+    Alerts:            []alertmanagerAlert{alert},
+  }
+}
@@ -0,0 +1,338 @@
+package app
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "os/user"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+
+  "shitbox-fixer/pkg/actions"
+)
+
+// AUDIT_LOG=off disables the audit log.
+const auditLogOff = "off"
+
+// Triggers of the commands in the audit log.
+const (
+  auditTriggerCheck        = "check"
+  auditTriggerAPI          = "api"
+  auditTriggerCLI          = "cli"
+  auditTriggerSend         = "send"
+  auditTriggerTroubleshoot = "troubleshoot"
+  auditTriggerFirmware     = "firmware"
+)
+
+// AuditEntry is a command sent to a device, one JSON line of the audit log.
+// Prev is the SHA-256 of the line before it, so changing or removing a line
+// breaks the chain.
+type AuditEntry struct {
+  Time          time.Time                `json:"time"`
+  CorrelationID string                   `json:"correlation_id"`
+  TraceID       string                   `json:"trace_id,omitempty"`
+  DeviceID      string                   `json:"device_id"`
+  Trigger       string                   `json:"trigger"`
+  Reason        string                   `json:"reason,omitempty"`
+  User          string                   `json:"user,omitempty"`
+  Host          string                   `json:"host"`
+  PID           int                      `json:"pid"`
+  Commands      []actions.Command        `json:"commands"`
+  Response      *actions.CommandResponse `json:"response,omitempty"`
+  Error         string                   `json:"error,omitempty"`
+  Prev          string                   `json:"prev"`
+}
+
+// auditTrigger says who or what sent the commands of a context. The commands
+// sent for one trigger, e.g. the steps of a reset sequence, share its
+// correlation ID.
+type auditTrigger struct {
+  trigger       string
+  reason        string
+  user          string
+  correlationID string
+}
+
+type auditTriggerKey struct{}
+
+// withAuditTrigger marks the commands sent with ctx. user is the remote
+// address for the API and the local user for the CLI.
+func withAuditTrigger(ctx context.Context, trigger, reason, user string) context.Context {
+  return context.WithValue(ctx, auditTriggerKey{}, auditTrigger{trigger: trigger, reason: reason, user: user, correlationID: randomHexID(8)})
+}
+
+// localUser names the user running the CLI.
+func localUser() string {
+  if u, err := user.Current(); err == nil {
+    return u.Username
+  }
+  return ""
+}
+
+// commandAudit appends to the audit log. Processes sharing the file, e.g. a
+// watcher and `send`, take turns through a lock on it.
+type commandAudit struct {
+  mu   sync.Mutex
+  path string
+}
+
+// audit is the audit log of the process, nil when disabled.
+var audit *commandAudit
+
+// auditLogPath resolves AUDIT_LOG: audit.jsonl in STATE_DIR unless data
+// storage is off, any other path, or off.
+func auditLogPath(cfg *Config) (string, error) {
+  switch {
+  case cfg.AuditLog == auditLogOff:
+    return "", nil
+  case cfg.AuditLog != "":
+    return cfg.AuditLog, os.MkdirAll(filepath.Dir(cfg.AuditLog), 0o700)
+  case cfg.DataStorage == dataStorageNone:
+    return "", nil
+  }
+  return statePath(cfg, "audit.jsonl")
+}
+
+// lockAuditLog opens the audit log locked for this process, waiting for
+// others to finish their entry.
+func lockAuditLog(path string) (*os.File, error) {
+  file, err := waitLockFile(path, 5*time.Second)
+  if err != nil {
+    return nil, err
+  }
+  if file == nil {
+    // No file locking on this platform.
+    return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+  }
+  return file, nil
+}
+
+// lastLineHash is the SHA-256 of the last line of the audit log, the prev of
+// the next entry.
+func lastLineHash(r io.Reader) (string, error) {
+  var last []byte
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+  for scanner.Scan() {
+    if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+      last = append(last[:0], scanner.Bytes()...)
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return "", err
+  }
+  if last == nil {
+    return "", nil
+  }
+  sum := sha256.Sum256(last)
+  return hex.EncodeToString(sum[:]), nil
+}
+
+// record appends the commands sent to a device with ctx and the outcome.
+func (a *commandAudit) record(ctx context.Context, deviceID string, commands []actions.Command, resp *actions.CommandResponse, sendErr error) error {
+  if a == nil {
+    return nil
+  }
+  trigger, ok := ctx.Value(auditTriggerKey{}).(auditTrigger)
+  if !ok {
+    trigger = auditTrigger{trigger: "unknown", correlationID: randomHexID(8)}
+  }
+  entry := AuditEntry{
+    Time:          time.Now(),
+    CorrelationID: trigger.correlationID,
+    DeviceID:      deviceID,
+    Trigger:       trigger.trigger,
+    Reason:        trigger.reason,
+    User:          trigger.user,
+    PID:           os.Getpid(),
+    Commands:      commands,
+  }
+  entry.Host, _ = os.Hostname()
+  if span, ok := ctx.Value(spanKey{}).(*Span); ok {
+    entry.TraceID = span.span.TraceID
+  }
+  if resp != nil && (resp.T != 0 || resp.Code != 0 || resp.Success) {
+    entry.Response = resp
+  }
+  if sendErr != nil {
+    entry.Error = sendErr.Error()
+  }
+
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  file, err := lockAuditLog(a.path)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  if entry.Prev, err = lastLineHash(file); err != nil {
+    return err
+  }
+  line, err := json.Marshal(entry)
+  if err != nil {
+    return err
+  }
+  if _, err := file.Seek(0, io.SeekEnd); err != nil {
+    return err
+  }
+  _, err = file.Write(append(line, '\n'))
+  return err
+}
+
+func runAudit(cfg *Config, args []string) error {
+  if len(args) == 0 {
+    return auditList(cfg, args)
+  }
+  switch args[0] {
+  case "list":
+    return auditList(cfg, args[1:])
+  case "verify":
+    return auditVerify(cfg, args[1:])
+  default:
+    if strings.HasPrefix(args[0], "-") {
+      return auditList(cfg, args)
+    }
+    return fmt.Errorf("unknown audit command: %s (valid: list, verify)", args[0])
+  }
+}
+
+// errAuditBroken marks an audit log whose chain does not hold.
+var errAuditBroken = errors.New("audit log is broken")
+
+// readAuditLog reads the audit log and checks its chain. It returns the
+// entries, the hash of the last line and, after reading all of them, an
+// errAuditBroken error for the first line that does not follow the one
+// before it.
+func readAuditLog(cfg *Config) ([]AuditEntry, string, error) {
+  path, err := auditLogPath(cfg)
+  if err != nil {
+    return nil, "", err
+  }
+  if path == "" {
+    return nil, "", fmt.Errorf("the audit log is disabled (AUDIT_LOG=off or DATA_STORAGE=none)")
+  }
+  file, err := os.Open(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, "", nil
+  }
+  if err != nil {
+    return nil, "", err
+  }
+  defer file.Close()
+
+  entries := []AuditEntry{}
+  prev := ""
+  var broken error
+  scanner := bufio.NewScanner(file)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+  for n := 1; scanner.Scan(); n++ {
+    line := scanner.Bytes()
+    if len(bytes.TrimSpace(line)) == 0 {
+      continue
+    }
+    var entry AuditEntry
+    err := json.Unmarshal(line, &entry)
+    switch {
+    case broken != nil:
+    case err != nil:
+      broken = fmt.Errorf("%w: line %d is not an audit entry: %v", errAuditBroken, n, err)
+    case entry.Prev != prev:
+      broken = fmt.Errorf("%w: line %d does not follow the line before it, which was changed, added or removed", errAuditBroken, n)
+    }
+    if err == nil {
+      entries = append(entries, entry)
+    }
+    sum := sha256.Sum256(line)
+    prev = hex.EncodeToString(sum[:])
+  }
+  if err := scanner.Err(); err != nil {
+    return entries, prev, err
+  }
+  return entries, prev, broken
+}
+
+func auditList(cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("audit list", flag.ContinueOnError)
+  since := fs.String("since", "", "only show commands newer than this, e.g. 30d or 12h")
+  device := fs.String("device", "", "only show commands sent to this device")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+  var cutoff time.Time
+  if *since != "" {
+    d, err := parseSince(*since)
+    if err != nil {
+      return fmt.Errorf("invalid --since: %w", err)
+    }
+    cutoff = time.Now().Add(-d)
+  }
+
+  entries, _, err := readAuditLog(cfg)
+  if errors.Is(err, errAuditBroken) {
+    fmt.Fprintf(os.Stderr, "Warning: %s, run `audit verify`\n", err)
+  } else if err != nil {
+    return err
+  }
+  filtered := []AuditEntry{}
+  for _, entry := range entries {
+    if entry.Time.Before(cutoff) || (*device != "" && entry.DeviceID != *device) {
+      continue
+    }
+    filtered = append(filtered, entry)
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(filtered)
+  }
+  if len(filtered) == 0 {
+    fmt.Println("No commands found")
+    return nil
+  }
+  table := newTable("TIME", "DEVICE", "TRIGGER", "REASON", "USER", "COMMANDS", "RESULT", "CORRELATION")
+  for _, entry := range filtered {
+    commands := make([]string, 0, len(entry.Commands))
+    for _, command := range entry.Commands {
+      commands = append(commands, fmt.Sprintf("%s=%v", command.Code, command.Value))
+    }
+    result, color := "ok", colorGreen
+    if entry.Error != "" {
+      result, color = entry.Error, colorRed
+    }
+    table.AddRow(cfg.TimeFormat.Format(entry.Time), entry.DeviceID, entry.Trigger, entry.Reason, entry.User, strings.Join(commands, ","), result, entry.CorrelationID)
+    table.SetColor(6, color)
+  }
+  return table.Render(os.Stdout, useColor())
+}
+
+// auditVerify checks the chain of the audit log. The hash of the last line
+// can be kept elsewhere, to also detect when lines are cut off the end.
+func auditVerify(cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  entries, head, err := readAuditLog(cfg)
+  if err != nil {
+    return err
+  }
+  if len(entries) == 0 {
+    fmt.Println("Audit log is empty")
+    return nil
+  }
+  fmt.Printf("Audit log is intact: %d entries, last %s\n", len(entries), head)
+  return nil
+}
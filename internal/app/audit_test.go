@@ -0,0 +1,194 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "testing"
+
+  "shitbox-fixer/pkg/actions"
+)
+
+// writeAuditLog records n commands through the audit log of cfg and returns
+// its lines.
+func writeAuditLog(t *testing.T, cfg *Config, n int) []string {
+  t.Helper()
+  path, err := auditLogPath(cfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  a := &commandAudit{path: path}
+  ctx := withAuditTrigger(context.Background(), auditTriggerCLI, "test", "tester")
+  for i := range n {
+    commands := []actions.Command{{Code: "switch", Value: i%2 == 0}}
+    if err := a.record(ctx, "dev1", commands, &actions.CommandResponse{Success: true, T: int64(i + 1)}, nil); err != nil {
+      t.Fatal(err)
+    }
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestReadAuditLog(t *testing.T) {
+  tests := []struct {
+    name string
+    // tamper changes the lines of a log of three entries.
+    tamper      func(lines []string) []string
+    wantEntries int
+    wantBroken  string
+  }{
+    {
+      name:        "intact",
+      tamper:      func(lines []string) []string { return lines },
+      wantEntries: 3,
+    },
+    {
+      name: "entry changed",
+      tamper: func(lines []string) []string {
+        lines[1] = strings.Replace(lines[1], `"value":false`, `"value":true`, 1)
+        return lines
+      },
+      wantEntries: 3,
+      wantBroken:  "line 3 does not follow",
+    },
+    {
+      name: "entry removed",
+      tamper: func(lines []string) []string {
+        return append(lines[:1], lines[2:]...)
+      },
+      wantEntries: 2,
+      wantBroken:  "line 2 does not follow",
+    },
+    {
+      name: "entry added",
+      tamper: func(lines []string) []string {
+        return slices.Concat(lines[:2], lines[1:])
+      },
+      wantEntries: 4,
+      wantBroken:  "line 3 does not follow",
+    },
+    {
+      name: "first entry replaced",
+      tamper: func(lines []string) []string {
+        return lines[1:]
+      },
+      wantEntries: 2,
+      wantBroken:  "line 1 does not follow",
+    },
+    {
+      name: "garbage line",
+      tamper: func(lines []string) []string {
+        return slices.Concat(lines[:1], []string{"not json\n"}, lines[1:])
+      },
+      wantEntries: 3,
+      wantBroken:  "line 2 is not an audit entry",
+    },
+    {
+      name: "blank lines",
+      tamper: func(lines []string) []string {
+        return slices.Concat(lines[:1], []string{"\n"}, lines[1:])
+      },
+      wantEntries: 3,
+    },
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      cfg := &Config{StateDir: t.TempDir()}
+      lines := writeAuditLog(t, cfg, 3)
+      path := filepath.Join(cfg.StateDir, "audit.jsonl")
+      if err := os.WriteFile(path, []byte(strings.Join(tt.tamper(lines), "")), 0o600); err != nil {
+        t.Fatal(err)
+      }
+
+      entries, head, err := readAuditLog(cfg)
+      if len(entries) != tt.wantEntries {
+        t.Errorf("readAuditLog() returned %d entries, want %d", len(entries), tt.wantEntries)
+      }
+      if tt.wantBroken == "" {
+        if err != nil {
+          t.Errorf("readAuditLog() error = %v, want none", err)
+        }
+        if head == "" {
+          t.Error("readAuditLog() returned no hash of the last line")
+        }
+        return
+      }
+      if !errors.Is(err, errAuditBroken) || !strings.Contains(err.Error(), tt.wantBroken) {
+        t.Errorf("readAuditLog() error = %v, want %q", err, tt.wantBroken)
+      }
+    })
+  }
+}
+
+// Cutting entries off the end keeps the chain intact, only the hash of the
+// last line tells.
+func TestReadAuditLogTruncated(t *testing.T) {
+  cfg := &Config{StateDir: t.TempDir()}
+  lines := writeAuditLog(t, cfg, 3)
+  _, head, err := readAuditLog(cfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  path := filepath.Join(cfg.StateDir, "audit.jsonl")
+  if err := os.WriteFile(path, []byte(strings.Join(lines[:2], "")), 0o600); err != nil {
+    t.Fatal(err)
+  }
+  entries, truncatedHead, err := readAuditLog(cfg)
+  if err != nil || len(entries) != 2 {
+    t.Fatalf("readAuditLog() = %d entries, %v, want 2 entries", len(entries), err)
+  }
+  if truncatedHead == head {
+    t.Error("the hash of the last line did not change when entries were cut off")
+  }
+}
+
+func TestAuditRecordChain(t *testing.T) {
+  cfg := &Config{StateDir: t.TempDir()}
+  writeAuditLog(t, cfg, 2)
+  entries, _, err := readAuditLog(cfg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if entries[0].Prev != "" {
+    t.Errorf("first entry prev = %q, want empty", entries[0].Prev)
+  }
+  if entries[1].Prev == "" {
+    t.Error("second entry has no prev")
+  }
+  first := entries[0]
+  if first.Trigger != auditTriggerCLI || first.Reason != "test" || first.User != "tester" || first.DeviceID != "dev1" {
+    t.Errorf("first entry = %+v, want the trigger, reason, user and device of the context", first)
+  }
+  if first.CorrelationID == "" || first.CorrelationID != entries[1].CorrelationID {
+    t.Errorf("correlation IDs = %q, %q, want the same one for one trigger", first.CorrelationID, entries[1].CorrelationID)
+  }
+}
+
+func TestAuditLogPath(t *testing.T) {
+  dir := t.TempDir()
+  tests := []struct {
+    name string
+    cfg  Config
+    want string
+  }{
+    {"default", Config{StateDir: dir}, filepath.Join(dir, "audit.jsonl")},
+    {"off", Config{StateDir: dir, AuditLog: auditLogOff}, ""},
+    {"no data storage", Config{StateDir: dir, DataStorage: dataStorageNone}, ""},
+    {"explicit path", Config{StateDir: dir, DataStorage: dataStorageNone, AuditLog: filepath.Join(dir, "logs", "audit.jsonl")}, filepath.Join(dir, "logs", "audit.jsonl")},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      got, err := auditLogPath(&tt.cfg)
+      if err != nil || got != tt.want {
+        t.Errorf("auditLogPath() = %q, %v, want %q", got, err, tt.want)
+      }
+    })
+  }
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+  "crypto/subtle"
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "net"
+  "net/http"
+  "os"
+  "strings"
+)
+
+// API roles. Read access covers status, history and events; control access
+// is needed to reset the device.
+const (
+  roleNone = iota
+  roleRead
+  roleControl
+)
+
+var (
+  errUnauthenticated = errors.New("missing or invalid credentials")
+  errForbidden       = errors.New("this token only grants read access")
+)
+
+// apiAuth checks API clients. Tokens are sent as bearer tokens, or as the
+// password of basic auth for clients that only support that. A client
+// certificate verified against SERVE_TLS_CLIENT_CA grants control access.
+type apiAuth struct {
+  readToken    string
+  controlToken string
+  clientCA     bool
+}
+
+func (a apiAuth) enabled() bool {
+  return a.readToken != "" || a.controlToken != "" || a.clientCA
+}
+
+func tokenEqual(a, b string) bool {
+  return b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a apiAuth) role(r *http.Request) int {
+  if !a.enabled() {
+    return roleControl
+  }
+  if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+    return roleControl
+  }
+
+  token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+  if !ok {
+    _, token, _ = r.BasicAuth()
+  }
+  switch {
+  case token == "":
+    return roleNone
+  case tokenEqual(token, a.controlToken):
+    return roleControl
+  case tokenEqual(token, a.readToken):
+    return roleRead
+  default:
+    return roleNone
+  }
+}
+
+// check returns errUnauthenticated or errForbidden when the request lacks
+// the given role.
+func (a apiAuth) check(r *http.Request, required int) error {
+  role := a.role(r)
+  switch {
+  case role >= required:
+    return nil
+  case role == roleNone:
+    return errUnauthenticated
+  default:
+    return errForbidden
+  }
+}
+
+func (s *apiServer) require(role int, handler http.HandlerFunc) http.HandlerFunc {
+  return requireRole(s.auth, role, handler)
+}
+
+// requireRole answers 401 or 403 instead of calling the handler when the
+// request lacks the role.
+func requireRole(auth apiAuth, role int, handler http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    err := auth.check(r, role)
+    switch {
+    case errors.Is(err, errUnauthenticated):
+      w.Header().Set("WWW-Authenticate", `Bearer realm="shitbox-fixer"`)
+      w.Header().Add("WWW-Authenticate", `Basic realm="shitbox-fixer"`)
+      writeError(w, http.StatusUnauthorized, err)
+    case err != nil:
+      writeError(w, http.StatusForbidden, err)
+    default:
+      handler(w, r)
+    }
+  }
+}
+
+// serveTLSConfig loads the server certificate and, for mutual TLS, the CA
+// that client certificates must be signed by. Without tokens a client
+// certificate is required, otherwise it is an alternative to a token.
+func serveTLSConfig(cfg *Config) (*tls.Config, error) {
+  cert, err := tls.LoadX509KeyPair(cfg.ServeTLSCert, cfg.ServeTLSKey)
+  if err != nil {
+    return nil, fmt.Errorf("failed to load SERVE_TLS_CERT and SERVE_TLS_KEY: %w", err)
+  }
+  tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+  if cfg.ServeTLSClientCA == "" {
+    return tlsConfig, nil
+  }
+
+  pem, err := os.ReadFile(cfg.ServeTLSClientCA)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read SERVE_TLS_CLIENT_CA: %w", err)
+  }
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(pem) {
+    return nil, fmt.Errorf("no certificates found in SERVE_TLS_CLIENT_CA %s", cfg.ServeTLSClientCA)
+  }
+  tlsConfig.ClientCAs = pool
+  tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+  if cfg.APIReadToken != "" || cfg.APIControlToken != "" {
+    tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+  }
+  return tlsConfig, nil
+}
+
+func isLoopback(addr net.Addr) bool {
+  tcp, ok := addr.(*net.TCPAddr)
+  return ok && tcp.IP.IsLoopback()
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+  "log/slog"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+const notifyEventCloudUnreachable = "cloud_unreachable"
+
+const (
+  eventCloudUnreachable = "cloud_unreachable"
+  eventCloudReachable   = "cloud_reachable"
+)
+
+// circuitBreaker pauses polling after CIRCUIT_BREAKER_THRESHOLD checks in a
+// row failed, rather than hammering an unreachable Tuya cloud and logging
+// the same error every poll interval. After the cool-off a single check
+// probes the cloud: it closes the breaker or pauses again.
+type circuitBreaker struct {
+  failures int
+  open     bool
+}
+
+// record counts the outcome of a check and returns how long to pause before
+// the next one, zero while the breaker is closed.
+func (b *circuitBreaker) record(cfg *Config, appLog *slog.Logger, result *CheckResult, err error) time.Duration {
+  if err == nil {
+    if b.open {
+      appLog.Info("Tuya cloud reachable again, resuming checks", "failed_checks", b.failures)
+      events.Publish(Event{Time: time.Now(), Type: eventCloudReachable, DeviceID: result.DeviceID})
+      sendNotification(cfg, appLog, notify.Notification{
+        Level:   notify.LevelInfo,
+        Event:   notifyEventCloudUnreachable,
+        Check:   notifyCheck(result),
+        Title:   tr(cfg, "Tuya cloud reachable again"),
+        Message: tr(cfg, "Checks resumed after %d failed checks", b.failures),
+      })
+    }
+    b.failures, b.open = 0, false
+    return 0
+  }
+
+  b.failures++
+  if cfg.CircuitBreakerThreshold <= 0 || b.failures < cfg.CircuitBreakerThreshold {
+    return 0
+  }
+  if b.open {
+    appLog.Warn("Tuya cloud still unreachable, pausing checks", "failed_checks", b.failures, "cool_off", cfg.CircuitBreakerCoolOff)
+    return cfg.CircuitBreakerCoolOff
+  }
+
+  b.open = true
+  appLog.Error("Tuya cloud unreachable, pausing checks", "failed_checks", b.failures, "cool_off", cfg.CircuitBreakerCoolOff, "error", err)
+  events.Publish(Event{Time: time.Now(), Type: eventCloudUnreachable, DeviceID: result.DeviceID, Error: err.Error()})
+  sendNotification(cfg, appLog, notify.Notification{
+    Level:   notify.LevelWarning,
+    Event:   notifyEventCloudUnreachable,
+    Check:   notifyCheck(result),
+    Title:   tr(cfg, "Tuya cloud unreachable"),
+    Message: tr(cfg, "%d checks in a row failed, pausing checks for %s: %s", b.failures, cfg.CircuitBreakerCoolOff, err.Error()),
+  })
+  return cfg.CircuitBreakerCoolOff
+}
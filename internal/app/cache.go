@@ -0,0 +1,58 @@
+package app
+
+import (
+  "context"
+  "sync"
+  "time"
+)
+
+type cacheEntry struct {
+  value     interface{}
+  expiresAt time.Time
+}
+
+// ttlCache is a small read-through cache for Tuya API responses, so that
+// everything looking at the same device within a cycle shares one API call.
+type ttlCache struct {
+  mu      sync.Mutex
+  ttl     time.Duration
+  entries map[string]cacheEntry
+}
+
+var responseCache = &ttlCache{entries: make(map[string]cacheEntry)}
+
+func (c *ttlCache) SetTTL(ttl time.Duration) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.ttl = ttl
+}
+
+func (c *ttlCache) Invalidate(key string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  delete(c.entries, key)
+}
+
+func (c *ttlCache) Get(ctx context.Context, key string, fetch func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+  c.mu.Lock()
+  ttl := c.ttl
+  entry, ok := c.entries[key]
+  c.mu.Unlock()
+
+  if ttl > 0 && ok && time.Now().Before(entry.expiresAt) {
+    return entry.value, nil
+  }
+
+  value, err := fetch(ctx)
+  if err != nil {
+    return nil, err
+  }
+
+  if ttl > 0 {
+    c.mu.Lock()
+    c.entries[key] = cacheEntry{value: value, expiresAt: time.Now().Add(ttl)}
+    c.mu.Unlock()
+  }
+
+  return value, nil
+}
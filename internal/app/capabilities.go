@@ -0,0 +1,196 @@
+package app
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "os/exec"
+  "runtime"
+  "strings"
+  "time"
+)
+
+type Capability struct {
+  Name      string `json:"name"`
+  Available bool   `json:"available"`
+  Detail    string `json:"detail"`
+}
+
+type CapabilityReport struct {
+  Version      string       `json:"version"`
+  GoVersion    string       `json:"go_version"`
+  OS           string       `json:"os"`
+  Arch         string       `json:"arch"`
+  Capabilities []Capability `json:"capabilities"`
+}
+
+// capabilities reports which subsystems this binary supports on the current
+// platform with the given config. cfg is nil when the config failed to load.
+func capabilities(cfg *Config, cfgErr error) []Capability {
+  var caps []Capability
+
+  if cfg != nil {
+    caps = append(caps, Capability{"cloud-api", true, fmt.Sprintf("region %s (%s)", cfg.Region, cfg.APIHost)})
+  } else {
+    caps = append(caps, Capability{"cloud-api", false, fmt.Sprintf("config error: %v", cfgErr)})
+  }
+
+  caps = append(caps,
+    Capability{"local-protocol", false, "not implemented, devices are controlled through the Tuya Cloud API"},
+    Capability{"pulsar", false, "not implemented, device status is polled"},
+    Capability{"keyring", false, "not implemented, credentials are read from the environment, .env or *_FILE secrets"},
+    Capability{"web-ui", false, "not implemented, see the REST API of serve"},
+    Capability{"rest-api", true, "serve"},
+    Capability{"grpc-api", true, "serve, on the REST API address"},
+    Capability{"api-auth", true, "API_READ_TOKEN, API_CONTROL_TOKEN, SERVE_TLS_CLIENT_CA"},
+    Capability{"control-socket", true, "CONTROL_SOCKET, used by status, reset and history"},
+    Capability{"tracing", true, "OpenTelemetry traces via OTLP/HTTP JSON, OTEL_EXPORTER_OTLP_ENDPOINT"},
+    Capability{"influxdb", true, "INFLUXDB_URL, InfluxDB 2.x write API"},
+    Capability{"prometheus-textfile", true, "METRICS_TEXTFILE for the node_exporter textfile collector"},
+    Capability{"uptime-kuma", true, "UPTIME_KUMA_PUSH_URL"},
+    Capability{"heartbeat", true, "HEARTBEAT_URL, HTTP or MQTT"},
+    Capability{"stats-mqtt", true, "STATS_MQTT_URL, daily stats via MQTT"},
+    Capability{"proxy", true, "TUYA_PROXY_URL for the Tuya API, HTTP_PROXY, HTTPS_PROXY and NO_PROXY for all HTTP traffic"},
+  )
+
+  if syslogSupported {
+    caps = append(caps, Capability{"syslog", true, "LOG_OUTPUT=syslog"})
+  } else {
+    caps = append(caps, Capability{"syslog", false, "not supported on " + runtime.GOOS})
+  }
+
+  switch {
+  case !journaldSupported:
+    caps = append(caps, Capability{"journald", false, "only supported on Linux"})
+  case !journaldAvailable():
+    caps = append(caps, Capability{"journald", false, "journal socket " + journaldSocket + " not found"})
+  default:
+    caps = append(caps, Capability{"journald", true, "LOG_OUTPUT=journald"})
+  }
+
+  if sdNotifySupported {
+    caps = append(caps, Capability{"sd-notify", true, "Type=notify and WatchdogSec for watch and serve under systemd"})
+  } else {
+    caps = append(caps, Capability{"sd-notify", false, "only supported on Linux"})
+  }
+
+  for _, tool := range []string{"sops", "age"} {
+    if path, err := exec.LookPath(tool); err == nil {
+      caps = append(caps, Capability{tool, true, "encrypted .env files can be decrypted with " + path})
+    } else {
+      caps = append(caps, Capability{tool, false, tool + " not found in PATH"})
+    }
+  }
+
+  if signalsSupported {
+    caps = append(caps, Capability{"signals", true, "SIGUSR1 triggers a check, SIGHUP reloads the config and SIGUSR2 toggles payload capture in watch mode"})
+  } else {
+    caps = append(caps, Capability{"signals", false, "not supported on " + runtime.GOOS})
+  }
+
+  if instanceLockSupported {
+    caps = append(caps, Capability{"instance-lock", true, "overlapping runs for the same device are skipped"})
+  } else {
+    caps = append(caps, Capability{"instance-lock", false, "file locking is not supported on " + runtime.GOOS})
+  }
+
+  if _, err := time.LoadLocation("Europe/Amsterdam"); err != nil {
+    caps = append(caps, Capability{"tzdata", false, "no time zone database found, install tzdata or build with -tags timetzdata"})
+  } else {
+    caps = append(caps, Capability{"tzdata", true, "time zone database available"})
+  }
+
+  if cfg != nil {
+    if err := checkStateDir(cfg); err != nil {
+      caps = append(caps, Capability{"state", false, fmt.Sprintf("state dir is not writable: %v", err)})
+    } else {
+      caps = append(caps, Capability{"state", true, cfg.StateDir})
+    }
+
+    if cfg.Vault != nil {
+      caps = append(caps, Capability{"vault", true, "credentials read from " + cfg.Vault.path})
+    } else {
+      caps = append(caps, Capability{"vault", false, "VAULT_ADDR not set"})
+    }
+
+    if len(cfg.NotifyChannels) > 0 {
+      names := make([]string, 0, len(cfg.NotifyChannels))
+      for _, channel := range cfg.NotifyChannels {
+        names = append(names, channel.Name)
+      }
+      caps = append(caps, Capability{"notifications", true, strings.Join(names, ", ")})
+    } else {
+      caps = append(caps, Capability{"notifications", false, "NOTIFY_WEBHOOK_URL not set"})
+    }
+
+    if cfg.AlertmanagerURL != "" || cfg.AlertmanagerWebhookURL != "" {
+      caps = append(caps, Capability{"alertmanager", true, "incidents are emitted"})
+    } else {
+      caps = append(caps, Capability{"alertmanager", false, "ALERTMANAGER_URL and ALERTMANAGER_WEBHOOK_URL not set"})
+    }
+  }
+
+  switch {
+  case noColor:
+    caps = append(caps, Capability{"color", false, "disabled with --no-color"})
+  case os.Getenv("NO_COLOR") != "":
+    caps = append(caps, Capability{"color", false, "NO_COLOR is set"})
+  case !isTerminal(os.Stdout):
+    caps = append(caps, Capability{"color", false, "stdout is not a terminal"})
+  default:
+    caps = append(caps, Capability{"color", true, "stdout is a terminal"})
+  }
+
+  return caps
+}
+
+func checkStateDir(cfg *Config) error {
+  if _, err := statePath(cfg, ""); err != nil {
+    return err
+  }
+  file, err := os.CreateTemp(cfg.StateDir, ".probe-*")
+  if err != nil {
+    return err
+  }
+  file.Close()
+  return os.Remove(file.Name())
+}
+
+func runCapabilities(cfg *Config, cfgErr error, args []string) error {
+  output := os.Getenv("OUTPUT")
+  if cfg != nil {
+    output = cfg.Output
+  }
+  if output == "" {
+    output = outputText
+  }
+
+  fs := flag.NewFlagSet("capabilities", flag.ContinueOnError)
+  fs.StringVar(&output, "output", output, "output format: text, json or table")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+
+  report := CapabilityReport{
+    Version:      Version,
+    GoVersion:    runtime.Version(),
+    OS:           runtime.GOOS,
+    Arch:         runtime.GOARCH,
+    Capabilities: capabilities(cfg, cfgErr),
+  }
+
+  if output == outputJSON {
+    return printJSON(report)
+  }
+
+  fmt.Printf("shitbox-fixer %s (%s, %s/%s)\n\n", report.Version, report.GoVersion, report.OS, report.Arch)
+  table := newTable("CAPABILITY", "AVAILABLE", "DETAIL")
+  for _, c := range report.Capabilities {
+    table.AddRow(c.Name, fmt.Sprint(c.Available), c.Detail)
+    table.SetColor(1, boolColor(c.Available))
+  }
+  return table.Render(os.Stdout, useColor())
+}
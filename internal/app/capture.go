@@ -0,0 +1,86 @@
+package app
+
+import (
+  "log/slog"
+  "sync"
+  "time"
+)
+
+// payloadCapture logs full Tuya API requests and responses for a limited
+// time, so a running daemon can be diagnosed without restarting it with
+// DEBUG=true. At most rate exchanges are logged per minute.
+type payloadCapture struct {
+  mu       sync.Mutex
+  until    time.Time
+  timer    *time.Timer
+  window   time.Time
+  count    int
+  dropped  int
+  duration time.Duration
+  rate     int
+}
+
+var capture = &payloadCapture{duration: 15 * time.Minute, rate: 60}
+
+func (c *payloadCapture) Configure(duration time.Duration, rate int) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.duration = duration
+  c.rate = rate
+}
+
+// Toggle starts a capture, or stops the running one.
+func (c *payloadCapture) Toggle(appLog *slog.Logger) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if time.Now().Before(c.until) {
+    c.stopLocked(appLog, "stopped")
+    return
+  }
+
+  c.until = time.Now().Add(c.duration)
+  c.window = time.Time{}
+  c.count = 0
+  c.dropped = 0
+  c.timer = time.AfterFunc(c.duration, func() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.until.IsZero() && !time.Now().Before(c.until) {
+      c.stopLocked(appLog, "expired")
+    }
+  })
+  appLog.Info("Payload capture started", "duration", c.duration, "rate_per_minute", c.rate)
+}
+
+func (c *payloadCapture) stopLocked(appLog *slog.Logger, reason string) {
+  if c.timer != nil {
+    c.timer.Stop()
+  }
+  c.until = time.Time{}
+  appLog.Info("Payload capture "+reason, "dropped", c.dropped)
+}
+
+// Record logs one API exchange if a capture is running. Tokens are redacted
+// as in --dump-http, the log may end up in the system journal.
+func (c *payloadCapture) Record(logger *slog.Logger, method, uri, status string, request, response []byte) {
+  c.mu.Lock()
+  now := time.Now()
+  if !now.Before(c.until) {
+    c.mu.Unlock()
+    return
+  }
+  if now.Sub(c.window) >= time.Minute {
+    c.window = now
+    c.count = 0
+  }
+  if c.count >= c.rate {
+    c.dropped++
+    c.mu.Unlock()
+    return
+  }
+  c.count++
+  c.mu.Unlock()
+
+  logger.Info("Captured Tuya API exchange", "method", method, "uri", redactURI(uri), "status", status, "request", string(request), "response", string(redactTokens(response)))
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+  "bytes"
+  "log/slog"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestCaptureRedactsTokens(t *testing.T) {
+  var out bytes.Buffer
+  logger := slog.New(slog.NewTextHandler(&out, nil))
+  c := &payloadCapture{duration: time.Minute, rate: 10}
+  c.Toggle(slog.New(slog.DiscardHandler))
+  defer c.Toggle(slog.New(slog.DiscardHandler))
+
+  c.Record(logger, "GET", "/v1.0/token?grant_type=1&access_token=secret-query", "200 OK", nil,
+    []byte(`{"success":true,"result":{"access_token":"secret-access","refresh_token":"secret-refresh","expire_time":7200}}`))
+  c.Record(logger, "GET", "/v1.0/devices/dev1", "200 OK", nil, []byte(`{"success":true,"result":{"online":true}}`))
+
+  logged := out.String()
+  if strings.Contains(logged, "secret") {
+    t.Errorf("capture logged a token: %s", logged)
+  }
+  if strings.Count(logged, redacted) != 2 || !strings.Contains(logged, "access_token=%28redacted%29") {
+    t.Errorf("capture did not redact all three tokens: %s", logged)
+  }
+  if !strings.Contains(logged, `online\":true`) {
+    t.Errorf("capture changed a response without tokens: %s", logged)
+  }
+}
+
+func TestRedactURI(t *testing.T) {
+  tests := []struct {
+    uri  string
+    want string
+  }{
+    {"/v1.0/devices/dev1", "/v1.0/devices/dev1"},
+    {"/v1.0/token?grant_type=1", "/v1.0/token?grant_type=1"},
+    {"/v1.0/devices/dev1?access_token=abc&type=7", "/v1.0/devices/dev1?access_token=%28redacted%29&type=7"},
+    {"/v1.0/token?refresh_token=abc", "/v1.0/token?refresh_token=%28redacted%29"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.uri, func(t *testing.T) {
+      if got := redactURI(tt.uri); got != tt.want {
+        t.Errorf("redactURI(%q) = %q, want %q", tt.uri, got, tt.want)
+      }
+    })
+  }
+}
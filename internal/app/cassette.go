@@ -0,0 +1,203 @@
+package app
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// cassette records Tuya API responses to a file (--record-http) and plays
+// them back later instead of calling the API (--replay-http), so detection
+// can be worked on offline against the payloads of a real device.
+type cassette struct {
+  mu           sync.Mutex
+  path         string
+  record       bool
+  interactions []*interaction
+  // played counts the replayed responses per request key.
+  played map[string]int
+}
+
+// httpCassette is nil unless --record-http or --replay-http is set.
+var httpCassette *cassette
+
+type interaction struct {
+  Method   string      `json:"method"`
+  URI      string      `json:"uri"`
+  Request  string      `json:"request,omitempty"`
+  Status   int         `json:"status"`
+  Header   http.Header `json:"header,omitempty"`
+  Response string      `json:"response"`
+  Recorded time.Time   `json:"recorded"`
+}
+
+// volatileParams change with every request, e.g. the time range of a log
+// query, and are ignored when matching a request to a recorded one.
+var volatileParams = map[string]bool{
+  "start_time": true,
+  "end_time":   true,
+}
+
+// cassetteKey identifies a request independent of the API host, the time
+// and the signature.
+func cassetteKey(method string, u *url.URL) string {
+  query := u.Query()
+  keys := make([]string, 0, len(query))
+  for key := range query {
+    if !volatileParams[key] {
+      keys = append(keys, key)
+    }
+  }
+  sort.Strings(keys)
+  pairs := make([]string, 0, len(keys))
+  for _, key := range keys {
+    pairs = append(pairs, key+"="+query.Get(key))
+  }
+  key := method + " " + u.Path
+  if len(pairs) > 0 {
+    key += "?" + strings.Join(pairs, "&")
+  }
+  return key
+}
+
+func recordCassette(path string) (*cassette, error) {
+  c := &cassette{path: path, record: true, interactions: []*interaction{}}
+  // Check that the file can be written before the first request.
+  if err := c.save(); err != nil {
+    return nil, err
+  }
+  return c, nil
+}
+
+func replayCassette(path string) (*cassette, error) {
+  c := &cassette{path: path, played: map[string]int{}}
+  if err := loadStateFile(path, &c.interactions); err != nil {
+    return nil, fmt.Errorf("failed to read cassette %s: %w", path, err)
+  }
+  if len(c.interactions) == 0 {
+    return nil, fmt.Errorf("cassette %s has no recorded requests", path)
+  }
+  return c, nil
+}
+
+func (c *cassette) save() error {
+  if err := saveStateFile(c.path, c.interactions); err != nil {
+    return fmt.Errorf("failed to write cassette %s: %w", c.path, err)
+  }
+  return nil
+}
+
+// wrap returns the transport that records or replays through c.
+func (c *cassette) wrap(next http.RoundTripper) http.RoundTripper {
+  if next == nil {
+    next = http.DefaultTransport
+  }
+  return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+    if c.record {
+      return c.recordRoundTrip(next, req)
+    }
+    return c.replayRoundTrip(req)
+  })
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+  return f(req)
+}
+
+func (c *cassette) recordRoundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+  var body []byte
+  if req.Body != nil {
+    var err error
+    if body, err = io.ReadAll(req.Body); err != nil {
+      return nil, err
+    }
+    req.Body = io.NopCloser(bytes.NewReader(body))
+  }
+
+  resp, err := next.RoundTrip(req)
+  if err != nil {
+    return nil, err
+  }
+  data, err := io.ReadAll(resp.Body)
+  resp.Body.Close()
+  if err != nil {
+    return nil, err
+  }
+  resp.Body = io.NopCloser(bytes.NewReader(data))
+
+  header := http.Header{}
+  if v := resp.Header.Get("Retry-After"); v != "" {
+    header.Set("Retry-After", v)
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.interactions = append(c.interactions, &interaction{
+    Method:   req.Method,
+    URI:      req.URL.RequestURI(),
+    Request:  string(body),
+    Status:   resp.StatusCode,
+    Header:   header,
+    Response: string(redactTokens(data)),
+    Recorded: time.Now(),
+  })
+  // Saved after every request, as a fatal error exits without cleanup.
+  if err := c.save(); err != nil {
+    return nil, err
+  }
+  return resp, nil
+}
+
+// replayRoundTrip answers with the recorded responses to the same request
+// in the order they were recorded, repeating the last one once they run
+// out. Token requests that were not recorded, because the token came from
+// the cache, get a made-up token.
+func (c *cassette) replayRoundTrip(req *http.Request) (*http.Response, error) {
+  key := cassetteKey(req.Method, req.URL)
+
+  c.mu.Lock()
+  var matches []*interaction
+  for _, i := range c.interactions {
+    u, err := url.Parse(i.URI)
+    if err == nil && cassetteKey(i.Method, u) == key {
+      matches = append(matches, i)
+    }
+  }
+  n := c.played[key]
+  c.played[key]++
+  c.mu.Unlock()
+
+  var match *interaction
+  switch {
+  case len(matches) > 0:
+    match = matches[min(n, len(matches)-1)]
+  case req.URL.Path == "/v1.0/token":
+    match = &interaction{Status: http.StatusOK, Response: fmt.Sprintf(`{"success":true,"result":{"access_token":"replay","expire_time":7200},"t":%d}`, time.Now().UnixMilli())}
+  default:
+    return nil, fmt.Errorf("no recorded response for %s in cassette %s", key, c.path)
+  }
+
+  header := match.Header.Clone()
+  if header == nil {
+    header = http.Header{}
+  }
+  header.Set("Content-Type", "application/json")
+  return &http.Response{
+    Status:        fmt.Sprintf("%d %s", match.Status, http.StatusText(match.Status)),
+    StatusCode:    match.Status,
+    Proto:         "HTTP/1.1",
+    ProtoMajor:    1,
+    ProtoMinor:    1,
+    Header:        header,
+    Body:          io.NopCloser(strings.NewReader(match.Response)),
+    ContentLength: int64(len(match.Response)),
+    Request:       req,
+  }, nil
+}
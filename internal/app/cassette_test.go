@@ -0,0 +1,145 @@
+package app
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestCassetteKey(t *testing.T) {
+  tests := []struct {
+    method string
+    uri    string
+    want   string
+  }{
+    {"GET", "https://openapi.tuyaeu.com/v1.0/devices/dev1", "GET /v1.0/devices/dev1"},
+    {"GET", "http://127.0.0.1:8080/v1.0/devices/dev1", "GET /v1.0/devices/dev1"},
+    {"GET", "/v1.0/devices/dev1/logs?type=7&start_time=1&end_time=2&size=100", "GET /v1.0/devices/dev1/logs?size=100&type=7"},
+    {"GET", "/v1.0/devices/dev1/logs?size=100&type=7", "GET /v1.0/devices/dev1/logs?size=100&type=7"},
+    {"POST", "/v1.0/devices/dev1/commands", "POST /v1.0/devices/dev1/commands"},
+    {"GET", "/v1.0/token?grant_type=1", "GET /v1.0/token?grant_type=1"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.method+" "+tt.uri, func(t *testing.T) {
+      u, err := url.Parse(tt.uri)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if got := cassetteKey(tt.method, u); got != tt.want {
+        t.Errorf("cassetteKey(%s, %s) = %q, want %q", tt.method, tt.uri, got, tt.want)
+      }
+    })
+  }
+}
+
+// cassetteGet sends a GET through transport and returns the response body.
+func cassetteGet(t *testing.T, transport http.RoundTripper, uri string) (string, error) {
+  t.Helper()
+  req, err := http.NewRequest(http.MethodGet, uri, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  resp, err := transport.RoundTrip(req)
+  if err != nil {
+    return "", err
+  }
+  defer resp.Body.Close()
+  data, err := io.ReadAll(resp.Body)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return string(data), nil
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "cassette.json")
+  recorder, err := recordCassette(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  calls := 0
+  api := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+    calls++
+    body := fmt.Sprintf(`{"success":true,"result":%d}`, calls)
+    if req.URL.Path == "/v1.0/token" {
+      body = `{"success":true,"result":{"access_token":"secret","expire_time":7200}}`
+    }
+    return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+  })
+  transport := recorder.wrap(api)
+  for _, uri := range []string{
+    "https://openapi.tuyaeu.com/v1.0/token?grant_type=1",
+    "https://openapi.tuyaeu.com/v1.0/devices/dev1/logs?start_time=1&end_time=2&type=7",
+    "https://openapi.tuyaeu.com/v1.0/devices/dev1/logs?start_time=3&end_time=4&type=7",
+  } {
+    if _, err := cassetteGet(t, transport, uri); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  player, err := replayCassette(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  transport = player.wrap(nil)
+  tests := []struct {
+    name    string
+    uri     string
+    want    string
+    wantErr string
+  }{
+    {"first recorded", "http://localhost/v1.0/devices/dev1/logs?type=7&start_time=9&end_time=10", `{"success":true,"result":2}`, ""},
+    {"second recorded", "http://localhost/v1.0/devices/dev1/logs?type=7&start_time=9&end_time=10", `{"success":true,"result":3}`, ""},
+    {"last repeated", "http://localhost/v1.0/devices/dev1/logs?type=7", `{"success":true,"result":3}`, ""},
+    {"token redacted", "http://localhost/v1.0/token?grant_type=1", `{"result":{"access_token":"(redacted)","expire_time":7200},"success":true}`, ""},
+    {"not recorded", "http://localhost/v1.0/devices/dev2/logs?type=7", "", "no recorded response for GET /v1.0/devices/dev2/logs?type=7"},
+  }
+  for _, tt := range tests {
+    got, err := cassetteGet(t, transport, tt.uri)
+    if tt.wantErr != "" {
+      if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+        t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", tt.name, err)
+      continue
+    }
+    if got != tt.want {
+      t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestCassetteReplayToken(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "cassette.json")
+  if err := saveStateFile(path, []*interaction{{Method: "GET", URI: "/v1.0/devices/dev1", Status: http.StatusOK, Response: `{"success":true}`}}); err != nil {
+    t.Fatal(err)
+  }
+  player, err := replayCassette(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  got, err := cassetteGet(t, player.wrap(nil), "http://localhost/v1.0/token?grant_type=1")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !strings.Contains(got, `"access_token":"replay"`) {
+    t.Errorf("token request without a recorded response got %s, want a made-up token", got)
+  }
+}
+
+func TestReplayCassetteEmpty(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "cassette.json")
+  if err := saveStateFile(path, []*interaction{}); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := replayCassette(path); err == nil || !strings.Contains(err.Error(), "has no recorded requests") {
+    t.Errorf("replayCassette() error = %v, want has no recorded requests", err)
+  }
+}
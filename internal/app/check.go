@@ -0,0 +1,172 @@
+package app
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "os"
+  "sort"
+  "strings"
+
+  "shitbox-fixer/pkg/rules"
+)
+
+type CheckItem struct {
+  Name   string `json:"name"`
+  Passed bool   `json:"passed"`
+  Detail string `json:"detail"`
+}
+
+// validateSetup checks the credentials, the device and that the configured
+// rules and reset sequence only use DP codes the device exposes.
+func validateSetup(ctx context.Context, cfg *Config) []CheckItem {
+  var items []CheckItem
+  add := func(name string, err error, detail string) {
+    if err != nil {
+      items = append(items, CheckItem{name, false, err.Error()})
+    } else {
+      items = append(items, CheckItem{name, true, detail})
+    }
+  }
+
+  if _, err := tuya.AccessToken(ctx, true); err != nil {
+    add("credentials", fmt.Errorf("%w (check TUYA_ACCESS_ID, TUYA_ACCESS_KEY and that TUYA_REGION matches the data center of the cloud project)", err), "")
+    return items
+  }
+  add("credentials", nil, fmt.Sprintf("access token issued by %s (region %s)", cfg.APIHost, cfg.Region))
+
+  deviceStatus, err := getDeviceStatus(ctx, cfg.DeviceID)
+  if err != nil {
+    add("device", fmt.Errorf("%w (run `devices` to list the devices of this project)", err), "")
+    return items
+  }
+  add("device", nil, fmt.Sprintf("%v (%v)", deviceStatus.Result["name"], deviceStatus.Result["category"]))
+
+  if online, _ := deviceStatus.Result["online"].(bool); online {
+    add("online", nil, "device is connected to the Tuya cloud")
+  } else {
+    add("online", fmt.Errorf("device is offline"), "")
+  }
+
+  spec, err := getDeviceSpecification(ctx, cfg.DeviceID)
+  if err != nil {
+    add("specification", err, "")
+    return items
+  }
+  functions := map[string]bool{}
+  for _, f := range spec.Result.Functions {
+    functions[f.Code] = true
+  }
+  statusCodes := map[string]bool{}
+  for _, f := range spec.Result.Status {
+    statusCodes[f.Code] = true
+  }
+  for code := range deviceStatusMap(deviceStatus) {
+    statusCodes[code] = true
+  }
+  add("specification", nil, fmt.Sprintf("%d functions, %d status DPs", len(functions), len(statusCodes)))
+
+  checkCodes := func(name string, codes []string, known map[string]bool, kind string) {
+    var missing []string
+    for _, code := range codes {
+      if !known[code] {
+        missing = append(missing, code)
+      }
+    }
+    if len(missing) > 0 {
+      add(name, fmt.Errorf("device has no %s %s", kind, strings.Join(missing, ", ")), "")
+    } else if len(codes) == 0 {
+      add(name, nil, "uses no DP codes")
+    } else {
+      add(name, nil, "uses "+strings.Join(codes, ", "))
+    }
+  }
+
+  var sequenceCodes []string
+  var verifyCodes []string
+  for _, step := range cfg.Preset.ResetSequence {
+    sequenceCodes = appendUnique(sequenceCodes, step.Code)
+    if step.Verify != "" {
+      if rule, err := rules.Parse(step.Verify); err == nil {
+        verifyCodes = appendUnique(verifyCodes, rule.StatusCodes()...)
+      }
+    }
+  }
+  checkCodes("reset sequence", sequenceCodes, functions, "writable DP")
+  if cfg.Preset.ProbeCode != "" {
+    checkCodes("probe", []string{cfg.Preset.ProbeCode}, functions, "writable DP")
+  }
+  if cfg.DetectRule != nil {
+    checkCodes("detect rule", cfg.DetectRule.StatusCodes(), statusCodes, "status DP")
+  }
+  if cfg.OccupiedRule != nil {
+    checkCodes("occupied rule", cfg.OccupiedRule.StatusCodes(), statusCodes, "status DP")
+  }
+  checkCodes("verify rule", appendUnique(cfg.VerifyRule.StatusCodes(), verifyCodes...), statusCodes, "status DP")
+
+  return items
+}
+
+func appendUnique(list []string, values ...string) []string {
+  for _, value := range values {
+    found := false
+    for _, existing := range list {
+      if existing == value {
+        found = true
+        break
+      }
+    }
+    if !found {
+      list = append(list, value)
+    }
+  }
+  sort.Strings(list)
+  return list
+}
+
+func runValidate(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("check", flag.ContinueOnError)
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text, json or table")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+
+  return printCheckItems(cfg, validateSetup(ctx, cfg))
+}
+
+// printCheckItems prints the items and fails when any of them did not pass.
+func printCheckItems(cfg *Config, items []CheckItem) error {
+  failed := 0
+  for _, item := range items {
+    if !item.Passed {
+      failed++
+    }
+  }
+
+  if cfg.Output == outputJSON {
+    if err := printJSON(items); err != nil {
+      return err
+    }
+  } else {
+    table := newTable("CHECK", "RESULT", "DETAIL")
+    for _, item := range items {
+      result := "pass"
+      if !item.Passed {
+        result = "FAIL"
+      }
+      table.AddRow(item.Name, result, item.Detail)
+      table.SetColor(1, boolColor(item.Passed))
+    }
+    if err := table.Render(os.Stdout, useColor()); err != nil {
+      return err
+    }
+  }
+
+  if failed > 0 {
+    return fmt.Errorf("%d of %d checks failed", failed, len(items))
+  }
+  return nil
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+)
+
+// runStatus shows the device status, through the running daemon when there
+// is one so it shares the daemon's response cache.
+func runStatus(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("status", flag.ContinueOnError)
+  group := fs.String("group", "", "show the status of a group of devices, see send --group")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+  if *group != "" {
+    return runGroupStatus(ctx, cfg, *group)
+  }
+
+  status, err := fetchStatus(ctx, cfg)
+  if err != nil {
+    return err
+  }
+  if cfg.Output == outputJSON {
+    return printJSON(status)
+  }
+  return printStatus(cfg, status)
+}
+
+func fetchStatus(ctx context.Context, cfg *Config) (DeviceStatus, error) {
+  var status DeviceStatus
+  err := daemonRequest(ctx, cfg, http.MethodGet, "/api/devices/"+cfg.DeviceID+"/status", nil, &status)
+  if errors.Is(err, errNoDaemon) {
+    var deviceStatus *DeviceInfoResponse
+    deviceStatus, err = getDeviceStatus(ctx, cfg.DeviceID)
+    if err == nil {
+      online, _ := deviceStatus.Result["online"].(bool)
+      status = DeviceStatus{DeviceID: cfg.DeviceID, Online: online, Status: deviceStatusMap(deviceStatus)}
+    }
+  }
+  return status, err
+}
+
+func printStatus(cfg *Config, status DeviceStatus) error {
+  color := useColor()
+  if err := statusTable(cfg, status.Status).Render(os.Stdout, color); err != nil {
+    return err
+  }
+  fmt.Println()
+  summary := newTable(trHeaders(cfg, "DEVICE", "ONLINE")...)
+  summary.AddRow(status.DeviceID, fmt.Sprint(status.Online))
+  summary.SetColor(1, boolColor(status.Online))
+  return summary.Render(os.Stdout, color)
+}
+
+// runGroupStatus shows the status of each device of a group, fetched up to
+// WORKERS at a time. A device that cannot be reached does not stop the
+// others.
+func runGroupStatus(ctx context.Context, cfg *Config, group string) error {
+  devices, err := selectDevices(ctx, cfg, group)
+  if err != nil {
+    return err
+  }
+  if len(devices) == 0 {
+    return fmt.Errorf("no devices in group %s", group)
+  }
+
+  statuses := make([]DeviceStatus, len(devices))
+  errs := make([]error, len(devices))
+  forEachDevice(devices, cfg.Workers, func(i int, device DeviceSummary) {
+    statuses[i], errs[i] = fetchStatus(ctx, deviceConfig(cfg, device))
+  })
+
+  fetched := []DeviceStatus{}
+  failed := 0
+  for i, device := range devices {
+    if errs[i] != nil {
+      failed++
+      slog.Error("Failed to get device status", "device_id", device.ID, "error", errs[i])
+      continue
+    }
+    if cfg.Output == outputJSON {
+      fetched = append(fetched, statuses[i])
+      continue
+    }
+    if i > 0 {
+      fmt.Println()
+    }
+    fmt.Printf("%s (%s)\n\n", device.Name, device.ID)
+    if err := printStatus(cfg, statuses[i]); err != nil {
+      return err
+    }
+  }
+  if cfg.Output == outputJSON {
+    if err := printJSON(fetched); err != nil {
+      return err
+    }
+  }
+  if failed > 0 {
+    return fmt.Errorf("%d of %d devices failed", failed, len(devices))
+  }
+  return nil
+}
+
+// runReset resets the device on request. With a running daemon the reset is
+// queued behind the daemon's own commands; otherwise it runs here under the
+// instance lock, so it cannot overlap a scheduled check.
+func runReset(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) (ResetResult, error) {
+  fs := flag.NewFlagSet("reset", flag.ContinueOnError)
+  group := fs.String("group", "", "reset a group of devices of the same model, see send --group")
+  concurrency := fs.Int("concurrency", cfg.Workers, "number of devices of a group to reset at once")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return ResetResult{}, err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return ResetResult{}, fmt.Errorf("invalid --output: %w", err)
+  }
+  if len(cfg.Preset.ResetSequence) == 0 {
+    return ResetResult{}, fmt.Errorf("preset %s has no reset sequence", cfg.Preset.Name)
+  }
+  if *concurrency < 1 {
+    return ResetResult{}, fmt.Errorf("invalid --concurrency: must be at least 1")
+  }
+  if *group != "" {
+    return runGroupReset(ctx, cfg, appLog, *group, *concurrency)
+  }
+
+  result, err := resetDevice(ctx, cfg, appLog)
+  if err != nil {
+    return ResetResult{}, err
+  }
+  if cfg.Output == outputJSON {
+    return result, printJSON(result)
+  }
+  if result.Error != "" {
+    fmt.Println(tr(cfg, "Reset failed: %s", result.Error))
+  } else {
+    fmt.Println(tr(cfg, "Device reset"))
+  }
+  return result, nil
+}
+
+func resetDevice(ctx context.Context, cfg *Config, appLog *slog.Logger) (ResetResult, error) {
+  var result ResetResult
+  err := daemonRequest(ctx, cfg, http.MethodPost, "/api/devices/"+cfg.DeviceID+"/reset", nil, &result)
+  var daemonErr *daemonError
+  switch {
+  case errors.Is(err, errNoDaemon):
+    if err := acquireInstanceLock(ctx, cfg, appLog); err != nil {
+      return ResetResult{}, err
+    }
+    appLog.Info("Resetting device")
+    result = manualReset(withAuditTrigger(ctx, auditTriggerCLI, "manual reset via CLI", localUser()), cfg, appLog, "CLI")
+  case errors.As(err, &daemonErr) && daemonErr.Status == http.StatusBadGateway:
+    result = ResetResult{DeviceID: cfg.DeviceID, Action: actionResetFailed, Error: daemonErr.Message}
+  case err != nil:
+    return ResetResult{}, err
+  default:
+    appLog.Info("Device reset by the running daemon")
+  }
+  return result, nil
+}
+
+// runGroupReset resets every device of a group with the preset and rules of
+// the config, at most concurrency at a time. The returned result has action
+// reset_failed when any device failed, for the exit code.
+func runGroupReset(ctx context.Context, cfg *Config, appLog *slog.Logger, group string, concurrency int) (ResetResult, error) {
+  devices, err := selectDevices(ctx, cfg, group)
+  if err != nil {
+    return ResetResult{}, err
+  }
+  if len(devices) == 0 {
+    return ResetResult{}, fmt.Errorf("no devices in group %s", group)
+  }
+
+  results := make([]ResetResult, len(devices))
+  forEachDevice(devices, concurrency, func(i int, device DeviceSummary) {
+    result, err := resetDevice(ctx, deviceConfig(cfg, device), appLog.With("device_id", device.ID))
+    if err != nil {
+      result = ResetResult{DeviceID: device.ID, Action: actionResetFailed, Error: err.Error()}
+    }
+    results[i] = result
+  })
+
+  failed := 0
+  for _, result := range results {
+    if result.Action == actionResetFailed {
+      failed++
+    }
+  }
+  summary := ResetResult{Action: actionReset}
+  if failed > 0 {
+    summary.Action = actionResetFailed
+  }
+
+  if cfg.Output == outputJSON {
+    return summary, printJSON(map[string]interface{}{
+      "results": results,
+      "reset":   len(results) - failed,
+      "failed":  failed,
+    })
+  }
+  table := newTable(trHeaders(cfg, "DEVICE", "NAME", "ACTION", "ERROR")...)
+  for i, result := range results {
+    table.AddRow(result.DeviceID, devices[i].Name, result.Action, result.Error)
+    table.SetColor(2, historyKindColor(result.Action))
+  }
+  if err := table.Render(os.Stdout, useColor()); err != nil {
+    return summary, err
+  }
+  fmt.Printf("\nReset %d of %d devices\n", len(results)-failed, len(results))
+  return summary, nil
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Tuya rejects requests whose timestamp is off by more than a few minutes,
+// a smaller skew is only reported.
+const maxClockSkew = time.Minute
+
+// parseZoneOffset parses a Tuya time zone such as "+01:00" into seconds east
+// of UTC.
+func parseZoneOffset(s string) (int, error) {
+  if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+    return 0, fmt.Errorf("invalid time zone %q", s)
+  }
+  hours, minutes, _ := strings.Cut(s[1:], ":")
+  h, err := strconv.Atoi(hours)
+  if err != nil {
+    return 0, fmt.Errorf("invalid time zone %q", s)
+  }
+  m := 0
+  if minutes != "" {
+    if m, err = strconv.Atoi(minutes); err != nil {
+      return 0, fmt.Errorf("invalid time zone %q", s)
+    }
+  }
+  offset := h*3600 + m*60
+  if s[0] == '-' {
+    offset = -offset
+  }
+  return offset, nil
+}
+
+func formatZoneOffset(offset int) string {
+  sign := '+'
+  if offset < 0 {
+    sign, offset = '-', -offset
+  }
+  return fmt.Sprintf("%c%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// checkClock compares the time zone the device runs its schedules in with
+// TIMEZONE, and the clock of this host with the Tuya cloud's. Devices take
+// their time from the cloud, so a scheduled clean at the wrong hour is
+// almost always a wrong time zone rather than a drifting device clock.
+func checkClock(ctx context.Context, cfg *Config, deviceID string) ([]CheckItem, error) {
+  responseCache.Invalidate("status/" + deviceID)
+  sent := time.Now()
+  deviceStatus, err := getDeviceStatus(ctx, deviceID)
+  if err != nil {
+    return nil, err
+  }
+  received := time.Now()
+
+  var items []CheckItem
+  _, expected := received.In(cfg.TimeFormat.Location).Zone()
+  // Tuya may report the standard offset during daylight saving time.
+  year := received.Year()
+  _, winter := time.Date(year, time.January, 1, 0, 0, 0, 0, cfg.TimeFormat.Location).Zone()
+  _, summer := time.Date(year, time.July, 1, 0, 0, 0, 0, cfg.TimeFormat.Location).Zone()
+  zone, _ := deviceStatus.Result["time_zone"].(string)
+  switch offset, err := parseZoneOffset(zone); {
+  case zone == "":
+    items = append(items, CheckItem{"time zone", true, "not reported by the device"})
+  case err != nil:
+    items = append(items, CheckItem{"time zone", false, err.Error()})
+  case offset != expected && offset != winter && offset != summer:
+    items = append(items, CheckItem{"time zone", false, fmt.Sprintf("device uses %s, TIMEZONE is %s (%s); change the location of the home in the Smart Life app, the device picks it up when it reconnects", zone, formatZoneOffset(expected), cfg.TimeFormat.Location)})
+  default:
+    items = append(items, CheckItem{"time zone", true, fmt.Sprintf("%s, matches TIMEZONE (%s)", zone, cfg.TimeFormat.Location)})
+  }
+
+  if deviceStatus.T > 0 {
+    // The cloud's time lies somewhere within the round trip.
+    local := sent.Add(received.Sub(sent) / 2)
+    skew := time.UnixMilli(deviceStatus.T).Sub(local).Round(time.Second)
+    if skew < 0 {
+      skew = -skew
+    }
+    if skew > maxClockSkew {
+      items = append(items, CheckItem{"host clock", false, fmt.Sprintf("off by %s from the Tuya cloud, sync it (e.g. with NTP)", skew)})
+    } else {
+      items = append(items, CheckItem{"host clock", true, "within a minute of the Tuya cloud"})
+    }
+  }
+  return items, nil
+}
+
+func runClock(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("clock", flag.ContinueOnError)
+  deviceID := fs.String("device", cfg.DeviceID, "device to check")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text, json or table")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+
+  items, err := checkClock(ctx, cfg, *deviceID)
+  if err != nil {
+    return err
+  }
+  return printCheckItems(cfg, items)
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+  "encoding/json"
+  "errors"
+  "os"
+)
+
+// coldStartState counts the checks completed per device ID. A device is in
+// cold start until it has been observed for COLD_START_CYCLES checks.
+type coldStartState map[string]int
+
+func coldStartPath(cfg *Config) (string, error) {
+  return statePath(cfg, "coldstart.json")
+}
+
+func loadColdStart(cfg *Config) (coldStartState, error) {
+  path, err := coldStartPath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return coldStartState{}, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  state := coldStartState{}
+  if err := json.Unmarshal(data, &state); err != nil {
+    return nil, err
+  }
+  return state, nil
+}
+
+func saveColdStart(cfg *Config, state coldStartState) error {
+  path, err := coldStartPath(cfg)
+  if err != nil {
+    return err
+  }
+  return saveStateFile(path, state)
+}
+
+// observeColdStart counts one completed check for the device and reports
+// whether it was still within the cold start period. Devices that already
+// have history entries are considered warm, so upgrading does not re-enter
+// cold start.
+func observeColdStart(cfg *Config) (bool, error) {
+  if cfg.ColdStartCycles <= 0 {
+    return false, nil
+  }
+
+  state, err := loadColdStart(cfg)
+  if err != nil {
+    return false, err
+  }
+
+  observed, ok := state[cfg.DeviceID]
+  if !ok {
+    entries, err := readHistory(cfg)
+    if err != nil {
+      return false, err
+    }
+    for _, entry := range entries {
+      if entry.DeviceID == cfg.DeviceID {
+        observed = cfg.ColdStartCycles
+        break
+      }
+    }
+  }
+
+  if observed >= cfg.ColdStartCycles {
+    if !ok {
+      state[cfg.DeviceID] = observed
+      return false, saveColdStart(cfg, state)
+    }
+    return false, nil
+  }
+
+  state[cfg.DeviceID] = observed + 1
+  return true, saveColdStart(cfg, state)
+}
@@ -0,0 +1,249 @@
+package app
+
+import (
+  "bufio"
+  "fmt"
+  "maps"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+// localConfigFiles are looked for in the working directory. They are
+// loaded on top of the base config file, so a checkout can override single
+// settings of a config shared by the user or the system.
+var localConfigFiles = []string{".env", ".env.age"}
+
+// configFileCandidates lists where the base config file is looked for, in
+// order: config.yaml or config.env in the user config directory
+// ($XDG_CONFIG_HOME/shitbox-fixer on Linux, ~/Library/Application Support/
+// shitbox-fixer on macOS, %AppData%\shitbox-fixer on Windows),
+// /etc/shitbox-fixer and finally .env next to the executable. Every .env
+// may also be an age encrypted .env.age.
+func configFileCandidates() []string {
+  var candidates []string
+  if dir, err := os.UserConfigDir(); err == nil {
+    dir = filepath.Join(dir, "shitbox-fixer")
+    candidates = append(candidates, filepath.Join(dir, "config.yaml"), filepath.Join(dir, "config.yml"), filepath.Join(dir, "config.env"))
+  }
+  candidates = append(candidates, "/etc/shitbox-fixer/config.yaml", "/etc/shitbox-fixer/config.env")
+  if exePath, err := os.Executable(); err == nil {
+    dir := filepath.Dir(exePath)
+    candidates = append(candidates, filepath.Join(dir, ".env"), filepath.Join(dir, ".env.age"))
+  }
+  return candidates
+}
+
+// findConfigFiles returns the config files to load, lowest precedence
+// first: the first base config file found, then the first local one. An
+// explicit path (--config) is loaded alone and must exist.
+func findConfigFiles(explicit string) ([]string, error) {
+  if explicit != "" {
+    if _, err := os.Stat(explicit); err != nil {
+      return nil, err
+    }
+    return []string{explicit}, nil
+  }
+
+  var paths []string
+  for _, candidates := range [][]string{configFileCandidates(), localConfigFiles} {
+    for _, path := range candidates {
+      if _, err := os.Stat(path); err == nil {
+        paths = append(paths, path)
+        break
+      }
+    }
+  }
+  // .env next to the executable is the local one when run from its
+  // directory.
+  if len(paths) == 2 && sameFile(paths[0], paths[1]) {
+    paths = paths[1:]
+  }
+  return paths, nil
+}
+
+func sameFile(a, b string) bool {
+  infoA, errA := os.Stat(a)
+  infoB, errB := os.Stat(b)
+  return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// yamlConfigFile returns the YAML file among the config files, the only
+// kind that can hold profiles, or "" when there is none.
+func yamlConfigFile(paths []string) string {
+  for _, path := range paths {
+    if isYAMLConfig(path) {
+      return path
+    }
+  }
+  return ""
+}
+
+func isYAMLConfig(path string) bool {
+  path = strings.TrimSuffix(path, ".age")
+  return strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml")
+}
+
+// parseConfigFile reads a config file into environment variable names and
+// values. YAML files map variable names (in any case) to values, e.g.
+// `tuya_region: eu`; other files use the .env format. YAML files can define
+// named profiles under `profiles`, whose values override the top-level ones
+// when the profile is selected.
+func parseConfigFile(path, profile string) (map[string]string, error) {
+  data, err := readConfigFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  values := map[string]string{}
+  if !isYAMLConfig(path) {
+    scanner := bufio.NewScanner(strings.NewReader(string(data)))
+    for scanner.Scan() {
+      line := strings.TrimSpace(scanner.Text())
+      if line == "" || strings.HasPrefix(line, "#") {
+        continue
+      }
+      parts := strings.SplitN(line, "=", 2)
+      if len(parts) == 2 {
+        values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+      }
+    }
+    if profile != "" {
+      return nil, fmt.Errorf("profiles are only supported in YAML config files, not %s", path)
+    }
+    return values, scanner.Err()
+  }
+
+  doc, err := parseYAML(string(data))
+  if err != nil {
+    return nil, fmt.Errorf("invalid %s: %w", path, err)
+  }
+  profiles, _ := doc["profiles"].(map[string]interface{})
+  delete(doc, "profiles")
+  if err := addYAMLValues(values, doc); err != nil {
+    return nil, fmt.Errorf("invalid %s: %w", path, err)
+  }
+
+  if profile != "" {
+    selected, ok := profiles[profile].(map[string]interface{})
+    if !ok {
+      return nil, fmt.Errorf("unknown profile %s in %s (available: %s)", profile, path, strings.Join(profileNames(profiles), ", "))
+    }
+    if err := addYAMLValues(values, selected); err != nil {
+      return nil, fmt.Errorf("invalid profile %s in %s: %w", profile, path, err)
+    }
+  }
+  return values, nil
+}
+
+func profileNames(profiles map[string]interface{}) []string {
+  names := make([]string, 0, len(profiles))
+  for name := range profiles {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// configProfiles returns the names of the profiles in a YAML config file.
+func configProfiles(path string) ([]string, error) {
+  if !isYAMLConfig(path) {
+    return nil, fmt.Errorf("profiles are only supported in YAML config files, not %s", path)
+  }
+  data, err := readConfigFile(path)
+  if err != nil {
+    return nil, err
+  }
+  doc, err := parseYAML(string(data))
+  if err != nil {
+    return nil, fmt.Errorf("invalid %s: %w", path, err)
+  }
+  profiles, _ := doc["profiles"].(map[string]interface{})
+  if len(profiles) == 0 {
+    return nil, fmt.Errorf("%s has no profiles", path)
+  }
+  return profileNames(profiles), nil
+}
+
+func addYAMLValues(values map[string]string, doc map[string]interface{}) error {
+  for key, value := range doc {
+    s, ok := value.(string)
+    if !ok {
+      return fmt.Errorf("%s must be a single value", key)
+    }
+    values[strings.ToUpper(key)] = s
+  }
+  return nil
+}
+
+// parseConfigFiles reads the config files in order, each overriding the
+// values of the ones before. The profile is selected in the YAML file.
+func parseConfigFiles(paths []string, profile string) (map[string]string, error) {
+  if profile != "" && yamlConfigFile(paths) == "" {
+    return nil, fmt.Errorf("profiles are only supported in YAML config files, not %s", strings.Join(paths, ", "))
+  }
+  values := map[string]string{}
+  for _, path := range paths {
+    fileProfile := ""
+    if isYAMLConfig(path) {
+      fileProfile = profile
+    }
+    fileValues, err := parseConfigFile(path, fileProfile)
+    if err != nil {
+      return nil, err
+    }
+    maps.Copy(values, fileValues)
+  }
+  return values, nil
+}
+
+// The loaded config files, and the variables they set, for reloading them.
+var (
+  configFilePaths   []string
+  configFileProfile string
+  configFileEnv     = map[string]bool{}
+)
+
+// loadConfigFiles sets the variables of the config files that are not
+// already set in the environment.
+func loadConfigFiles(paths []string, profile string) error {
+  values, err := parseConfigFiles(paths, profile)
+  if err != nil {
+    return err
+  }
+  configFilePaths, configFileProfile = paths, profile
+  for key, value := range values {
+    if _, ok := os.LookupEnv(key); !ok {
+      os.Setenv(key, value)
+      configFileEnv[key] = true
+    }
+  }
+  return nil
+}
+
+// reloadConfigFiles reads the config files again. Variables set by the
+// files are updated or unset; the environment and flags still take
+// precedence.
+func reloadConfigFiles() error {
+  if len(configFilePaths) == 0 {
+    return nil
+  }
+  values, err := parseConfigFiles(configFilePaths, configFileProfile)
+  if err != nil {
+    return err
+  }
+  for key := range configFileEnv {
+    if _, ok := values[key]; !ok {
+      os.Unsetenv(key)
+      delete(configFileEnv, key)
+    }
+  }
+  for key, value := range values {
+    if _, ok := os.LookupEnv(key); !ok || configFileEnv[key] {
+      os.Setenv(key, value)
+      configFileEnv[key] = true
+    }
+  }
+  return nil
+}
@@ -0,0 +1,338 @@
+package app
+
+import (
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+const notifyEventConsumable = "consumable"
+
+var consumableName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// Consumable is a part that is replaced after a number of clean cycles or
+// after some time, whichever comes first.
+type Consumable struct {
+  Name     string
+  Cleans   int
+  Interval time.Duration
+}
+
+// parseConsumables parses CONSUMABLES, e.g. "filter=300,litter=14d". A
+// number counts clean cycles, a duration the time since the replacement.
+func parseConsumables(s string) ([]Consumable, error) {
+  var consumables []Consumable
+  seen := map[string]bool{}
+  for _, part := range strings.Split(s, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+    name, value, ok := strings.Cut(part, "=")
+    name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+    if !ok || !consumableName.MatchString(name) {
+      return nil, fmt.Errorf("%q (expected name=cycles or name=duration, e.g. filter=300)", part)
+    }
+    if seen[name] {
+      return nil, fmt.Errorf("%s is listed twice", name)
+    }
+    seen[name] = true
+
+    c := Consumable{Name: name}
+    if cleans, err := strconv.Atoi(value); err == nil {
+      if cleans <= 0 {
+        return nil, fmt.Errorf("invalid number of cycles %q for %s", value, name)
+      }
+      c.Cleans = cleans
+    } else if interval, err := parseSince(value); err == nil && interval > 0 {
+      c.Interval = interval
+    } else {
+      return nil, fmt.Errorf("invalid limit %q for %s (expected cycles or a duration)", value, name)
+    }
+    consumables = append(consumables, c)
+  }
+  return consumables, nil
+}
+
+func (c Consumable) limit() string {
+  if c.Cleans > 0 {
+    return fmt.Sprintf("%d cycles", c.Cleans)
+  }
+  return formatDays(c.Interval)
+}
+
+func formatDays(d time.Duration) string {
+  if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+    return fmt.Sprintf("%dd", d/(24*time.Hour))
+  }
+  return d.String()
+}
+
+// Replacements are recorded by `consumables reset` and only read by the
+// watcher, which keeps its counters in a file of its own.
+type replacementState map[string]map[string]time.Time
+
+type ConsumableUsage struct {
+  Since    time.Time `json:"since"`
+  Cleans   int       `json:"cleans"`
+  Reminded bool      `json:"reminded,omitempty"`
+}
+
+type consumableState struct {
+  CountedUntil time.Time                   `json:"counted_until,omitzero"`
+  Usage        map[string]*ConsumableUsage `json:"usage"`
+}
+
+type usageState map[string]*consumableState
+
+func replacementsPath(cfg *Config) (string, error) {
+  return statePath(cfg, "consumables.json")
+}
+
+func usagePath(cfg *Config) (string, error) {
+  return statePath(cfg, "consumable-usage.json")
+}
+
+func loadReplacements(cfg *Config) (replacementState, error) {
+  state := replacementState{}
+  path, err := replacementsPath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  return state, loadStateFile(path, &state)
+}
+
+func loadUsage(cfg *Config) (usageState, error) {
+  state := usageState{}
+  path, err := usagePath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  return state, loadStateFile(path, &state)
+}
+
+// currentUsage returns the usage of a consumable, starting over when it was
+// replaced since. Consumables seen for the first time count from now.
+func (s *consumableState) currentUsage(name string, replaced, now time.Time) *ConsumableUsage {
+  usage := s.Usage[name]
+  switch {
+  case usage == nil && replaced.IsZero():
+    usage = &ConsumableUsage{Since: now}
+  case usage == nil || replaced.After(usage.Since):
+    usage = &ConsumableUsage{Since: replaced}
+  }
+  s.Usage[name] = usage
+  return usage
+}
+
+func (u *ConsumableUsage) due(c Consumable, now time.Time) bool {
+  return (c.Cleans > 0 && u.Cleans >= c.Cleans) || (c.Interval > 0 && now.Sub(u.Since) >= c.Interval)
+}
+
+// trackConsumables counts the clean cycles in the logs of a check and reminds
+// once when a consumable is due. Log entries are counted once, the logs of
+// consecutive checks overlap.
+func trackConsumables(cfg *Config, appLog *slog.Logger, result *CheckResult) {
+  if len(cfg.Consumables) == 0 || result.Standby {
+    return
+  }
+  replacements, err := loadReplacements(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load consumable replacements", "error", err)
+    return
+  }
+  usage, err := loadUsage(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load consumable usage", "error", err)
+    return
+  }
+  state := usage[result.DeviceID]
+  if state == nil {
+    state = &consumableState{}
+    usage[result.DeviceID] = state
+  }
+  if state.Usage == nil {
+    state.Usage = map[string]*ConsumableUsage{}
+  }
+
+  var cleans []time.Time
+  countedUntil := state.CountedUntil
+  for _, logEntry := range result.Logs {
+    logMap, ok := logEntry.(map[string]interface{})
+    if !ok || !isCleanEvent(cfg.Preset, logMap) {
+      continue
+    }
+    eventTime, _ := logMap["event_time"].(float64)
+    if t := time.UnixMilli(int64(eventTime)); t.After(state.CountedUntil) {
+      cleans = append(cleans, t)
+      if t.After(countedUntil) {
+        countedUntil = t
+      }
+    }
+  }
+  state.CountedUntil = countedUntil
+
+  var due []Consumable
+  for _, c := range cfg.Consumables {
+    u := state.currentUsage(c.Name, replacements[result.DeviceID][c.Name], result.Time)
+    for _, t := range cleans {
+      if t.After(u.Since) {
+        u.Cleans++
+      }
+    }
+    if !u.Reminded && u.due(c, result.Time) {
+      u.Reminded = true
+      due = append(due, c)
+    }
+  }
+
+  path, err := usagePath(cfg)
+  if err == nil {
+    err = saveStateFile(path, usage)
+  }
+  if err != nil {
+    appLog.Warn("Failed to save consumable usage", "error", err)
+  }
+
+  for _, c := range due {
+    appLog.Info("Consumable due for replacement", "consumable", c.Name, "limit", c.limit())
+    sendNotification(cfg, appLog, notify.Notification{
+      Level:   notify.LevelInfo,
+      Event:   notifyEventConsumable,
+      Check:   notifyCheck(result),
+      Title:   tr(cfg, "Replace %s", c.Name),
+      Message: tr(cfg, "%s is due for replacement after %s, run `consumables reset %s` afterwards", c.Name, c.limit(), c.Name),
+    })
+  }
+}
+
+type ConsumableStatus struct {
+  Name   string    `json:"name"`
+  Limit  string    `json:"limit"`
+  Cleans int       `json:"cleans"`
+  Since  time.Time `json:"since,omitzero"`
+  Due    bool      `json:"due"`
+}
+
+func runConsumables(cfg *Config, args []string) error {
+  sub := "list"
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    sub, args = args[0], args[1:]
+  }
+  fs := flag.NewFlagSet("consumables "+sub, flag.ContinueOnError)
+  deviceID := fs.String("device", cfg.DeviceID, "device of the consumables")
+
+  switch sub {
+  case "list":
+    fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text, json or table")
+    if err := fs.Parse(args); err != nil {
+      return err
+    }
+    if err := validateOutput(cfg.Output); err != nil {
+      return fmt.Errorf("invalid --output: %w", err)
+    }
+    return listConsumables(cfg, *deviceID)
+
+  case "reset":
+    if len(args) == 0 || args[0] == "" || args[0][0] == '-' {
+      return fmt.Errorf("usage: consumables reset <name> [--device id]")
+    }
+    name := args[0]
+    if err := fs.Parse(args[1:]); err != nil {
+      return err
+    }
+    known := false
+    for _, c := range cfg.Consumables {
+      known = known || c.Name == name
+    }
+    if !known {
+      return fmt.Errorf("unknown consumable %q, see CONSUMABLES", name)
+    }
+
+    state, err := loadReplacements(cfg)
+    if err != nil {
+      return err
+    }
+    if state[*deviceID] == nil {
+      state[*deviceID] = map[string]time.Time{}
+    }
+    state[*deviceID][name] = time.Now()
+    path, err := replacementsPath(cfg)
+    if err != nil {
+      return err
+    }
+    if err := saveStateFile(path, state); err != nil {
+      return err
+    }
+    fmt.Printf("Reset %s on %s, counting from now\n", name, *deviceID)
+    return nil
+  }
+
+  return fmt.Errorf("unknown consumables command: %s (valid: list, reset)", sub)
+}
+
+func listConsumables(cfg *Config, deviceID string) error {
+  replacements, err := loadReplacements(cfg)
+  if err != nil {
+    return err
+  }
+  usage, err := loadUsage(cfg)
+  if err != nil {
+    return err
+  }
+  state := usage[deviceID]
+  if state == nil {
+    state = &consumableState{}
+  }
+  if state.Usage == nil {
+    state.Usage = map[string]*ConsumableUsage{}
+  }
+
+  now := time.Now()
+  statuses := []ConsumableStatus{}
+  for _, c := range cfg.Consumables {
+    replaced := replacements[deviceID][c.Name]
+    status := ConsumableStatus{Name: c.Name, Limit: c.limit(), Since: replaced}
+    // Without a check since, a replacement has no cycles counted yet.
+    if u := state.Usage[c.Name]; u != nil && !replaced.After(u.Since) {
+      status.Since, status.Cleans = u.Since, u.Cleans
+      status.Due = u.due(c, now)
+    } else if !replaced.IsZero() {
+      status.Due = (&ConsumableUsage{Since: replaced}).due(c, now)
+    }
+    statuses = append(statuses, status)
+  }
+  sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+  if cfg.Output == outputJSON {
+    return printJSON(statuses)
+  }
+  if len(statuses) == 0 {
+    fmt.Println("No consumables configured, see CONSUMABLES")
+    return nil
+  }
+  table := newTable("NAME", "LIMIT", "CYCLES", "SINCE", "DUE")
+  for _, s := range statuses {
+    since := "-"
+    if !s.Since.IsZero() {
+      since = cfg.TimeFormat.Format(s.Since)
+    }
+    due := "no"
+    if s.Due {
+      due = "yes"
+    }
+    table.AddRow(s.Name, s.Limit, strconv.Itoa(s.Cleans), since, due)
+    if s.Due {
+      table.SetColor(4, colorYellow)
+    }
+  }
+  return table.Render(os.Stdout, useColor())
+}
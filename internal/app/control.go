@@ -0,0 +1,183 @@
+package app
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "net/http"
+  "os"
+  "strings"
+  "time"
+)
+
+// CONTROL_SOCKET=off disables the control socket; a tcp:// address listens
+// on localhost TCP instead of a Unix socket.
+const (
+  controlSocketOff = "off"
+  controlTCPPrefix = "tcp://"
+)
+
+var errNoDaemon = errors.New("no running daemon")
+
+// daemonError is an error response of the daemon; 502 means the Tuya API or
+// the device failed.
+type daemonError struct {
+  Status  int
+  Message string
+}
+
+func (e *daemonError) Error() string {
+  return "daemon: " + e.Message
+}
+
+// controlAddress returns the network and address of the control socket,
+// by default one Unix socket per device in STATE_DIR.
+func controlAddress(cfg *Config) (string, string, error) {
+  switch {
+  case cfg.ControlSocket == controlSocketOff:
+    return "", "", nil
+  case strings.HasPrefix(cfg.ControlSocket, controlTCPPrefix):
+    return "tcp", strings.TrimPrefix(cfg.ControlSocket, controlTCPPrefix), nil
+  case cfg.ControlSocket != "":
+    return "unix", cfg.ControlSocket, nil
+  }
+  path, err := statePath(cfg, "control-"+strings.NewReplacer("/", "_", "\\", "_").Replace(cfg.DeviceID)+".sock")
+  return "unix", path, err
+}
+
+func listenControl(cfg *Config) (net.Listener, error) {
+  network, address, err := controlAddress(cfg)
+  if err != nil || network == "" {
+    return nil, err
+  }
+  if network == "unix" {
+    return listenSocket(address)
+  }
+
+  listener, err := net.Listen(network, address)
+  if err != nil {
+    return nil, err
+  }
+  if !isLoopback(listener.Addr()) {
+    listener.Close()
+    return nil, fmt.Errorf("CONTROL_SOCKET must listen on localhost, got %s", address)
+  }
+  return listener, nil
+}
+
+// listenSocket listens on a Unix socket that only its owner can connect to.
+func listenSocket(path string) (net.Listener, error) {
+  // A socket left behind by a crashed daemon refuses connections.
+  if conn, err := net.Dial("unix", path); err == nil {
+    conn.Close()
+    return nil, fmt.Errorf("another daemon is listening on %s", path)
+  }
+  os.Remove(path)
+
+  listener, err := net.Listen("unix", path)
+  if err != nil {
+    return nil, err
+  }
+  if err := os.Chmod(path, 0o600); err != nil {
+    listener.Close()
+    return nil, err
+  }
+  return listener, nil
+}
+
+// serveControl lets the CLI of the same user drive the daemon, so manual
+// resets go through the daemon's command queue and history instead of
+// racing it. The Unix socket is only accessible to its owner; on TCP the API
+// tokens apply when they are set. triggers is the poll loop's channel for
+// `trigger`.
+func serveControl(ctx context.Context, live *liveConfig, appLog *slog.Logger, triggers chan<- struct{}) (stop func()) {
+  cfg := live.Load()
+  listener, err := listenControl(cfg)
+  if err != nil {
+    appLog.Warn("Failed to open control socket, the CLI will not use this daemon", "error", err)
+    return func() {}
+  }
+  if listener == nil {
+    return func() {}
+  }
+
+  api := &apiServer{ctx: ctx, cfg: live, appLog: appLog, source: "CLI", triggers: triggers}
+  if listener.Addr().Network() == "tcp" {
+    api.auth = apiAuth{readToken: cfg.APIReadToken, controlToken: cfg.APIControlToken}
+  }
+  server := &http.Server{
+    Handler:           api.routes(),
+    ReadHeaderTimeout: 10 * time.Second,
+    BaseContext:       func(net.Listener) context.Context { return ctx },
+  }
+  go func() {
+    if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+      appLog.Error("Control socket failed", "error", err)
+    }
+  }()
+  appLog.Debug("Listening on control socket", "address", listener.Addr().String())
+
+  return func() {
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    _ = server.Shutdown(shutdownCtx)
+  }
+}
+
+// daemonRequest sends an API request to the daemon on the control socket
+// and decodes the JSON response into out. It returns errNoDaemon when no
+// daemon is listening.
+func daemonRequest(ctx context.Context, cfg *Config, method, path string, body, out interface{}) error {
+  network, address, err := controlAddress(cfg)
+  if err != nil || network == "" {
+    return errNoDaemon
+  }
+
+  var reader io.Reader
+  if body != nil {
+    payload, err := json.Marshal(body)
+    if err != nil {
+      return err
+    }
+    reader = bytes.NewReader(payload)
+  }
+  req, err := http.NewRequestWithContext(ctx, method, "http://fixer"+path, reader)
+  if err != nil {
+    return err
+  }
+  if body != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+  if network == "tcp" && cfg.APIControlToken != "" {
+    req.Header.Set("Authorization", "Bearer "+cfg.APIControlToken)
+  }
+
+  client := &http.Client{Transport: &http.Transport{
+    DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+      return (&net.Dialer{}).DialContext(ctx, network, address)
+    },
+  }}
+  resp, err := client.Do(req)
+  if err != nil {
+    var opErr *net.OpError
+    if errors.As(err, &opErr) && opErr.Op == "dial" {
+      return errNoDaemon
+    }
+    return fmt.Errorf("failed to reach the daemon: %w", err)
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode >= 300 {
+    var apiErr apiError
+    if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+      apiErr.Error = resp.Status
+    }
+    return &daemonError{Status: resp.StatusCode, Message: apiErr.Error}
+  }
+  return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,429 @@
+package app
+
+import (
+  "bufio"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+// Data storage levels, see DATA_STORAGE.
+const (
+  dataStorageFull    = "full"
+  dataStorageMinimal = "minimal"
+  dataStorageNone    = "none"
+)
+
+type DataExport struct {
+  ExportedAt    time.Time             `json:"exported_at"`
+  DeviceID      string                `json:"device_id"`
+  History       []HistoryEntry        `json:"history"`
+  OpenIncident  *Incident             `json:"open_incident"`
+  Outage        *Outage               `json:"outage"`
+  Stuck         *StuckPeriod          `json:"stuck"`
+  Rollups       []DayStats            `json:"rollups"`
+  ColdStart     *int                  `json:"cold_start_checks"`
+  Overrides     []Override            `json:"overrides"`
+  Notifications []notify.Notification `json:"queued_notifications"`
+  Inbox         []InboxEntry          `json:"notifications"`
+  Firmware      *firmwareSeen         `json:"firmware"`
+
+  ConsumableReplacements map[string]time.Time `json:"consumable_replacements"`
+  ConsumableUsage        *consumableState     `json:"consumable_usage"`
+  NotifyState            *notifyState         `json:"notify_state"`
+
+  // The commands sent to the device. They are exported, but not wiped, as
+  // removing lines would break the chain of the audit log.
+  Audit []AuditEntry `json:"audit"`
+}
+
+// noticeFirstRun explains what is stored the first time the state directory
+// is created, so users know before anything is written.
+func noticeFirstRun(cfg *Config, appLog *slog.Logger) {
+  if _, err := os.Stat(cfg.StateDir); !os.IsNotExist(err) {
+    return
+  }
+  switch cfg.DataStorage {
+  case dataStorageNone:
+    appLog.Info("No history is stored (DATA_STORAGE=none), only the state needed for incidents and queued notifications", "state_dir", cfg.StateDir)
+  case dataStorageFull:
+    appLog.Info("Storing history with raw device status and logs (DATA_STORAGE=full), see `data export` and `data wipe`", "state_dir", cfg.StateDir)
+  default:
+    appLog.Info("Storing resets and failures without raw device data (DATA_STORAGE=minimal), see `data export` and `data wipe`", "state_dir", cfg.StateDir)
+  }
+}
+
+func runData(cfg *Config, args []string) error {
+  if len(args) == 0 {
+    return fmt.Errorf("usage: data export|wipe")
+  }
+
+  switch args[0] {
+  case "export":
+    return dataExport(cfg, args[1:])
+  case "wipe":
+    return dataWipe(cfg, args[1:])
+  default:
+    return fmt.Errorf("unknown data command: %s (valid: export, wipe)", args[0])
+  }
+}
+
+func collectDeviceData(cfg *Config, deviceID string) (*DataExport, error) {
+  export := &DataExport{ExportedAt: time.Now(), DeviceID: deviceID, History: []HistoryEntry{}, Rollups: []DayStats{}, Overrides: []Override{}, Notifications: []notify.Notification{}, Inbox: []InboxEntry{}, Audit: []AuditEntry{}}
+
+  entries, err := readHistory(cfg)
+  if err != nil {
+    return nil, err
+  }
+  for _, entry := range entries {
+    if entry.DeviceID == deviceID {
+      export.History = append(export.History, entry)
+    }
+  }
+
+  incident, err := loadOpenIncident(cfg)
+  if err != nil {
+    return nil, err
+  }
+  if incident != nil && incident.DeviceID == deviceID {
+    export.OpenIncident = incident
+  }
+
+  outage, err := loadOutage(cfg)
+  if err != nil {
+    return nil, err
+  }
+  if outage != nil && outage.DeviceID == deviceID {
+    export.Outage = outage
+  }
+
+  stuck, err := loadStuckPeriod(cfg)
+  if err != nil {
+    return nil, err
+  }
+  if stuck != nil && stuck.DeviceID == deviceID {
+    export.Stuck = stuck
+  }
+
+  rollups, err := loadRollups(cfg)
+  if err != nil {
+    return nil, err
+  }
+  export.Rollups = append(export.Rollups, rollups[deviceID]...)
+
+  coldStart, err := loadColdStart(cfg)
+  if err != nil {
+    return nil, err
+  }
+  if checks, ok := coldStart[deviceID]; ok {
+    export.ColdStart = &checks
+  }
+
+  inbox, err := readInbox(cfg)
+  if err != nil {
+    return nil, err
+  }
+  for _, entry := range inbox {
+    if entry.DeviceID == deviceID {
+      export.Inbox = append(export.Inbox, entry)
+    }
+  }
+
+  overrides, err := loadOverrides(cfg)
+  if err != nil {
+    return nil, err
+  }
+  export.Overrides = append(export.Overrides, overrides[deviceID]...)
+
+  firmware, err := loadFirmwareState(cfg)
+  if err != nil {
+    return nil, err
+  }
+  export.Firmware = firmware[deviceID]
+
+  replacements, err := loadReplacements(cfg)
+  if err != nil {
+    return nil, err
+  }
+  export.ConsumableReplacements = replacements[deviceID]
+  usage, err := loadUsage(cfg)
+  if err != nil {
+    return nil, err
+  }
+  export.ConsumableUsage = usage[deviceID]
+
+  // The throttling and escalation state is that of the device of STATE_DIR.
+  if deviceID == cfg.DeviceID {
+    path, err := notifyStatePath(cfg)
+    if err != nil {
+      return nil, err
+    }
+    if _, err := os.Stat(path); err == nil {
+      if export.NotifyState, err = loadNotifyState(cfg); err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  if path, err := auditLogPath(cfg); err != nil {
+    return nil, err
+  } else if path != "" {
+    audited, _, err := readAuditLog(cfg)
+    if err != nil && !errors.Is(err, errAuditBroken) {
+      return nil, err
+    }
+    for _, entry := range audited {
+      if entry.DeviceID == deviceID {
+        export.Audit = append(export.Audit, entry)
+      }
+    }
+  }
+
+  channels, err := queuedChannels(cfg)
+  if err != nil {
+    return nil, err
+  }
+  for _, channel := range channels {
+    queued, err := channel.readQueue(cfg)
+    if err != nil {
+      return nil, err
+    }
+    for _, n := range queued {
+      if n.DeviceID == deviceID {
+        export.Notifications = append(export.Notifications, n)
+      }
+    }
+  }
+
+  return export, nil
+}
+
+// queuedChannels returns every channel with a notification queue on disk,
+// including channels that are no longer configured.
+func queuedChannels(cfg *Config) ([]NotifyChannel, error) {
+  pattern, err := statePath(cfg, "notify-queue-*.json")
+  if err != nil {
+    return nil, err
+  }
+  paths, err := filepath.Glob(pattern)
+  if err != nil {
+    return nil, err
+  }
+  channels := make([]NotifyChannel, 0, len(paths))
+  for _, path := range paths {
+    name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "notify-queue-"), ".json")
+    channels = append(channels, NotifyChannel{Channel: notify.Channel{Name: name}})
+  }
+  return channels, nil
+}
+
+func dataExport(cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("data export", flag.ContinueOnError)
+  deviceID := fs.String("device", cfg.DeviceID, "device to export")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if *deviceID == "" {
+    return fmt.Errorf("no device, set TUYA_DEVICE_ID or use --device")
+  }
+
+  export, err := collectDeviceData(cfg, *deviceID)
+  if err != nil {
+    return err
+  }
+  return printJSON(export)
+}
+
+func dataWipe(cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("data wipe", flag.ContinueOnError)
+  deviceID := fs.String("device", cfg.DeviceID, "device to wipe")
+  yes := fs.Bool("yes", false, "do not ask for confirmation")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if *deviceID == "" {
+    return fmt.Errorf("no device, set TUYA_DEVICE_ID or use --device")
+  }
+
+  export, err := collectDeviceData(cfg, *deviceID)
+  if err != nil {
+    return err
+  }
+
+  if !*yes {
+    if !isTerminal(os.Stdin) {
+      return fmt.Errorf("refusing to wipe without confirmation, use --yes")
+    }
+    fmt.Printf("Delete %d history entries and all state of device %s from %s? [y/N] ", len(export.History), *deviceID, cfg.StateDir)
+    line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+    line = strings.ToLower(strings.TrimSpace(line))
+    if line != "y" && line != "yes" {
+      return fmt.Errorf("aborted")
+    }
+  }
+
+  entries, err := readHistory(cfg)
+  if err != nil {
+    return err
+  }
+  kept := make([]HistoryEntry, 0, len(entries))
+  for _, entry := range entries {
+    if entry.DeviceID != *deviceID {
+      kept = append(kept, entry)
+    }
+  }
+  if err := writeHistory(cfg, kept); err != nil {
+    return err
+  }
+
+  if len(export.Inbox) > 0 {
+    inbox, err := readInbox(cfg)
+    if err != nil {
+      return err
+    }
+    keptInbox := make([]InboxEntry, 0, len(inbox))
+    for _, entry := range inbox {
+      if entry.DeviceID != *deviceID {
+        keptInbox = append(keptInbox, entry)
+      }
+    }
+    if err := writeInbox(cfg, keptInbox); err != nil {
+      return err
+    }
+  }
+
+  if export.OpenIncident != nil {
+    if err := saveOpenIncident(cfg, nil); err != nil {
+      return err
+    }
+  }
+
+  if export.Outage != nil {
+    if err := saveOutage(cfg, nil); err != nil {
+      return err
+    }
+  }
+
+  if export.Stuck != nil {
+    if err := saveStuckPeriod(cfg, nil); err != nil {
+      return err
+    }
+  }
+
+  if len(export.Rollups) > 0 {
+    rollups, err := loadRollups(cfg)
+    if err != nil {
+      return err
+    }
+    delete(rollups, *deviceID)
+    if err := saveRollups(cfg, rollups); err != nil {
+      return err
+    }
+  }
+
+  if export.ColdStart != nil {
+    coldStart, err := loadColdStart(cfg)
+    if err != nil {
+      return err
+    }
+    delete(coldStart, *deviceID)
+    if err := saveColdStart(cfg, coldStart); err != nil {
+      return err
+    }
+  }
+
+  if len(export.Overrides) > 0 {
+    overrides, err := loadOverrides(cfg)
+    if err != nil {
+      return err
+    }
+    delete(overrides, *deviceID)
+    if err := saveOverrides(cfg, overrides); err != nil {
+      return err
+    }
+  }
+
+  if export.Firmware != nil {
+    firmware, err := loadFirmwareState(cfg)
+    if err != nil {
+      return err
+    }
+    delete(firmware, *deviceID)
+    if err := saveFirmwareState(cfg, firmware); err != nil {
+      return err
+    }
+  }
+
+  if export.ConsumableReplacements != nil {
+    replacements, err := loadReplacements(cfg)
+    if err != nil {
+      return err
+    }
+    delete(replacements, *deviceID)
+    path, err := replacementsPath(cfg)
+    if err != nil {
+      return err
+    }
+    if err := saveStateFile(path, replacements); err != nil {
+      return err
+    }
+  }
+
+  if export.ConsumableUsage != nil {
+    usage, err := loadUsage(cfg)
+    if err != nil {
+      return err
+    }
+    delete(usage, *deviceID)
+    path, err := usagePath(cfg)
+    if err != nil {
+      return err
+    }
+    if err := saveStateFile(path, usage); err != nil {
+      return err
+    }
+  }
+
+  if export.NotifyState != nil {
+    path, err := notifyStatePath(cfg)
+    if err != nil {
+      return err
+    }
+    if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+      return err
+    }
+  }
+
+  channels, err := queuedChannels(cfg)
+  if err != nil {
+    return err
+  }
+  for _, channel := range channels {
+    queued, err := channel.readQueue(cfg)
+    if err != nil {
+      return err
+    }
+    keptQueue := make([]notify.Notification, 0, len(queued))
+    for _, n := range queued {
+      if n.DeviceID != *deviceID {
+        keptQueue = append(keptQueue, n)
+      }
+    }
+    if err := channel.writeQueue(cfg, keptQueue); err != nil {
+      return err
+    }
+  }
+
+  fmt.Printf("Wiped %d history entries and the state of device %s\n", len(export.History), *deviceID)
+  if len(export.Audit) > 0 {
+    fmt.Printf("The audit log keeps the %d commands sent to the device, see `audit list`\n", len(export.Audit))
+  }
+  return nil
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "sort"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+// Events classify notifications for throttling and deduplication. The
+// problem events describe a condition of the device that lasts until it
+// recovers or is reset.
+const (
+  notifyEventStuck           = "stuck"
+  notifyEventResetSuppressed = "reset_suppressed"
+  notifyEventResetFailed     = "reset_failed"
+  notifyEventReset           = notify.EventReset
+  notifyEventRecovered       = notify.EventRecovered
+  notifyEventEscalated       = "escalated"
+  notifyEventDrawerFull      = "drawer_full"
+)
+
+var notifyEvents = []string{notifyEventStuck, notifyEventResetSuppressed, notifyEventResetFailed, notifyEventReset, notifyEventRecovered, notifyEventEscalated, notifyEventDrawerFull, notifyEventConsumable, notifyEventFirmware, notifyEventCloudUnreachable, notifyEventWatchdog}
+
+func isProblemEvent(event string) bool {
+  return event == notifyEventStuck || event == notifyEventResetSuppressed || event == notifyEventResetFailed
+}
+
+// NotifyThrottle is the minimum time between two notifications of the same
+// event. The empty key holds the default for events not listed.
+type NotifyThrottle map[string]time.Duration
+
+// parseNotifyThrottle parses NOTIFY_THROTTLE, e.g. "2h" for every event or
+// "stuck=6h,reset_failed=2h".
+func parseNotifyThrottle(s string) (NotifyThrottle, error) {
+  throttle := NotifyThrottle{}
+  for _, part := range strings.Split(s, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+    event, value, ok := strings.Cut(part, "=")
+    if !ok {
+      event, value = "", part
+    }
+    event = strings.TrimSpace(event)
+    if event != "" && !isNotifyEvent(event) {
+      return nil, fmt.Errorf("unknown event %q (valid: %s)", event, strings.Join(notifyEvents, ", "))
+    }
+    if event == notifyEventRecovered {
+      return nil, fmt.Errorf("recoveries are never throttled")
+    }
+    duration, err := parseSince(strings.TrimSpace(value))
+    if err != nil || duration < 0 {
+      return nil, fmt.Errorf("invalid duration %q", value)
+    }
+    throttle[event] = duration
+  }
+  return throttle, nil
+}
+
+func isNotifyEvent(event string) bool {
+  for _, e := range notifyEvents {
+    if e == event {
+      return true
+    }
+  }
+  return false
+}
+
+func (t NotifyThrottle) For(event string) time.Duration {
+  if event == notifyEventRecovered {
+    return 0
+  }
+  if d, ok := t[event]; ok {
+    return d
+  }
+  return t[""]
+}
+
+// notifyState remembers what was sent per event across runs, so cron runs
+// are throttled just like a watcher.
+type notifyState struct {
+  LastSent   map[string]time.Time `json:"last_sent,omitempty"`
+  Suppressed map[string]int       `json:"suppressed,omitempty"`
+  Active     map[string]time.Time `json:"active,omitempty"`
+
+  FailedResets int                  `json:"failed_resets,omitempty"`
+  Escalated    map[string]time.Time `json:"escalated,omitempty"`
+
+  DrawerFullSince *time.Time `json:"drawer_full_since,omitempty"`
+}
+
+func notifyStatePath(cfg *Config) (string, error) {
+  return statePath(cfg, "notify-state.json")
+}
+
+func loadNotifyState(cfg *Config) (*notifyState, error) {
+  state := &notifyState{LastSent: map[string]time.Time{}, Suppressed: map[string]int{}, Active: map[string]time.Time{}, Escalated: map[string]time.Time{}}
+  path, err := notifyStatePath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return state, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  if err := json.Unmarshal(data, state); err != nil {
+    return nil, fmt.Errorf("corrupt notification state %s: %w", path, err)
+  }
+  if state.LastSent == nil {
+    state.LastSent = map[string]time.Time{}
+  }
+  if state.Suppressed == nil {
+    state.Suppressed = map[string]int{}
+  }
+  if state.Active == nil {
+    state.Active = map[string]time.Time{}
+  }
+  if state.Escalated == nil {
+    state.Escalated = map[string]time.Time{}
+  }
+  return state, nil
+}
+
+func saveNotifyState(cfg *Config, state *notifyState) error {
+  path, err := notifyStatePath(cfg)
+  if err != nil {
+    return err
+  }
+  return saveStateFile(path, state)
+}
+
+// admitNotification decides whether a notification is sent. With
+// NOTIFY_ON_CHANGE a problem event is only sent when the condition starts,
+// and NOTIFY_THROTTLE drops events sent too recently; the next notification
+// of the event mentions how many were dropped. Notifications without an
+// event are always sent, and so is everything when the state is unreadable.
+func admitNotification(cfg *Config, appLog *slog.Logger, n *notify.Notification) bool {
+  if n.Event == "" || (!cfg.NotifyOnChange && len(cfg.NotifyThrottle) == 0) {
+    return true
+  }
+  state, err := loadNotifyState(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load notification state", "error", err)
+    return true
+  }
+
+  if cfg.NotifyOnChange {
+    if isProblemEvent(n.Event) {
+      if since, active := state.Active[n.Event]; active {
+        appLog.Debug("Notification skipped, condition unchanged", "event", n.Event, "since", since)
+        return false
+      }
+      state.Active[n.Event] = n.Time
+    } else if n.Event == notifyEventReset {
+      // A verified reset resolves the problem, the reset notification says so.
+      state.Active = map[string]time.Time{}
+    }
+  }
+
+  if throttle := cfg.NotifyThrottle.For(n.Event); throttle > 0 {
+    if last, ok := state.LastSent[n.Event]; ok && n.Time.Sub(last) < throttle {
+      state.Suppressed[n.Event]++
+      appLog.Debug("Notification throttled", "event", n.Event, "last_sent", last, "suppressed", state.Suppressed[n.Event])
+      if err := saveNotifyState(cfg, state); err != nil {
+        appLog.Warn("Failed to save notification state", "error", err)
+      }
+      return false
+    }
+  }
+  if count := state.Suppressed[n.Event]; count > 0 {
+    n.Message += tr(cfg, " (%d similar notification(s) throttled since %s)", count, cfg.TimeFormat.Format(state.LastSent[n.Event]))
+    delete(state.Suppressed, n.Event)
+  }
+  state.LastSent[n.Event] = n.Time
+
+  if err := saveNotifyState(cfg, state); err != nil {
+    appLog.Warn("Failed to save notification state", "error", err)
+  }
+  return true
+}
+
+// notifyRecovered sends a recovery notification on the first healthy check
+// after a problem was notified with NOTIFY_ON_CHANGE.
+func notifyRecovered(cfg *Config, appLog *slog.Logger, result *CheckResult) {
+  if !cfg.NotifyOnChange || len(cfg.NotifyChannels) == 0 {
+    return
+  }
+  state, err := loadNotifyState(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load notification state", "error", err)
+    return
+  }
+  if len(state.Active) == 0 {
+    return
+  }
+
+  events := make([]string, 0, len(state.Active))
+  for event := range state.Active {
+    events = append(events, event)
+  }
+  sort.Strings(events)
+  conditions := make([]string, 0, len(events))
+  for _, event := range events {
+    conditions = append(conditions, tr(cfg, "%s since %s", event, cfg.TimeFormat.Format(state.Active[event])))
+  }
+  state.Active = map[string]time.Time{}
+  if err := saveNotifyState(cfg, state); err != nil {
+    appLog.Warn("Failed to save notification state", "error", err)
+    return
+  }
+
+  sendNotification(cfg, appLog, notify.Notification{
+    Level:   notify.LevelInfo,
+    Event:   notifyEventRecovered,
+    Title:   tr(cfg, "Device recovered"),
+    Message: tr(cfg, "Device is working properly again (%s)", strings.Join(conditions, ", ")),
+    Check:   notifyCheck(result),
+  })
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+  "fmt"
+  "log/slog"
+  "time"
+
+  "shitbox-fixer/pkg/detect"
+)
+
+// detectSettings configures pkg/detect from the preset and DETECT_*.
+func detectSettings(cfg *Config) detect.Settings {
+  return detect.Settings{
+    ResetOnOffline: cfg.Preset.ResetOnOffline,
+    StuckValues:    cfg.Preset.StuckValues,
+    FaultNames:     cfg.Preset.FaultNames,
+    OfflineGrace:   cfg.DetectOfflineGrace,
+    OfflineRamp:    cfg.DetectOfflineRamp,
+    NoCleanWindow:  cfg.DetectNoClean,
+    StuckDuration:  cfg.DetectStuckDuration,
+    Rule:           cfg.DetectRule,
+    Weights:        cfg.DetectWeights,
+  }
+}
+
+// deviceLastSeen returns when the device last reported to the cloud, or the
+// zero time when Tuya does not say.
+func deviceLastSeen(deviceInfo *DeviceInfoResponse) time.Time {
+  updated, ok := deviceInfo.Result["update_time"].(float64)
+  if !ok || updated <= 0 {
+    return time.Time{}
+  }
+  return time.Unix(int64(updated), 0)
+}
+
+func detectorInput(cfg *Config, appLog *slog.Logger, deviceInfo *DeviceInfoResponse, lastLogs []interface{}, offlineOK, noClean bool) *detect.Input {
+  in := &detect.Input{
+    Settings:  detectSettings(cfg),
+    DeviceID:  cfg.DeviceID,
+    LastSeen:  deviceLastSeen(deviceInfo),
+    Status:    deviceStatusMap(deviceInfo),
+    OfflineOK: offlineOK,
+    NoClean:   noClean,
+    Env:       ruleEnv(cfg.Preset, deviceInfo, lastLogs),
+    Values:    map[string]float64{},
+  }
+  in.Online, _ = deviceInfo.Result["online"].(bool)
+  if !in.Online && cfg.DetectOfflineGrace > 0 {
+    since, err := offlineSince(cfg, in.LastSeen)
+    if err != nil {
+      appLog.Warn("Failed to load outage state", "error", err)
+    }
+    in.OfflineSince = since
+  }
+  for _, entry := range lastLogs {
+    logMap, ok := entry.(map[string]interface{})
+    if !ok {
+      continue
+    }
+    var log detect.Log
+    log.Code, _ = logMap["code"].(string)
+    if value, ok := logMap["value"]; ok {
+      log.Value = fmt.Sprint(value)
+    }
+    if eventTime, ok := logMap["event_time"].(float64); ok {
+      log.Time = time.UnixMilli(int64(eventTime))
+    }
+    in.Logs = append(in.Logs, log)
+  }
+  return in
+}
+
+// runDetection scores the device state of a check with pkg/detect. owner
+// is set for the check that keeps the state, see trackStuck.
+func runDetection(cfg *Config, appLog *slog.Logger, deviceInfo *DeviceInfoResponse, lastLogs []interface{}, offlineOK, noClean, owner bool) detect.Detection {
+  in := detectorInput(cfg, appLog, deviceInfo, lastLogs, offlineOK, noClean)
+  if period := trackStuck(cfg, appLog, in, time.Now(), owner); period != nil {
+    in.Stuck = &period.Period
+  }
+  return detect.Run(in, appLog)
+}
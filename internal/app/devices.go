@@ -0,0 +1,97 @@
+package app
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "net/url"
+  "os"
+)
+
+type DeviceSummary struct {
+  ID          string `json:"id"`
+  Name        string `json:"name"`
+  Category    string `json:"category"`
+  ProductName string `json:"product_name"`
+  Online      bool   `json:"online"`
+}
+
+type DeviceListResponse struct {
+  Code    int    `json:"code"`
+  Msg     string `json:"msg"`
+  Success bool   `json:"success"`
+  Result  struct {
+    Devices    []DeviceSummary `json:"devices"`
+    HasMore    bool            `json:"has_more"`
+    LastRowKey string          `json:"last_row_key"`
+  } `json:"result"`
+  T int64 `json:"t"`
+}
+
+func getDevices(ctx context.Context) ([]DeviceSummary, error) {
+  var devices []DeviceSummary
+  lastRowKey := ""
+
+  for {
+    query := url.Values{}
+    query.Set("size", "100")
+    if lastRowKey != "" {
+      query.Set("last_row_key", lastRowKey)
+    }
+
+    resp := &DeviceListResponse{}
+    err := tuyaGet(ctx, "/v1.0/iot-01/associated-users/devices?"+query.Encode(), resp)
+
+    if err != nil {
+      return nil, fmt.Errorf("failed to get devices: %w", err)
+    }
+
+    if !resp.Success {
+      return nil, tuyaError(resp.Code, resp.Msg)
+    }
+
+    devices = append(devices, resp.Result.Devices...)
+
+    if !resp.Result.HasMore || resp.Result.LastRowKey == "" || resp.Result.LastRowKey == lastRowKey {
+      break
+    }
+    lastRowKey = resp.Result.LastRowKey
+  }
+
+  return devices, nil
+}
+
+func runDevices(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("devices", flag.ContinueOnError)
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+
+  devices, err := getDevices(ctx)
+  if err != nil {
+    return err
+  }
+
+  if cfg.Output == outputJSON {
+    if devices == nil {
+      devices = []DeviceSummary{}
+    }
+    return printJSON(devices)
+  }
+
+  if len(devices) == 0 {
+    fmt.Println("No devices found. Make sure your Tuya app account is linked to the cloud project.")
+    return nil
+  }
+
+  table := newTable("ID", "NAME", "CATEGORY", "PRODUCT", "ONLINE")
+  for _, device := range devices {
+    table.AddRow(device.ID, device.Name, device.Category, device.ProductName, fmt.Sprint(device.Online))
+    table.SetColor(4, boolColor(device.Online))
+  }
+  return table.Render(os.Stdout, useColor())
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+  "log/slog"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+// checkDrawer notifies once when DRAWER_FULL_RULE starts to hold. A full
+// drawer is not a reason to reset, the device is fine until someone empties
+// it.
+func checkDrawer(cfg *Config, appLog *slog.Logger, deviceInfo *DeviceInfoResponse, lastLogs []interface{}, result *CheckResult) {
+  if cfg.DrawerFullRule == nil {
+    return
+  }
+  full, err := cfg.DrawerFullRule.Eval(ruleEnv(cfg.Preset, deviceInfo, lastLogs))
+  if err != nil {
+    appLog.Warn("Failed to evaluate DRAWER_FULL_RULE", "rule", cfg.DrawerFullRule.Source, "error", err)
+    return
+  }
+  result.DrawerFull = full
+  if result.Standby {
+    return
+  }
+
+  state, err := loadNotifyState(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load notification state", "error", err)
+    return
+  }
+  switch {
+  case full && state.DrawerFullSince == nil:
+    since := result.Time
+    state.DrawerFullSince = &since
+  case !full && state.DrawerFullSince != nil:
+    appLog.Info("Waste drawer emptied", "full_since", *state.DrawerFullSince)
+    state.DrawerFullSince = nil
+  default:
+    return
+  }
+  if err := saveNotifyState(cfg, state); err != nil {
+    appLog.Warn("Failed to save notification state", "error", err)
+  }
+
+  if full {
+    appLog.Warn("Waste drawer is full")
+    sendNotification(cfg, appLog, notify.Notification{
+      Level:   notify.LevelWarning,
+      Event:   notifyEventDrawerFull,
+      Check:   notifyCheck(result),
+      Title:   tr(cfg, "Waste drawer full"),
+      Message: tr(cfg, "The waste drawer needs to be emptied"),
+    })
+  }
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+  "log/slog"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+// Escalations are tracked per trigger and sent once, until the device works
+// again.
+const (
+  escalateFailedResets = "failed_resets"
+  escalateOffline      = "offline"
+)
+
+// escalate raises a critical notification when a problem outlasts the
+// regular notifications: ESCALATE_FAILED_RESETS resets failed in a row, or
+// the device has been offline for ESCALATE_OFFLINE. Critical notifications
+// also go to ESCALATION_WEBHOOK_URL, which receives nothing else.
+func escalate(cfg *Config, appLog *slog.Logger, result *CheckResult, checkErr error) {
+  if cfg.EscalateFailedResets == 0 && cfg.EscalateOffline == 0 {
+    return
+  }
+  // A failed check says nothing about the device, and the leader escalates.
+  if (checkErr != nil && result.Action == actionNone) || result.Standby {
+    return
+  }
+
+  state, err := loadNotifyState(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load notification state", "error", err)
+    return
+  }
+
+  switch {
+  case result.Action == actionResetFailed:
+    state.FailedResets++
+  case result.Action == actionReset:
+    state.FailedResets = 0
+    delete(state.Escalated, escalateFailedResets)
+  case !result.NeedsReset && result.Reason == "":
+    state.FailedResets = 0
+    state.Escalated = map[string]time.Time{}
+  }
+  if result.Online {
+    delete(state.Escalated, escalateOffline)
+  }
+
+  var escalations []notify.Notification
+  if _, done := state.Escalated[escalateFailedResets]; !done && cfg.EscalateFailedResets > 0 && state.FailedResets >= cfg.EscalateFailedResets {
+    state.Escalated[escalateFailedResets] = result.Time
+    escalations = append(escalations, notify.Notification{
+      Title:   tr(cfg, "Resets keep failing"),
+      Message: tr(cfg, "%d resets failed in a row, the device needs attention", state.FailedResets),
+    })
+  }
+  if _, done := state.Escalated[escalateOffline]; !done && cfg.EscalateOffline > 0 && !result.Online && !result.offlineSince.IsZero() {
+    if offline := result.Time.Sub(result.offlineSince).Truncate(time.Minute); offline >= cfg.EscalateOffline {
+      state.Escalated[escalateOffline] = result.Time
+      escalations = append(escalations, notify.Notification{
+        Title:   tr(cfg, "Device offline"),
+        Message: tr(cfg, "Device has been offline for %s", offline),
+      })
+    }
+  }
+
+  if err := saveNotifyState(cfg, state); err != nil {
+    appLog.Warn("Failed to save notification state", "error", err)
+  }
+  for _, n := range escalations {
+    appLog.Warn("Escalating", "title", n.Title, "message", n.Message)
+    n.Level, n.Event, n.Check = notify.LevelCritical, notifyEventEscalated, notifyCheck(result)
+    sendNotification(cfg, appLog, n)
+  }
+}
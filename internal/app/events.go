@@ -0,0 +1,91 @@
+package app
+
+import (
+  "reflect"
+  "sync"
+  "time"
+)
+
+const (
+  eventCheck  = "check"
+  eventReset  = "reset"
+  eventStatus = "status"
+)
+
+// Event is published for every check, every reset requested through an API
+// and whenever the device status changes between checks, for clients that
+// want to be pushed updates rather than poll.
+type Event struct {
+  Time     time.Time `json:"time"`
+  Type     string    `json:"type"`
+  DeviceID string    `json:"device_id"`
+  Online   bool      `json:"online,omitempty"`
+  Action   string    `json:"action,omitempty"`
+  Reason   string    `json:"reason,omitempty"`
+  Score    float64   `json:"score"`
+  Error    string    `json:"error,omitempty"`
+
+  // Status is only set on status events.
+  Status map[string]interface{} `json:"status,omitempty"`
+}
+
+func checkEvent(result *CheckResult, err error) Event {
+  event := Event{
+    Time:     result.Time,
+    Type:     eventCheck,
+    DeviceID: result.DeviceID,
+    Online:   result.Online,
+    Action:   result.Action,
+    Reason:   result.Reason,
+    Score:    result.Score,
+  }
+  if err != nil {
+    event.Error = err.Error()
+  }
+  return event
+}
+
+// statusChanged reports whether a check saw a different device status than
+// the previous one. The first check has nothing to compare against.
+func statusChanged(previous, result *CheckResult) bool {
+  if previous == nil {
+    return false
+  }
+  return previous.Online != result.Online || !reflect.DeepEqual(previous.Status, result.Status)
+}
+
+func statusEvent(result *CheckResult) Event {
+  return Event{Time: result.Time, Type: eventStatus, DeviceID: result.DeviceID, Online: result.Online, Status: result.Status}
+}
+
+// eventBus fans events out to subscribers. A subscriber that does not keep
+// up misses events rather than blocking the poll loop.
+type eventBus struct {
+  mu          sync.Mutex
+  subscribers map[chan Event]bool
+}
+
+var events = &eventBus{subscribers: map[chan Event]bool{}}
+
+func (b *eventBus) Subscribe() (ch chan Event, cancel func()) {
+  ch = make(chan Event, 16)
+  b.mu.Lock()
+  b.subscribers[ch] = true
+  b.mu.Unlock()
+  return ch, func() {
+    b.mu.Lock()
+    delete(b.subscribers, ch)
+    b.mu.Unlock()
+  }
+}
+
+func (b *eventBus) Publish(event Event) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  for ch := range b.subscribers {
+    select {
+    case ch <- event:
+    default:
+    }
+  }
+}
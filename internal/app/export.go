@@ -0,0 +1,113 @@
+package app
+
+import (
+  "context"
+  "encoding/csv"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Formats of `history export`.
+const (
+  exportCSV  = "csv"
+  exportJSON = "json"
+)
+
+// historyExport writes history entries to a file for spreadsheets and other
+// tools: CSV with a row per entry, or JSON with everything stored,
+// including the raw device data of DATA_STORAGE=full.
+func historyExport(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("history export", flag.ContinueOnError)
+  format := fs.String("format", exportCSV, "file format: csv or json")
+  out := fs.String("out", "-", "file to write, - for stdout")
+  tag := fs.String("tag", "", "only export entries with this tag")
+  kind := fs.String("kind", "", "only export entries of this kind, e.g. reset")
+  since := fs.String("since", "", "only export entries newer than this, e.g. 30d or 12h")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if *format != exportCSV && *format != exportJSON {
+    return fmt.Errorf("invalid --format: %s (valid: csv, json)", *format)
+  }
+
+  entries, err := queryHistory(ctx, cfg, *tag, *kind, *since)
+  if err != nil {
+    return err
+  }
+  if entries == nil {
+    entries = []HistoryEntry{}
+  }
+
+  var w io.Writer = os.Stdout
+  var file *os.File
+  if *out != "-" {
+    file, err = os.OpenFile(*out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+    if err != nil {
+      return err
+    }
+    defer file.Close()
+    w = file
+  }
+  if *format == exportJSON {
+    err = json.NewEncoder(w).Encode(entries)
+  } else {
+    err = writeHistoryCSV(w, cfg, entries)
+  }
+  if err != nil {
+    return err
+  }
+  if file == nil {
+    return nil
+  }
+  if err := file.Close(); err != nil {
+    return err
+  }
+  fmt.Printf("Exported %d history entries to %s\n", len(entries), *out)
+  return nil
+}
+
+// writeHistoryCSV writes the entries with a header row. Times are RFC 3339
+// in the configured time zone, tags are separated by commas and notes by
+// semicolons.
+func writeHistoryCSV(w io.Writer, cfg *Config, entries []HistoryEntry) error {
+  formatTime := func(t time.Time) string {
+    return t.In(cfg.TimeFormat.Location).Format(time.RFC3339)
+  }
+  cw := csv.NewWriter(w)
+  if err := cw.Write([]string{"id", "time", "device_id", "kind", "reason", "score", "message", "until", "tags", "notes"}); err != nil {
+    return err
+  }
+  for _, entry := range entries {
+    until := ""
+    if entry.Until != nil {
+      until = formatTime(*entry.Until)
+    }
+    notes := make([]string, 0, len(entry.Notes))
+    for _, note := range entry.Notes {
+      notes = append(notes, note.Text)
+    }
+    record := []string{
+      strconv.Itoa(entry.ID),
+      formatTime(entry.Time),
+      entry.DeviceID,
+      entry.Kind,
+      entry.Reason,
+      strconv.FormatFloat(entry.Score, 'f', -1, 64),
+      entry.Message,
+      until,
+      strings.Join(entry.Tags, ","),
+      strings.Join(notes, "; "),
+    }
+    if err := cw.Write(record); err != nil {
+      return err
+    }
+  }
+  cw.Flush()
+  return cw.Error()
+}
@@ -0,0 +1,463 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/actions"
+  "shitbox-fixer/pkg/notify"
+)
+
+const (
+  historyFirmware     = "firmware"
+  notifyEventFirmware = "firmware"
+)
+
+// The firmware rarely changes, once a day is plenty.
+const firmwareCheckInterval = 24 * time.Hour
+
+// Tuya's upgrade_status of a module.
+const (
+  firmwareUpgradeAvailable = 1
+  firmwareUpgrading        = 2
+  firmwareUpgraded         = 3
+  firmwareUpgradeFailed    = 4
+)
+
+const firmwarePollInterval = 10 * time.Second
+
+// FirmwareModule is one updatable module of a device, e.g. the Wi-Fi module
+// or the MCU.
+type FirmwareModule struct {
+  Type           int    `json:"type"`
+  TypeDesc       string `json:"type_desc"`
+  CurrentVersion string `json:"current_version"`
+  Version        string `json:"version"`
+  UpgradeStatus  int    `json:"upgrade_status"`
+  UpgradeText    string `json:"upgrade_text"`
+}
+
+func (m FirmwareModule) name() string {
+  if m.TypeDesc != "" {
+    return m.TypeDesc
+  }
+  return fmt.Sprintf("module %d", m.Type)
+}
+
+// FirmwareUpgrade is the response of POST
+// /api/devices/{id}/firmware/{type}.
+type FirmwareUpgrade struct {
+  DeviceID string `json:"device_id"`
+  Module   int    `json:"module"`
+}
+
+type FirmwareResponse struct {
+  Code    int              `json:"code"`
+  Msg     string           `json:"msg"`
+  Success bool             `json:"success"`
+  Result  []FirmwareModule `json:"result"`
+  T       int64            `json:"t"`
+}
+
+func getFirmware(ctx context.Context, deviceID string) ([]FirmwareModule, error) {
+  resp := &FirmwareResponse{}
+  if err := tuyaGet(ctx, fmt.Sprintf("/v1.0/devices/%s/upgrade-info", deviceID), resp); err != nil {
+    return nil, fmt.Errorf("failed to get firmware: %w", err)
+  }
+  if !resp.Success {
+    return nil, tuyaError(resp.Code, resp.Msg)
+  }
+  return resp.Result, nil
+}
+
+// firmwareSeen is what the last firmware check found, by module name:
+// the installed versions and the updates already notified about.
+type firmwareSeen struct {
+  CheckedAt time.Time         `json:"checked_at"`
+  Versions  map[string]string `json:"versions"`
+  Notified  map[string]string `json:"notified,omitempty"`
+}
+
+type firmwareState map[string]*firmwareSeen
+
+func firmwarePath(cfg *Config) (string, error) {
+  return statePath(cfg, "firmware.json")
+}
+
+func loadFirmwareState(cfg *Config) (firmwareState, error) {
+  state := firmwareState{}
+  path, err := firmwarePath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  return state, loadStateFile(path, &state)
+}
+
+func saveFirmwareState(cfg *Config, state firmwareState) error {
+  path, err := firmwarePath(cfg)
+  if err != nil {
+    return err
+  }
+  return saveStateFile(path, state)
+}
+
+// recordFirmware stores the installed versions and adds a history entry when
+// one of them changed.
+func recordFirmware(cfg *Config, appLog *slog.Logger, deviceID string, seen *firmwareSeen, modules []FirmwareModule) error {
+  previous := seen.Versions
+  seen.CheckedAt, seen.Versions = time.Now(), map[string]string{}
+
+  var changes []string
+  for _, m := range modules {
+    seen.Versions[m.name()] = m.CurrentVersion
+    if was := previous[m.name()]; was != m.CurrentVersion {
+      change := m.name() + " " + m.CurrentVersion
+      if was != "" {
+        change += fmt.Sprintf(" (was %s)", was)
+      }
+      changes = append(changes, change)
+    }
+  }
+  if len(changes) == 0 {
+    return nil
+  }
+  sort.Strings(changes)
+  entry := HistoryEntry{DeviceID: deviceID, Kind: historyFirmware, Message: strings.Join(changes, ", ")}
+  if _, err := appendHistory(cfg, entry); err != nil {
+    return err
+  }
+  appLog.Info("Firmware recorded", "firmware", entry.Message)
+  return nil
+}
+
+// checkFirmware records the installed firmware in the history whenever it
+// changes and notifies once per update Tuya offers. Stuck cleans are often
+// fixed in firmware.
+func checkFirmware(ctx context.Context, cfg *Config, appLog *slog.Logger, result *CheckResult) {
+  if cfg.DataStorage == dataStorageNone || !result.Online {
+    return
+  }
+  state, err := loadFirmwareState(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load firmware state", "error", err)
+    return
+  }
+  seen := state[result.DeviceID]
+  if seen != nil && time.Since(seen.CheckedAt) < firmwareCheckInterval {
+    return
+  }
+
+  setPhase(ctx, "get firmware")
+  modules, err := getFirmware(ctx, result.DeviceID)
+  if err != nil {
+    appLog.Debug("Failed to check firmware, trying again on the next check", "error", err)
+    return
+  }
+  if seen == nil {
+    seen = &firmwareSeen{}
+    state[result.DeviceID] = seen
+  }
+  if seen.Notified == nil {
+    seen.Notified = map[string]string{}
+  }
+  if err := recordFirmware(cfg, appLog, result.DeviceID, seen, modules); err != nil {
+    appLog.Warn("Failed to record history", "error", err)
+    return
+  }
+
+  var updates []FirmwareModule
+  for _, m := range modules {
+    if m.UpgradeStatus == firmwareUpgradeAvailable && m.Version != "" && seen.Notified[m.name()] != m.Version {
+      seen.Notified[m.name()] = m.Version
+      updates = append(updates, m)
+    }
+  }
+  if err := saveFirmwareState(cfg, state); err != nil {
+    appLog.Warn("Failed to save firmware state", "error", err)
+    return
+  }
+
+  for _, m := range updates {
+    appLog.Info("Firmware update available", "module", m.name(), "installed", m.CurrentVersion, "available", m.Version)
+    message := tr(cfg, "%s %s is available (installed: %s), run `firmware upgrade` or install it in the Smart Life app", m.name(), m.Version, m.CurrentVersion)
+    if m.UpgradeText != "" {
+      message += "\n\n" + m.UpgradeText
+    }
+    sendNotification(cfg, appLog, notify.Notification{
+      Level:   notify.LevelInfo,
+      Event:   notifyEventFirmware,
+      Check:   notifyCheck(result),
+      Title:   tr(cfg, "Firmware update available"),
+      Message: message,
+    })
+  }
+}
+
+func runFirmware(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  sub := "list"
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    sub, args = args[0], args[1:]
+  }
+  fs := flag.NewFlagSet("firmware "+sub, flag.ContinueOnError)
+  deviceID := fs.String("device", cfg.DeviceID, "device to query or upgrade")
+
+  switch sub {
+  case "list":
+    fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text, json or table")
+    if err := fs.Parse(args); err != nil {
+      return err
+    }
+    if err := validateOutput(cfg.Output); err != nil {
+      return fmt.Errorf("invalid --output: %w", err)
+    }
+    modules, err := getFirmware(ctx, *deviceID)
+    if err != nil {
+      return err
+    }
+    if cfg.Output == outputJSON {
+      return printJSON(modules)
+    }
+    table := newTable("MODULE", "TYPE", "INSTALLED", "AVAILABLE", "STATUS")
+    for _, m := range modules {
+      table.AddRow(m.name(), strconv.Itoa(m.Type), m.CurrentVersion, m.Version, firmwareStatus(m.UpgradeStatus))
+      if m.UpgradeStatus == firmwareUpgradeAvailable {
+        table.SetColor(4, colorYellow)
+      }
+    }
+    return table.Render(os.Stdout, useColor())
+
+  case "upgrade":
+    module := fs.String("module", "", "module to upgrade, by name or type (default: all with an update)")
+    confirm := fs.Bool("confirm", false, "start the upgrade, without it only the planned upgrade is shown")
+    timeout := fs.Duration("timeout", 30*time.Minute, "how long to wait for each module to finish")
+    if err := fs.Parse(args); err != nil {
+      return err
+    }
+    return upgradeFirmware(ctx, cfg, appLog, *deviceID, *module, *confirm, *timeout)
+  }
+
+  return fmt.Errorf("unknown firmware command: %s (valid: list, upgrade)", sub)
+}
+
+func firmwareStatus(status int) string {
+  switch status {
+  case 0:
+    return "up to date"
+  case firmwareUpgradeAvailable:
+    return "update available"
+  case firmwareUpgrading:
+    return "upgrading"
+  case firmwareUpgraded:
+    return "upgraded"
+  case firmwareUpgradeFailed:
+    return "failed"
+  default:
+    return strconv.Itoa(status)
+  }
+}
+
+// deviceCleaning reports whether a status DP has one of the preset's clean
+// values, e.g. status "cleaning".
+func deviceCleaning(preset Preset, status map[string]interface{}) bool {
+  for _, value := range status {
+    s, ok := value.(string)
+    if !ok {
+      continue
+    }
+    for _, clean := range preset.CleanValues {
+      if s == clean {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// upgradeFirmware starts the OTA upgrade of the modules with an update and
+// waits for each to finish. The device restarts during the upgrade, so the
+// watcher is kept from resetting it with a never-reset override.
+func upgradeFirmware(ctx context.Context, cfg *Config, appLog *slog.Logger, deviceID, module string, confirm bool, timeout time.Duration) error {
+  modules, err := getFirmware(ctx, deviceID)
+  if err != nil {
+    return err
+  }
+  var upgrades []FirmwareModule
+  for _, m := range modules {
+    if module != "" && module != m.name() && module != strconv.Itoa(m.Type) {
+      continue
+    }
+    if m.UpgradeStatus == firmwareUpgradeAvailable {
+      upgrades = append(upgrades, m)
+    }
+  }
+  if len(upgrades) == 0 {
+    fmt.Println("No firmware update available")
+    return nil
+  }
+  for _, m := range upgrades {
+    fmt.Printf("%s: %s -> %s\n", m.name(), m.CurrentVersion, m.Version)
+  }
+
+  if err := upgradeAllowed(ctx, cfg.Preset, deviceID); err != nil {
+    return err
+  }
+  if !confirm {
+    return fmt.Errorf("refusing to upgrade without confirmation, use --confirm")
+  }
+
+  unpin, err := pinDevice(cfg, deviceID, time.Duration(len(upgrades))*timeout)
+  if err != nil {
+    return err
+  }
+  defer unpin()
+
+  ctx = withAuditTrigger(ctx, auditTriggerFirmware, "firmware upgrade", localUser())
+
+  for _, m := range upgrades {
+    if err := upgradeModule(ctx, cfg, deviceID, m, timeout); err != nil {
+      return err
+    }
+  }
+
+  if cfg.DataStorage == dataStorageNone {
+    return nil
+  }
+  if modules, err = getFirmware(ctx, deviceID); err != nil {
+    return err
+  }
+  state, err := loadFirmwareState(cfg)
+  if err != nil {
+    return err
+  }
+  seen := state[deviceID]
+  if seen == nil {
+    seen = &firmwareSeen{}
+    state[deviceID] = seen
+  }
+  if err := recordFirmware(cfg, appLog, deviceID, seen, modules); err != nil {
+    return err
+  }
+  return saveFirmwareState(cfg, state)
+}
+
+// upgradeAllowed refuses an upgrade while the device is offline or cleaning.
+func upgradeAllowed(ctx context.Context, preset Preset, deviceID string) error {
+  responseCache.Invalidate("status/" + deviceID)
+  deviceStatus, err := getDeviceStatus(ctx, deviceID)
+  if err != nil {
+    return err
+  }
+  if online, _ := deviceStatus.Result["online"].(bool); !online {
+    return fmt.Errorf("device %s is offline, refusing to upgrade", deviceID)
+  }
+  if deviceCleaning(preset, deviceStatusMap(deviceStatus)) {
+    return fmt.Errorf("a clean cycle is running, refusing to upgrade; try again when it finished")
+  }
+  return nil
+}
+
+// startUpgrade starts the OTA upgrade of a module as a job of the device's
+// command queue, so it cannot interleave with a reset sequence. The
+// guardrails are checked again in the job, right before the upgrade starts.
+func startUpgrade(ctx context.Context, preset Preset, deviceID string, m FirmwareModule) error {
+  return deviceCommands.Do(ctx, deviceID, "firmware upgrade", func(ctx context.Context) error {
+    if err := upgradeAllowed(ctx, preset, deviceID); err != nil {
+      return err
+    }
+    // The audit log shows the upgrade as firmware_upgrade=<module type>.
+    upgrade := []actions.Command{{Code: "firmware_upgrade", Value: m.Type}}
+    return commandClient().Post(ctx, deviceID, fmt.Sprintf("/v1.0/devices/%s/firmware/%d", deviceID, m.Type), nil, m.name()+" upgrade", upgrade)
+  })
+}
+
+// upgradeModule starts the upgrade of one module and polls its progress
+// until the new version is installed. The running daemon of the device
+// starts it, so it is queued behind the daemon's own commands.
+func upgradeModule(ctx context.Context, cfg *Config, deviceID string, m FirmwareModule, timeout time.Duration) error {
+  err := errNoDaemon
+  if deviceID == cfg.DeviceID {
+    var started FirmwareUpgrade
+    err = daemonRequest(ctx, cfg, http.MethodPost, fmt.Sprintf("/api/devices/%s/firmware/%d", url.PathEscape(deviceID), m.Type), nil, &started)
+  }
+  if errors.Is(err, errNoDaemon) {
+    err = startUpgrade(ctx, cfg.Preset, deviceID, m)
+  }
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Upgrading %s to %s, the device restarts when it is done\n", m.name(), m.Version)
+
+  ctx, cancel := context.WithTimeout(ctx, timeout)
+  defer cancel()
+  last := -1
+  for {
+    if err := sleepContext(ctx, firmwarePollInterval); err != nil {
+      return fmt.Errorf("%s upgrade did not finish within %s", m.name(), timeout)
+    }
+    modules, err := getFirmware(ctx, deviceID)
+    if err != nil {
+      // The device drops off while it installs the update.
+      continue
+    }
+    for _, current := range modules {
+      if current.Type != m.Type {
+        continue
+      }
+      switch {
+      case current.CurrentVersion == m.Version || current.UpgradeStatus == firmwareUpgraded:
+        fmt.Printf("Upgraded %s to %s\n", m.name(), current.CurrentVersion)
+        return nil
+      case current.UpgradeStatus == firmwareUpgradeFailed:
+        return fmt.Errorf("%s upgrade failed", m.name())
+      case current.UpgradeStatus != last:
+        last = current.UpgradeStatus
+        fmt.Printf("%s: %s\n", m.name(), firmwareStatus(current.UpgradeStatus))
+      }
+    }
+  }
+}
+
+// pinDevice sets a never-reset override until the upgrade is done, unless
+// the device already has one. The returned function removes it again.
+func pinDevice(cfg *Config, deviceID string, d time.Duration) (func(), error) {
+  overrides, err := activeOverrides(cfg, deviceID)
+  if err != nil {
+    return nil, err
+  }
+  if hasOverride(overrides, overrideNeverReset) {
+    return func() {}, nil
+  }
+  state, err := loadOverrides(cfg)
+  if err != nil {
+    return nil, err
+  }
+  pin := Override{Kind: overrideNeverReset, Until: time.Now().Add(d), Note: "firmware upgrade", Created: time.Now()}
+  state[deviceID] = append(state[deviceID], pin)
+  if err := saveOverrides(cfg, state); err != nil {
+    return nil, err
+  }
+  return func() {
+    state, err := loadOverrides(cfg)
+    if err != nil {
+      return
+    }
+    kept := []Override{}
+    for _, o := range state[deviceID] {
+      if o.Kind != pin.Kind || !o.Created.Equal(pin.Created) {
+        kept = append(kept, o)
+      }
+    }
+    state[deviceID] = kept
+    _ = saveOverrides(cfg, state)
+  }, nil
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+  "flag"
+  "os"
+  "strings"
+)
+
+// configEnvVars lists every environment variable read by loadConfig. Each one
+// can also be set with a flag named after it, e.g. --device-id for
+// TUYA_DEVICE_ID.
+var configEnvVars = []string{
+  "PROFILE",
+  "TUYA_ACCESS_ID",
+  "TUYA_ACCESS_KEY",
+  "TUYA_ACCESS_ID_FILE",
+  "TUYA_ACCESS_KEY_FILE",
+  "AGE_IDENTITY_FILE",
+  "VAULT_ADDR",
+  "VAULT_PATH",
+  "VAULT_NAMESPACE",
+  "VAULT_AUTH",
+  "VAULT_TOKEN",
+  "VAULT_TOKEN_FILE",
+  "VAULT_ROLE_ID",
+  "VAULT_SECRET_ID",
+  "VAULT_SECRET_ID_FILE",
+  "TUYA_REGION",
+  "TUYA_DEVICE_ID",
+  "DEVICE_PRESET",
+  "DEVICE_GROUPS",
+  "WORKERS",
+  "SHUTDOWN_DELAY",
+  "DEBUG",
+  "OUTPUT",
+  "VERDICT_OUTPUT",
+  "RESET_EXIT_CODE",
+  "POLL_INTERVAL",
+  "STATUS_CACHE_TTL",
+  "HTTP_CONNECT_TIMEOUT",
+  "HTTP_TIMEOUT",
+  "TUYA_API_HOST",
+  "TUYA_MSG_HOST",
+  "TUYA_PROXY_URL",
+  "TUYA_PROXY_URL_FILE",
+  "RUN_TIMEOUT",
+  "TUYA_MAX_ATTEMPTS",
+  "TUYA_RATE_LIMIT",
+  "STATE_DIR",
+  "DATA_STORAGE",
+  "HISTORY_RETENTION",
+  "ROLLUP_RETENTION",
+  "ACTION_QUIET_HOURS",
+  "NOTIFY_WEBHOOK_URL",
+  "NOTIFY_WEBHOOK_URL_FILE",
+  "NOTIFY_ESCALATION_URL",
+  "NOTIFY_ESCALATION_URL_FILE",
+  "PAGERDUTY_ROUTING_KEY",
+  "PAGERDUTY_ROUTING_KEY_FILE",
+  "PAGERDUTY_SEVERITY",
+  "PAGERDUTY_EVENTS_URL",
+  "OPSGENIE_API_KEY",
+  "OPSGENIE_API_KEY_FILE",
+  "OPSGENIE_PRIORITY",
+  "OPSGENIE_API_URL",
+  "ESCALATE_FAILED_RESETS",
+  "ESCALATE_OFFLINE",
+  "NOTIFY_QUIET_HOURS",
+  "NOTIFY_WEBHOOK_QUIET_HOURS",
+  "NOTIFY_TEMPLATE",
+  "NOTIFY_WEBHOOK_TEMPLATE",
+  "NOTIFY_QUIET_HOURS_BYPASS",
+  "NOTIFY_THROTTLE",
+  "NOTIFY_ON_CHANGE",
+  "ALERTMANAGER_URL",
+  "ALERTMANAGER_WEBHOOK_URL",
+  "ALERTMANAGER_URL_FILE",
+  "ALERTMANAGER_WEBHOOK_URL_FILE",
+  "INFLUXDB_URL",
+  "INFLUXDB_TOKEN",
+  "INFLUXDB_TOKEN_FILE",
+  "INFLUXDB_ORG",
+  "INFLUXDB_BUCKET",
+  "METRICS_TEXTFILE",
+  "UPTIME_KUMA_PUSH_URL",
+  "UPTIME_KUMA_PUSH_URL_FILE",
+  "HEARTBEAT_URL",
+  "HEARTBEAT_URL_FILE",
+  "HEARTBEAT_METHOD",
+  "STATS_MQTT_URL",
+  "STATS_MQTT_URL_FILE",
+  "WATCHDOG_FACTOR",
+  "CIRCUIT_BREAKER_THRESHOLD",
+  "CIRCUIT_BREAKER_COOLOFF",
+  "COLD_START_CYCLES",
+  "SERVE_ADDRESS",
+  "HEALTH_ADDRESS",
+  "SERVE_TLS_CERT",
+  "SERVE_TLS_KEY",
+  "SERVE_TLS_CLIENT_CA",
+  "API_READ_TOKEN",
+  "API_READ_TOKEN_FILE",
+  "API_CONTROL_TOKEN",
+  "API_CONTROL_TOKEN_FILE",
+  "CONTROL_SOCKET",
+  "AUDIT_LOG",
+  "OTEL_EXPORTER_OTLP_ENDPOINT",
+  "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+  "OTEL_EXPORTER_OTLP_PROTOCOL",
+  "OTEL_EXPORTER_OTLP_HEADERS",
+  "OTEL_EXPORTER_OTLP_HEADERS_FILE",
+  "OTEL_SERVICE_NAME",
+  "INSTANCE_LOCK",
+  "INSTANCE_LOCK_WAIT",
+  "LEADER_LOCK",
+  "LEADER_ID",
+  "LEADER_LEASE",
+  "DETECT_RULE",
+  "DETECT_WEIGHTS",
+  "DETECT_OFFLINE_RAMP",
+  "DETECT_OFFLINE_GRACE",
+  "DETECT_NO_CLEAN",
+  "DETECT_STUCK_DURATION",
+  "RESET_THRESHOLD",
+  "NOTIFY_THRESHOLD",
+  "VERIFY_RULE",
+  "DRAWER_FULL_RULE",
+  "OCCUPIED_RULE",
+  "OCCUPIED_WAIT",
+  "CONSUMABLES",
+  "VERIFY_DELAY",
+  "LOG_DP_IDS",
+  "LOG_LEVEL",
+  "DEBUG_CAPTURE_DURATION",
+  "DEBUG_CAPTURE_RATE",
+  "LOG_FORMAT",
+  "LOG_OUTPUT",
+  "SYSLOG_ADDRESS",
+  "TIMEZONE",
+  "TIME_LOCALE",
+  "TIME_STYLE",
+  "OUTPUT_LANGUAGE",
+}
+
+var boolEnvVars = map[string]bool{
+  "DEBUG": true,
+}
+
+// envFlag sets its environment variable when the flag is parsed. Flags are
+// parsed before the .env file is loaded, and the .env file never overrides
+// variables that are already set, giving flags > environment > .env.
+type envFlag struct {
+  env     string
+  boolean bool
+}
+
+func (f *envFlag) String() string {
+  return ""
+}
+
+func (f *envFlag) Set(value string) error {
+  return os.Setenv(f.env, value)
+}
+
+func (f *envFlag) IsBoolFlag() bool {
+  return f.boolean
+}
+
+func envFlagName(env string) string {
+  return strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(env, "TUYA_"), "_", "-"))
+}
+
+func registerConfigFlags(fs *flag.FlagSet) {
+  for _, env := range configEnvVars {
+    fs.Var(&envFlag{env: env, boolean: boolEnvVars[env]}, envFlagName(env), "overrides "+env)
+  }
+}
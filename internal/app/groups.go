@@ -0,0 +1,126 @@
+package app
+
+import (
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// parseDeviceGroups parses DEVICE_GROUPS: named groups separated by ";",
+// each a comma-separated list of device IDs or names, e.g.
+// "upstairs=Bathroom,Attic;row-a=bf1234,bf5678".
+func parseDeviceGroups(s string) (map[string][]string, error) {
+  groups := map[string][]string{}
+  for _, def := range strings.Split(s, ";") {
+    def = strings.TrimSpace(def)
+    if def == "" {
+      continue
+    }
+    name, list, ok := strings.Cut(def, "=")
+    name = strings.TrimSpace(name)
+    if !ok || name == "" {
+      return nil, fmt.Errorf("expected name=device,device, got %q", def)
+    }
+    if name == "all" || name == "online" || strings.Contains(name, ":") {
+      return nil, fmt.Errorf("group name %q is reserved for --group selectors", name)
+    }
+    if _, ok := groups[name]; ok {
+      return nil, fmt.Errorf("group %s defined twice", name)
+    }
+    var members []string
+    for _, member := range strings.Split(list, ",") {
+      if member = strings.TrimSpace(member); member != "" {
+        members = append(members, member)
+      }
+    }
+    if len(members) == 0 {
+      return nil, fmt.Errorf("group %s has no devices", name)
+    }
+    groups[name] = members
+  }
+  return groups, nil
+}
+
+// defaultWorkers is how many devices or profiles are worked on at once
+// without WORKERS.
+const defaultWorkers = 4
+
+// parseWorkers parses WORKERS.
+func parseWorkers(s string) (int, error) {
+  if s == "" {
+    return defaultWorkers, nil
+  }
+  n, err := strconv.Atoi(s)
+  if err != nil || n < 1 {
+    return 0, fmt.Errorf("invalid WORKERS: %s (must be a number >= 1)", s)
+  }
+  return n, nil
+}
+
+// forEachDevice calls fn for every device, up to workers at a time, and
+// waits for all of them. fn gets the device's index to store its result.
+func forEachDevice(devices []DeviceSummary, workers int, fn func(i int, device DeviceSummary)) {
+  sem := make(chan struct{}, workers)
+  var wg sync.WaitGroup
+  for i, device := range devices {
+    sem <- struct{}{}
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      defer func() { <-sem }()
+      fn(i, device)
+    }()
+  }
+  wg.Wait()
+}
+
+func groupNames(groups map[string][]string) []string {
+  names := make([]string, 0, len(groups))
+  for name := range groups {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// groupMembers resolves the members of a DEVICE_GROUPS group, by ID or
+// name, against the devices of the cloud project.
+func groupMembers(devices []DeviceSummary, group string, members []string) ([]DeviceSummary, error) {
+  selected := []DeviceSummary{}
+  for _, member := range members {
+    found := false
+    for _, device := range devices {
+      if device.ID == member || device.Name == member {
+        selected = append(selected, device)
+        found = true
+        break
+      }
+    }
+    if !found {
+      return nil, fmt.Errorf("group %s: no device %q in the cloud project", group, member)
+    }
+  }
+  return selected, nil
+}
+
+// deviceConfig is cfg for another device of the same model, for the
+// commands that run against a group.
+func deviceConfig(cfg *Config, device DeviceSummary) *Config {
+  c := *cfg
+  c.DeviceID = device.ID
+  return &c
+}
+
+// hasGroupFlag reports whether a command's arguments select a group, so the
+// config does not need TUYA_DEVICE_ID.
+func hasGroupFlag(args []string) bool {
+  for _, arg := range args {
+    arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+    if arg == "group" || strings.HasPrefix(arg, "group=") {
+      return true
+    }
+  }
+  return false
+}
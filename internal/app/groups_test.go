@@ -0,0 +1,102 @@
+package app
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestParseDeviceGroups(t *testing.T) {
+  tests := []struct {
+    value   string
+    want    map[string][]string
+    wantErr string
+  }{
+    {"", map[string][]string{}, ""},
+    {"upstairs=dev1,dev2", map[string][]string{"upstairs": {"dev1", "dev2"}}, ""},
+    {" upstairs = dev1 , Litter box ; basement=dev3; ", map[string][]string{"upstairs": {"dev1", "Litter box"}, "basement": {"dev3"}}, ""},
+    {"upstairs=dev1,,", map[string][]string{"upstairs": {"dev1"}}, ""},
+    {"upstairs", nil, "expected name=device,device"},
+    {"=dev1", nil, "expected name=device,device"},
+    {"all=dev1", nil, `group name "all" is reserved`},
+    {"online=dev1", nil, `group name "online" is reserved`},
+    {"model:T4=dev1", nil, `group name "model:T4" is reserved`},
+    {"upstairs=dev1;upstairs=dev2", nil, "group upstairs defined twice"},
+    {"upstairs= , ", nil, "group upstairs has no devices"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.value, func(t *testing.T) {
+      got, err := parseDeviceGroups(tt.value)
+      if tt.wantErr != "" {
+        if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+          t.Errorf("parseDeviceGroups(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+        }
+        return
+      }
+      if err != nil || !reflect.DeepEqual(got, tt.want) {
+        t.Errorf("parseDeviceGroups(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+      }
+    })
+  }
+}
+
+func TestParseWorkers(t *testing.T) {
+  tests := []struct {
+    value   string
+    want    int
+    wantErr bool
+  }{
+    {"", defaultWorkers, false},
+    {"1", 1, false},
+    {"16", 16, false},
+    {"0", 0, true},
+    {"-2", 0, true},
+    {"four", 0, true},
+  }
+  for _, tt := range tests {
+    t.Run(tt.value, func(t *testing.T) {
+      got, err := parseWorkers(tt.value)
+      if (err != nil) != tt.wantErr || got != tt.want {
+        t.Errorf("parseWorkers(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+      }
+    })
+  }
+}
+
+func TestGroupMembers(t *testing.T) {
+  devices := []DeviceSummary{
+    {ID: "dev1", Name: "Upstairs"},
+    {ID: "dev2", Name: "Basement"},
+  }
+  got, err := groupMembers(devices, "home", []string{"Basement", "dev1"})
+  if err != nil {
+    t.Fatal(err)
+  }
+  if want := []DeviceSummary{devices[1], devices[0]}; !reflect.DeepEqual(got, want) {
+    t.Errorf("groupMembers() = %+v, want %+v", got, want)
+  }
+
+  if _, err := groupMembers(devices, "home", []string{"dev1", "dev3"}); err == nil || !strings.Contains(err.Error(), `no device "dev3"`) {
+    t.Errorf("groupMembers() error = %v, want no device \"dev3\"", err)
+  }
+}
+
+func TestHasGroupFlag(t *testing.T) {
+  tests := []struct {
+    args []string
+    want bool
+  }{
+    {nil, false},
+    {[]string{"--group", "upstairs"}, true},
+    {[]string{"-group=all"}, true},
+    {[]string{"--output", "json", "--group=online"}, true},
+    {[]string{"--grouping"}, false},
+  }
+  for _, tt := range tests {
+    t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+      if got := hasGroupFlag(tt.args); got != tt.want {
+        t.Errorf("hasGroupFlag(%q) = %v, want %v", tt.args, got, tt.want)
+      }
+    })
+  }
+}
@@ -0,0 +1,321 @@
+package app
+
+import (
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "math"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+
+  "shitbox-fixer/pkg/actions"
+)
+
+// A minimal gRPC server for the service in api/fixer.proto, written against
+// net/http so the fixer keeps building without dependencies. It handles the
+// unary and server-streaming calls the service needs, uncompressed only.
+
+const grpcService = "/shitboxfixer.v1.Fixer/"
+
+// gRPC status codes.
+const (
+  grpcOK               = 0
+  grpcInvalidArgument  = 3
+  grpcNotFound         = 5
+  grpcUnimplemented    = 12
+  grpcPermissionDenied = 7
+  grpcUnavailable      = 14
+  grpcUnauthenticated  = 16
+)
+
+type grpcError struct {
+  code int
+  err  error
+}
+
+func (e *grpcError) Error() string {
+  return e.err.Error()
+}
+
+func isGRPCRequest(r *http.Request) bool {
+  return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// protoBuffer encodes protobuf messages field by field. Zero values are
+// skipped, as in proto3.
+type protoBuffer []byte
+
+func (b *protoBuffer) tag(field, wireType int) {
+  *b = binary.AppendUvarint(*b, uint64(field<<3|wireType))
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+  b.tag(field, 2)
+  *b = binary.AppendUvarint(*b, uint64(len(v)))
+  *b = append(*b, v...)
+}
+
+func (b *protoBuffer) string(field int, v string) {
+  if v != "" {
+    b.bytes(field, []byte(v))
+  }
+}
+
+func (b *protoBuffer) bool(field int, v bool) {
+  if v {
+    b.tag(field, 0)
+    *b = append(*b, 1)
+  }
+}
+
+func (b *protoBuffer) int64(field int, v int64) {
+  if v != 0 {
+    b.tag(field, 0)
+    *b = binary.AppendUvarint(*b, uint64(v))
+  }
+}
+
+func (b *protoBuffer) double(field int, v float64) {
+  if v != 0 {
+    b.tag(field, 1)
+    *b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+  }
+}
+
+// parseProtoStrings decodes the string fields of a message by field number
+// and skips everything else, which is all the request messages contain.
+func parseProtoStrings(data []byte) (map[int]string, error) {
+  fields := map[int]string{}
+  for len(data) > 0 {
+    key, n := binary.Uvarint(data)
+    if n <= 0 {
+      return nil, errors.New("invalid field key")
+    }
+    data = data[n:]
+    field, wireType := int(key>>3), int(key&7)
+    switch wireType {
+    case 0:
+      _, n = binary.Uvarint(data)
+      if n <= 0 {
+        return nil, errors.New("invalid varint")
+      }
+      data = data[n:]
+    case 1:
+      if len(data) < 8 {
+        return nil, errors.New("truncated fixed64")
+      }
+      data = data[8:]
+    case 2:
+      length, n := binary.Uvarint(data)
+      if n <= 0 || uint64(len(data)-n) < length {
+        return nil, errors.New("truncated field")
+      }
+      fields[field] = string(data[n : n+int(length)])
+      data = data[n+int(length):]
+    case 5:
+      if len(data) < 4 {
+        return nil, errors.New("truncated fixed32")
+      }
+      data = data[4:]
+    default:
+      return nil, fmt.Errorf("unsupported wire type %d", wireType)
+    }
+  }
+  return fields, nil
+}
+
+// readGRPCMessage reads one length-prefixed message from a request body.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+  var header [5]byte
+  if _, err := io.ReadFull(r, header[:]); err != nil {
+    return nil, err
+  }
+  if header[0] != 0 {
+    return nil, &grpcError{grpcUnimplemented, errors.New("compressed messages are not supported")}
+  }
+  msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+  if _, err := io.ReadFull(r, msg); err != nil {
+    return nil, err
+  }
+  return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+  frame := make([]byte, 5, 5+len(msg))
+  binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+  if _, err := w.Write(append(frame, msg...)); err != nil {
+    return err
+  }
+  return http.NewResponseController(w).Flush()
+}
+
+// grpcEscape percent-encodes a grpc-message trailer value.
+func grpcEscape(s string) string {
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    if c < 0x20 || c > 0x7e || c == '%' {
+      fmt.Fprintf(&b, "%%%02X", c)
+    } else {
+      b.WriteByte(c)
+    }
+  }
+  return b.String()
+}
+
+func (s *apiServer) serveGRPC(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/grpc")
+  w.WriteHeader(http.StatusOK)
+
+  err := s.handleGRPC(w, r)
+  code := grpcOK
+  var gerr *grpcError
+  switch {
+  case errors.As(err, &gerr):
+    code = gerr.code
+  case err != nil:
+    code = grpcUnavailable
+  }
+  w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+  if err != nil {
+    w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(err.Error()))
+  }
+}
+
+func (s *apiServer) handleGRPC(w http.ResponseWriter, r *http.Request) error {
+  method, ok := strings.CutPrefix(r.URL.Path, grpcService)
+  if !ok || (method != "GetStatus" && method != "GetQueue" && method != "Reset" && method != "WatchEvents") {
+    return &grpcError{grpcUnimplemented, fmt.Errorf("unknown method %s", r.URL.Path)}
+  }
+  required := roleRead
+  if method == "Reset" {
+    required = roleControl
+  }
+  if err := s.auth.check(r, required); err != nil {
+    if errors.Is(err, errUnauthenticated) {
+      return &grpcError{grpcUnauthenticated, err}
+    }
+    return &grpcError{grpcPermissionDenied, err}
+  }
+
+  msg, err := readGRPCMessage(r.Body)
+  if err != nil {
+    return err
+  }
+  request, err := parseProtoStrings(msg)
+  if err != nil {
+    return &grpcError{grpcInvalidArgument, err}
+  }
+  deviceID := request[1]
+
+  switch method {
+  case "GetStatus":
+    if deviceID == "" {
+      deviceID = s.cfg.Load().DeviceID
+    }
+    deviceStatus, err := getDeviceStatus(r.Context(), deviceID)
+    if err != nil {
+      return err
+    }
+    var resp protoBuffer
+    resp.string(1, deviceID)
+    online, _ := deviceStatus.Result["online"].(bool)
+    resp.bool(2, online)
+    status := deviceStatusMap(deviceStatus)
+    codes := make([]string, 0, len(status))
+    for code := range status {
+      codes = append(codes, code)
+    }
+    sort.Strings(codes)
+    for _, code := range codes {
+      resp.bytes(3, encodeStatusEntry(code, status[code]))
+    }
+    return writeGRPCMessage(w, resp)
+
+  case "GetQueue":
+    var resp protoBuffer
+    for _, job := range deviceCommands.Snapshot(deviceID) {
+      resp.bytes(1, encodeCommandJob(job))
+    }
+    return writeGRPCMessage(w, resp)
+
+  case "Reset":
+    if deviceID != "" && deviceID != s.cfg.Load().DeviceID {
+      return &grpcError{grpcNotFound, errNotManaged(deviceID)}
+    }
+    result := s.reset(r.RemoteAddr)
+    var resp protoBuffer
+    resp.string(1, result.DeviceID)
+    resp.string(2, result.Action)
+    resp.string(3, result.Error)
+    return writeGRPCMessage(w, resp)
+
+  default:
+    ch, cancel := events.Subscribe()
+    defer cancel()
+    // Send the headers now, so the client sees the stream is open.
+    if err := http.NewResponseController(w).Flush(); err != nil {
+      return err
+    }
+    for {
+      select {
+      case <-r.Context().Done():
+        return nil
+      case event := <-ch:
+        if deviceID != "" && event.DeviceID != deviceID {
+          continue
+        }
+        if err := writeGRPCMessage(w, encodeEvent(event)); err != nil {
+          return err
+        }
+      }
+    }
+  }
+}
+
+// encodeStatusEntry encodes a map<string, string> entry of DP values, which
+// are JSON encoded as their types vary.
+func encodeStatusEntry(code string, value interface{}) []byte {
+  data, _ := json.Marshal(value)
+  var entry protoBuffer
+  entry.string(1, code)
+  entry.string(2, string(data))
+  return entry
+}
+
+func encodeCommandJob(job actions.Job) []byte {
+  var msg protoBuffer
+  msg.int64(1, int64(job.ID))
+  msg.string(2, job.DeviceID)
+  msg.string(3, job.Source)
+  msg.int64(4, job.Enqueued.UnixMilli())
+  if !job.Started.IsZero() {
+    msg.int64(5, job.Started.UnixMilli())
+  }
+  return msg
+}
+
+func encodeEvent(event Event) []byte {
+  var msg protoBuffer
+  msg.int64(1, event.Time.UnixMilli())
+  msg.string(2, event.Type)
+  msg.string(3, event.DeviceID)
+  msg.bool(4, event.Online)
+  msg.string(5, event.Action)
+  msg.string(6, event.Reason)
+  msg.double(7, event.Score)
+  msg.string(8, event.Error)
+  codes := make([]string, 0, len(event.Status))
+  for code := range event.Status {
+    codes = append(codes, code)
+  }
+  sort.Strings(codes)
+  for _, code := range codes {
+    msg.bytes(9, encodeStatusEntry(code, event.Status[code]))
+  }
+  return msg
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "log/slog"
+  "net"
+  "net/http"
+  "sync"
+  "time"
+)
+
+// healthStatus backs the /healthz and /readyz probes of watch and serve,
+// e.g. for the liveness and readiness probes of Kubernetes.
+type healthStatus struct {
+  mu        sync.Mutex
+  loop      *loopStatus
+  lastCheck time.Time
+  lastError error
+}
+
+var health = &healthStatus{}
+
+// HealthResponse is the JSON body of /healthz and /readyz. /healthz also
+// tells how often the watchdog restarted the poll loop.
+type HealthResponse struct {
+  Status           string `json:"status"`
+  Reason           string `json:"reason,omitempty"`
+  WatchdogRestarts *int   `json:"watchdog_restarts,omitempty"`
+}
+
+func (h *healthStatus) watch(loop *loopStatus) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.loop = loop
+}
+
+func (h *healthStatus) recordCheck(err error) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.lastCheck = time.Now()
+  h.lastError = err
+}
+
+// live reports whether the poll loop still completes checks, the same test
+// as for systemd's watchdog. A process that does not watch is always live.
+func (h *healthStatus) live() string {
+  h.mu.Lock()
+  loop := h.loop
+  h.mu.Unlock()
+  if loop == nil {
+    return ""
+  }
+  if healthy, ago := loop.healthy(); !healthy {
+    return "no check completed for " + ago.Round(time.Second).String()
+  }
+  return ""
+}
+
+// restarts returns how often the watchdog restarted the poll loop, and
+// false when the process does not watch.
+func (h *healthStatus) restarts() (int, bool) {
+  h.mu.Lock()
+  loop := h.loop
+  h.mu.Unlock()
+  if loop == nil {
+    return 0, false
+  }
+  loop.mu.Lock()
+  defer loop.mu.Unlock()
+  return loop.restarts, true
+}
+
+// ready reports whether the last check got through, so the device is
+// watched: not before the first check, after a failed one or while the
+// circuit breaker pauses the checks.
+func (h *healthStatus) ready() string {
+  h.mu.Lock()
+  loop, lastCheck, lastError := h.loop, h.lastCheck, h.lastError
+  h.mu.Unlock()
+  if loop == nil {
+    return ""
+  }
+  loop.mu.Lock()
+  paused := time.Now().Before(loop.pausedUntil)
+  loop.mu.Unlock()
+  switch {
+  case lastCheck.IsZero():
+    return "no check completed yet"
+  case paused:
+    return "circuit breaker open"
+  case lastError != nil:
+    return "last check failed: " + lastError.Error()
+  }
+  return ""
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse) {
+  if resp.Reason != "" {
+    resp.Status = "unavailable"
+    writeJSON(w, http.StatusServiceUnavailable, resp)
+    return
+  }
+  resp.Status = "ok"
+  writeJSON(w, http.StatusOK, resp)
+}
+
+// The probes need no token, they reveal no more than whether checks work.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+  resp := HealthResponse{Reason: health.live()}
+  if restarts, ok := health.restarts(); ok {
+    resp.WatchdogRestarts = &restarts
+  }
+  writeHealth(w, resp)
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+  writeHealth(w, HealthResponse{Reason: health.ready()})
+}
+
+func healthRoutes(mux *http.ServeMux) {
+  mux.HandleFunc("GET /healthz", handleHealthz)
+  mux.HandleFunc("GET /readyz", handleReadyz)
+}
+
+// serveHealth serves only the probes on HEALTH_ADDRESS, for watch mode or
+// to keep them off the authenticated API of serve.
+func serveHealth(ctx context.Context, cfg *Config, appLog *slog.Logger) (stop func()) {
+  if cfg.HealthAddress == "" {
+    return func() {}
+  }
+  listener, err := net.Listen("tcp", cfg.HealthAddress)
+  if err != nil {
+    appLog.Error("Failed to serve health probes", "address", cfg.HealthAddress, "error", err)
+    return func() {}
+  }
+  mux := http.NewServeMux()
+  healthRoutes(mux)
+  server := &http.Server{
+    Handler:           mux,
+    ReadHeaderTimeout: 10 * time.Second,
+    BaseContext:       func(net.Listener) context.Context { return ctx },
+  }
+  go func() {
+    if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+      appLog.Error("Health probe server failed", "error", err)
+    }
+  }()
+  appLog.Info("Serving health probes", "address", listener.Addr().String())
+
+  return func() {
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    _ = server.Shutdown(shutdownCtx)
+  }
+}
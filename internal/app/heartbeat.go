@@ -0,0 +1,100 @@
+package app
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+)
+
+type Heartbeat struct {
+  Time     time.Time `json:"time"`
+  DeviceID string    `json:"device_id"`
+  Online   bool      `json:"online"`
+  Action   string    `json:"action"`
+  Standby  bool      `json:"standby,omitempty"`
+}
+
+func validateHeartbeat(rawURL, method string) error {
+  u, err := url.Parse(rawURL)
+  if err != nil || u.Host == "" {
+    return fmt.Errorf("invalid HEARTBEAT_URL (expected an http(s):// or mqtt(s):// URL)")
+  }
+  switch u.Scheme {
+  case "http", "https":
+    if method != http.MethodGet && method != http.MethodPost {
+      return fmt.Errorf("invalid HEARTBEAT_METHOD: %s (valid: GET, POST)", method)
+    }
+  case "mqtt", "mqtts":
+    if mqttTopic(u) == "" {
+      return fmt.Errorf("invalid HEARTBEAT_URL: missing MQTT topic, e.g. mqtt://broker:1883/home/fixer/heartbeat")
+    }
+  default:
+    return fmt.Errorf("invalid HEARTBEAT_URL scheme %q (valid: http, https, mqtt, mqtts)", u.Scheme)
+  }
+  return nil
+}
+
+// sendHeartbeat tells a dead man's switch, e.g. healthchecks.io or an MQTT
+// topic watched by Home Assistant, that the watcher completed a check. When
+// the heartbeats stop, the fixer itself is down, which looks just like a
+// healthy device otherwise.
+func sendHeartbeat(ctx context.Context, cfg *Config, appLog *slog.Logger, result *CheckResult) {
+  if cfg.HeartbeatURL == "" {
+    return
+  }
+  u, err := url.Parse(cfg.HeartbeatURL)
+  if err != nil {
+    return
+  }
+  payload, err := json.Marshal(Heartbeat{Time: time.Now(), DeviceID: result.DeviceID, Online: result.Online, Action: result.Action, Standby: result.Standby})
+  if err != nil {
+    return
+  }
+
+  if strings.HasPrefix(u.Scheme, "mqtt") {
+    err = publishMQTT(ctx, u, payload)
+  } else {
+    err = sendHTTPHeartbeat(ctx, cfg.HeartbeatURL, cfg.HeartbeatMethod, payload)
+  }
+  if err != nil {
+    // Leave out the URL, it may contain a token or credentials.
+    var urlErr *url.Error
+    if errors.As(err, &urlErr) {
+      err = urlErr.Err
+    }
+    appLog.Warn("Failed to send heartbeat", "error", err)
+    return
+  }
+  appLog.Debug("Sent heartbeat")
+}
+
+func sendHTTPHeartbeat(ctx context.Context, rawURL, method string, payload []byte) error {
+  var body io.Reader
+  if method == http.MethodPost {
+    body = bytes.NewReader(payload)
+  }
+  req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+  if err != nil {
+    return err
+  }
+  if body != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+  resp, err := notifyClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return fmt.Errorf("unexpected status %s", resp.Status)
+  }
+  return nil
+}
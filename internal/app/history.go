@@ -0,0 +1,428 @@
+package app
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  historyCheckFailed = "check_failed"
+  historyNote        = "note"
+)
+
+var errHistoryNotFound = errors.New("history entry not found")
+
+// historyMu serializes appends and rewrites within the process, e.g. the
+// poll loop and notes added through the control socket.
+var historyMu sync.Mutex
+
+type Annotation struct {
+  Time time.Time `json:"time"`
+  Text string    `json:"text"`
+}
+
+type HistoryEntry struct {
+  ID       int          `json:"id"`
+  Time     time.Time    `json:"time"`
+  DeviceID string       `json:"device_id"`
+  Kind     string       `json:"kind"`
+  Reason   string       `json:"reason,omitempty"`
+  Score    float64      `json:"score,omitempty"`
+  Message  string       `json:"message,omitempty"`
+  Tags     []string     `json:"tags,omitempty"`
+  Notes    []Annotation `json:"notes,omitempty"`
+
+  // Until ends the period of an offline entry.
+  Until *time.Time `json:"until,omitempty"`
+
+  // Raw device data, only stored with DATA_STORAGE=full.
+  Status map[string]interface{} `json:"status,omitempty"`
+  Logs   []interface{}          `json:"logs,omitempty"`
+}
+
+func (e HistoryEntry) hasTag(tag string) bool {
+  for _, t := range e.Tags {
+    if t == tag {
+      return true
+    }
+  }
+  return false
+}
+
+func historyPath(cfg *Config) (string, error) {
+  return statePath(cfg, "history.jsonl")
+}
+
+func readHistory(cfg *Config) ([]HistoryEntry, error) {
+  path, err := historyPath(cfg)
+  if err != nil {
+    return nil, err
+  }
+
+  file, err := os.Open(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  var entries []HistoryEntry
+  scanner := bufio.NewScanner(file)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" {
+      continue
+    }
+    var entry HistoryEntry
+    if err := json.Unmarshal([]byte(line), &entry); err != nil {
+      return nil, fmt.Errorf("corrupt history entry in %s: %w", path, err)
+    }
+    entries = append(entries, entry)
+  }
+  return entries, scanner.Err()
+}
+
+func writeHistory(cfg *Config, entries []HistoryEntry) error {
+  path, err := historyPath(cfg)
+  if err != nil {
+    return err
+  }
+
+  tmp := path + ".tmp"
+  file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+  if err != nil {
+    return err
+  }
+
+  enc := json.NewEncoder(file)
+  for _, entry := range entries {
+    if err := enc.Encode(entry); err != nil {
+      file.Close()
+      return err
+    }
+  }
+  if err := file.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+func appendHistory(cfg *Config, entry HistoryEntry) (HistoryEntry, error) {
+  historyMu.Lock()
+  defer historyMu.Unlock()
+
+  entries, err := readHistory(cfg)
+  if err != nil {
+    return entry, err
+  }
+
+  entry.ID = 1
+  if len(entries) > 0 {
+    entry.ID = entries[len(entries)-1].ID + 1
+  }
+  if entry.Time.IsZero() {
+    entry.Time = time.Now()
+  }
+  if entry.DeviceID == "" {
+    entry.DeviceID = cfg.DeviceID
+  }
+
+  path, err := historyPath(cfg)
+  if err != nil {
+    return entry, err
+  }
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+  if err != nil {
+    return entry, err
+  }
+  defer file.Close()
+
+  return entry, json.NewEncoder(file).Encode(entry)
+}
+
+// recordCheckResult stores everything but healthy checks, so the history
+// stays a list of incidents rather than one line per poll.
+func recordCheckResult(cfg *Config, appLog *slog.Logger, result *CheckResult, checkErr error) {
+  if cfg.DataStorage == dataStorageNone {
+    return
+  }
+
+  entry := HistoryEntry{Time: result.Time, DeviceID: result.DeviceID, Kind: result.Action, Reason: result.Reason, Score: result.Score}
+  if cfg.DataStorage == dataStorageFull {
+    entry.Status = result.Status
+    entry.Logs = result.Logs
+  }
+  if checkErr != nil {
+    entry.Message = checkErr.Error()
+    if result.Action == actionNone {
+      entry.Kind = historyCheckFailed
+    }
+  } else if result.Action == actionNone {
+    return
+  }
+
+  if _, err := appendHistory(cfg, entry); err != nil {
+    appLog.Warn("Failed to record history", "error", err)
+  }
+}
+
+// parseSince accepts Go durations plus a "d" suffix for days, e.g. "30d".
+func parseSince(s string) (time.Duration, error) {
+  if strings.HasSuffix(s, "d") {
+    days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+    if err != nil {
+      return 0, fmt.Errorf("invalid duration %q", s)
+    }
+    return time.Duration(days) * 24 * time.Hour, nil
+  }
+  return time.ParseDuration(s)
+}
+
+func splitTags(s string) []string {
+  var tags []string
+  for _, tag := range strings.Split(s, ",") {
+    tag = strings.TrimSpace(tag)
+    if tag != "" {
+      tags = append(tags, tag)
+    }
+  }
+  return tags
+}
+
+func addTags(existing []string, tags []string) []string {
+  for _, tag := range tags {
+    found := false
+    for _, t := range existing {
+      if t == tag {
+        found = true
+        break
+      }
+    }
+    if !found {
+      existing = append(existing, tag)
+    }
+  }
+  return existing
+}
+
+func runHistory(ctx context.Context, cfg *Config, args []string) error {
+  if len(args) == 0 {
+    return historyList(ctx, cfg, args)
+  }
+
+  switch args[0] {
+  case "list":
+    return historyList(ctx, cfg, args[1:])
+  case "note":
+    return historyAddNote(ctx, cfg, args[1:])
+  case "annotate":
+    return historyAnnotate(ctx, cfg, args[1:])
+  case "prune":
+    return historyPrune(ctx, cfg, args[1:])
+  case "export":
+    return historyExport(ctx, cfg, args[1:])
+  default:
+    if strings.HasPrefix(args[0], "-") {
+      return historyList(ctx, cfg, args)
+    }
+    return fmt.Errorf("unknown history command: %s (valid: list, note, annotate, prune, export)", args[0])
+  }
+}
+
+// filterHistory keeps the entries matching all of the given filters; empty
+// filters match everything.
+func filterHistory(entries []HistoryEntry, tag, kind string, cutoff time.Time) []HistoryEntry {
+  filtered := []HistoryEntry{}
+  for _, entry := range entries {
+    if tag != "" && !entry.hasTag(tag) {
+      continue
+    }
+    if kind != "" && entry.Kind != kind {
+      continue
+    }
+    if entry.Time.Before(cutoff) {
+      continue
+    }
+    filtered = append(filtered, entry)
+  }
+  return filtered
+}
+
+// annotateHistory adds a note and/or tags to the history entry with the
+// given ID.
+func annotateHistory(cfg *Config, id int, note string, tags []string) (HistoryEntry, error) {
+  historyMu.Lock()
+  defer historyMu.Unlock()
+
+  entries, err := readHistory(cfg)
+  if err != nil {
+    return HistoryEntry{}, err
+  }
+  for i := range entries {
+    if entries[i].ID != id {
+      continue
+    }
+    if note != "" {
+      entries[i].Notes = append(entries[i].Notes, Annotation{Time: time.Now(), Text: note})
+    }
+    entries[i].Tags = addTags(entries[i].Tags, tags)
+    return entries[i], writeHistory(cfg, entries)
+  }
+  return HistoryEntry{}, fmt.Errorf("%w: #%d", errHistoryNotFound, id)
+}
+
+// queryHistory reads the history entries matching the filters of `history
+// list`, from the running daemon if there is one.
+func queryHistory(ctx context.Context, cfg *Config, tag, kind, since string) ([]HistoryEntry, error) {
+  var cutoff time.Time
+  if since != "" {
+    d, err := parseSince(since)
+    if err != nil {
+      return nil, fmt.Errorf("invalid --since: %w", err)
+    }
+    cutoff = time.Now().Add(-d)
+  }
+
+  // The daemon owns the history while it runs.
+  query := url.Values{}
+  for key, value := range map[string]string{"tag": tag, "kind": kind, "since": since} {
+    if value != "" {
+      query.Set(key, value)
+    }
+  }
+  var filtered []HistoryEntry
+  err := daemonRequest(ctx, cfg, http.MethodGet, "/api/history?"+query.Encode(), nil, &filtered)
+  if errors.Is(err, errNoDaemon) {
+    var entries []HistoryEntry
+    entries, err = readHistory(cfg)
+    filtered = filterHistory(entries, tag, kind, cutoff)
+  }
+  return filtered, err
+}
+
+func historyList(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("history list", flag.ContinueOnError)
+  tag := fs.String("tag", "", "only show entries with this tag")
+  kind := fs.String("kind", "", "only show entries of this kind, e.g. reset")
+  since := fs.String("since", "", "only show entries newer than this, e.g. 30d or 12h")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+
+  filtered, err := queryHistory(ctx, cfg, *tag, *kind, *since)
+  if err != nil {
+    return err
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(filtered)
+  }
+
+  if len(filtered) == 0 {
+    fmt.Println("No history entries found")
+    return nil
+  }
+
+  table := newTable("ID", "TIME", "KIND", "REASON", "TAGS", "NOTES")
+  for _, entry := range filtered {
+    notes := make([]string, 0, len(entry.Notes))
+    for _, note := range entry.Notes {
+      notes = append(notes, note.Text)
+    }
+    reason := entry.Reason
+    if reason == "" {
+      reason = entry.Message
+    }
+    table.AddRow(strconv.Itoa(entry.ID), cfg.TimeFormat.Format(entry.Time), entry.Kind, reason, strings.Join(entry.Tags, ","), strings.Join(notes, "; "))
+    table.SetColor(2, historyKindColor(entry.Kind))
+  }
+  return table.Render(os.Stdout, useColor())
+}
+
+func historyAddNote(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("history note", flag.ContinueOnError)
+  tags := fs.String("tag", "", "comma-separated tags")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  text := strings.TrimSpace(strings.Join(fs.Args(), " "))
+  if text == "" {
+    return fmt.Errorf("usage: history note [--tag a,b] <text>")
+  }
+
+  var entry HistoryEntry
+  err := daemonRequest(ctx, cfg, http.MethodPost, "/api/history", NoteRequest{Text: text, Tags: splitTags(*tags)}, &entry)
+  if errors.Is(err, errNoDaemon) {
+    entry, err = appendHistory(cfg, HistoryEntry{Kind: historyNote, Message: text, Tags: splitTags(*tags)})
+  }
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Added note #%d\n", entry.ID)
+  return nil
+}
+
+func historyAnnotate(ctx context.Context, cfg *Config, args []string) error {
+  if len(args) == 0 {
+    return fmt.Errorf("usage: history annotate <id> [--note text] [--tag a,b]")
+  }
+  id, err := strconv.Atoi(args[0])
+  if err != nil {
+    return fmt.Errorf("invalid history ID: %s", args[0])
+  }
+
+  fs := flag.NewFlagSet("history annotate", flag.ContinueOnError)
+  note := fs.String("note", "", "annotation text")
+  tags := fs.String("tag", "", "comma-separated tags to add")
+  if err := fs.Parse(args[1:]); err != nil {
+    return err
+  }
+  if *note == "" && *tags == "" {
+    return fmt.Errorf("nothing to annotate, use --note and/or --tag")
+  }
+
+  var entry HistoryEntry
+  err = daemonRequest(ctx, cfg, http.MethodPost, fmt.Sprintf("/api/history/%d/annotations", id), NoteRequest{Text: *note, Tags: splitTags(*tags)}, &entry)
+  if errors.Is(err, errNoDaemon) {
+    _, err = annotateHistory(cfg, id, *note, splitTags(*tags))
+  }
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Annotated entry #%d\n", id)
+  return nil
+}
+
+func historyKindColor(kind string) string {
+  switch kind {
+  case actionReset:
+    return colorYellow
+  case actionResetFailed, historyCheckFailed, historyOffline:
+    return colorRed
+  case actionNotified, actionResetSuppressed, actionResetDeferred, historyStuck:
+    return colorYellow
+  case historyFirmware:
+    return colorCyan
+  default:
+    return ""
+  }
+}
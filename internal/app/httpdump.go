@@ -0,0 +1,144 @@
+package app
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// httpDumper writes every Tuya API exchange to a file for --dump-http: the
+// signed request with the string it signed, and the raw response. The
+// access token and the tokens in token responses are redacted, and the
+// access ID is shortened, so the file can be attached to an issue.
+type httpDumper struct {
+  mu  sync.Mutex
+  out io.WriteCloser
+}
+
+// httpDump is nil unless --dump-http is set.
+var httpDump *httpDumper
+
+const redacted = "(redacted)"
+
+func openHTTPDump(path string) (*httpDumper, error) {
+  f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+  if err != nil {
+    return nil, fmt.Errorf("failed to open --dump-http file: %w", err)
+  }
+  return &httpDumper{out: f}, nil
+}
+
+func (d *httpDumper) Close() error {
+  return d.out.Close()
+}
+
+// Record dumps one exchange. resp is nil when the request failed, err is
+// then written instead of the response.
+func (d *httpDumper) Record(req *http.Request, toSign string, body []byte, resp *http.Response, data []byte, err error) {
+  var b strings.Builder
+  fmt.Fprintf(&b, "=== %s\n", time.Now().Format(time.RFC3339Nano))
+  fmt.Fprintf(&b, "%s %s\n", req.Method, redactURI(req.URL.String()))
+  writeDumpHeaders(&b, req.Header)
+  fmt.Fprintf(&b, "String to sign: %q\n", toSign)
+  if len(body) > 0 {
+    fmt.Fprintf(&b, "\n%s\n", body)
+  }
+  b.WriteString("---\n")
+  if err != nil {
+    fmt.Fprintf(&b, "Error: %v\n\n", err)
+  } else {
+    fmt.Fprintf(&b, "%s %s\n", resp.Proto, resp.Status)
+    writeDumpHeaders(&b, resp.Header)
+    fmt.Fprintf(&b, "\n%s\n\n", bytes.TrimRight(redactTokens(data), "\n"))
+  }
+
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  _, _ = io.WriteString(d.out, b.String())
+}
+
+func writeDumpHeaders(b *strings.Builder, header http.Header) {
+  names := make([]string, 0, len(header))
+  for name := range header {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    value := strings.Join(header[name], ", ")
+    switch name {
+    case "Access_token":
+      value = redacted
+    case "Client_id":
+      value = shortenID(value)
+    }
+    fmt.Fprintf(b, "%s: %s\n", name, value)
+  }
+}
+
+// shortenID keeps the start and end of an ID, enough to tell which one was
+// used without publishing it.
+func shortenID(id string) string {
+  if len(id) <= 8 {
+    return redacted
+  }
+  return id[:4] + "..." + id[len(id)-4:]
+}
+
+// redactTokens hides the access and refresh token of a token response.
+// Other responses are dumped as they are.
+func redactTokens(data []byte) []byte {
+  var resp map[string]interface{}
+  if json.Unmarshal(data, &resp) != nil {
+    return data
+  }
+  result, ok := resp["result"].(map[string]interface{})
+  if !ok {
+    return data
+  }
+  changed := false
+  for _, key := range []string{"access_token", "refresh_token"} {
+    if _, ok := result[key]; ok {
+      result[key] = redacted
+      changed = true
+    }
+  }
+  if !changed {
+    return data
+  }
+  redactedData, err := json.Marshal(resp)
+  if err != nil {
+    return data
+  }
+  return redactedData
+}
+
+// redactURI hides token values in the query of a request URI.
+func redactURI(uri string) string {
+  path, rawQuery, ok := strings.Cut(uri, "?")
+  if !ok {
+    return uri
+  }
+  query, err := url.ParseQuery(rawQuery)
+  if err != nil {
+    return path + "?" + redacted
+  }
+  changed := false
+  for _, key := range []string{"access_token", "refresh_token"} {
+    if query.Has(key) {
+      query.Set(key, redacted)
+      changed = true
+    }
+  }
+  if !changed {
+    return uri
+  }
+  return path + "?" + query.Encode()
+}
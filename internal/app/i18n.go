@@ -0,0 +1,206 @@
+package app
+
+import (
+  "fmt"
+  "sort"
+)
+
+const languageEnglish = "en"
+
+// catalogs translate the status output and notification texts. Messages are
+// keyed by their English format string, so a missing translation falls back
+// to English. Logs and errors stay in English, they are meant for whoever
+// debugs the fixer.
+var catalogs = map[string]map[string]string{
+  "de": {
+    "Device may be stuck": "Gerät hängt möglicherweise",
+    "Detection score %s (%s) is below the reset threshold of %s": "Erkennungswert %s (%s) liegt unter der Reset-Schwelle von %s",
+    "Reset suppressed": "Reset unterdrückt",
+    "Device needs reset, but actions are suppressed during quiet hours": "Gerät muss zurückgesetzt werden, aber Aktionen sind während der Ruhezeiten unterdrückt",
+    "Device needs reset, but a cat is in the box":                       "Gerät muss zurückgesetzt werden, aber eine Katze ist in der Toilette",
+    "Reset failed":                          "Reset fehlgeschlagen",
+    "Reset failed: %s":                      "Reset fehlgeschlagen: %s",
+    "Reset not verified":                    "Reset nicht bestätigt",
+    "Device reset":                          "Gerät zurückgesetzt",
+    "Device was stuck and has been reset":   "Gerät hing und wurde zurückgesetzt",
+    "Device recovered":                      "Gerät funktioniert wieder",
+    "Device is working properly again (%s)": "Gerät funktioniert wieder einwandfrei (%s)",
+    "%s since %s":                           "%s seit %s",
+    "Resets keep failing":                   "Resets schlagen wiederholt fehl",
+    "%d resets failed in a row, the device needs attention": "%d Resets in Folge fehlgeschlagen, das Gerät braucht Aufmerksamkeit",
+    "Device offline":                                   "Gerät offline",
+    "Device has been offline for %s":                   "Gerät ist seit %s offline",
+    "%d notification(s) during quiet hours":            "%d Benachrichtigung(en) während der Ruhezeiten",
+    " (%d similar notification(s) throttled since %s)": " (%d ähnliche Benachrichtigung(en) seit %s zurückgehalten)",
+    "Waste drawer full":                                "Abfallschublade voll",
+    "The waste drawer needs to be emptied":             "Die Abfallschublade muss geleert werden",
+    "Replace %s":                                       "%s ersetzen",
+    "%s is due for replacement after %s, run `consumables reset %s` afterwards": "%s muss nach %s ersetzt werden, danach `consumables reset %s` ausführen",
+    "Firmware update available": "Firmware-Update verfügbar",
+    "%s %s is available (installed: %s), run `firmware upgrade` or install it in the Smart Life app": "%s %s ist verfügbar (installiert: %s), `firmware upgrade` ausführen oder in der Smart-Life-App installieren",
+    "Tuya cloud unreachable":                               "Tuya-Cloud nicht erreichbar",
+    "%d checks in a row failed, pausing checks for %s: %s": "%d Prüfungen in Folge fehlgeschlagen, Prüfungen pausieren für %s: %s",
+    "Tuya cloud reachable again":                           "Tuya-Cloud wieder erreichbar",
+    "Checks resumed after %d failed checks":                "Prüfungen nach %d fehlgeschlagenen Prüfungen fortgesetzt",
+    "Poll loop restarted":                                  "Prüfschleife neu gestartet",
+    "No check completed for %s (phase: %s), the watchdog restarted the poll loop (restart #%d)": "Seit %s wurde keine Prüfung abgeschlossen (Phase: %s), der Watchdog hat die Prüfschleife neu gestartet (Neustart Nr. %d)",
+    "Manual override: %s %s":                 "Manuelle Übersteuerung: %s %s",
+    "Report for %s, %s to %s":                "Bericht für %s, %s bis %s",
+    "Report for %s, %s":                      "Bericht für %s, %s",
+    "Average time between cleans":            "Durchschnittliche Zeit zwischen Reinigungen",
+    "Cat visits":                             "Katzenbesuche",
+    " (%+d%% compared to the period before)": " (%+d%% im Vergleich zum Zeitraum davor)",
+    "Cleans":                                 "Reinigungen",
+    " (%d failed)":                           " (%d fehlgeschlagen)",
+    "%d minutes":                             "%d Minuten",
+    "Most common stuck state":                "Häufigster Hängezustand",
+    "none":                                   "keiner",
+    "VALUE":                                  "WERT",
+    "TYPE":                                   "TYP",
+    "DEVICE":                                 "GERÄT",
+    "SCORE":                                  "WERTUNG",
+    "NEEDS RESET":                            "RESET NÖTIG",
+    "REASON":                                 "GRUND",
+    "ACTION":                                 "AKTION",
+  },
+  "nl": {
+    "Device may be stuck": "Apparaat is mogelijk vastgelopen",
+    "Detection score %s (%s) is below the reset threshold of %s": "Detectiescore %s (%s) ligt onder de resetdrempel van %s",
+    "Reset suppressed": "Reset onderdrukt",
+    "Device needs reset, but actions are suppressed during quiet hours": "Apparaat moet gereset worden, maar acties zijn onderdrukt tijdens de stille uren",
+    "Device needs reset, but a cat is in the box":                       "Apparaat moet gereset worden, maar er zit een kat in de bak",
+    "Reset failed":                          "Reset mislukt",
+    "Reset failed: %s":                      "Reset mislukt: %s",
+    "Reset not verified":                    "Reset niet bevestigd",
+    "Device reset":                          "Apparaat gereset",
+    "Device was stuck and has been reset":   "Apparaat was vastgelopen en is gereset",
+    "Device recovered":                      "Apparaat hersteld",
+    "Device is working properly again (%s)": "Apparaat werkt weer naar behoren (%s)",
+    "%s since %s":                           "%s sinds %s",
+    "Resets keep failing":                   "Resets blijven mislukken",
+    "%d resets failed in a row, the device needs attention": "%d resets op rij mislukt, het apparaat heeft aandacht nodig",
+    "Device offline":                                   "Apparaat offline",
+    "Device has been offline for %s":                   "Apparaat is al %s offline",
+    "%d notification(s) during quiet hours":            "%d melding(en) tijdens de stille uren",
+    " (%d similar notification(s) throttled since %s)": " (%d vergelijkbare melding(en) tegengehouden sinds %s)",
+    "Waste drawer full":                                "Afvallade vol",
+    "The waste drawer needs to be emptied":             "De afvallade moet geleegd worden",
+    "Replace %s":                                       "%s vervangen",
+    "%s is due for replacement after %s, run `consumables reset %s` afterwards": "%s moet na %s vervangen worden, voer daarna `consumables reset %s` uit",
+    "Firmware update available": "Firmware-update beschikbaar",
+    "%s %s is available (installed: %s), run `firmware upgrade` or install it in the Smart Life app": "%s %s is beschikbaar (geïnstalleerd: %s), voer `firmware upgrade` uit of installeer het in de Smart Life-app",
+    "Tuya cloud unreachable":                               "Tuya-cloud onbereikbaar",
+    "%d checks in a row failed, pausing checks for %s: %s": "%d controles op rij mislukt, controles gepauzeerd voor %s: %s",
+    "Tuya cloud reachable again":                           "Tuya-cloud weer bereikbaar",
+    "Checks resumed after %d failed checks":                "Controles hervat na %d mislukte controles",
+    "Poll loop restarted":                                  "Controlelus herstart",
+    "No check completed for %s (phase: %s), the watchdog restarted the poll loop (restart #%d)": "Al %s geen controle voltooid (fase: %s), de watchdog heeft de controlelus herstart (herstart nr. %d)",
+    "Manual override: %s %s":                 "Handmatige overschrijving: %s %s",
+    "Report for %s, %s to %s":                "Rapport voor %s, %s tot %s",
+    "Report for %s, %s":                      "Rapport voor %s, %s",
+    "Average time between cleans":            "Gemiddelde tijd tussen reinigingen",
+    "Cat visits":                             "Kattenbezoeken",
+    " (%+d%% compared to the period before)": " (%+d%% vergeleken met de periode ervoor)",
+    "Cleans":                                 "Reinigingen",
+    " (%d failed)":                           " (%d mislukt)",
+    "%d minutes":                             "%d minuten",
+    "Most common stuck state":                "Meest voorkomende vastgelopen status",
+    "none":                                   "geen",
+    "NAME":                                   "NAAM",
+    "VALUE":                                  "WAARDE",
+    "DEVICE":                                 "APPARAAT",
+    "NEEDS RESET":                            "RESET NODIG",
+    "REASON":                                 "REDEN",
+    "ACTION":                                 "ACTIE",
+  },
+  "tr": {
+    "Device may be stuck": "Cihaz takılmış olabilir",
+    "Detection score %s (%s) is below the reset threshold of %s": "Tespit puanı %s (%s), %s sıfırlama eşiğinin altında",
+    "Reset suppressed": "Sıfırlama engellendi",
+    "Device needs reset, but actions are suppressed during quiet hours": "Cihazın sıfırlanması gerekiyor, ancak sessiz saatlerde işlemler engelleniyor",
+    "Device needs reset, but a cat is in the box":                       "Cihazın sıfırlanması gerekiyor, ancak kedi kumun içinde",
+    "Reset failed":                          "Sıfırlama başarısız",
+    "Reset failed: %s":                      "Sıfırlama başarısız: %s",
+    "Reset not verified":                    "Sıfırlama doğrulanamadı",
+    "Device reset":                          "Cihaz sıfırlandı",
+    "Device was stuck and has been reset":   "Cihaz takılmıştı ve sıfırlandı",
+    "Device recovered":                      "Cihaz düzeldi",
+    "Device is working properly again (%s)": "Cihaz yeniden düzgün çalışıyor (%s)",
+    "%s since %s":                           "%[1]s (%[2]s tarihinden beri)",
+    "Resets keep failing":                   "Sıfırlamalar başarısız olmaya devam ediyor",
+    "%d resets failed in a row, the device needs attention": "Art arda %d sıfırlama başarısız oldu, cihazın ilgilenilmesi gerekiyor",
+    "Device offline":                                   "Cihaz çevrimdışı",
+    "Device has been offline for %s":                   "Cihaz %s süredir çevrimdışı",
+    "%d notification(s) during quiet hours":            "Sessiz saatlerde %d bildirim",
+    " (%d similar notification(s) throttled since %s)": " (%[2]s tarihinden beri %[1]d benzer bildirim engellendi)",
+    "Waste drawer full":                                "Atık çekmecesi dolu",
+    "The waste drawer needs to be emptied":             "Atık çekmecesinin boşaltılması gerekiyor",
+    "Replace %s":                                       "%s değiştirin",
+    "%s is due for replacement after %s, run `consumables reset %s` afterwards": "%[1]s %[2]s sonra değiştirilmeli, ardından `consumables reset %[3]s` çalıştırın",
+    "Firmware update available": "Donanım yazılımı güncellemesi mevcut",
+    "%s %s is available (installed: %s), run `firmware upgrade` or install it in the Smart Life app": "%s %s mevcut (yüklü: %s), `firmware upgrade` çalıştırın veya Smart Life uygulamasından yükleyin",
+    "Tuya cloud unreachable":                               "Tuya bulutuna ulaşılamıyor",
+    "%d checks in a row failed, pausing checks for %s: %s": "Art arda %d kontrol başarısız oldu, kontroller %s boyunca duraklatıldı: %s",
+    "Tuya cloud reachable again":                           "Tuya bulutuna yeniden ulaşılabiliyor",
+    "Checks resumed after %d failed checks":                "%d başarısız kontrolden sonra kontroller devam ediyor",
+    "Poll loop restarted":                                  "Kontrol döngüsü yeniden başlatıldı",
+    "No check completed for %s (phase: %s), the watchdog restarted the poll loop (restart #%d)": "%s boyunca hiçbir kontrol tamamlanmadı (aşama: %s), watchdog kontrol döngüsünü yeniden başlattı (%d. yeniden başlatma)",
+    "Manual override: %s %s":                 "Elle geçersiz kılma: %s %s",
+    "Report for %s, %s to %s":                "%s raporu, %s - %s",
+    "Report for %s, %s":                      "%s raporu, %s",
+    "Average time between cleans":            "Temizlikler arası ortalama süre",
+    "Cat visits":                             "Kedi ziyaretleri",
+    " (%+d%% compared to the period before)": " (önceki döneme göre %%%+d)",
+    "Cleans":                                 "Temizlikler",
+    "Resets":                                 "Sıfırlamalar",
+    " (%d failed)":                           " (%d başarısız)",
+    "Offline":                                "Çevrimdışı",
+    "%d minutes":                             "%d dakika",
+    "Most common stuck state":                "En sık takılma durumu",
+    "none":                                   "yok",
+    "CODE":                                   "KOD",
+    "NAME":                                   "AD",
+    "VALUE":                                  "DEĞER",
+    "TYPE":                                   "TÜR",
+    "DEVICE":                                 "CİHAZ",
+    "ONLINE":                                 "ÇEVRİMİÇİ",
+    "SCORE":                                  "PUAN",
+    "NEEDS RESET":                            "SIFIRLAMA GEREKLİ",
+    "REASON":                                 "NEDEN",
+    "ACTION":                                 "İŞLEM",
+  },
+}
+
+func languages() []string {
+  langs := []string{languageEnglish}
+  for lang := range catalogs {
+    langs = append(langs, lang)
+  }
+  sort.Strings(langs)
+  return langs
+}
+
+func isLanguage(lang string) bool {
+  _, ok := catalogs[lang]
+  return ok || lang == languageEnglish
+}
+
+// tr translates an English message format to OUTPUT_LANGUAGE and formats it.
+func tr(cfg *Config, format string, args ...interface{}) string {
+  if translated, ok := catalogs[cfg.Language][format]; ok {
+    format = translated
+  }
+  if len(args) == 0 {
+    return format
+  }
+  return fmt.Sprintf(format, args...)
+}
+
+// trHeaders translates table headers.
+func trHeaders(cfg *Config, headers ...string) []string {
+  translated := make([]string, len(headers))
+  for i, header := range headers {
+    translated[i] = tr(cfg, header)
+  }
+  return translated
+}
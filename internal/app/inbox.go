@@ -0,0 +1,324 @@
+package app
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+// Delivery states of a notification on one channel.
+const (
+  deliverySent   = "sent"
+  deliveryQueued = "queued"
+  deliveryFailed = "failed"
+)
+
+type Delivery struct {
+  Channel string    `json:"channel"`
+  Status  string    `json:"status"`
+  Time    time.Time `json:"time"`
+  Error   string    `json:"error,omitempty"`
+}
+
+// InboxEntry is an emitted notification with its delivery status per
+// channel, kept so it can be audited and retried later.
+type InboxEntry struct {
+  notify.Notification
+  Deliveries []Delivery `json:"deliveries"`
+}
+
+func (e InboxEntry) delivery(channel string) *Delivery {
+  for i := range e.Deliveries {
+    if e.Deliveries[i].Channel == channel {
+      return &e.Deliveries[i]
+    }
+  }
+  return nil
+}
+
+func inboxPath(cfg *Config) (string, error) {
+  return statePath(cfg, "notifications.jsonl")
+}
+
+func readInbox(cfg *Config) ([]InboxEntry, error) {
+  path, err := inboxPath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  file, err := os.Open(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+
+  var entries []InboxEntry
+  scanner := bufio.NewScanner(file)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+  for scanner.Scan() {
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" {
+      continue
+    }
+    var entry InboxEntry
+    if err := json.Unmarshal([]byte(line), &entry); err != nil {
+      return nil, fmt.Errorf("corrupt notification in %s: %w", path, err)
+    }
+    entries = append(entries, entry)
+  }
+  return entries, scanner.Err()
+}
+
+func writeInbox(cfg *Config, entries []InboxEntry) error {
+  path, err := inboxPath(cfg)
+  if err != nil {
+    return err
+  }
+  tmp := path + ".tmp"
+  file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+  if err != nil {
+    return err
+  }
+  enc := json.NewEncoder(file)
+  for _, entry := range entries {
+    if err := enc.Encode(entry); err != nil {
+      file.Close()
+      return err
+    }
+  }
+  if err := file.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+// nextInboxID returns the ID for a new notification. IDs are assigned
+// before delivery so queued copies can be matched to their entry.
+func nextInboxID(cfg *Config) (int, error) {
+  entries, err := readInbox(cfg)
+  if err != nil {
+    return 0, err
+  }
+  if len(entries) == 0 {
+    return 1, nil
+  }
+  return entries[len(entries)-1].ID + 1, nil
+}
+
+func appendInbox(cfg *Config, entry InboxEntry) error {
+  path, err := inboxPath(cfg)
+  if err != nil {
+    return err
+  }
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+  if err != nil {
+    return err
+  }
+  defer file.Close()
+  return json.NewEncoder(file).Encode(entry)
+}
+
+// markDelivered updates the delivery status of the given notifications on
+// one channel, e.g. once a quiet hours summary went out.
+func markDelivered(cfg *Config, appLog *slog.Logger, channel string, ids []int, status string, deliveryErr error) {
+  if cfg.DataStorage == dataStorageNone || len(ids) == 0 {
+    return
+  }
+  entries, err := readInbox(cfg)
+  if err != nil {
+    appLog.Warn("Failed to update notification inbox", "error", err)
+    return
+  }
+  wanted := map[int]bool{}
+  for _, id := range ids {
+    wanted[id] = true
+  }
+  for i := range entries {
+    if !wanted[entries[i].ID] {
+      continue
+    }
+    d := entries[i].delivery(channel)
+    if d == nil {
+      entries[i].Deliveries = append(entries[i].Deliveries, Delivery{Channel: channel})
+      d = &entries[i].Deliveries[len(entries[i].Deliveries)-1]
+    }
+    d.Status = status
+    d.Time = time.Now()
+    d.Error = ""
+    if deliveryErr != nil {
+      d.Error = deliveryErr.Error()
+    }
+  }
+  if err := writeInbox(cfg, entries); err != nil {
+    appLog.Warn("Failed to update notification inbox", "error", err)
+  }
+}
+
+func runNotifications(cfg *Config, appLog *slog.Logger, args []string) error {
+  if len(args) > 0 && args[0] == "retry" {
+    return notificationsRetry(cfg, appLog, args[1:])
+  }
+  if len(args) > 0 && args[0] == "list" {
+    args = args[1:]
+  }
+  if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+    return fmt.Errorf("unknown notifications command: %s (valid: list, retry)", args[0])
+  }
+
+  fs := flag.NewFlagSet("notifications list", flag.ContinueOnError)
+  level := fs.String("level", "", "only show notifications of this level: info, warning, error or critical")
+  channel := fs.String("channel", "", "only show notifications delivered to this channel")
+  status := fs.String("status", "", "only show notifications with this delivery status: sent, queued or failed")
+  since := fs.String("since", "", "only show notifications newer than this, e.g. 30d or 12h")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+
+  var cutoff time.Time
+  if *since != "" {
+    d, err := parseSince(*since)
+    if err != nil {
+      return fmt.Errorf("invalid --since: %w", err)
+    }
+    cutoff = time.Now().Add(-d)
+  }
+
+  entries, err := readInbox(cfg)
+  if err != nil {
+    return err
+  }
+
+  filtered := []InboxEntry{}
+  for _, entry := range entries {
+    if *level != "" && entry.Level != *level {
+      continue
+    }
+    if entry.Time.Before(cutoff) {
+      continue
+    }
+    if *channel != "" && entry.delivery(*channel) == nil {
+      continue
+    }
+    if *status != "" {
+      matched := false
+      for _, d := range entry.Deliveries {
+        if d.Status == *status && (*channel == "" || d.Channel == *channel) {
+          matched = true
+        }
+      }
+      if !matched {
+        continue
+      }
+    }
+    filtered = append(filtered, entry)
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(filtered)
+  }
+
+  if len(filtered) == 0 {
+    fmt.Println("No notifications found")
+    return nil
+  }
+
+  table := newTable("ID", "TIME", "LEVEL", "TITLE", "DELIVERY")
+  for _, entry := range filtered {
+    deliveries := make([]string, 0, len(entry.Deliveries))
+    failed := false
+    for _, d := range entry.Deliveries {
+      text := d.Channel + ": " + d.Status
+      if d.Error != "" {
+        text += " (" + d.Error + ")"
+      }
+      deliveries = append(deliveries, text)
+      failed = failed || d.Status == deliveryFailed
+    }
+    table.AddRow(strconv.Itoa(entry.ID), cfg.TimeFormat.Format(entry.Time), entry.Level, entry.Title, strings.Join(deliveries, ", "))
+    if failed {
+      table.SetColor(4, colorRed)
+    }
+  }
+  return table.Render(os.Stdout, useColor())
+}
+
+// notificationsRetry sends a notification again on every configured channel
+// where its delivery failed, or on the channel given with --channel.
+func notificationsRetry(cfg *Config, appLog *slog.Logger, args []string) error {
+  if len(args) == 0 {
+    return fmt.Errorf("usage: notifications retry <id> [--channel name]")
+  }
+  id, err := strconv.Atoi(args[0])
+  if err != nil {
+    return fmt.Errorf("invalid notification ID: %s", args[0])
+  }
+  fs := flag.NewFlagSet("notifications retry", flag.ContinueOnError)
+  only := fs.String("channel", "", "channel to retry on, also when the first delivery succeeded")
+  if err := fs.Parse(args[1:]); err != nil {
+    return err
+  }
+
+  entries, err := readInbox(cfg)
+  if err != nil {
+    return err
+  }
+  var entry *InboxEntry
+  for i := range entries {
+    if entries[i].ID == id {
+      entry = &entries[i]
+    }
+  }
+  if entry == nil {
+    return fmt.Errorf("notification #%d not found", id)
+  }
+
+  retried := 0
+  var failed []string
+  for _, channel := range cfg.NotifyChannels {
+    d := entry.delivery(channel.Name)
+    if *only != "" {
+      if channel.Name != *only {
+        continue
+      }
+    } else if d == nil || d.Status != deliveryFailed {
+      continue
+    }
+
+    retried++
+    err := channel.Deliver(entry.Notification)
+    status := deliverySent
+    if err != nil {
+      status = deliveryFailed
+      failed = append(failed, channel.Name)
+    }
+    markDelivered(cfg, appLog, channel.Name, []int{id}, status, err)
+  }
+
+  if retried == 0 {
+    if *only != "" {
+      return fmt.Errorf("channel %s is not configured", *only)
+    }
+    fmt.Printf("Notification #%d has no failed deliveries\n", id)
+    return nil
+  }
+  if len(failed) > 0 {
+    return fmt.Errorf("delivery of notification #%d failed again on %s", id, strings.Join(failed, ", "))
+  }
+  fmt.Printf("Notification #%d delivered\n", id)
+  return nil
+}
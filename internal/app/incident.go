@@ -0,0 +1,125 @@
+package app
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "log/slog"
+  "os"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+const (
+  incidentFiring   = "firing"
+  incidentResolved = "resolved"
+)
+
+// Incident is a period during which the device needed a reset. It opens on
+// the first check that detects a problem and resolves on the first healthy one.
+type Incident struct {
+  DeviceID string    `json:"device_id"`
+  Status   string    `json:"status"`
+  Reason   string    `json:"reason"`
+  StartsAt time.Time `json:"starts_at"`
+  EndsAt   time.Time `json:"ends_at,omitempty"`
+}
+
+func (i Incident) Fingerprint() string {
+  sum := sha256.Sum256([]byte(i.DeviceID + "/" + i.StartsAt.UTC().Format(time.RFC3339Nano)))
+  return hex.EncodeToString(sum[:8])
+}
+
+func incidentPath(cfg *Config) (string, error) {
+  return statePath(cfg, "incident.json")
+}
+
+func loadOpenIncident(cfg *Config) (*Incident, error) {
+  path, err := incidentPath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  incident := &Incident{}
+  if err := json.Unmarshal(data, incident); err != nil {
+    return nil, err
+  }
+  return incident, nil
+}
+
+func saveOpenIncident(cfg *Config, incident *Incident) error {
+  path, err := incidentPath(cfg)
+  if err != nil {
+    return err
+  }
+  if incident == nil {
+    err := os.Remove(path)
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  return saveStateFile(path, incident)
+}
+
+func emitIncident(cfg *Config, appLog *slog.Logger, incident Incident) {
+  if cfg.AlertmanagerWebhookURL != "" {
+    if err := notify.PostJSON(notifyClient, cfg.AlertmanagerWebhookURL, alertmanagerWebhook(incident)); err != nil {
+      appLog.Warn("Failed to send Alertmanager webhook", "error", err)
+    }
+  }
+  if cfg.AlertmanagerURL != "" {
+    if err := notify.PostJSON(notifyClient, cfg.AlertmanagerURL+"/api/v2/alerts", []alertmanagerAlert{newAlertmanagerAlert(incident)}); err != nil {
+      appLog.Warn("Failed to send alert to Alertmanager", "error", err)
+    }
+  }
+}
+
+// trackIncident opens or resolves the device incident based on a check
+// result. Failed checks leave the incident state untouched.
+func trackIncident(cfg *Config, appLog *slog.Logger, result *CheckResult, checkErr error) {
+  if checkErr != nil && !result.NeedsReset {
+    return
+  }
+  // The leader tracks incidents, a standby would only duplicate alerts.
+  if result.Standby {
+    return
+  }
+
+  open, err := loadOpenIncident(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load incident state", "error", err)
+    return
+  }
+
+  switch {
+  case result.NeedsReset && open == nil:
+    incident := Incident{DeviceID: result.DeviceID, Status: incidentFiring, Reason: result.Reason, StartsAt: result.Time}
+    if err := saveOpenIncident(cfg, &incident); err != nil {
+      appLog.Warn("Failed to save incident state", "error", err)
+    }
+    emitIncident(cfg, appLog, incident)
+  case result.NeedsReset && open != nil:
+    // Alertmanager expires alerts that are not re-sent, so keep it firing.
+    if cfg.AlertmanagerURL != "" {
+      if err := notify.PostJSON(notifyClient, cfg.AlertmanagerURL+"/api/v2/alerts", []alertmanagerAlert{newAlertmanagerAlert(*open)}); err != nil {
+        appLog.Warn("Failed to send alert to Alertmanager", "error", err)
+      }
+    }
+  case !result.NeedsReset && open != nil:
+    open.Status = incidentResolved
+    open.EndsAt = result.Time
+    if err := saveOpenIncident(cfg, nil); err != nil {
+      appLog.Warn("Failed to save incident state", "error", err)
+    }
+    emitIncident(cfg, appLog, *open)
+  }
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+  "bytes"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// influxMeasurement holds one point per check with the sampled device
+// status, tagged with the device ID.
+const influxMeasurement = "device_status"
+
+var influxClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+  influxKeyEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+  influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+func influxFieldValue(value interface{}) (string, bool) {
+  switch v := value.(type) {
+  case bool:
+    return strconv.FormatBool(v), true
+  case float64:
+    // Tuya reports integers, but JSON numbers are always written as floats
+    // so a field never changes its type.
+    return strconv.FormatFloat(v, 'f', -1, 64), true
+  case string:
+    return `"` + influxStringEscaper.Replace(v) + `"`, true
+  default:
+    return "", false
+  }
+}
+
+// influxLine formats a check result in the InfluxDB line protocol. Every DP
+// of the status becomes a field named after its code, next to online, score
+// and the action taken.
+func influxLine(result *CheckResult) string {
+  fields := map[string]string{
+    "online": strconv.FormatBool(result.Online),
+    "score":  strconv.FormatFloat(result.Score, 'f', -1, 64),
+    "action": `"` + influxStringEscaper.Replace(result.Action) + `"`,
+  }
+  for code, value := range result.Status {
+    if formatted, ok := influxFieldValue(value); ok {
+      if _, reserved := fields[code]; !reserved {
+        fields[code] = formatted
+      }
+    }
+  }
+
+  keys := make([]string, 0, len(fields))
+  for key := range fields {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  pairs := make([]string, 0, len(keys))
+  for _, key := range keys {
+    pairs = append(pairs, influxKeyEscaper.Replace(key)+"="+fields[key])
+  }
+
+  return fmt.Sprintf("%s,device_id=%s %s %d", influxMeasurement, influxKeyEscaper.Replace(result.DeviceID), strings.Join(pairs, ","), result.Time.UnixNano())
+}
+
+// writeInflux records the sampled device status in InfluxDB through the v2
+// write API. Checks that could not read the device are skipped, and so are
+// standby instances, which would only duplicate the leader's points.
+func writeInflux(cfg *Config, appLog *slog.Logger, result *CheckResult, checkErr error) {
+  if cfg.InfluxURL == "" || result.Standby {
+    return
+  }
+  if checkErr != nil && len(result.Status) == 0 && !result.Online {
+    return
+  }
+
+  query := url.Values{}
+  query.Set("org", cfg.InfluxOrg)
+  query.Set("bucket", cfg.InfluxBucket)
+  query.Set("precision", "ns")
+  req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.InfluxURL, "/")+"/api/v2/write?"+query.Encode(), bytes.NewBufferString(influxLine(result)+"\n"))
+  if err != nil {
+    appLog.Warn("Failed to write to InfluxDB", "error", err)
+    return
+  }
+  req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+  if cfg.InfluxToken != "" {
+    req.Header.Set("Authorization", "Token "+cfg.InfluxToken)
+  }
+
+  resp, err := influxClient.Do(req)
+  if err != nil {
+    appLog.Warn("Failed to write to InfluxDB", "error", err)
+    return
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    appLog.Warn("Failed to write to InfluxDB", "status", resp.Status)
+  }
+}
@@ -0,0 +1,256 @@
+package app
+
+import (
+  "bufio"
+  "context"
+  "flag"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+
+  "shitbox-fixer/pkg/tuyaclient"
+)
+
+type wizard struct {
+  in *bufio.Reader
+}
+
+// prompt asks for a value, returning def on an empty answer.
+func (w *wizard) prompt(question, def string) (string, error) {
+  if def != "" {
+    fmt.Printf("%s [%s]: ", question, def)
+  } else {
+    fmt.Printf("%s: ", question)
+  }
+  line, err := w.in.ReadString('\n')
+  if err != nil && (err != io.EOF || line == "") {
+    fmt.Println()
+    return "", fmt.Errorf("aborted")
+  }
+  if line = strings.TrimSpace(line); line != "" {
+    return line, nil
+  }
+  return def, nil
+}
+
+// choose asks until the answer is one of valid.
+func (w *wizard) choose(question, def string, valid []string) (string, error) {
+  for {
+    answer, err := w.prompt(fmt.Sprintf("%s (%s)", question, strings.Join(valid, ", ")), def)
+    if err != nil {
+      return "", err
+    }
+    for _, v := range valid {
+      if answer == v {
+        return answer, nil
+      }
+    }
+    fmt.Printf("  %q is not one of %s\n", answer, strings.Join(valid, ", "))
+  }
+}
+
+func regionNames() []string {
+  names := make([]string, 0, len(regionConfig))
+  for name := range regionConfig {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// matchingPreset returns the preset with the longest reset sequence that
+// only uses functions the device has.
+func matchingPreset(functions map[string]bool) string {
+  best := "generic"
+  longest := 0
+  for _, name := range presetNames() {
+    matches := true
+    for _, step := range presets[name].ResetSequence {
+      if !functions[step.Code] {
+        matches = false
+        break
+      }
+    }
+    if matches && len(presets[name].ResetSequence) > longest {
+      best = name
+      longest = len(presets[name].ResetSequence)
+    }
+  }
+  return best
+}
+
+// runInit asks for the credentials, lets the user pick a device and writes a
+// .env file for it. Runs before the config is loaded, as there usually is
+// none yet.
+func runInit(ctx context.Context, args []string) error {
+  fs := flag.NewFlagSet("init", flag.ContinueOnError)
+  path := fs.String("file", ".env", "config file to write")
+  force := fs.Bool("force", false, "overwrite an existing config file")
+  detect := fs.Bool("detect-region", false, "find the data center instead of asking for it")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if _, err := os.Stat(*path); err == nil && !*force {
+    return fmt.Errorf("%s already exists, use --force to overwrite it", *path)
+  }
+
+  w := &wizard{in: bufio.NewReader(os.Stdin)}
+  fmt.Println("Create a cloud project at https://iot.tuya.com and link your Tuya app account to it first, see the README.")
+  fmt.Println()
+
+  accessID, err := w.prompt("Access ID", os.Getenv("TUYA_ACCESS_ID"))
+  if err != nil {
+    return err
+  }
+  accessKey, err := w.prompt("Access Secret (shown while typing)", os.Getenv("TUYA_ACCESS_KEY"))
+  if err != nil {
+    return err
+  }
+  proxy, err := parseProxyURL(os.Getenv("TUYA_PROXY_URL"))
+  if err != nil {
+    return err
+  }
+  httpClient := newHTTPClient(defaultHTTPConnectTimeout, defaultHTTPTimeout, proxy)
+
+  // With TUYA_API_HOST the data center is known already.
+  region, apiHost := os.Getenv("TUYA_REGION"), os.Getenv("TUYA_API_HOST")
+  switch {
+  case apiHost != "" && *detect:
+    return fmt.Errorf("--detect-region cannot be combined with TUYA_API_HOST")
+  case apiHost != "":
+    if apiHost, err = parseAPIHost(apiHost); err != nil {
+      return err
+    }
+  case *detect:
+    fmt.Println("Looking for the data center of the cloud project...")
+    if region, err = detectRegion(ctx, region, accessID, accessKey, "", httpClient, slog.Default()); err != nil {
+      return err
+    }
+    fmt.Printf("Data center: %s\n", region)
+    apiHost = regionConfig[region].ApiHost
+  default:
+    if region, err = w.choose("Data center", region, regionNames()); err != nil {
+      return err
+    }
+    apiHost = regionConfig[region].ApiHost
+  }
+
+  initTuya(apiHost, accessID, accessKey, httpClient, tuyaclient.DefaultMaxAttempts, slog.Default())
+  if _, err := tuya.AccessToken(ctx, true); err != nil {
+    return fmt.Errorf("%w (check the credentials and that the data center matches the cloud project)", err)
+  }
+
+  devices, err := getDevices(ctx)
+  if err != nil {
+    return err
+  }
+  if len(devices) == 0 {
+    return fmt.Errorf("no devices found, make sure your Tuya app account is linked to the cloud project")
+  }
+
+  fmt.Println()
+  table := newTable("#", "ID", "NAME", "CATEGORY", "ONLINE")
+  def := ""
+  for i, device := range devices {
+    table.AddRow(strconv.Itoa(i+1), device.ID, device.Name, device.Category, fmt.Sprint(device.Online))
+    table.SetColor(4, boolColor(device.Online))
+    if device.ID == os.Getenv("TUYA_DEVICE_ID") || (def == "" && device.Category == "msp") {
+      def = strconv.Itoa(i + 1)
+    }
+  }
+  if err := table.Render(os.Stdout, useColor()); err != nil {
+    return err
+  }
+  if def == "" {
+    def = "1"
+  }
+  var device DeviceSummary
+  for {
+    answer, err := w.prompt("Device", def)
+    if err != nil {
+      return err
+    }
+    n, err := strconv.Atoi(answer)
+    if err == nil && n >= 1 && n <= len(devices) {
+      device = devices[n-1]
+      break
+    }
+    fmt.Printf("  enter a number from 1 to %d\n", len(devices))
+  }
+
+  spec, err := getDeviceSpecification(ctx, device.ID)
+  if err != nil {
+    return err
+  }
+  status := map[string]interface{}{}
+  if deviceStatus, err := getDeviceStatus(ctx, device.ID); err == nil {
+    status = deviceStatusMap(deviceStatus)
+  }
+  functions := map[string]bool{}
+  for _, f := range spec.Result.Functions {
+    functions[f.Code] = true
+  }
+  dpIDs := map[string]int{}
+  if properties, err := getDeviceProperties(ctx, device.ID); err == nil {
+    for _, p := range properties.Result.Properties {
+      dpIDs[p.Code] = p.DPID
+    }
+  }
+
+  fmt.Printf("\nData points of %s:\n", device.Name)
+  dps := newTable("DP", "CODE", "TYPE", "WRITABLE", "VALUE")
+  for _, f := range spec.Result.Status {
+    value := ""
+    if v, ok := status[f.Code]; ok {
+      value = fmt.Sprint(v)
+    }
+    dpID := ""
+    if f.DPID != 0 {
+      dpID = strconv.Itoa(f.DPID)
+    } else if id, ok := dpIDs[f.Code]; ok {
+      dpID = strconv.Itoa(id)
+    }
+    dps.AddRow(dpID, f.Code, f.Type, fmt.Sprint(functions[f.Code]), value)
+  }
+  if err := dps.Render(os.Stdout, useColor()); err != nil {
+    return err
+  }
+  fmt.Println()
+
+  preset, err := w.choose("Preset", matchingPreset(functions), presetNames())
+  if err != nil {
+    return err
+  }
+
+  format := "%s=%s\n"
+  if isYAMLConfig(*path) {
+    format = "%s: %q\n"
+  }
+  var b strings.Builder
+  fmt.Fprintf(&b, "# Written by shitbox-fixer init for %s (%s)\n", device.Name, device.Category)
+  settings := [][2]string{
+    {"TUYA_ACCESS_ID", accessID},
+    {"TUYA_ACCESS_KEY", accessKey},
+    {"TUYA_REGION", region},
+    {"TUYA_DEVICE_ID", device.ID},
+    {"DEVICE_PRESET", preset},
+  }
+  if os.Getenv("TUYA_API_HOST") != "" {
+    settings = append(settings, [2]string{"TUYA_API_HOST", apiHost})
+  }
+  for _, kv := range settings {
+    fmt.Fprintf(&b, format, kv[0], kv[1])
+  }
+
+  // The file holds the access secret.
+  if err := os.WriteFile(*path, []byte(b.String()), 0o600); err != nil {
+    return fmt.Errorf("failed to write %s: %w", *path, err)
+  }
+  fmt.Printf("\nWrote %s, run `%s check` to validate the setup.\n", *path, filepath.Base(os.Args[0]))
+  return nil
+}
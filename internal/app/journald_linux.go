@@ -0,0 +1,90 @@
+//go:build linux
+
+package app
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "log/slog"
+  "net"
+  "os"
+  "strings"
+)
+
+const journaldSupported = true
+
+type journaldSink struct {
+  conn net.Conn
+}
+
+func journaldAvailable() bool {
+  _, err := os.Stat(journaldSocket)
+  return err == nil
+}
+
+// newJournaldSink talks the native journal protocol, so every log attribute
+// becomes a journal field that can be filtered with journalctl.
+func newJournaldSink() (logSink, error) {
+  conn, err := net.Dial("unixgram", journaldSocket)
+  if err != nil {
+    return nil, fmt.Errorf("failed to connect to journald: %w", err)
+  }
+  return &journaldSink{conn: conn}, nil
+}
+
+func journalPriority(level slog.Level) string {
+  switch {
+  case level >= slog.LevelError:
+    return "3"
+  case level >= slog.LevelWarn:
+    return "4"
+  case level >= slog.LevelInfo:
+    return "6"
+  default:
+    return "7"
+  }
+}
+
+// journalFieldName maps an attribute key to a valid journal field name:
+// upper case letters, digits and underscores, not starting with either of
+// the latter.
+func journalFieldName(key string) string {
+  name := strings.Map(func(r rune) rune {
+    switch {
+    case r >= 'a' && r <= 'z':
+      return r - 'a' + 'A'
+    case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+      return r
+    default:
+      return '_'
+    }
+  }, key)
+  name = strings.TrimLeft(name, "_")
+  if name == "" || (name[0] >= '0' && name[0] <= '9') {
+    name = "F_" + name
+  }
+  return name
+}
+
+func writeJournalField(b *bytes.Buffer, name, value string) {
+  if !strings.Contains(value, "\n") {
+    b.WriteString(name + "=" + value + "\n")
+    return
+  }
+  b.WriteString(name + "\n")
+  _ = binary.Write(b, binary.LittleEndian, uint64(len(value)))
+  b.WriteString(value + "\n")
+}
+
+func (s *journaldSink) Send(level slog.Level, msg string, attrs []slog.Attr) error {
+  var b bytes.Buffer
+  writeJournalField(&b, "MESSAGE", msg)
+  writeJournalField(&b, "PRIORITY", journalPriority(level))
+  writeJournalField(&b, "SYSLOG_IDENTIFIER", syslogTag)
+  for _, a := range attrs {
+    writeJournalField(&b, journalFieldName(a.Key), attrString(a.Value))
+  }
+  _, err := s.conn.Write(b.Bytes())
+  return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package app
+
+import "fmt"
+
+const journaldSupported = false
+
+func journaldAvailable() bool {
+  return false
+}
+
+func newJournaldSink() (logSink, error) {
+  return nil, fmt.Errorf("journald is only supported on Linux")
+}
@@ -0,0 +1,191 @@
+package app
+
+import (
+  "bytes"
+  "context"
+  "crypto/tls"
+  "crypto/x509"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// kubeServiceAccountDir is where Kubernetes mounts the credentials of the
+// pod's service account.
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// The ShitboxDevice custom resource, see the CRD in the README.
+const (
+  deviceResourceGroup   = "shitbox-fixer.kaanklky.github.io"
+  deviceResourceVersion = "v1alpha1"
+  deviceResourcePlural  = "shitboxdevices"
+)
+
+// kubeClient talks to the Kubernetes API, in the cluster with the pod's
+// service account or through `kubectl proxy`, which needs no credentials.
+type kubeClient struct {
+  server    string
+  tokenFile string
+  client    *http.Client
+}
+
+type ShitboxDevice struct {
+  Metadata struct {
+    Name       string `json:"name"`
+    Namespace  string `json:"namespace"`
+    Generation int64  `json:"generation"`
+  } `json:"metadata"`
+  Spec   ShitboxDeviceSpec   `json:"spec"`
+  Status ShitboxDeviceStatus `json:"status"`
+}
+
+// ShitboxDeviceSpec describes a device to watch. The fields are shortcuts
+// for the settings of the same name; Env sets any other one.
+type ShitboxDeviceSpec struct {
+  DeviceID     string            `json:"deviceId"`
+  Preset       string            `json:"preset,omitempty"`
+  PollInterval string            `json:"pollInterval,omitempty"`
+  DetectRule   string            `json:"detectRule,omitempty"`
+  VerifyRule   string            `json:"verifyRule,omitempty"`
+  OccupiedRule string            `json:"occupiedRule,omitempty"`
+  QuietHours   string            `json:"quietHours,omitempty"`
+  Suspend      bool              `json:"suspend,omitempty"`
+  Env          map[string]string `json:"env,omitempty"`
+}
+
+type ShitboxDeviceStatus struct {
+  ObservedGeneration int64  `json:"observedGeneration"`
+  Phase              string `json:"phase"`
+  Healthy            bool   `json:"healthy"`
+  LastCheck          string `json:"lastCheck"`
+  LastAction         string `json:"lastAction"`
+  Reason             string `json:"reason"`
+  Message            string `json:"message"`
+}
+
+func (d *ShitboxDevice) key() string {
+  return d.Metadata.Namespace + "/" + d.Metadata.Name
+}
+
+func newKubeClient(server string) (*kubeClient, error) {
+  if server != "" {
+    return &kubeClient{server: strings.TrimSuffix(server, "/"), client: &http.Client{Timeout: 30 * time.Second}}, nil
+  }
+  host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+  if host == "" || port == "" {
+    return nil, fmt.Errorf("not running in a Kubernetes pod, pass --api-server, e.g. the address of `kubectl proxy`")
+  }
+  caFile := filepath.Join(kubeServiceAccountDir, "ca.crt")
+  ca, err := os.ReadFile(caFile)
+  if err != nil {
+    return nil, err
+  }
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(ca) {
+    return nil, fmt.Errorf("no certificates found in %s", caFile)
+  }
+  return &kubeClient{
+    server:    "https://" + net.JoinHostPort(host, port),
+    tokenFile: filepath.Join(kubeServiceAccountDir, "token"),
+    client: &http.Client{
+      Timeout:   30 * time.Second,
+      Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+    },
+  }, nil
+}
+
+// podNamespace is the namespace of the pod the operator runs in.
+func podNamespace() string {
+  data, err := os.ReadFile(filepath.Join(kubeServiceAccountDir, "namespace"))
+  if err != nil {
+    return "default"
+  }
+  return strings.TrimSpace(string(data))
+}
+
+func (k *kubeClient) do(ctx context.Context, method, uri, contentType string, body, resp interface{}) error {
+  var reader io.Reader
+  if body != nil {
+    data, err := json.Marshal(body)
+    if err != nil {
+      return err
+    }
+    reader = bytes.NewReader(data)
+  }
+  req, err := http.NewRequestWithContext(ctx, method, k.server+uri, reader)
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Accept", "application/json")
+  if body != nil {
+    req.Header.Set("Content-Type", contentType)
+  }
+  if k.tokenFile != "" {
+    // Read for every request, as Kubernetes rotates the token.
+    token, err := os.ReadFile(k.tokenFile)
+    if err != nil {
+      return err
+    }
+    req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+  }
+
+  res, err := k.client.Do(req)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+  data, err := io.ReadAll(res.Body)
+  if err != nil {
+    return err
+  }
+  if res.StatusCode/100 != 2 {
+    var errResp struct {
+      Message string `json:"message"`
+    }
+    _ = json.Unmarshal(data, &errResp)
+    if errResp.Message != "" {
+      return fmt.Errorf("kubernetes returned %s: %s", res.Status, errResp.Message)
+    }
+    return fmt.Errorf("kubernetes returned %s", res.Status)
+  }
+  if resp == nil {
+    return nil
+  }
+  return json.Unmarshal(data, resp)
+}
+
+func deviceResourcePath(namespace string) string {
+  path := "/apis/" + deviceResourceGroup + "/" + deviceResourceVersion
+  if namespace != "" {
+    path += "/namespaces/" + url.PathEscape(namespace)
+  }
+  return path + "/" + deviceResourcePlural
+}
+
+// listDevices lists the ShitboxDevice resources of a namespace, or of all
+// namespaces when it is empty.
+func (k *kubeClient) listDevices(ctx context.Context, namespace string) ([]ShitboxDevice, error) {
+  var list struct {
+    Items []ShitboxDevice `json:"items"`
+  }
+  if err := k.do(ctx, http.MethodGet, deviceResourcePath(namespace), "", nil, &list); err != nil {
+    return nil, fmt.Errorf("failed to list %s: %w", deviceResourcePlural, err)
+  }
+  return list.Items, nil
+}
+
+func (k *kubeClient) updateDeviceStatus(ctx context.Context, device ShitboxDevice, status ShitboxDeviceStatus) error {
+  uri := deviceResourcePath(device.Metadata.Namespace) + "/" + url.PathEscape(device.Metadata.Name) + "/status"
+  body := map[string]interface{}{"status": status}
+  if err := k.do(ctx, http.MethodPatch, uri, "application/merge-patch+json", body, nil); err != nil {
+    return fmt.Errorf("failed to update the status of %s: %w", device.key(), err)
+  }
+  return nil
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "strconv"
+  "time"
+)
+
+// kumaMessage summarizes a check for the Uptime Kuma monitor.
+func kumaMessage(result *CheckResult, checkErr error) string {
+  switch {
+  case checkErr != nil && result.Action == actionNone:
+    return fmt.Sprintf("check failed: %v", checkErr)
+  case checkErr != nil:
+    return fmt.Sprintf("%s: %v", result.Action, checkErr)
+  case result.Action == actionNone:
+    if result.Online {
+      return "device online, no action needed"
+    }
+    return "device offline, no action needed"
+  case result.Reason != "":
+    return result.Action + ": " + result.Reason
+  default:
+    return result.Action
+  }
+}
+
+// pushUptimeKuma reports a check to an Uptime Kuma push monitor: down when
+// the check failed or the device could not be reset, up otherwise, with the
+// check duration as the ping.
+func pushUptimeKuma(cfg *Config, appLog *slog.Logger, result *CheckResult, checkErr error) {
+  if cfg.UptimeKumaURL == "" || result.Standby {
+    return
+  }
+
+  u, err := url.Parse(cfg.UptimeKumaURL)
+  if err != nil {
+    appLog.Warn("Failed to push to Uptime Kuma", "error", err)
+    return
+  }
+  status := "up"
+  if checkErr != nil || result.Action == actionResetFailed {
+    status = "down"
+  }
+  query := u.Query()
+  query.Set("status", status)
+  query.Set("msg", kumaMessage(result, checkErr))
+  query.Set("ping", strconv.FormatInt(time.Since(result.Time).Milliseconds(), 10))
+  u.RawQuery = query.Encode()
+
+  resp, err := notifyClient.Get(u.String())
+  if err != nil {
+    // Leave out the URL, it contains the push token.
+    var urlErr *url.Error
+    if errors.As(err, &urlErr) {
+      err = urlErr.Err
+    }
+    appLog.Warn("Failed to push to Uptime Kuma", "error", err)
+    return
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    appLog.Warn("Failed to push to Uptime Kuma", "status", resp.Status)
+  }
+}
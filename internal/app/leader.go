@@ -0,0 +1,151 @@
+package app
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "sync"
+  "time"
+)
+
+type leaderLease struct {
+  Holder  string    `json:"holder"`
+  Expires time.Time `json:"expires"`
+}
+
+// leaderElection lets redundant instances share a lease file, e.g. on a NAS
+// mounted by both. Only the holder of an unexpired lease acts on the device,
+// the others stand by and take over once it stops renewing.
+type leaderElection struct {
+  path  string
+  id    string
+  lease time.Duration
+
+  mu      sync.Mutex
+  renewed bool
+  leader  bool
+  expires time.Time
+}
+
+func newLeaderElection(path, id string, lease time.Duration) *leaderElection {
+  return &leaderElection{path: path, id: id, lease: lease}
+}
+
+func defaultLeaderID() string {
+  host, err := os.Hostname()
+  if err != nil {
+    host = "unknown"
+  }
+  return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (e *leaderElection) read() (*leaderLease, error) {
+  data, err := os.ReadFile(e.path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  lease := &leaderLease{}
+  if err := json.Unmarshal(data, lease); err != nil {
+    return nil, fmt.Errorf("invalid lease file: %w", err)
+  }
+  return lease, nil
+}
+
+// lock takes the flock of a file next to the lease file, so of two
+// instances finding the lease expired only one takes it over. Without file
+// locking on the platform the lease is taken over unlocked.
+func (e *leaderElection) lock() (unlock func(), err error) {
+  file, err := waitLockFile(e.path+".lock", 5*time.Second)
+  if err != nil {
+    return nil, err
+  }
+  return func() {
+    if file != nil {
+      file.Close()
+    }
+  }, nil
+}
+
+// Renew claims or extends the lease and reports whether this instance is the
+// leader. When the lease file cannot be accessed, the current role is kept
+// until our own lease would have expired; after that the instance acts on
+// its own rather than leaving the device unattended.
+func (e *leaderElection) Renew(appLog *slog.Logger) bool {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+
+  now := time.Now()
+  leader, holder, err := e.renew(now)
+  if err != nil {
+    if e.leader && now.Before(e.expires) {
+      appLog.Warn("Failed to renew leader lease, keeping leadership until it expires", "lock", e.path, "error", err)
+      return true
+    }
+    appLog.Warn("Leader lease unavailable, acting without a standby", "lock", e.path, "error", err)
+    leader, holder = true, e.id
+  }
+
+  if leader {
+    e.expires = now.Add(e.lease)
+  }
+  if !e.renewed || leader != e.leader {
+    if leader {
+      appLog.Info("Became leader", "id", e.id, "lock", e.path)
+    } else {
+      appLog.Info("Standing by", "id", e.id, "leader", holder)
+    }
+  }
+  e.renewed = true
+  e.leader = leader
+  return leader
+}
+
+func (e *leaderElection) renew(now time.Time) (bool, string, error) {
+  unlock, err := e.lock()
+  if err != nil {
+    return false, "", err
+  }
+  defer unlock()
+
+  lease, err := e.read()
+  if err != nil {
+    return false, "", err
+  }
+  if lease != nil && lease.Holder != e.id && now.Before(lease.Expires) {
+    return false, lease.Holder, nil
+  }
+  if err := saveStateFile(e.path, leaderLease{Holder: e.id, Expires: now.Add(e.lease)}); err != nil {
+    return false, "", err
+  }
+  return true, e.id, nil
+}
+
+// Release gives up the lease on shutdown, so the standby takes over with its
+// next check instead of waiting for the lease to expire.
+func (e *leaderElection) Release(appLog *slog.Logger) {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  if !e.leader {
+    return
+  }
+  e.leader = false
+
+  unlock, err := e.lock()
+  if err == nil {
+    defer unlock()
+    var lease *leaderLease
+    if lease, err = e.read(); err == nil && lease != nil && lease.Holder == e.id {
+      err = os.Remove(e.path)
+    }
+  }
+  if err != nil {
+    appLog.Warn("Failed to release leader lease, the standby takes over once it expires", "lock", e.path, "error", err)
+    return
+  }
+  appLog.Info("Released leader lease", "id", e.id, "lock", e.path)
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+  "fmt"
+  "log/slog"
+  "path/filepath"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestLeaderElectionTakeover(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "leader.json")
+  appLog := slog.New(slog.DiscardHandler)
+  if err := saveStateFile(path, leaderLease{Holder: "crashed", Expires: time.Now().Add(-time.Minute)}); err != nil {
+    t.Fatal(err)
+  }
+
+  // All standbys find the lease expired at once, only one may take over.
+  elections := make([]*leaderElection, 8)
+  leaders := make([]bool, len(elections))
+  var wg sync.WaitGroup
+  for i := range elections {
+    elections[i] = newLeaderElection(path, fmt.Sprintf("standby-%d", i), time.Minute)
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      leaders[i] = elections[i].Renew(appLog)
+    }()
+  }
+  wg.Wait()
+
+  leader := -1
+  for i, isLeader := range leaders {
+    if !isLeader {
+      continue
+    }
+    if leader >= 0 {
+      t.Fatalf("standby-%d and standby-%d both became leader", leader, i)
+    }
+    leader = i
+  }
+  if leader < 0 {
+    t.Fatal("no standby took over the expired lease")
+  }
+  for i, e := range elections {
+    if got := e.Renew(appLog); got != (i == leader) {
+      t.Errorf("standby-%d Renew() = %v after the takeover, want %v", i, got, i == leader)
+    }
+  }
+}
+
+func TestLeaderElectionRelease(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "leader.json")
+  appLog := slog.New(slog.DiscardHandler)
+  first := newLeaderElection(path, "first", time.Hour)
+  second := newLeaderElection(path, "second", time.Hour)
+
+  if !first.Renew(appLog) {
+    t.Fatal("first instance did not become leader")
+  }
+  if second.Renew(appLog) {
+    t.Fatal("second instance became leader while the lease is held")
+  }
+
+  // The standby releasing does not touch the leader's lease.
+  second.Release(appLog)
+  if !first.Renew(appLog) {
+    t.Fatal("first instance lost the lease when the standby released")
+  }
+
+  first.Release(appLog)
+  if !second.Renew(appLog) {
+    t.Error("second instance did not take over the released lease")
+  }
+  if first.Renew(appLog) {
+    t.Error("first instance took the lease back from the new leader")
+  }
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// INSTANCE_LOCK=off disables the lock, e.g. when an external scheduler
+// already prevents overlapping runs.
+const instanceLockOff = "off"
+
+var errInstanceLocked = errors.New("another instance is running")
+
+// instanceLocks are the held locks by path, kept open until the process
+// exits. A group reset holds one per device.
+var (
+  instanceLocksMu sync.Mutex
+  instanceLocks   = map[string]*os.File{}
+)
+
+func holdsInstanceLock(path string) bool {
+  instanceLocksMu.Lock()
+  defer instanceLocksMu.Unlock()
+  return instanceLocks[path] != nil
+}
+
+// instanceLockPath defaults to one lock per device in STATE_DIR, so runs for
+// different devices never wait for each other.
+func instanceLockPath(cfg *Config) (string, error) {
+  if cfg.InstanceLock != "" {
+    return cfg.InstanceLock, nil
+  }
+  return statePath(cfg, "lock-"+strings.NewReplacer("/", "_", "\\", "_").Replace(cfg.DeviceID))
+}
+
+// acquireInstanceLock makes sure only one check or watcher acts on the
+// device at a time, waiting up to INSTANCE_LOCK_WAIT for a running one to
+// finish. The lock is held until the process exits.
+func acquireInstanceLock(ctx context.Context, cfg *Config, appLog *slog.Logger) error {
+  if cfg.InstanceLock == instanceLockOff {
+    return nil
+  }
+  path, err := instanceLockPath(cfg)
+  if err != nil {
+    return err
+  }
+  if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+    return err
+  }
+
+  deadline := time.Now().Add(cfg.InstanceLockWait)
+  for {
+    if holdsInstanceLock(path) {
+      return nil
+    }
+    file, err := tryLockFile(path)
+    if err == nil {
+      if file == nil {
+        appLog.Debug("Instance locking is not supported on this platform")
+        return nil
+      }
+      instanceLocksMu.Lock()
+      instanceLocks[path] = file
+      instanceLocksMu.Unlock()
+      _ = file.Truncate(0)
+      _, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+      return nil
+    }
+    if !errors.Is(err, errInstanceLocked) {
+      return fmt.Errorf("failed to lock %s: %w", path, err)
+    }
+    if !time.Now().Before(deadline) {
+      if holder, readErr := os.ReadFile(path); readErr == nil && len(holder) > 0 {
+        return fmt.Errorf("%w (pid %s, lock %s)", errInstanceLocked, strings.TrimSpace(string(holder)), path)
+      }
+      return fmt.Errorf("%w (lock %s)", errInstanceLocked, path)
+    }
+    if err := sleepContext(ctx, 500*time.Millisecond); err != nil {
+      return err
+    }
+  }
+}
+
+// waitLockFile takes the flock of path, waiting up to wait for its holder,
+// e.g. another process appending to the same file. The file is nil when the
+// platform has no file locking.
+func waitLockFile(path string, wait time.Duration) (*os.File, error) {
+  deadline := time.Now().Add(wait)
+  for {
+    file, err := tryLockFile(path)
+    if errors.Is(err, errInstanceLocked) && time.Now().Before(deadline) {
+      time.Sleep(20 * time.Millisecond)
+      continue
+    }
+    return file, err
+  }
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+
+package app
+
+import "os"
+
+const instanceLockSupported = false
+
+func tryLockFile(path string) (*os.File, error) {
+  return nil, nil
+}
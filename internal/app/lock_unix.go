@@ -0,0 +1,28 @@
+//go:build !windows && !plan9
+
+package app
+
+import (
+  "errors"
+  "os"
+  "syscall"
+)
+
+const instanceLockSupported = true
+
+// tryLockFile takes an advisory flock on path. The kernel releases it when
+// the process exits, so a crashed run never leaves a stale lock behind.
+func tryLockFile(path string) (*os.File, error) {
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+  if err != nil {
+    return nil, err
+  }
+  if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+    file.Close()
+    if errors.Is(err, syscall.EWOULDBLOCK) {
+      return nil, errInstanceLocked
+    }
+    return nil, err
+  }
+  return file, nil
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "strings"
+)
+
+const (
+  logFormatText = "text"
+  logFormatJSON = "json"
+)
+
+func parseLogLevel(s string) (slog.Level, error) {
+  switch strings.ToLower(s) {
+  case "debug":
+    return slog.LevelDebug, nil
+  case "info":
+    return slog.LevelInfo, nil
+  case "warn", "warning":
+    return slog.LevelWarn, nil
+  case "error":
+    return slog.LevelError, nil
+  default:
+    return 0, fmt.Errorf("%s (valid: debug, info, warn, error)", s)
+  }
+}
+
+func newLogger(w io.Writer, level slog.Level, format string) *slog.Logger {
+  opts := &slog.HandlerOptions{Level: level}
+  if format == logFormatJSON {
+    return slog.New(slog.NewJSONHandler(w, opts))
+  }
+  return slog.New(slog.NewTextHandler(w, opts))
+}
+
+func newAppLogger(cfg *Config, w io.Writer) (*slog.Logger, error) {
+  switch cfg.LogOutput {
+  case logOutputSyslog:
+    sink, err := newSyslogSink(cfg.SyslogAddress)
+    if err != nil {
+      return nil, err
+    }
+    return newSinkLogger(sink, cfg.LogLevel), nil
+  case logOutputJournald:
+    sink, err := newJournaldSink()
+    if err != nil {
+      return nil, err
+    }
+    return newSinkLogger(sink, cfg.LogLevel), nil
+  default:
+    return newLogger(w, cfg.LogLevel, cfg.LogFormat), nil
+  }
+}
+
+// fatal logs err and exits with code, exitConfigError or exitAPIError, as
+// exitReset would tell a script that the device was fixed.
+func fatal(logger *slog.Logger, code int, msg string, err error) {
+  logger.Error(msg, "error", err)
+  flushTraces()
+  os.Exit(code)
+}
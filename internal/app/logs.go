@@ -0,0 +1,212 @@
+package app
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const defaultLogDPIDs = "1,2,3,4,5,6,7,8,9"
+
+// logDPIDsAuto derives the DP IDs to query from the device specification.
+const logDPIDsAuto = "auto"
+
+// Tuya returns at most 100 log entries per page.
+const maxLogPageSize = 100
+
+type LogQuery struct {
+  Since time.Duration
+  DPIDs string
+  Limit int
+}
+
+type DeviceLogsResponse struct {
+  Code    int    `json:"code"`
+  Msg     string `json:"msg"`
+  Success bool   `json:"success"`
+  Result  struct {
+    Logs       []interface{} `json:"logs"`
+    HasNext    bool          `json:"has_next"`
+    LastRowKey string        `json:"last_row_key"`
+  } `json:"result"`
+  T int64 `json:"t"`
+}
+
+func validateLogDPIDs(s string) error {
+  if s == logDPIDsAuto {
+    return nil
+  }
+  for _, id := range strings.Split(s, ",") {
+    if _, err := strconv.Atoi(strings.TrimSpace(id)); err != nil {
+      return fmt.Errorf("%s (expected auto or comma-separated DP IDs)", s)
+    }
+  }
+  return nil
+}
+
+// logDPIDs resolves the configured DP IDs. With auto it uses every DP of the
+// device specification, or of the device's shadow properties when the
+// specification has no DP IDs, falling back to the default list.
+func logDPIDs(ctx context.Context, cfg *Config) string {
+  if cfg.LogDPIDs != logDPIDsAuto {
+    return cfg.LogDPIDs
+  }
+
+  var ids []int
+  seen := map[int]bool{}
+  add := func(id int) {
+    if id > 0 && !seen[id] {
+      seen[id] = true
+      ids = append(ids, id)
+    }
+  }
+
+  spec, err := getDeviceSpecification(ctx, cfg.DeviceID)
+  if err != nil {
+    slog.Debug("Failed to get device specification for log DP IDs", "error", err)
+  } else {
+    for _, fn := range append(spec.Result.Status, spec.Result.Functions...) {
+      add(fn.DPID)
+    }
+  }
+
+  if len(ids) == 0 {
+    properties, err := getDeviceProperties(ctx, cfg.DeviceID)
+    if err != nil {
+      slog.Debug("Failed to get device properties for log DP IDs", "error", err)
+    } else {
+      for _, property := range properties.Result.Properties {
+        add(property.DPID)
+      }
+    }
+  }
+
+  if len(ids) == 0 {
+    slog.Debug("No DP IDs found for the device, using defaults", "dp_ids", defaultLogDPIDs)
+    return defaultLogDPIDs
+  }
+  sort.Ints(ids)
+
+  parts := make([]string, 0, len(ids))
+  for _, id := range ids {
+    parts = append(parts, strconv.Itoa(id))
+  }
+  return strings.Join(parts, ",")
+}
+
+func queryDeviceLogs(ctx context.Context, deviceID string, q LogQuery) ([]interface{}, error) {
+  now := time.Now().UnixMilli()
+  startTime := now - q.Since.Milliseconds()
+
+  var logs []interface{}
+  lastRowKey := ""
+
+  for len(logs) < q.Limit {
+    size := q.Limit - len(logs)
+    if size > maxLogPageSize {
+      size = maxLogPageSize
+    }
+
+    query := url.Values{}
+    query.Set("query_type", "1")
+    query.Set("type", q.DPIDs)
+    query.Set("start_time", strconv.FormatInt(startTime, 10))
+    query.Set("end_time", strconv.FormatInt(now, 10))
+    query.Set("size", strconv.Itoa(size))
+    if lastRowKey != "" {
+      query.Set("last_row_key", lastRowKey)
+    }
+
+    resp := &DeviceLogsResponse{}
+    err := tuyaGet(ctx, fmt.Sprintf("/v2.0/cloud/thing/%s/logs?%s", deviceID, query.Encode()), resp)
+
+    if err != nil {
+      return nil, fmt.Errorf("failed to get device logs: %w", err)
+    }
+
+    if !resp.Success {
+      return nil, tuyaError(resp.Code, resp.Msg)
+    }
+
+    logs = append(logs, resp.Result.Logs...)
+
+    if !resp.Result.HasNext || resp.Result.LastRowKey == "" || resp.Result.LastRowKey == lastRowKey {
+      break
+    }
+    lastRowKey = resp.Result.LastRowKey
+  }
+
+  if len(logs) > q.Limit {
+    logs = logs[:q.Limit]
+  }
+  return logs, nil
+}
+
+func runLogs(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+  since := fs.Duration("since", time.Hour, "how far back to query, e.g. 6h")
+  dpIDs := fs.String("dp", cfg.LogDPIDs, "comma-separated DP IDs to query, or auto")
+  limit := fs.Int("limit", 100, "maximum number of log entries")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+  if *since <= 0 {
+    return fmt.Errorf("--since must be positive")
+  }
+  if *limit <= 0 {
+    return fmt.Errorf("--limit must be positive")
+  }
+
+  if err := validateLogDPIDs(*dpIDs); err != nil {
+    return fmt.Errorf("invalid --dp: %w", err)
+  }
+  cfg.LogDPIDs = *dpIDs
+
+  logs, err := queryDeviceLogs(ctx, cfg.DeviceID, LogQuery{Since: *since, DPIDs: logDPIDs(ctx, cfg), Limit: *limit})
+  if err != nil {
+    return err
+  }
+
+  for _, logEntry := range logs {
+    if logMap, ok := logEntry.(map[string]interface{}); ok {
+      if t, ok := logMap["event_time"].(float64); ok {
+        logMap["event_time_readable"] = cfg.TimeFormat.Absolute(time.UnixMilli(int64(t)))
+      }
+    }
+  }
+
+  if cfg.Output == outputJSON {
+    if logs == nil {
+      logs = []interface{}{}
+    }
+    return printJSON(logs)
+  }
+
+  if len(logs) == 0 {
+    fmt.Printf("No logs found in the last %s\n", *since)
+    return nil
+  }
+
+  table := newTable("TIME", "CODE", "VALUE")
+  for _, logEntry := range logs {
+    logMap, ok := logEntry.(map[string]interface{})
+    if !ok {
+      continue
+    }
+    eventTime, _ := logMap["event_time"].(float64)
+    label := cfg.Preset.dpLabel(fmt.Sprint(logMap["code"]))
+    table.AddRow(cfg.TimeFormat.Format(time.UnixMilli(int64(eventTime))), label, fmt.Sprint(logMap["value"]))
+  }
+  return table.Render(os.Stdout, useColor())
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "strconv"
+  "strings"
+)
+
+const (
+  logOutputStdout   = "stdout"
+  logOutputSyslog   = "syslog"
+  logOutputJournald = "journald"
+)
+
+const syslogTag = "shitbox-fixer"
+
+var journaldSocket = "/run/systemd/journal/socket"
+
+// logSink receives fully resolved log records. Syslog and journald keep the
+// level as a priority instead of a text prefix.
+type logSink interface {
+  Send(level slog.Level, msg string, attrs []slog.Attr) error
+}
+
+type sinkHandler struct {
+  sink   logSink
+  level  slog.Leveler
+  attrs  []slog.Attr
+  prefix string
+}
+
+func newSinkLogger(sink logSink, level slog.Level) *slog.Logger {
+  return slog.New(&sinkHandler{sink: sink, level: level})
+}
+
+func (h *sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+  return level >= h.level.Level()
+}
+
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+  attrs := append([]slog.Attr{}, h.attrs...)
+  r.Attrs(func(a slog.Attr) bool {
+    attrs = flattenAttr(attrs, h.prefix, a)
+    return true
+  })
+  return h.sink.Send(r.Level, r.Message, attrs)
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+  clone := *h
+  clone.attrs = append([]slog.Attr{}, h.attrs...)
+  for _, a := range attrs {
+    clone.attrs = flattenAttr(clone.attrs, h.prefix, a)
+  }
+  return &clone
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+  clone := *h
+  clone.prefix = h.prefix + name + "."
+  return &clone
+}
+
+func flattenAttr(out []slog.Attr, prefix string, a slog.Attr) []slog.Attr {
+  a.Value = a.Value.Resolve()
+  if a.Value.Kind() == slog.KindGroup {
+    for _, member := range a.Value.Group() {
+      out = flattenAttr(out, prefix+a.Key+".", member)
+    }
+    return out
+  }
+  if a.Key == "" {
+    return out
+  }
+  a.Key = prefix + a.Key
+  return append(out, a)
+}
+
+func attrString(v slog.Value) string {
+  if v.Kind() != slog.KindAny {
+    return v.String()
+  }
+  if err, ok := v.Any().(error); ok {
+    return err.Error()
+  }
+  if data, err := json.Marshal(v.Any()); err == nil {
+    return string(data)
+  }
+  return fmt.Sprint(v.Any())
+}
+
+// formatLogLine renders a record as `msg key=value ...` for syslog.
+func formatLogLine(msg string, attrs []slog.Attr) string {
+  var b strings.Builder
+  b.WriteString(msg)
+  for _, a := range attrs {
+    value := attrString(a.Value)
+    if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+      value = strconv.Quote(value)
+    }
+    b.WriteString(" " + a.Key + "=" + value)
+  }
+  return b.String()
+}
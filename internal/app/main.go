@@ -0,0 +1,1679 @@
+// Package app is the shitbox-fixer command: its configuration, the CLI
+// commands, the watcher and the daemon with its API, on top of the packages
+// under pkg/. cmd/shitbox-fixer only calls Main.
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "text/template"
+  "time"
+
+  "shitbox-fixer/pkg/actions"
+  "shitbox-fixer/pkg/detect"
+  "shitbox-fixer/pkg/notify"
+  "shitbox-fixer/pkg/rules"
+  "shitbox-fixer/pkg/tuyaclient"
+)
+
+// Version, GitCommit and BuildDate are set by cmd/shitbox-fixer from its
+// build flags.
+var (
+  Version   = "dev"
+  GitCommit = "unknown"
+  BuildDate = "unknown"
+)
+
+// Exit codes of a one-time check, so schedulers and monitoring systems can
+// tell a fixed device from one that could not be fixed.
+const (
+  exitOK          = 0
+  exitReset       = 1
+  exitResetFailed = 2
+  exitConfigError = 3
+  exitAPIError    = 4
+)
+
+// deviceFetchTimeout bounds fetching the device status and logs of a check,
+// so a hanging request does not run into the next scheduled run.
+const deviceFetchTimeout = 30 * time.Second
+
+type Config struct {
+  AccessID         string
+  AccessKey        string
+  Region           string
+  APIHost          string
+  MsgHost          string
+  DeviceID         string
+  ShutdownDelay    time.Duration
+  LogLevel         slog.Level
+  LogFormat        string
+  LogOutput        string
+  SyslogAddress    string
+  LogDPIDs         string
+  DataStorage      string
+  HistoryRetention time.Duration
+  RollupRetention  time.Duration
+
+  CaptureDuration         time.Duration
+  CaptureRate             int
+  DetectRule              *rules.Rule
+  DetectWeights           map[string]float64
+  DetectOfflineRamp       time.Duration
+  DetectOfflineGrace      time.Duration
+  DetectNoClean           time.Duration
+  DetectStuckDuration     time.Duration
+  ResetThreshold          float64
+  NotifyThreshold         float64
+  VerifyRule              *rules.Rule
+  DrawerFullRule          *rules.Rule
+  OccupiedRule            *rules.Rule
+  OccupiedWait            time.Duration
+  Consumables             []Consumable
+  DeviceGroups            map[string][]string
+  Workers                 int
+  TuyaRateLimit           float64
+  VerifyDelay             time.Duration
+  TimeFormat              TimeFormat
+  Preset                  Preset
+  PollInterval            time.Duration
+  WatchdogFactor          int
+  StatusCacheTTL          time.Duration
+  HTTPConnectTimeout      time.Duration
+  HTTPTimeout             time.Duration
+  RunTimeout              time.Duration
+  TuyaMaxAttempts         int
+  TuyaProxyURL            *url.URL
+  ColdStartCycles         int
+  CircuitBreakerThreshold int
+  CircuitBreakerCoolOff   time.Duration
+  StateDir                string
+  Output                  string
+
+  ActionQuietHours  QuietHours
+  NotifyChannels    []NotifyChannel
+  NotifyQuietBypass []string
+  NotifyThrottle    NotifyThrottle
+  NotifyOnChange    bool
+  Language          string
+
+  EscalateFailedResets int
+  EscalateOffline      time.Duration
+
+  AlertmanagerURL        string
+  AlertmanagerWebhookURL string
+
+  InfluxURL    string
+  InfluxToken  string
+  InfluxOrg    string
+  InfluxBucket string
+
+  MetricsTextfile string
+  UptimeKumaURL   string
+  HeartbeatURL    string
+  HeartbeatMethod string
+  StatsMQTTURL    string
+
+  VerdictOutput *os.File
+  ResetExitCode int
+
+  ServeAddress     string
+  HealthAddress    string
+  ServeTLSCert     string
+  ServeTLSKey      string
+  ServeTLSClientCA string
+  APIReadToken     string
+  APIControlToken  string
+  InstanceLock     string
+  InstanceLockWait time.Duration
+  ControlSocket    string
+  AuditLog         string
+  TraceEndpoint    string
+  TraceHeaders     map[string]string
+  TraceServiceName string
+
+  Leader *leaderElection
+  Vault  *vaultClient
+}
+
+var regionConfig = map[string]struct {
+  ApiHost string
+  MsgHost string
+}{
+  "eu": {
+    ApiHost: "https://openapi.tuyaeu.com",
+    MsgHost: "pulsar+ssl://mqe.tuyaeu.com:7285/",
+  },
+  "us": {
+    ApiHost: "https://openapi.tuyaus.com",
+    MsgHost: "pulsar+ssl://mqe.tuyaus.com:7285/",
+  },
+  "cn": {
+    ApiHost: "https://openapi.tuyacn.com",
+    MsgHost: "pulsar+ssl://mqe.tuyacn.com:7285/",
+  },
+  "in": {
+    ApiHost: "https://openapi.tuyain.com",
+    MsgHost: "pulsar+ssl://mqe.tuyain.com:7285/",
+  },
+}
+
+type DeviceInfoResponse struct {
+  Code    int                    `json:"code"`
+  Msg     string                 `json:"msg"`
+  Success bool                   `json:"success"`
+  Result  map[string]interface{} `json:"result"`
+  T       int64                  `json:"t"`
+}
+
+type DeviceSpecFunction struct {
+  Code   string `json:"code"`
+  DPID   int    `json:"dp_id"`
+  Type   string `json:"type"`
+  Values string `json:"values"`
+}
+
+type DeviceSpecResponse struct {
+  Code    int    `json:"code"`
+  Msg     string `json:"msg"`
+  Success bool   `json:"success"`
+  Result  struct {
+    Category  string               `json:"category"`
+    Functions []DeviceSpecFunction `json:"functions"`
+    Status    []DeviceSpecFunction `json:"status"`
+  } `json:"result"`
+  T int64 `json:"t"`
+}
+
+func loadConfig() (*Config, error) {
+  return readConfig(nil)
+}
+
+// readConfig builds the config from the environment. On reload, current is
+// the running config: its vault session and verdict output are kept rather
+// than logging in or opening the file descriptor again.
+func readConfig(current *Config) (*Config, error) {
+  if err := loadSecretFiles(); err != nil {
+    return nil, err
+  }
+
+  cfg := &Config{
+    AccessID:                os.Getenv("TUYA_ACCESS_ID"),
+    AccessKey:               os.Getenv("TUYA_ACCESS_KEY"),
+    Region:                  os.Getenv("TUYA_REGION"),
+    DeviceID:                os.Getenv("TUYA_DEVICE_ID"),
+    ShutdownDelay:           0,
+    PollInterval:            time.Minute,
+    WatchdogFactor:          3,
+    StatusCacheTTL:          5 * time.Second,
+    HTTPConnectTimeout:      defaultHTTPConnectTimeout,
+    HTTPTimeout:             defaultHTTPTimeout,
+    RunTimeout:              5 * time.Minute,
+    TuyaMaxAttempts:         tuyaclient.DefaultMaxAttempts,
+    CircuitBreakerThreshold: 5,
+    CircuitBreakerCoolOff:   10 * time.Minute,
+    VerifyDelay:             10 * time.Second,
+    StateDir:                os.Getenv("STATE_DIR"),
+    Output:                  os.Getenv("OUTPUT"),
+    LogLevel:                slog.LevelInfo,
+    LogFormat:               os.Getenv("LOG_FORMAT"),
+    LogOutput:               os.Getenv("LOG_OUTPUT"),
+    SyslogAddress:           os.Getenv("SYSLOG_ADDRESS"),
+    LogDPIDs:                os.Getenv("LOG_DP_IDS"),
+    DataStorage:             os.Getenv("DATA_STORAGE"),
+
+    AlertmanagerURL:        strings.TrimSuffix(os.Getenv("ALERTMANAGER_URL"), "/"),
+    AlertmanagerWebhookURL: os.Getenv("ALERTMANAGER_WEBHOOK_URL"),
+
+    InfluxURL:    os.Getenv("INFLUXDB_URL"),
+    InfluxToken:  os.Getenv("INFLUXDB_TOKEN"),
+    InfluxOrg:    os.Getenv("INFLUXDB_ORG"),
+    InfluxBucket: os.Getenv("INFLUXDB_BUCKET"),
+
+    MetricsTextfile: os.Getenv("METRICS_TEXTFILE"),
+    UptimeKumaURL:   os.Getenv("UPTIME_KUMA_PUSH_URL"),
+    HeartbeatURL:    os.Getenv("HEARTBEAT_URL"),
+    HeartbeatMethod: strings.ToUpper(os.Getenv("HEARTBEAT_METHOD")),
+    StatsMQTTURL:    os.Getenv("STATS_MQTT_URL"),
+  }
+
+  if cfg.InfluxURL != "" && (cfg.InfluxOrg == "" || cfg.InfluxBucket == "") {
+    return nil, fmt.Errorf("INFLUXDB_URL requires INFLUXDB_ORG and INFLUXDB_BUCKET")
+  }
+  if cfg.UptimeKumaURL != "" {
+    if u, err := url.Parse(cfg.UptimeKumaURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+      return nil, fmt.Errorf("invalid UPTIME_KUMA_PUSH_URL (expected the push URL of the monitor, e.g. https://kuma.lan/api/push/<token>)")
+    }
+  }
+  if cfg.HeartbeatMethod == "" {
+    cfg.HeartbeatMethod = http.MethodGet
+  }
+  if cfg.HeartbeatURL != "" {
+    if err := validateHeartbeat(cfg.HeartbeatURL, cfg.HeartbeatMethod); err != nil {
+      return nil, err
+    }
+  }
+  if cfg.StatsMQTTURL != "" {
+    if u, err := url.Parse(cfg.StatsMQTTURL); err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Host == "" || mqttTopic(u) == "" {
+      return nil, fmt.Errorf("invalid STATS_MQTT_URL (expected an mqtt(s):// URL with a topic, e.g. mqtt://broker:1883/home/litterbox/stats)")
+    }
+  }
+  // node_exporter only reads files ending in .prom.
+  if cfg.MetricsTextfile != "" && filepath.Ext(cfg.MetricsTextfile) != ".prom" {
+    return nil, fmt.Errorf("invalid METRICS_TEXTFILE: %s (must end with .prom)", cfg.MetricsTextfile)
+  }
+
+  if cfg.StateDir == "" {
+    cfg.StateDir = defaultStateDir()
+    // Keep the history and incidents of each site apart.
+    if profile := os.Getenv("PROFILE"); profile != "" {
+      cfg.StateDir = filepath.Join(cfg.StateDir, "profiles", profile)
+    }
+  }
+
+  if cfg.DataStorage == "" {
+    cfg.DataStorage = dataStorageMinimal
+  }
+  if cfg.DataStorage != dataStorageFull && cfg.DataStorage != dataStorageMinimal && cfg.DataStorage != dataStorageNone {
+    return nil, fmt.Errorf("invalid DATA_STORAGE: %s (valid: full, minimal, none)", cfg.DataStorage)
+  }
+  historyRetention, err := parseRetention("HISTORY_RETENTION", os.Getenv("HISTORY_RETENTION"), 0, minHistoryRetention)
+  if err != nil {
+    return nil, err
+  }
+  cfg.HistoryRetention = historyRetention
+  rollupRetention, err := parseRetention("ROLLUP_RETENTION", os.Getenv("ROLLUP_RETENTION"), defaultRollupRetention, 24*time.Hour)
+  if err != nil {
+    return nil, err
+  }
+  cfg.RollupRetention = rollupRetention
+
+  if current != nil {
+    cfg.VerdictOutput = current.VerdictOutput
+  } else {
+    verdictOutput, err := openVerdictOutput(os.Getenv("VERDICT_OUTPUT"))
+    if err != nil {
+      return nil, fmt.Errorf("invalid VERDICT_OUTPUT: %w", err)
+    }
+    cfg.VerdictOutput = verdictOutput
+  }
+
+  if cfg.Output == "" {
+    cfg.Output = outputText
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return nil, fmt.Errorf("invalid OUTPUT: %w", err)
+  }
+
+  // DEBUG=true is kept as a shorthand for LOG_LEVEL=debug.
+  if os.Getenv("DEBUG") == "true" {
+    cfg.LogLevel = slog.LevelDebug
+  }
+  if logLevelStr := os.Getenv("LOG_LEVEL"); logLevelStr != "" {
+    level, err := parseLogLevel(logLevelStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+    }
+    cfg.LogLevel = level
+  }
+
+  if cfg.LogFormat == "" {
+    cfg.LogFormat = logFormatText
+  }
+  if cfg.LogFormat != logFormatText && cfg.LogFormat != logFormatJSON {
+    return nil, fmt.Errorf("invalid LOG_FORMAT: %s (valid: text, json)", cfg.LogFormat)
+  }
+
+  // systemd sets JOURNAL_STREAM when stdout is connected to the journal.
+  if cfg.LogOutput == "" && os.Getenv("JOURNAL_STREAM") != "" && journaldAvailable() {
+    cfg.LogOutput = logOutputJournald
+  }
+  if cfg.LogOutput == "" {
+    cfg.LogOutput = logOutputStdout
+  }
+  if cfg.LogOutput != logOutputStdout && cfg.LogOutput != logOutputSyslog && cfg.LogOutput != logOutputJournald {
+    return nil, fmt.Errorf("invalid LOG_OUTPUT: %s (valid: stdout, syslog, journald)", cfg.LogOutput)
+  }
+
+  cfg.TimeFormat = TimeFormat{Location: time.Local, Locale: os.Getenv("TIME_LOCALE"), Style: os.Getenv("TIME_STYLE")}
+  if timezone := os.Getenv("TIMEZONE"); timezone != "" {
+    location, err := time.LoadLocation(timezone)
+    if err != nil {
+      return nil, fmt.Errorf("invalid TIMEZONE: %w", err)
+    }
+    cfg.TimeFormat.Location = location
+  }
+  if cfg.TimeFormat.Locale == "" {
+    cfg.TimeFormat.Locale = "iso"
+  }
+  if _, ok := timeLayouts[cfg.TimeFormat.Locale]; !ok {
+    return nil, fmt.Errorf("invalid TIME_LOCALE: %s (valid: %s)", cfg.TimeFormat.Locale, strings.Join(timeLocales(), ", "))
+  }
+  if cfg.TimeFormat.Style == "" {
+    cfg.TimeFormat.Style = timeStyleBoth
+  }
+  if cfg.TimeFormat.Style != timeStyleAbsolute && cfg.TimeFormat.Style != timeStyleRelative && cfg.TimeFormat.Style != timeStyleBoth {
+    return nil, fmt.Errorf("invalid TIME_STYLE: %s (valid: absolute, relative, both)", cfg.TimeFormat.Style)
+  }
+
+  cfg.Language = os.Getenv("OUTPUT_LANGUAGE")
+  if cfg.Language == "" {
+    cfg.Language = languageEnglish
+  }
+  if !isLanguage(cfg.Language) {
+    return nil, fmt.Errorf("invalid OUTPUT_LANGUAGE: %s (valid: %s)", cfg.Language, strings.Join(languages(), ", "))
+  }
+
+  if current != nil && current.Vault != nil {
+    cfg.AccessID, cfg.AccessKey, cfg.Vault = current.AccessID, current.AccessKey, current.Vault
+  } else if vaultAddr := os.Getenv("VAULT_ADDR"); vaultAddr != "" {
+    if cfg.AccessID != "" || cfg.AccessKey != "" {
+      return nil, fmt.Errorf("TUYA_ACCESS_ID and TUYA_ACCESS_KEY must not be set when reading them from vault")
+    }
+    auth := os.Getenv("VAULT_AUTH")
+    if auth == "" {
+      auth = vaultAuthToken
+    }
+    vault, err := newVaultClient(vaultAddr, os.Getenv("VAULT_PATH"), os.Getenv("VAULT_NAMESPACE"), auth,
+      os.Getenv("VAULT_TOKEN"), os.Getenv("VAULT_ROLE_ID"), os.Getenv("VAULT_SECRET_ID"))
+    if err != nil {
+      return nil, err
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    cfg.AccessID, cfg.AccessKey, err = vault.Credentials(ctx)
+    cancel()
+    if err != nil {
+      return nil, err
+    }
+    cfg.Vault = vault
+  }
+
+  if cfg.AccessID == "" || cfg.AccessKey == "" {
+    return nil, fmt.Errorf("missing required environment variables")
+  }
+
+  if cfg.Region == "" && os.Getenv("TUYA_API_HOST") == "" {
+    cfg.Region = storedRegion(cfg.StateDir, cfg.AccessID)
+  }
+  if cfg.Region == "" {
+    cfg.Region = "eu"
+  }
+
+  // TUYA_API_HOST and TUYA_MSG_HOST reach data centers without a region of
+  // their own here; TUYA_REGION then only names them.
+  region, known := regionConfig[cfg.Region]
+  cfg.APIHost, cfg.MsgHost = region.ApiHost, region.MsgHost
+  if host := os.Getenv("TUYA_API_HOST"); host != "" {
+    apiHost, err := parseAPIHost(host)
+    if err != nil {
+      return nil, err
+    }
+    cfg.APIHost = apiHost
+  } else if !known {
+    return nil, fmt.Errorf("invalid region: %s (valid: eu, us, cn, in, or set TUYA_API_HOST)", cfg.Region)
+  }
+  if host := os.Getenv("TUYA_MSG_HOST"); host != "" {
+    if u, err := url.Parse(host); err != nil || (u.Scheme != "pulsar" && u.Scheme != "pulsar+ssl") || u.Host == "" {
+      return nil, fmt.Errorf("invalid TUYA_MSG_HOST (expected a pulsar:// or pulsar+ssl:// URL, e.g. pulsar+ssl://mqe.tuyaeu.com:7285/)")
+    }
+    cfg.MsgHost = host
+  }
+
+  if cfg.LogDPIDs == "" {
+    cfg.LogDPIDs = logDPIDsAuto
+  }
+  if err := validateLogDPIDs(cfg.LogDPIDs); err != nil {
+    return nil, fmt.Errorf("invalid LOG_DP_IDS: %w", err)
+  }
+
+  presetName := os.Getenv("DEVICE_PRESET")
+  if presetName == "" {
+    presetName = "generic"
+  }
+
+  preset, ok := presets[presetName]
+  if !ok {
+    return nil, fmt.Errorf("invalid DEVICE_PRESET: %s (valid: %s)", presetName, strings.Join(presetNames(), ", "))
+  }
+  cfg.Preset = preset
+
+  for _, step := range preset.ResetSequence {
+    if step.Verify == "" {
+      continue
+    }
+    if _, err := compileRule(step.Verify); err != nil {
+      return nil, fmt.Errorf("invalid verify rule of preset %s step %s: %w", preset.Name, step.Code, err)
+    }
+  }
+
+  if detectRuleStr := os.Getenv("DETECT_RULE"); detectRuleStr != "" {
+    rule, err := compileDetectRule(detectRuleStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid DETECT_RULE: %w", err)
+    }
+    cfg.DetectRule = rule
+  }
+
+  cfg.DetectWeights = detect.DefaultWeights(detect.Settings{ResetOnOffline: preset.ResetOnOffline})
+  if err := detect.ParseWeights(os.Getenv("DETECT_WEIGHTS"), cfg.DetectWeights); err != nil {
+    return nil, fmt.Errorf("invalid DETECT_WEIGHTS: %w", err)
+  }
+  if rampStr := os.Getenv("DETECT_OFFLINE_RAMP"); rampStr != "" {
+    ramp, err := time.ParseDuration(rampStr)
+    if err != nil || ramp < 0 {
+      return nil, fmt.Errorf("invalid DETECT_OFFLINE_RAMP: %s", rampStr)
+    }
+    cfg.DetectOfflineRamp = ramp
+  }
+  if graceStr := os.Getenv("DETECT_OFFLINE_GRACE"); graceStr != "" {
+    grace, err := time.ParseDuration(graceStr)
+    if err != nil || grace < 0 {
+      return nil, fmt.Errorf("invalid DETECT_OFFLINE_GRACE: %s", graceStr)
+    }
+    cfg.DetectOfflineGrace = grace
+  }
+  if noCleanStr := os.Getenv("DETECT_NO_CLEAN"); noCleanStr != "" {
+    noClean, err := time.ParseDuration(noCleanStr)
+    if err != nil || noClean < 0 {
+      return nil, fmt.Errorf("invalid DETECT_NO_CLEAN: %s", noCleanStr)
+    }
+    if noClean > 0 && len(preset.CleanValues) == 0 {
+      return nil, fmt.Errorf("invalid DETECT_NO_CLEAN: preset %s has no clean values", preset.Name)
+    }
+    cfg.DetectNoClean = noClean
+  }
+  if stuckStr := os.Getenv("DETECT_STUCK_DURATION"); stuckStr != "" {
+    stuck, err := time.ParseDuration(stuckStr)
+    if err != nil || stuck < 0 {
+      return nil, fmt.Errorf("invalid DETECT_STUCK_DURATION: %s", stuckStr)
+    }
+    cfg.DetectStuckDuration = stuck
+  }
+
+  cfg.ResetThreshold = 0.8
+  if thresholdStr := os.Getenv("RESET_THRESHOLD"); thresholdStr != "" {
+    threshold, err := detect.ParseThreshold(thresholdStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid RESET_THRESHOLD: %w", err)
+    }
+    cfg.ResetThreshold = threshold
+  }
+  if thresholdStr := os.Getenv("NOTIFY_THRESHOLD"); thresholdStr != "" {
+    threshold, err := detect.ParseThreshold(thresholdStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid NOTIFY_THRESHOLD: %w", err)
+    }
+    if threshold >= cfg.ResetThreshold {
+      return nil, fmt.Errorf("NOTIFY_THRESHOLD must be below RESET_THRESHOLD (%s)", detect.FormatScore(cfg.ResetThreshold))
+    }
+    cfg.NotifyThreshold = threshold
+  }
+
+  verifyRuleStr := os.Getenv("VERIFY_RULE")
+  if verifyRuleStr == "" {
+    verifyRuleStr = preset.VerifyRule
+  }
+  if verifyRuleStr == "" {
+    verifyRuleStr = defaultVerifyRule
+  }
+  verifyRule, err := compileRule(verifyRuleStr)
+  if err != nil {
+    return nil, fmt.Errorf("invalid VERIFY_RULE: %w", err)
+  }
+  cfg.VerifyRule = verifyRule
+
+  drawerFullRuleStr := os.Getenv("DRAWER_FULL_RULE")
+  if drawerFullRuleStr == "" {
+    drawerFullRuleStr = preset.DrawerFullRule
+  }
+  if drawerFullRuleStr != "" {
+    rule, err := compileRule(drawerFullRuleStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid DRAWER_FULL_RULE: %w", err)
+    }
+    cfg.DrawerFullRule = rule
+  }
+
+  if occupiedRuleStr := os.Getenv("OCCUPIED_RULE"); occupiedRuleStr != "" {
+    rule, err := compileRule(occupiedRuleStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid OCCUPIED_RULE: %w", err)
+    }
+    cfg.OccupiedRule = rule
+  }
+  if waitStr := os.Getenv("OCCUPIED_WAIT"); waitStr != "" {
+    wait, err := time.ParseDuration(waitStr)
+    if err != nil || wait < 0 {
+      return nil, fmt.Errorf("invalid OCCUPIED_WAIT: %s", waitStr)
+    }
+    cfg.OccupiedWait = wait
+  }
+
+  groups, err := parseDeviceGroups(os.Getenv("DEVICE_GROUPS"))
+  if err != nil {
+    return nil, fmt.Errorf("invalid DEVICE_GROUPS: %w", err)
+  }
+  cfg.DeviceGroups = groups
+  if cfg.Workers, err = parseWorkers(os.Getenv("WORKERS")); err != nil {
+    return nil, err
+  }
+
+  consumables, err := parseConsumables(os.Getenv("CONSUMABLES"))
+  if err != nil {
+    return nil, fmt.Errorf("invalid CONSUMABLES: %w", err)
+  }
+  cfg.Consumables = consumables
+
+  verifyDelayStr := os.Getenv("VERIFY_DELAY")
+  if verifyDelayStr != "" {
+    duration, err := time.ParseDuration(verifyDelayStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid VERIFY_DELAY: %w", err)
+    }
+    cfg.VerifyDelay = duration
+  }
+
+  shutdownDelayStr := os.Getenv("SHUTDOWN_DELAY")
+  if shutdownDelayStr != "" {
+    duration, err := time.ParseDuration(shutdownDelayStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid SHUTDOWN_DELAY: %w", err)
+    }
+    cfg.ShutdownDelay = duration
+  }
+
+  pollIntervalStr := os.Getenv("POLL_INTERVAL")
+  if pollIntervalStr != "" {
+    duration, err := time.ParseDuration(pollIntervalStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid POLL_INTERVAL: %w", err)
+    }
+    if duration <= 0 {
+      return nil, fmt.Errorf("invalid POLL_INTERVAL: must be positive")
+    }
+    cfg.PollInterval = duration
+  }
+
+  statusCacheTTLStr := os.Getenv("STATUS_CACHE_TTL")
+  if statusCacheTTLStr != "" {
+    duration, err := time.ParseDuration(statusCacheTTLStr)
+    if err != nil {
+      return nil, fmt.Errorf("invalid STATUS_CACHE_TTL: %w", err)
+    }
+    cfg.StatusCacheTTL = duration
+  }
+
+  for _, timeout := range []struct {
+    name  string
+    value *time.Duration
+  }{
+    {"HTTP_CONNECT_TIMEOUT", &cfg.HTTPConnectTimeout},
+    {"HTTP_TIMEOUT", &cfg.HTTPTimeout},
+    {"RUN_TIMEOUT", &cfg.RunTimeout},
+  } {
+    if s := os.Getenv(timeout.name); s != "" {
+      duration, err := time.ParseDuration(s)
+      if err != nil {
+        return nil, fmt.Errorf("invalid %s: %w", timeout.name, err)
+      }
+      if duration < 0 {
+        return nil, fmt.Errorf("invalid %s: must not be negative", timeout.name)
+      }
+      *timeout.value = duration
+    }
+  }
+
+  proxy, err := parseProxyURL(os.Getenv("TUYA_PROXY_URL"))
+  if err != nil {
+    return nil, err
+  }
+  cfg.TuyaProxyURL = proxy
+
+  if s := os.Getenv("TUYA_MAX_ATTEMPTS"); s != "" {
+    attempts, err := strconv.Atoi(s)
+    if err != nil || attempts < 1 {
+      return nil, fmt.Errorf("invalid TUYA_MAX_ATTEMPTS: must be a positive number")
+    }
+    cfg.TuyaMaxAttempts = attempts
+  }
+  if cfg.TuyaRateLimit, err = parseRateLimit(os.Getenv("TUYA_RATE_LIMIT")); err != nil {
+    return nil, err
+  }
+
+  actionQuietHours, err := parseQuietHours(os.Getenv("ACTION_QUIET_HOURS"))
+  if err != nil {
+    return nil, fmt.Errorf("invalid ACTION_QUIET_HOURS: %w", err)
+  }
+  cfg.ActionQuietHours = actionQuietHours
+
+  notifyQuietHours, err := parseQuietHours(os.Getenv("NOTIFY_QUIET_HOURS"))
+  if err != nil {
+    return nil, fmt.Errorf("invalid NOTIFY_QUIET_HOURS: %w", err)
+  }
+
+  var notifyTemplate *template.Template
+  if templateStr := os.Getenv("NOTIFY_TEMPLATE"); templateStr != "" {
+    if notifyTemplate, err = notify.ParseTemplate("NOTIFY_TEMPLATE", templateStr, cfg.TimeFormat.Format); err != nil {
+      return nil, fmt.Errorf("invalid NOTIFY_TEMPLATE: %w", err)
+    }
+  }
+
+  if webhookURL := os.Getenv("NOTIFY_WEBHOOK_URL"); webhookURL != "" {
+    channel := NotifyChannel{Channel: notify.Channel{Name: "webhook", Kind: notify.KindWebhook, URL: webhookURL, Template: notifyTemplate}, QuietHours: notifyQuietHours}
+    if templateStr := os.Getenv("NOTIFY_WEBHOOK_TEMPLATE"); templateStr != "" {
+      if channel.Template, err = notify.ParseTemplate("NOTIFY_WEBHOOK_TEMPLATE", templateStr, cfg.TimeFormat.Format); err != nil {
+        return nil, fmt.Errorf("invalid NOTIFY_WEBHOOK_TEMPLATE: %w", err)
+      }
+    }
+    if quietHoursStr := os.Getenv("NOTIFY_WEBHOOK_QUIET_HOURS"); quietHoursStr != "" {
+      quietHours, err := parseQuietHours(quietHoursStr)
+      if err != nil {
+        return nil, fmt.Errorf("invalid NOTIFY_WEBHOOK_QUIET_HOURS: %w", err)
+      }
+      channel.QuietHours = quietHours
+    }
+    cfg.NotifyChannels = append(cfg.NotifyChannels, channel)
+  }
+  // Escalations must not wait for the end of quiet hours.
+  if escalationURL := os.Getenv("NOTIFY_ESCALATION_URL"); escalationURL != "" {
+    cfg.NotifyChannels = append(cfg.NotifyChannels, NotifyChannel{Channel: notify.Channel{Name: "escalation", Kind: notify.KindWebhook, URL: escalationURL, Template: notifyTemplate, MinLevel: notify.LevelCritical}})
+  }
+
+  if routingKey := os.Getenv("PAGERDUTY_ROUTING_KEY"); routingKey != "" {
+    channel := NotifyChannel{Channel: notify.Channel{Name: "pagerduty", Kind: notify.KindPagerDuty, URL: notify.PagerDutyEventsURL, Template: notifyTemplate, Key: routingKey}}
+    if eventsURL := os.Getenv("PAGERDUTY_EVENTS_URL"); eventsURL != "" {
+      channel.URL = eventsURL
+    }
+    defaults := map[string]string{notify.LevelWarning: "warning", notify.LevelError: "error", notify.LevelCritical: "critical"}
+    if channel.Levels, err = notify.ParseLevelMap(os.Getenv("PAGERDUTY_SEVERITY"), defaults, notify.PagerDutySeverities); err != nil {
+      return nil, fmt.Errorf("invalid PAGERDUTY_SEVERITY: %w", err)
+    }
+    cfg.NotifyChannels = append(cfg.NotifyChannels, channel)
+  }
+
+  if apiKey := os.Getenv("OPSGENIE_API_KEY"); apiKey != "" {
+    channel := NotifyChannel{Channel: notify.Channel{Name: "opsgenie", Kind: notify.KindOpsgenie, URL: notify.OpsgenieAPIURL, Template: notifyTemplate, Key: apiKey}}
+    if apiURL := os.Getenv("OPSGENIE_API_URL"); apiURL != "" {
+      channel.URL = apiURL
+    }
+    defaults := map[string]string{notify.LevelWarning: "P3", notify.LevelError: "P2", notify.LevelCritical: "P1"}
+    if channel.Levels, err = notify.ParseLevelMap(os.Getenv("OPSGENIE_PRIORITY"), defaults, notify.OpsgeniePriorities); err != nil {
+      return nil, fmt.Errorf("invalid OPSGENIE_PRIORITY: %w", err)
+    }
+    cfg.NotifyChannels = append(cfg.NotifyChannels, channel)
+  }
+
+  if countStr := os.Getenv("ESCALATE_FAILED_RESETS"); countStr != "" {
+    count, err := strconv.Atoi(countStr)
+    if err != nil || count < 1 {
+      return nil, fmt.Errorf("invalid ESCALATE_FAILED_RESETS: %s (must be a positive number)", countStr)
+    }
+    cfg.EscalateFailedResets = count
+  }
+  if offlineStr := os.Getenv("ESCALATE_OFFLINE"); offlineStr != "" {
+    offline, err := parseSince(offlineStr)
+    if err != nil || offline <= 0 {
+      return nil, fmt.Errorf("invalid ESCALATE_OFFLINE: %s (must be a positive duration)", offlineStr)
+    }
+    cfg.EscalateOffline = offline
+  }
+
+  for _, level := range strings.Split(os.Getenv("NOTIFY_QUIET_HOURS_BYPASS"), ",") {
+    level = strings.TrimSpace(level)
+    if level == "" {
+      continue
+    }
+    if level != notify.LevelInfo && level != notify.LevelWarning && level != notify.LevelError && level != notify.LevelCritical {
+      return nil, fmt.Errorf("invalid NOTIFY_QUIET_HOURS_BYPASS level: %s (valid: info, warning, error, critical)", level)
+    }
+    cfg.NotifyQuietBypass = append(cfg.NotifyQuietBypass, level)
+  }
+
+  if cfg.NotifyThrottle, err = parseNotifyThrottle(os.Getenv("NOTIFY_THROTTLE")); err != nil {
+    return nil, fmt.Errorf("invalid NOTIFY_THROTTLE: %w", err)
+  }
+  if onChangeStr := os.Getenv("NOTIFY_ON_CHANGE"); onChangeStr != "" {
+    if cfg.NotifyOnChange, err = strconv.ParseBool(onChangeStr); err != nil {
+      return nil, fmt.Errorf("invalid NOTIFY_ON_CHANGE: %s (expected true or false)", onChangeStr)
+    }
+  }
+
+  cfg.CaptureDuration = 15 * time.Minute
+  if durationStr := os.Getenv("DEBUG_CAPTURE_DURATION"); durationStr != "" {
+    duration, err := time.ParseDuration(durationStr)
+    if err != nil || duration <= 0 {
+      return nil, fmt.Errorf("invalid DEBUG_CAPTURE_DURATION: %s (must be a positive duration)", durationStr)
+    }
+    cfg.CaptureDuration = duration
+  }
+  cfg.CaptureRate = 60
+  if rateStr := os.Getenv("DEBUG_CAPTURE_RATE"); rateStr != "" {
+    rate, err := strconv.Atoi(rateStr)
+    if err != nil || rate < 1 {
+      return nil, fmt.Errorf("invalid DEBUG_CAPTURE_RATE: %s (must be an integer >= 1)", rateStr)
+    }
+    cfg.CaptureRate = rate
+  }
+
+  coldStartCyclesStr := os.Getenv("COLD_START_CYCLES")
+  if coldStartCyclesStr != "" {
+    cycles, err := strconv.Atoi(coldStartCyclesStr)
+    if err != nil || cycles < 0 {
+      return nil, fmt.Errorf("invalid COLD_START_CYCLES: %s (must be an integer >= 0)", coldStartCyclesStr)
+    }
+    cfg.ColdStartCycles = cycles
+  }
+
+  if s := os.Getenv("CIRCUIT_BREAKER_THRESHOLD"); s != "" {
+    threshold, err := strconv.Atoi(s)
+    if err != nil || threshold < 0 {
+      return nil, fmt.Errorf("invalid CIRCUIT_BREAKER_THRESHOLD: %s (must be an integer >= 0)", s)
+    }
+    cfg.CircuitBreakerThreshold = threshold
+  }
+
+  if s := os.Getenv("CIRCUIT_BREAKER_COOLOFF"); s != "" {
+    duration, err := time.ParseDuration(s)
+    if err != nil {
+      return nil, fmt.Errorf("invalid CIRCUIT_BREAKER_COOLOFF: %w", err)
+    }
+    if duration <= 0 {
+      return nil, fmt.Errorf("invalid CIRCUIT_BREAKER_COOLOFF: must be positive")
+    }
+    cfg.CircuitBreakerCoolOff = duration
+  }
+
+  watchdogFactorStr := os.Getenv("WATCHDOG_FACTOR")
+  if watchdogFactorStr != "" {
+    factor, err := strconv.Atoi(watchdogFactorStr)
+    if err != nil || factor < 2 {
+      return nil, fmt.Errorf("invalid WATCHDOG_FACTOR: %s (must be an integer >= 2)", watchdogFactorStr)
+    }
+    cfg.WatchdogFactor = factor
+  }
+
+  cfg.ServeAddress = os.Getenv("SERVE_ADDRESS")
+  if cfg.ServeAddress == "" {
+    cfg.ServeAddress = defaultServeAddress
+  }
+  cfg.HealthAddress = os.Getenv("HEALTH_ADDRESS")
+
+  cfg.ResetExitCode = exitReset
+  if s := os.Getenv("RESET_EXIT_CODE"); s != "" {
+    code, err := strconv.Atoi(s)
+    if err != nil || code < 0 || code > 125 {
+      return nil, fmt.Errorf("invalid RESET_EXIT_CODE: %s (must be a number from 0 to 125)", s)
+    }
+    cfg.ResetExitCode = code
+  }
+
+  cfg.ServeTLSCert = os.Getenv("SERVE_TLS_CERT")
+  cfg.ServeTLSKey = os.Getenv("SERVE_TLS_KEY")
+  cfg.ServeTLSClientCA = os.Getenv("SERVE_TLS_CLIENT_CA")
+  if (cfg.ServeTLSCert == "") != (cfg.ServeTLSKey == "") {
+    return nil, fmt.Errorf("SERVE_TLS_CERT and SERVE_TLS_KEY must be set together")
+  }
+  if cfg.ServeTLSClientCA != "" && cfg.ServeTLSCert == "" {
+    return nil, fmt.Errorf("SERVE_TLS_CLIENT_CA requires SERVE_TLS_CERT and SERVE_TLS_KEY")
+  }
+  cfg.APIReadToken = os.Getenv("API_READ_TOKEN")
+  cfg.APIControlToken = os.Getenv("API_CONTROL_TOKEN")
+
+  cfg.ControlSocket = os.Getenv("CONTROL_SOCKET")
+  cfg.AuditLog = os.Getenv("AUDIT_LOG")
+
+  if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != otlpProtocolJSON {
+    return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_PROTOCOL: %s (only %s is supported)", protocol, otlpProtocolJSON)
+  }
+  cfg.TraceEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+  if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); cfg.TraceEndpoint == "" && endpoint != "" {
+    cfg.TraceEndpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+  }
+  if cfg.TraceEndpoint != "" {
+    if u, err := url.Parse(cfg.TraceEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+      return nil, fmt.Errorf("invalid OTLP traces endpoint: %s (expected http(s)://host:port)", cfg.TraceEndpoint)
+    }
+  }
+  traceHeaders, err := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+  if err != nil {
+    return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: %w", err)
+  }
+  cfg.TraceHeaders = traceHeaders
+  cfg.TraceServiceName = os.Getenv("OTEL_SERVICE_NAME")
+  if cfg.TraceServiceName == "" {
+    cfg.TraceServiceName = "shitbox-fixer"
+  }
+  cfg.InstanceLock = os.Getenv("INSTANCE_LOCK")
+  if waitStr := os.Getenv("INSTANCE_LOCK_WAIT"); waitStr != "" {
+    duration, err := time.ParseDuration(waitStr)
+    if err != nil || duration < 0 {
+      return nil, fmt.Errorf("invalid INSTANCE_LOCK_WAIT: %s", waitStr)
+    }
+    cfg.InstanceLockWait = duration
+  }
+
+  if lockPath := os.Getenv("LEADER_LOCK"); lockPath != "" {
+    leaderID := os.Getenv("LEADER_ID")
+    if leaderID == "" {
+      leaderID = defaultLeaderID()
+    }
+    lease := 3 * cfg.PollInterval
+    if leaseStr := os.Getenv("LEADER_LEASE"); leaseStr != "" {
+      duration, err := time.ParseDuration(leaseStr)
+      if err != nil || duration <= 0 {
+        return nil, fmt.Errorf("invalid LEADER_LEASE: %s (must be a positive duration)", leaseStr)
+      }
+      lease = duration
+    }
+    cfg.Leader = newLeaderElection(lockPath, leaderID, lease)
+  }
+
+  return cfg, nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+  timer := time.NewTimer(d)
+  defer timer.Stop()
+
+  select {
+  case <-timer.C:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+func getDeviceStatus(ctx context.Context, deviceID string) (*DeviceInfoResponse, error) {
+  value, err := responseCache.Get(ctx, "status/"+deviceID, func(ctx context.Context) (interface{}, error) {
+    resp := &DeviceInfoResponse{}
+    err := tuyaGet(ctx, fmt.Sprintf("/v1.0/devices/%s", deviceID), resp)
+
+    if err != nil {
+      return nil, fmt.Errorf("failed to get device status: %w", err)
+    }
+
+    if !resp.Success {
+      return nil, tuyaError(resp.Code, resp.Msg)
+    }
+
+    return resp, nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  return value.(*DeviceInfoResponse), nil
+}
+
+func getDeviceSpecification(ctx context.Context, deviceID string) (*DeviceSpecResponse, error) {
+  value, err := responseCache.Get(ctx, "spec/"+deviceID, func(ctx context.Context) (interface{}, error) {
+    resp := &DeviceSpecResponse{}
+    err := tuyaGet(ctx, fmt.Sprintf("/v1.0/devices/%s/specifications", deviceID), resp)
+
+    if err != nil {
+      return nil, fmt.Errorf("failed to get device specification: %w", err)
+    }
+
+    if !resp.Success {
+      return nil, tuyaError(resp.Code, resp.Msg)
+    }
+
+    return resp, nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  return value.(*DeviceSpecResponse), nil
+}
+
+type DevicePropertiesResponse struct {
+  Code    int    `json:"code"`
+  Msg     string `json:"msg"`
+  Success bool   `json:"success"`
+  Result  struct {
+    Properties []struct {
+      Code  string      `json:"code"`
+      DPID  int         `json:"dp_id"`
+      Value interface{} `json:"value"`
+    } `json:"properties"`
+  } `json:"result"`
+  T int64 `json:"t"`
+}
+
+func getDeviceProperties(ctx context.Context, deviceID string) (*DevicePropertiesResponse, error) {
+  value, err := responseCache.Get(ctx, "properties/"+deviceID, func(ctx context.Context) (interface{}, error) {
+    resp := &DevicePropertiesResponse{}
+    err := tuyaGet(ctx, fmt.Sprintf("/v2.0/cloud/thing/%s/shadow/properties", deviceID), resp)
+
+    if err != nil {
+      return nil, fmt.Errorf("failed to get device properties: %w", err)
+    }
+
+    if !resp.Success {
+      return nil, tuyaError(resp.Code, resp.Msg)
+    }
+
+    return resp, nil
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  return value.(*DevicePropertiesResponse), nil
+}
+
+func getLastDeviceLogs(ctx context.Context, cfg *Config) ([]interface{}, error) {
+  logs, err := queryDeviceLogs(ctx, cfg.DeviceID, LogQuery{
+    Since: 10 * time.Minute,
+    DPIDs: logDPIDs(ctx, cfg),
+    Limit: 5,
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  if len(logs) == 0 {
+    return nil, fmt.Errorf("no logs found")
+  }
+
+  return logs, nil
+}
+
+func sendCommand(ctx context.Context, deviceID string, code string, value interface{}) error {
+  return sendCommands(ctx, deviceID, []actions.Command{{Code: code, Value: value}})
+}
+
+func sendCommands(ctx context.Context, deviceID string, commands []actions.Command) error {
+  return commandClient().Send(ctx, deviceID, commands)
+}
+
+// commandClient sends commands with the Tuya client and records them in the
+// audit log. Every call that changes a device goes through it.
+func commandClient() *actions.Client {
+  return &actions.Client{Tuya: tuya, Hints: tuyaErrorHints, Sent: commandSent}
+}
+
+func commandSent(ctx context.Context, deviceID string, commands []actions.Command, resp *actions.CommandResponse, err error) {
+  if auditErr := audit.record(ctx, deviceID, commands, resp, err); auditErr != nil {
+    slog.Warn("Failed to write the audit log", "error", auditErr)
+  }
+  if err == nil {
+    responseCache.Invalidate("status/" + deviceID)
+  }
+}
+
+// controlDevice runs the reset sequence as a single queued job once the box
+// is not occupied (see waitUnoccupied), so no other command reaches the
+// device between its steps.
+func controlDevice(ctx context.Context, cfg *Config, appLog *slog.Logger) error {
+  return deviceCommands.Do(ctx, cfg.DeviceID, "reset sequence", func(ctx context.Context) error {
+    if err := waitUnoccupied(ctx, cfg, appLog); err != nil {
+      return err
+    }
+    return sequenceRunner(cfg.Preset, appLog).Run(ctx, cfg.DeviceID, cfg.Preset.ResetSequence)
+  })
+}
+
+// sequenceRunner runs reset sequences with pkg/actions, verifying steps
+// against the preset's device.
+func sequenceRunner(preset Preset, appLog *slog.Logger) *actions.Runner {
+  return &actions.Runner{
+    Sender: commandClient(),
+    Verify: func(ctx context.Context, deviceID string, rule *rules.Rule) error {
+      return checkRule(ctx, deviceID, preset, rule)
+    },
+    Logger: appLog,
+    Tracer: spanTracer(spanKindInternal),
+  }
+}
+
+// runCheck checks the device and resets it when needed, traced as one span
+// with the Tuya API calls and the reset sequence below it.
+func runCheck(ctx context.Context, cfg *Config, appLog *slog.Logger) (*CheckResult, error) {
+  ctx, span := startSpan(ctx, "check", spanKindInternal, spanAttr("device.id", cfg.DeviceID))
+  result, err := checkDevice(ctx, cfg, appLog)
+  span.SetAttr("check.action", result.Action)
+  span.SetAttr("check.online", result.Online)
+  span.SetAttr("check.score", result.Score)
+  if result.Reason != "" {
+    span.SetAttr("check.reason", result.Reason)
+  }
+  span.End(err)
+  return result, err
+}
+
+// runCheckWithin runs a one-time check within RUN_TIMEOUT. Like a shutdown,
+// the deadline does not interrupt a reset sequence that has started.
+func runCheckWithin(ctx context.Context, cfg *Config, appLog *slog.Logger) (*CheckResult, error) {
+  if cfg.RunTimeout <= 0 {
+    return runCheck(ctx, cfg, appLog)
+  }
+  runCtx, cancel := context.WithTimeout(ctx, cfg.RunTimeout)
+  defer cancel()
+  result, err := runCheck(runCtx, cfg, appLog)
+  if err != nil && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+    err = fmt.Errorf("check did not finish within RUN_TIMEOUT (%s): %w", cfg.RunTimeout, err)
+  }
+  return result, err
+}
+
+// reportCheckResult hands the outcome of a check to the history, incidents
+// and exporters.
+func reportCheckResult(cfg *Config, appLog *slog.Logger, result *CheckResult, err error) {
+  recordCheckResult(cfg, appLog, result, err)
+  trackIncident(cfg, appLog, result, err)
+  trackOutage(cfg, appLog, result, err)
+  escalate(cfg, appLog, result, err)
+  trackConsumables(cfg, appLog, result)
+  writeInflux(cfg, appLog, result, err)
+  writeMetricsTextfile(cfg, appLog, result, err)
+  pushUptimeKuma(cfg, appLog, result, err)
+  pruneDaily(cfg, appLog)
+}
+
+func checkDevice(ctx context.Context, cfg *Config, appLog *slog.Logger) (*CheckResult, error) {
+  result := &CheckResult{
+    Time:     time.Now(),
+    DeviceID: cfg.DeviceID,
+    Status:   map[string]interface{}{},
+    Action:   actionNone,
+  }
+
+  if cfg.Leader != nil {
+    result.Standby = !cfg.Leader.Renew(appLog)
+  }
+
+  // The leader sends the notifications, queued ones included.
+  if !result.Standby {
+    flushNotifications(cfg, appLog)
+  }
+
+  // Status and logs are independent, fetch them at once. A failed status
+  // fails the check, so it also cancels the logs.
+  setPhase(ctx, "get device status and logs")
+  fetchCtx, cancel := context.WithTimeout(ctx, deviceFetchTimeout)
+  defer cancel()
+  var lastLogs []interface{}
+  var logsErr error
+  var wg sync.WaitGroup
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    lastLogs, logsErr = getLastDeviceLogs(fetchCtx, cfg)
+  }()
+  deviceStatus, err := getDeviceStatus(fetchCtx, cfg.DeviceID)
+  if err != nil {
+    cancel()
+    wg.Wait()
+    return result, err
+  }
+  wg.Wait()
+
+  result.Online, _ = deviceStatus.Result["online"].(bool)
+  result.DeviceName, _ = deviceStatus.Result["name"].(string)
+  if !result.Online {
+    result.offlineSince = deviceLastSeen(deviceStatus)
+  }
+  result.Status = deviceStatusMap(deviceStatus)
+
+  appLog.Debug("Device status", "online", result.Online, "status", result.Status)
+
+  if logsErr != nil {
+    if ctx.Err() != nil {
+      return result, logsErr
+    }
+    appLog.Debug("Failed to get device logs", "error", logsErr)
+  }
+  for _, logEntry := range lastLogs {
+    if logMap, ok := logEntry.(map[string]interface{}); ok {
+      if eventTime, ok := logMap["event_time"].(float64); ok {
+        logMap["event_time_readable"] = cfg.TimeFormat.Absolute(time.UnixMilli(int64(eventTime)))
+      }
+    }
+  }
+  result.Logs = lastLogs
+
+  if len(lastLogs) > 0 {
+    appLog.Debug("Last device logs", "logs", lastLogs)
+  }
+
+  coldStart, err := observeColdStart(cfg)
+  if err != nil {
+    appLog.Warn("Failed to update cold start state", "error", err)
+  }
+
+  overrides, err := activeOverrides(cfg, cfg.DeviceID)
+  if err != nil {
+    appLog.Warn("Failed to load manual overrides", "error", err)
+  }
+  result.Overrides = overrides
+  for _, o := range overrides {
+    appLog.Warn("Manual override active", "override", o.Kind+" "+describeUntil(cfg, o), "note", o.Note)
+  }
+
+  offlineOK := !result.Online && hasOverride(overrides, overrideOfflineOK)
+  if offlineOK {
+    appLog.Info("Device is offline, treated as ok by manual override")
+  }
+  // Offline devices do not clean, the offline input covers them.
+  noClean := result.Online && cleanOverdue(ctx, cfg, appLog, lastLogs)
+  detection := runDetection(cfg, appLog, deviceStatus, lastLogs, offlineOK, noClean, !result.Standby)
+  result.Score, result.Inputs = detection.Score, detection.Inputs
+  if detection.Score > 0 {
+    appLog.Debug("Detection score", "score", detect.FormatScore(detection.Score), "inputs", detection.Inputs)
+  }
+  result.NeedsReset = detection.Score >= cfg.ResetThreshold
+  checkDrawer(cfg, appLog, deviceStatus, lastLogs, result)
+  if result.NeedsReset || (cfg.NotifyThreshold > 0 && detection.Score >= cfg.NotifyThreshold) {
+    result.Reason = detection.Reason
+  }
+
+  if !result.NeedsReset && result.Reason != "" {
+    appLog.Info("Device may need a reset, score is below RESET_THRESHOLD", "reason", result.Reason, "score", detect.FormatScore(result.Score))
+    if !result.Standby {
+      result.Action = actionNotified
+      sendNotification(cfg, appLog, notify.Notification{
+        Level:   notify.LevelWarning,
+        Event:   notifyEventStuck,
+        Check:   notifyCheck(result),
+        Title:   tr(cfg, "Device may be stuck"),
+        Message: tr(cfg, "Detection score %s (%s) is below the reset threshold of %s", detect.FormatScore(result.Score), result.Reason, detect.FormatScore(cfg.ResetThreshold)),
+      })
+    }
+  } else if result.NeedsReset {
+    if coldStart {
+      result.Action = actionResetDeferred
+      appLog.Info("Device needs reset, but it is still being observed after cold start", "reason", result.Reason)
+      return result, nil
+    }
+
+    if hasOverride(overrides, overrideNeverReset) {
+      result.Action = actionResetOverridden
+      appLog.Info("Device needs reset, but resets are disabled by manual override", "reason", result.Reason)
+      return result, nil
+    }
+
+    if result.Standby {
+      result.Action = actionResetStandby
+      appLog.Info("Device needs reset, leaving it to the leader", "reason", result.Reason)
+      return result, nil
+    }
+
+    if cfg.ActionQuietHours.Contains(cfg.TimeFormat.Now()) {
+      result.Action = actionResetSuppressed
+      appLog.Info("Device needs reset, but actions are suppressed during quiet hours", "reason", result.Reason)
+      sendNotification(cfg, appLog, notify.Notification{
+        Level:   notify.LevelWarning,
+        Event:   notifyEventResetSuppressed,
+        Check:   notifyCheck(result),
+        Title:   tr(cfg, "Reset suppressed"),
+        Message: tr(cfg, "Device needs reset, but actions are suppressed during quiet hours"),
+      })
+      return result, nil
+    }
+
+    // A shutdown waits for the sequence and its verification, so the device
+    // is not left half-way through it.
+    release := shutdown.protect()
+    defer release()
+
+    appLog.Info("Device needs reset, sending control command", "reason", result.Reason)
+    setPhase(ctx, "reset sequence")
+    result.Action = actionReset
+    for _, step := range cfg.Preset.ResetSequence {
+      result.Commands = append(result.Commands, actions.Command{Code: step.Code, Value: step.Value})
+    }
+    err := controlDevice(withAuditTrigger(ctx, auditTriggerCheck, result.Reason, ""), cfg, appLog)
+    if errors.Is(err, errOccupied) {
+      result.Action = actionResetSuppressed
+      result.Commands = nil
+      appLog.Info("Device needs reset, but a cat is in the box", "reason", result.Reason)
+      sendNotification(cfg, appLog, notify.Notification{
+        Level:   notify.LevelWarning,
+        Event:   notifyEventResetSuppressed,
+        Check:   notifyCheck(result),
+        Title:   tr(cfg, "Reset suppressed"),
+        Message: tr(cfg, "Device needs reset, but a cat is in the box"),
+      })
+      return result, nil
+    }
+    if err != nil {
+      result.Action = actionResetFailed
+      sendNotification(cfg, appLog, notify.Notification{
+        Level:   notify.LevelError,
+        Event:   notifyEventResetFailed,
+        Check:   notifyCheck(result),
+        Title:   tr(cfg, "Reset failed"),
+        Message: err.Error(),
+      })
+      return result, fmt.Errorf("failed to control device: %w", err)
+    }
+    appLog.Info("Control command sent successfully")
+
+    setPhase(ctx, "verify reset")
+    if err := verifyReset(ctx, cfg, appLog); err != nil {
+      result.Action = actionResetFailed
+      sendNotification(cfg, appLog, notify.Notification{
+        Level:   notify.LevelError,
+        Event:   notifyEventResetFailed,
+        Check:   notifyCheck(result),
+        Title:   tr(cfg, "Reset not verified"),
+        Message: err.Error(),
+      })
+      return result, fmt.Errorf("reset verification failed: %w", err)
+    }
+    appLog.Info("Reset verified", "rule", cfg.VerifyRule.Source)
+    sendNotification(cfg, appLog, notify.Notification{
+      Level:   notify.LevelInfo,
+      Event:   notifyEventReset,
+      Check:   notifyCheck(result),
+      Title:   tr(cfg, "Device reset"),
+      Message: tr(cfg, "Device was stuck and has been reset"),
+    })
+  } else {
+    appLog.Info("Device is working properly, no action needed")
+    if !result.Standby {
+      notifyRecovered(cfg, appLog, result)
+    }
+  }
+
+  return result, nil
+}
+
+// Main runs the command line of os.Args and exits.
+func Main() {
+  configFlag := flag.String("config", "", "config file to load instead of searching the default locations")
+  flag.BoolVar(&noColor, "no-color", false, "disable colored output, like NO_COLOR")
+  detectRegionFlag := flag.Bool("detect-region", false, "find the data center that knows the device and remember it")
+  recordHTTPFlag := flag.String("record-http", "", "record the Tuya API responses to this cassette file")
+  replayHTTPFlag := flag.String("replay-http", "", "answer Tuya API requests from this cassette file instead of calling the API")
+  dumpHTTPFlag := flag.String("dump-http", "", "append every Tuya API request and response to this file, with secrets redacted")
+  allProfilesFlag := flag.Bool("all-profiles", false, "run the command for every profile of the config file at the same time")
+  tenantsFlag := flag.Bool("tenants", false, "with serve, serve every profile of the config file as a tenant behind one API")
+  registerConfigFlags(flag.CommandLine)
+  flag.Parse()
+
+  command := ""
+  args := flag.Args()
+  if len(args) > 0 {
+    command = args[0]
+    args = args[1:]
+  }
+
+  if command == "version" {
+    fmt.Printf("Version: %s\nCommit: %s\nBuilt: %s\n", Version, GitCommit, BuildDate)
+    os.Exit(0)
+  }
+
+  if command == "presets" {
+    printPresets()
+    os.Exit(0)
+  }
+
+  if command == "simulate" {
+    code, err := runSimulate(shutdownContext(slog.Default()), args)
+    if err != nil {
+      fatal(slog.Default(), exitConfigError, "Simulator failed", err)
+    }
+    os.Exit(code)
+  }
+
+  configPaths, err := findConfigFiles(*configFlag)
+  if err != nil {
+    slog.Error("Failed to load config", "error", err)
+    os.Exit(exitConfigError)
+  }
+  if *tenantsFlag {
+    if command != "serve" || *allProfilesFlag {
+      slog.Error("--tenants only works with serve, without --all-profiles")
+      os.Exit(exitConfigError)
+    }
+    globalArgs := os.Args[1 : len(os.Args)-len(flag.Args())]
+    if err := runTenants(shutdownContext(slog.Default()), configPaths, globalArgs, args); err != nil {
+      slog.Error("Failed to serve tenants", "error", err)
+      os.Exit(exitConfigError)
+    }
+    os.Exit(0)
+  }
+  if *allProfilesFlag {
+    globalArgs := os.Args[1 : len(os.Args)-len(flag.Args())]
+    code, err := runAllProfiles(configPaths, globalArgs, flag.Args())
+    if err != nil {
+      slog.Error("Failed to run all profiles", "error", err)
+      os.Exit(exitConfigError)
+    }
+    os.Exit(code)
+  }
+  profile := os.Getenv("PROFILE")
+  if profile != "" && len(configPaths) == 0 {
+    slog.Error("Failed to load config: PROFILE is set but no config file was found")
+    os.Exit(exitConfigError)
+  }
+  if len(configPaths) > 0 {
+    if err := loadConfigFiles(configPaths, profile); err != nil {
+      // A file that was asked for explicitly must load.
+      if *configFlag != "" || profile != "" {
+        slog.Error("Failed to load config file", "paths", strings.Join(configPaths, ","), "error", err)
+        os.Exit(exitConfigError)
+      }
+      slog.Warn("Failed to load config file", "paths", strings.Join(configPaths, ","), "error", err)
+    }
+  }
+
+  if *dumpHTTPFlag != "" {
+    dump, err := openHTTPDump(*dumpHTTPFlag)
+    if err != nil {
+      slog.Error("Failed to set up HTTP dump", "error", err)
+      os.Exit(exitConfigError)
+    }
+    httpDump = dump
+    defer dump.Close()
+  }
+
+  if *recordHTTPFlag != "" && *replayHTTPFlag != "" {
+    slog.Error("Failed to set up HTTP cassette: --record-http and --replay-http cannot be combined")
+    os.Exit(exitConfigError)
+  }
+  if *recordHTTPFlag != "" || *replayHTTPFlag != "" {
+    var err error
+    if *recordHTTPFlag != "" {
+      httpCassette, err = recordCassette(*recordHTTPFlag)
+    } else {
+      httpCassette, err = replayCassette(*replayHTTPFlag)
+    }
+    if err != nil {
+      slog.Error("Failed to set up HTTP cassette", "error", err)
+      os.Exit(exitConfigError)
+    }
+  }
+
+  if command == "init" {
+    if err := runInit(context.Background(), args); err != nil {
+      fatal(slog.Default(), exitConfigError, "Setup failed", err)
+    }
+    return
+  }
+
+  cfg, err := loadConfig()
+  if command == "capabilities" {
+    if err := runCapabilities(cfg, err, args); err != nil {
+      fatal(slog.Default(), exitConfigError, "Failed to report capabilities", err)
+    }
+    return
+  }
+  if err != nil {
+    slog.Error("Failed to load config", "error", err)
+    os.Exit(exitConfigError)
+  }
+
+  groupCommand := (command == "status" || command == "reset" || command == "report") && hasGroupFlag(args)
+  if cfg.DeviceID == "" && command != "devices" && command != "data" && command != "send" && command != "operator" && !groupCommand {
+    slog.Error(fmt.Sprintf("Failed to load config: missing TUYA_DEVICE_ID (run `%s devices` to find it)", filepath.Base(os.Args[0])))
+    os.Exit(exitConfigError)
+  }
+
+  var appOut io.Writer = os.Stdout
+  if cfg.Output == outputJSON {
+    appOut = os.Stderr
+  }
+
+  appLog, err := newAppLogger(cfg, appOut)
+  if err != nil {
+    slog.Error("Failed to set up logging", "error", err)
+    os.Exit(exitConfigError)
+  }
+  slog.SetDefault(appLog)
+
+  ctx := shutdownContext(appLog)
+  if *detectRegionFlag {
+    if err := applyDetectedRegion(ctx, cfg, appLog); err != nil {
+      fatal(appLog, exitAPIError, "Region detection failed", err)
+    }
+  }
+  opts := tuyaOptions(cfg.APIHost, cfg.AccessID, cfg.AccessKey, newHTTPClient(cfg.HTTPConnectTimeout, cfg.HTTPTimeout, cfg.TuyaProxyURL), cfg.TuyaMaxAttempts, appLog)
+  opts.Limiter = newRateLimiter(cfg.TuyaRateLimit)
+  // A cassette holds its own token requests, or none at all.
+  if cfg.DataStorage != dataStorageNone && httpCassette == nil {
+    if path, err := statePath(cfg, "token.json"); err != nil {
+      appLog.Warn("Failed to cache access token", "error", err)
+    } else {
+      opts.TokenStore = stateTokenStore(path)
+    }
+  }
+  tuya = tuyaclient.New(opts)
+  if path, err := auditLogPath(cfg); err != nil {
+    appLog.Warn("Failed to open the audit log, commands are not audited", "error", err)
+  } else if path != "" {
+    audit = &commandAudit{path: path}
+  }
+  initTracing(cfg, appLog)
+  defer flushTraces()
+
+  responseCache.SetTTL(cfg.StatusCacheTTL)
+  capture.Configure(cfg.CaptureDuration, cfg.CaptureRate)
+
+  if command == "devices" {
+    if err := runDevices(ctx, cfg, args); err != nil {
+      fatal(appLog, exitAPIError, "Failed to list devices", err)
+    }
+    return
+  }
+
+  if command == "check" {
+    if err := runValidate(ctx, cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "Configuration check failed", err)
+    }
+    return
+  }
+
+  if command == "send" {
+    if err := runSend(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitAPIError, "Failed to send command", err)
+    }
+    return
+  }
+
+  if command == "logs" {
+    if err := runLogs(ctx, cfg, args); err != nil {
+      fatal(appLog, exitAPIError, "Failed to get device logs", err)
+    }
+    return
+  }
+
+  if command == "audit" {
+    if err := runAudit(cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "Audit command failed", err)
+    }
+    return
+  }
+
+  if command == "history" {
+    if err := runHistory(ctx, cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "History command failed", err)
+    }
+    return
+  }
+
+  if command == "report" {
+    if err := runReport(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitAPIError, "Report command failed", err)
+    }
+    return
+  }
+
+  if command == "stats" {
+    if err := runStats(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitAPIError, "Stats command failed", err)
+    }
+    return
+  }
+
+  if command == "troubleshoot" {
+    if err := runTroubleshoot(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitAPIError, "Troubleshooting failed", err)
+    }
+    return
+  }
+
+  if command == "consumables" {
+    if err := runConsumables(cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "Consumables command failed", err)
+    }
+    return
+  }
+
+  if command == "clock" {
+    if err := runClock(ctx, cfg, args); err != nil {
+      fatal(appLog, exitAPIError, "Clock check failed", err)
+    }
+    return
+  }
+
+  if command == "firmware" {
+    if err := runFirmware(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitAPIError, "Firmware command failed", err)
+    }
+    return
+  }
+
+  if command == "override" {
+    if err := runOverride(cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "Override command failed", err)
+    }
+    return
+  }
+
+  if command == "notifications" {
+    if err := runNotifications(cfg, appLog, args); err != nil {
+      fatal(appLog, exitConfigError, "Notifications command failed", err)
+    }
+    return
+  }
+
+  if command == "trigger" {
+    if err := runTrigger(ctx, cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "Failed to trigger a check", err)
+    }
+    return
+  }
+
+  if command == "status" {
+    if err := runStatus(ctx, cfg, args); err != nil {
+      fatal(appLog, exitAPIError, "Failed to get device status", err)
+    }
+    return
+  }
+
+  if command == "queue" {
+    if err := runQueue(ctx, cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "Failed to list the command queue", err)
+    }
+    return
+  }
+
+  if command == "wait" {
+    if err := runWait(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitAPIError, "Wait failed", err)
+    }
+    return
+  }
+
+  if command == "reset" {
+    result, err := runReset(ctx, cfg, appLog, args)
+    if err != nil {
+      fatal(appLog, exitAPIError, "Failed to reset device", err)
+    }
+    if result.Action == actionResetFailed {
+      os.Exit(exitResetFailed)
+    }
+    return
+  }
+
+  if command == "data" {
+    if err := runData(cfg, args); err != nil {
+      fatal(appLog, exitConfigError, "Data command failed", err)
+    }
+    return
+  }
+
+  noticeFirstRun(cfg, appLog)
+
+  if err := acquireInstanceLock(ctx, cfg, appLog); err != nil {
+    // Overlapping cron runs are expected, the running one does the work.
+    if errors.Is(err, errInstanceLocked) && command != "watch" && command != "serve" {
+      appLog.Info("Skipping check", "reason", err.Error())
+      os.Exit(exitOK)
+    }
+    fatal(appLog, exitConfigError, "Failed to acquire instance lock", err)
+  }
+
+  if command == "watch" {
+    runWatch(ctx, newLiveConfig(cfg), appLog)
+    return
+  }
+
+  if command == "serve" {
+    if err := runServe(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitConfigError, "Failed to serve API", err)
+    }
+    return
+  }
+
+  if command == "operator" {
+    if err := runOperator(ctx, cfg, appLog, args); err != nil {
+      fatal(appLog, exitConfigError, "Operator failed", err)
+    }
+    return
+  }
+
+  result, err := runCheckWithin(ctx, cfg, appLog)
+  reportCheckResult(cfg, appLog, result, err)
+  if cfg.Output == outputJSON {
+    printCheckResult(result, err)
+  }
+  if cfg.Output == outputTable {
+    printCheckTable(cfg, result, err)
+  }
+  printVerdict(cfg, result, err)
+  if err != nil {
+    appLog.Error("Check failed", "error", err)
+    flushTraces()
+    os.Exit(checkExitCode(cfg, result, err))
+  }
+
+  if cfg.ShutdownDelay > 0 {
+    appLog.Debug("Sleeping before exit", "duration", cfg.ShutdownDelay)
+    _ = sleepContext(ctx, cfg.ShutdownDelay)
+  }
+
+  flushTraces()
+  os.Exit(checkExitCode(cfg, result, nil))
+}
+
+// checkExitCode maps the outcome of a check to its exit code. A successful
+// reset exits with RESET_EXIT_CODE, e.g. 0 for Kubernetes Jobs that count
+// any other code as a failure and retry.
+func checkExitCode(cfg *Config, result *CheckResult, err error) int {
+  switch {
+  case result.Action == actionResetFailed:
+    return exitResetFailed
+  case err != nil:
+    return exitAPIError
+  case result.Action == actionReset:
+    return cfg.ResetExitCode
+  default:
+    return exitOK
+  }
+}
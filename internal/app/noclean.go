@@ -0,0 +1,70 @@
+package app
+
+import (
+  "context"
+  "log/slog"
+  "sync"
+  "time"
+)
+
+// lastClean remembers the newest clean seen, so the logs of the whole
+// DETECT_NO_CLEAN window are only queried once it is older than that.
+var lastClean struct {
+  sync.Mutex
+  deviceID string
+  time     time.Time
+}
+
+// newestClean returns the time of the newest clean in logs, or the zero time.
+func newestClean(preset Preset, logs []interface{}) time.Time {
+  var newest time.Time
+  for _, logEntry := range logs {
+    logMap, ok := logEntry.(map[string]interface{})
+    if !ok || !isCleanEvent(preset, logMap) {
+      continue
+    }
+    eventTime, _ := logMap["event_time"].(float64)
+    if t := time.UnixMilli(int64(eventTime)); t.After(newest) {
+      newest = t
+    }
+  }
+  return newest
+}
+
+// cleanOverdue reports whether the device has not cleaned within
+// DETECT_NO_CLEAN. A box that silently stops cycling is online and never
+// reports a stuck value, so the other inputs miss it. When the logs cannot
+// be read, the clean is not considered overdue.
+func cleanOverdue(ctx context.Context, cfg *Config, appLog *slog.Logger, lastLogs []interface{}) bool {
+  if cfg.DetectNoClean <= 0 {
+    return false
+  }
+  lastClean.Lock()
+  defer lastClean.Unlock()
+  if lastClean.deviceID != cfg.DeviceID {
+    lastClean.deviceID, lastClean.time = cfg.DeviceID, time.Time{}
+  }
+  update := func(t time.Time) {
+    if t.After(lastClean.time) {
+      lastClean.time = t
+    }
+  }
+
+  update(newestClean(cfg.Preset, lastLogs))
+  if time.Since(lastClean.time) < cfg.DetectNoClean {
+    return false
+  }
+
+  setPhase(ctx, "get clean logs")
+  logs, err := queryDeviceLogs(ctx, cfg.DeviceID, LogQuery{Since: cfg.DetectNoClean, DPIDs: logDPIDs(ctx, cfg), Limit: statsLogLimit})
+  if err != nil {
+    appLog.Debug("Failed to get device logs for DETECT_NO_CLEAN", "error", err)
+    return false
+  }
+  update(newestClean(cfg.Preset, logs))
+  if time.Since(lastClean.time) < cfg.DetectNoClean {
+    return false
+  }
+  appLog.Debug("No clean within DETECT_NO_CLEAN", "window", cfg.DetectNoClean, "last_clean", lastClean.time)
+  return true
+}
@@ -0,0 +1,210 @@
+package app
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+// NotifyChannel is a channel of pkg/notify with its quiet hours, during
+// which notifications are queued and later sent as one summary.
+type NotifyChannel struct {
+  notify.Channel
+  QuietHours QuietHours
+}
+
+// notifyCheck is what notifications tell about the check that raised them.
+func notifyCheck(result *CheckResult) *notify.Check {
+  if result == nil {
+    return nil
+  }
+  return &notify.Check{
+    DeviceName: result.DeviceName,
+    Online:     result.Online,
+    Status:     result.Status,
+    Reason:     result.Reason,
+    Score:      result.Score,
+    Logs:       result.Logs,
+  }
+}
+
+// notifyClient sends the requests of heartbeats, Uptime Kuma and
+// Alertmanager.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func (c NotifyChannel) queuePath(cfg *Config) (string, error) {
+  return statePath(cfg, "notify-queue-"+c.Name+".json")
+}
+
+func (c NotifyChannel) readQueue(cfg *Config) ([]notify.Notification, error) {
+  path, err := c.queuePath(cfg)
+  if err != nil {
+    return nil, err
+  }
+
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  var queued []notify.Notification
+  if err := json.Unmarshal(data, &queued); err != nil {
+    return nil, fmt.Errorf("corrupt notification queue %s: %w", path, err)
+  }
+  return queued, nil
+}
+
+func (c NotifyChannel) enqueue(cfg *Config, n notify.Notification) error {
+  queued, err := c.readQueue(cfg)
+  if err != nil {
+    return err
+  }
+  return c.writeQueue(cfg, append(queued, n))
+}
+
+func (c NotifyChannel) writeQueue(cfg *Config, queued []notify.Notification) error {
+  path, err := c.queuePath(cfg)
+  if err != nil {
+    return err
+  }
+  if len(queued) == 0 {
+    err := os.Remove(path)
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+
+  return saveStateFile(path, queued)
+}
+
+// flush delivers everything queued during quiet hours as a single summary.
+func (c NotifyChannel) flush(cfg *Config, appLog *slog.Logger) error {
+  queued, err := c.readQueue(cfg)
+  if err != nil || len(queued) == 0 {
+    return err
+  }
+
+  summary := notify.Notification{
+    Time:     time.Now(),
+    Level:    notify.LevelInfo,
+    DeviceID: cfg.DeviceID,
+    Title:    tr(cfg, "%d notification(s) during quiet hours", len(queued)),
+  }
+  lines := make([]string, 0, len(queued))
+  for _, n := range queued {
+    if notify.LevelRank(n.Level) > notify.LevelRank(summary.Level) {
+      summary.Level = n.Level
+    }
+    line := fmt.Sprintf("%s [%s] %s", cfg.TimeFormat.Format(n.Time), n.Level, n.Title)
+    if n.Message != "" {
+      line += ": " + n.Message
+    }
+    lines = append(lines, line)
+  }
+  summary.Message = strings.Join(lines, "\n")
+
+  if err := c.Deliver(summary); err != nil {
+    return err
+  }
+  ids := make([]int, 0, len(queued))
+  for _, n := range queued {
+    ids = append(ids, n.ID)
+  }
+  markDelivered(cfg, appLog, c.Name, ids, deliverySent, nil)
+
+  path, err := c.queuePath(cfg)
+  if err != nil {
+    return err
+  }
+  return os.Remove(path)
+}
+
+func bypassesQuietHours(cfg *Config, level string) bool {
+  for _, bypass := range cfg.NotifyQuietBypass {
+    if bypass == level {
+      return true
+    }
+  }
+  return false
+}
+
+func sendNotification(cfg *Config, appLog *slog.Logger, n notify.Notification) {
+  if n.Time.IsZero() {
+    n.Time = time.Now()
+  }
+  if n.DeviceID == "" {
+    n.DeviceID = cfg.DeviceID
+  }
+  if len(cfg.NotifyChannels) == 0 {
+    return
+  }
+  if !admitNotification(cfg, appLog, &n) {
+    return
+  }
+
+  keepInbox := cfg.DataStorage != dataStorageNone
+  if keepInbox {
+    id, err := nextInboxID(cfg)
+    if err != nil {
+      appLog.Warn("Failed to read notification inbox", "error", err)
+      keepInbox = false
+    }
+    n.ID = id
+  }
+  entry := InboxEntry{Notification: n, Deliveries: []Delivery{}}
+
+  for _, channel := range cfg.NotifyChannels {
+    if notify.LevelRank(n.Level) < notify.LevelRank(channel.MinLevel) {
+      continue
+    }
+    delivery := Delivery{Channel: channel.Name, Status: deliverySent, Time: time.Now()}
+    rendered := channel.Render(appLog, n)
+    if channel.QuietHours.Contains(n.Time.In(cfg.TimeFormat.Location)) && !bypassesQuietHours(cfg, n.Level) {
+      delivery.Status = deliveryQueued
+      if err := channel.enqueue(cfg, rendered); err != nil {
+        appLog.Warn("Failed to queue notification", "channel", channel.Name, "error", err)
+        delivery.Status, delivery.Error = deliveryFailed, err.Error()
+      }
+      entry.Deliveries = append(entry.Deliveries, delivery)
+      continue
+    }
+
+    if err := channel.flush(cfg, appLog); err != nil {
+      appLog.Warn("Failed to send queued notifications", "channel", channel.Name, "error", err)
+    }
+    if err := channel.Deliver(rendered); err != nil {
+      appLog.Warn("Failed to send notification", "channel", channel.Name, "error", err)
+      delivery.Status, delivery.Error = deliveryFailed, err.Error()
+    }
+    entry.Deliveries = append(entry.Deliveries, delivery)
+  }
+
+  if keepInbox {
+    if err := appendInbox(cfg, entry); err != nil {
+      appLog.Warn("Failed to record notification", "error", err)
+    }
+  }
+}
+
+func flushNotifications(cfg *Config, appLog *slog.Logger) {
+  now := cfg.TimeFormat.Now()
+  for _, channel := range cfg.NotifyChannels {
+    if channel.QuietHours.Contains(now) {
+      continue
+    }
+    if err := channel.flush(cfg, appLog); err != nil {
+      appLog.Warn("Failed to send queued notifications", "channel", channel.Name, "error", err)
+    }
+  }
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log/slog"
+  "time"
+)
+
+// occupiedRecheck is how often the status is fetched again while waiting for
+// the cat to leave within OCCUPIED_WAIT.
+const occupiedRecheck = 15 * time.Second
+
+// errOccupied is returned instead of starting a reset sequence while
+// OCCUPIED_RULE holds.
+var errOccupied = errors.New("a cat is in the box")
+
+// isOccupied fetches the current status and evaluates OCCUPIED_RULE.
+func isOccupied(ctx context.Context, cfg *Config) (bool, error) {
+  responseCache.Invalidate("status/" + cfg.DeviceID)
+  deviceStatus, err := getDeviceStatus(ctx, cfg.DeviceID)
+  if err != nil {
+    return false, err
+  }
+  occupied, err := cfg.OccupiedRule.Eval(ruleEnv(cfg.Preset, deviceStatus, nil))
+  if err != nil {
+    return false, fmt.Errorf("failed to evaluate OCCUPIED_RULE %s: %w", cfg.OccupiedRule.Source, err)
+  }
+  return occupied, nil
+}
+
+// waitUnoccupied is the safety interlock in front of every reset sequence:
+// power-cycling the box mid-visit must never happen. It returns nil once
+// OCCUPIED_RULE does not hold, re-checking for up to OCCUPIED_WAIT, and
+// errOccupied when the cat stays. Without a fresh status the reset is not
+// started either.
+func waitUnoccupied(ctx context.Context, cfg *Config, appLog *slog.Logger) error {
+  if cfg.OccupiedRule == nil {
+    return nil
+  }
+  deadline := time.Now().Add(cfg.OccupiedWait)
+  for {
+    occupied, err := isOccupied(ctx, cfg)
+    if err != nil {
+      return fmt.Errorf("failed to check whether the box is occupied: %w", err)
+    }
+    if !occupied {
+      return nil
+    }
+    remaining := time.Until(deadline)
+    if remaining <= 0 {
+      return errOccupied
+    }
+    appLog.Info("A cat is in the box, waiting before the reset", "rule", cfg.OccupiedRule.Source, "remaining", remaining.Truncate(time.Second))
+    if err := sleepContext(ctx, min(occupiedRecheck, remaining)); err != nil {
+      return err
+    }
+  }
+}
@@ -0,0 +1,382 @@
+package app
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "sort"
+  "sync"
+  "time"
+)
+
+// Phases of a ShitboxDevice in its status.
+const (
+  phaseRunning   = "Running"
+  phaseSuspended = "Suspended"
+  phaseFailed    = "Failed"
+)
+
+// operatorEnvVars are set by the operator for every watcher and cannot be
+// set in the spec.
+var operatorEnvVars = map[string]bool{
+  "PROFILE":        true,
+  "TUYA_DEVICE_ID": true,
+  "STATE_DIR":      true,
+  "VERDICT_OUTPUT": true,
+  "HEALTH_ADDRESS": true,
+}
+
+// operator runs a watcher process per ShitboxDevice resource, like
+// --all-profiles does per profile.
+type operator struct {
+  cfg        *Config
+  appLog     *slog.Logger
+  kube       *kubeClient
+  executable string
+  outputMu   sync.Mutex
+
+  mu       sync.Mutex
+  watchers map[string]*deviceWatcher
+}
+
+// deviceWatcher is the watcher of one generation of a resource. A spec
+// that cannot be run gets a watcher without a process, so it is reported
+// once and not tried again until the spec changes.
+type deviceWatcher struct {
+  device ShitboxDevice
+  cmd    *exec.Cmd
+  done   chan struct{}
+  // Set before done is closed.
+  exitCode int
+  stopped  bool
+  status   ShitboxDeviceStatus
+}
+
+func (w *deviceWatcher) exited() bool {
+  select {
+  case <-w.done:
+    return true
+  default:
+    return false
+  }
+}
+
+// runOperator reconciles ShitboxDevice resources into watchers: every
+// resource gets its own `watch` process configured from its spec, which is
+// restarted when the spec changes and stopped when the resource is deleted
+// or suspended. The outcome of every check is written to the resource's
+// status. The resources are listed every --resync, so changes take effect
+// within that time.
+func runOperator(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  fs := flag.NewFlagSet("operator", flag.ContinueOnError)
+  server := fs.String("api-server", "", "Kubernetes API address, e.g. http://127.0.0.1:8001 of `kubectl proxy` (default: in-cluster)")
+  namespace := fs.String("namespace", "", "namespace of the resources (default: the pod's)")
+  allNamespaces := fs.Bool("all-namespaces", false, "watch the resources of all namespaces")
+  resync := fs.Duration("resync", 30*time.Second, "how often to list the resources")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if *resync <= 0 {
+    return fmt.Errorf("--resync must be positive")
+  }
+  kube, err := newKubeClient(*server)
+  if err != nil {
+    return err
+  }
+  switch {
+  case *allNamespaces:
+    *namespace = ""
+  case *namespace == "":
+    *namespace = podNamespace()
+  }
+  executable, err := os.Executable()
+  if err != nil {
+    return err
+  }
+
+  o := &operator{cfg: cfg, appLog: appLog, kube: kube, executable: executable, watchers: map[string]*deviceWatcher{}}
+  appLog.Info("Operator started", "namespace", *namespace, "resync", *resync)
+  stopHealth := serveHealth(ctx, cfg, appLog)
+  defer stopHealth()
+  for {
+    devices, err := kube.listDevices(ctx, *namespace)
+    if err != nil && ctx.Err() == nil {
+      // Keep the watchers running, the API server may be restarting.
+      appLog.Error("Failed to list devices", "error", err)
+    } else if err == nil {
+      o.reconcile(ctx, devices)
+    }
+    if err := sleepContext(ctx, *resync); err != nil {
+      break
+    }
+  }
+
+  o.mu.Lock()
+  watchers := o.watchers
+  o.watchers = map[string]*deviceWatcher{}
+  o.mu.Unlock()
+  var wg sync.WaitGroup
+  for _, w := range watchers {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      o.stop(w)
+    }()
+  }
+  wg.Wait()
+  appLog.Info("Operator stopped")
+  return nil
+}
+
+func (o *operator) reconcile(ctx context.Context, devices []ShitboxDevice) {
+  seen := map[string]bool{}
+  for _, device := range devices {
+    key := device.key()
+    seen[key] = true
+    o.mu.Lock()
+    w := o.watchers[key]
+    o.mu.Unlock()
+
+    changed := w == nil || w.device.Metadata.Generation != device.Metadata.Generation
+    if w != nil && changed {
+      o.appLog.Info("Device spec changed, restarting its watcher", "resource", key)
+      o.stop(w)
+    }
+    if !changed {
+      // A watcher that crashed is restarted, a configuration error has to
+      // be fixed in the spec first.
+      if !w.exited() || w.cmd == nil || w.exitCode == exitConfigError || device.Spec.Suspend {
+        continue
+      }
+      o.appLog.Info("Restarting watcher", "resource", key)
+    }
+    w = o.start(ctx, device)
+    o.mu.Lock()
+    o.watchers[key] = w
+    o.mu.Unlock()
+  }
+
+  o.mu.Lock()
+  var deleted []*deviceWatcher
+  for key, w := range o.watchers {
+    if !seen[key] {
+      deleted = append(deleted, w)
+      delete(o.watchers, key)
+    }
+  }
+  o.mu.Unlock()
+  for _, w := range deleted {
+    o.appLog.Info("Device deleted, stopping its watcher", "resource", w.device.key())
+    o.stop(w)
+  }
+}
+
+// deviceEnv is the environment of a resource's watcher on top of the
+// operator's own.
+func (o *operator) deviceEnv(device ShitboxDevice) ([]string, error) {
+  spec := device.Spec
+  if spec.DeviceID == "" {
+    return nil, fmt.Errorf("spec.deviceId is required")
+  }
+  keys := make([]string, 0, len(spec.Env))
+  for key := range spec.Env {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  var env []string
+  for _, key := range keys {
+    known := false
+    for _, name := range configEnvVars {
+      if name == key {
+        known = true
+        break
+      }
+    }
+    switch {
+    case !known:
+      return nil, fmt.Errorf("spec.env: unknown setting %s", key)
+    case operatorEnvVars[key]:
+      return nil, fmt.Errorf("spec.env: %s is set by the operator", key)
+    }
+    env = append(env, key+"="+spec.Env[key])
+  }
+  // Later entries win, so the fields override spec.env.
+  for _, setting := range [][2]string{
+    {"DEVICE_PRESET", spec.Preset},
+    {"POLL_INTERVAL", spec.PollInterval},
+    {"DETECT_RULE", spec.DetectRule},
+    {"VERIFY_RULE", spec.VerifyRule},
+    {"OCCUPIED_RULE", spec.OccupiedRule},
+    {"ACTION_QUIET_HOURS", spec.QuietHours},
+  } {
+    if setting[1] != "" {
+      env = append(env, setting[0]+"="+setting[1])
+    }
+  }
+  return append(env,
+    "PROFILE=",
+    "HEALTH_ADDRESS=",
+    "TUYA_DEVICE_ID="+spec.DeviceID,
+    "STATE_DIR="+filepath.Join(o.cfg.StateDir, device.Metadata.Namespace, device.Metadata.Name),
+    // The verdict pipe, see start.
+    "VERDICT_OUTPUT=3",
+  ), nil
+}
+
+// start starts the watcher of a resource, or reports why it cannot run.
+func (o *operator) start(ctx context.Context, device ShitboxDevice) *deviceWatcher {
+  key := device.key()
+  w := &deviceWatcher{device: device, done: make(chan struct{}), exitCode: exitConfigError}
+  w.status = ShitboxDeviceStatus{ObservedGeneration: device.Metadata.Generation}
+  fail := func(err error) *deviceWatcher {
+    o.appLog.Error("Failed to start watcher", "resource", key, "error", err)
+    w.status.Phase = phaseFailed
+    w.status.Message = err.Error()
+    close(w.done)
+    o.report(ctx, w)
+    return w
+  }
+
+  if device.Spec.Suspend {
+    w.status.Phase = phaseSuspended
+    close(w.done)
+    o.report(ctx, w)
+    return w
+  }
+  env, err := o.deviceEnv(device)
+  if err != nil {
+    return fail(err)
+  }
+
+  // The watcher writes a verdict per check to fd 3, the first of
+  // ExtraFiles.
+  verdicts, verdictWriter, err := os.Pipe()
+  if err != nil {
+    return fail(err)
+  }
+  cmd := exec.Command(o.executable, "watch")
+  cmd.Env = append(os.Environ(), env...)
+  cmd.ExtraFiles = []*os.File{verdictWriter}
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    verdicts.Close()
+    verdictWriter.Close()
+    return fail(err)
+  }
+  stderr, err := cmd.StderrPipe()
+  if err != nil {
+    verdicts.Close()
+    verdictWriter.Close()
+    return fail(err)
+  }
+  err = cmd.Start()
+  verdictWriter.Close()
+  if err != nil {
+    verdicts.Close()
+    return fail(err)
+  }
+  w.cmd = cmd
+  w.exitCode = 0
+  o.appLog.Info("Started watcher", "resource", key, "device_id", device.Spec.DeviceID, "pid", cmd.Process.Pid)
+  o.mu.Lock()
+  w.status.Phase = phaseRunning
+  o.mu.Unlock()
+  o.report(ctx, w)
+
+  var output sync.WaitGroup
+  output.Add(3)
+  go func() {
+    defer output.Done()
+    copyPrefixed(stdout, os.Stdout, "resource", key, &o.outputMu)
+  }()
+  go func() {
+    defer output.Done()
+    copyPrefixed(stderr, os.Stderr, "resource", key, &o.outputMu)
+  }()
+  go func() {
+    defer output.Done()
+    defer verdicts.Close()
+    scanner := bufio.NewScanner(verdicts)
+    for scanner.Scan() {
+      var verdict Verdict
+      if err := json.Unmarshal(scanner.Bytes(), &verdict); err != nil {
+        continue
+      }
+      o.mu.Lock()
+      w.status.Healthy = verdict.Healthy
+      w.status.LastCheck = time.Now().UTC().Format(time.RFC3339)
+      w.status.LastAction = verdict.Action
+      w.status.Reason = verdict.Reason
+      w.status.Message = verdict.Error
+      o.mu.Unlock()
+      o.report(ctx, w)
+    }
+  }()
+
+  go func() {
+    // The output has to be read to the end before Wait closes the pipes.
+    output.Wait()
+    err := cmd.Wait()
+    code := 0
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) {
+      code = exitErr.ExitCode()
+    } else if err != nil {
+      code = 1
+    }
+    o.mu.Lock()
+    w.exitCode = code
+    stopped := w.stopped
+    if !stopped {
+      w.status.Phase = phaseFailed
+      w.status.Message = "watcher exited"
+      if err != nil {
+        w.status.Message += ": " + err.Error()
+      }
+      if code == exitConfigError {
+        w.status.Message += ", check the spec and the operator's log"
+      }
+    }
+    o.mu.Unlock()
+    close(w.done)
+    if !stopped {
+      o.appLog.Error("Watcher exited", "resource", key, "error", err)
+      o.report(ctx, w)
+    }
+  }()
+  return w
+}
+
+// stop shuts a watcher down and waits for it, which includes finishing a
+// reset sequence it has started.
+func (o *operator) stop(w *deviceWatcher) {
+  o.mu.Lock()
+  w.stopped = true
+  o.mu.Unlock()
+  if w.cmd != nil && !w.exited() {
+    if err := w.cmd.Process.Signal(shutdownSignals[len(shutdownSignals)-1]); err != nil {
+      w.cmd.Process.Kill()
+    }
+  }
+  <-w.done
+}
+
+// report writes a watcher's status to its resource.
+func (o *operator) report(ctx context.Context, w *deviceWatcher) {
+  if ctx.Err() != nil {
+    return
+  }
+  o.mu.Lock()
+  status := w.status
+  o.mu.Unlock()
+  if err := o.kube.updateDeviceStatus(ctx, w.device, status); err != nil {
+    o.appLog.Warn("Failed to report device status", "error", err)
+  }
+}
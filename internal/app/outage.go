@@ -0,0 +1,117 @@
+package app
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "time"
+)
+
+const historyOffline = "offline"
+
+// Outage is the offline period the device is in, kept until it reports
+// again and the period is recorded in the history.
+type Outage struct {
+  DeviceID string    `json:"device_id"`
+  Since    time.Time `json:"since"`
+}
+
+func outagePath(cfg *Config) (string, error) {
+  return statePath(cfg, "outage.json")
+}
+
+func loadOutage(cfg *Config) (*Outage, error) {
+  path, err := outagePath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  outage := &Outage{}
+  if err := json.Unmarshal(data, outage); err != nil {
+    return nil, err
+  }
+  return outage, nil
+}
+
+func saveOutage(cfg *Config, outage *Outage) error {
+  path, err := outagePath(cfg)
+  if err != nil {
+    return err
+  }
+  if outage == nil {
+    err := os.Remove(path)
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  return saveStateFile(path, outage)
+}
+
+// offlineSince is since when an offline device is known to be offline: the
+// last time it reported to the cloud or, when Tuya does not say, the first
+// check that saw it offline. It is zero for the first such check.
+func offlineSince(cfg *Config, lastSeen time.Time) (time.Time, error) {
+  if !lastSeen.IsZero() {
+    return lastSeen, nil
+  }
+  outage, err := loadOutage(cfg)
+  if err != nil || outage == nil || outage.DeviceID != cfg.DeviceID {
+    return time.Time{}, err
+  }
+  return outage.Since, nil
+}
+
+// trackOutage records offline periods in the history once the device is back
+// online, for reports. The period starts when the device last reported to
+// the cloud, or at the first check that saw it offline.
+func trackOutage(cfg *Config, appLog *slog.Logger, result *CheckResult, checkErr error) {
+  if cfg.DataStorage == dataStorageNone || result.Standby {
+    return
+  }
+  // Without the device status it is unknown whether the device is online.
+  if checkErr != nil && len(result.Status) == 0 {
+    return
+  }
+
+  outage, err := loadOutage(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load outage state", "error", err)
+    return
+  }
+
+  switch {
+  case !result.Online && outage == nil:
+    since := result.offlineSince
+    if since.IsZero() {
+      since = result.Time
+    }
+    if err := saveOutage(cfg, &Outage{DeviceID: result.DeviceID, Since: since}); err != nil {
+      appLog.Warn("Failed to save outage state", "error", err)
+    }
+  case result.Online && outage != nil:
+    until := result.Time
+    entry := HistoryEntry{
+      Time:     outage.Since,
+      DeviceID: outage.DeviceID,
+      Kind:     historyOffline,
+      Message:  fmt.Sprintf("offline for %s", until.Sub(outage.Since).Truncate(time.Minute)),
+      Until:    &until,
+    }
+    if _, err := appendHistory(cfg, entry); err != nil {
+      appLog.Warn("Failed to record history", "error", err)
+      return
+    }
+    if err := saveOutage(cfg, nil); err != nil {
+      appLog.Warn("Failed to save outage state", "error", err)
+    }
+  }
+}
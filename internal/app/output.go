@@ -0,0 +1,181 @@
+package app
+
+import (
+  "encoding/json"
+  "fmt"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/actions"
+  "shitbox-fixer/pkg/detect"
+)
+
+const (
+  outputText  = "text"
+  outputJSON  = "json"
+  outputTable = "table"
+)
+
+const (
+  actionNone            = "none"
+  actionReset           = "reset"
+  actionResetFailed     = "reset_failed"
+  actionResetSuppressed = "reset_suppressed"
+  actionResetDeferred   = "reset_deferred"
+  actionResetStandby    = "reset_standby"
+  actionResetOverridden = "reset_overridden"
+  actionNotified        = "notified"
+)
+
+type CheckResult struct {
+  Time       time.Time              `json:"time"`
+  DeviceID   string                 `json:"device_id"`
+  DeviceName string                 `json:"device_name,omitempty"`
+  Online     bool                   `json:"online"`
+  Status     map[string]interface{} `json:"status"`
+  Logs       []interface{}          `json:"logs,omitempty"`
+  NeedsReset bool                   `json:"needs_reset"`
+  Reason     string                 `json:"reason,omitempty"`
+  Score      float64                `json:"score"`
+  Inputs     []detect.Contribution  `json:"inputs,omitempty"`
+  Action     string                 `json:"action"`
+  DrawerFull bool                   `json:"drawer_full,omitempty"`
+  Standby    bool                   `json:"standby,omitempty"`
+  Overrides  []Override             `json:"overrides,omitempty"`
+  Commands   []actions.Command      `json:"commands,omitempty"`
+  Error      string                 `json:"error,omitempty"`
+
+  // offlineSince is when an offline device last reported to the cloud.
+  offlineSince time.Time
+}
+
+func validateOutput(output string) error {
+  if output != outputText && output != outputJSON && output != outputTable {
+    return fmt.Errorf("%s (valid: text, json, table)", output)
+  }
+  return nil
+}
+
+func printJSON(v interface{}) error {
+  enc := json.NewEncoder(os.Stdout)
+  return enc.Encode(v)
+}
+
+// Verdict is a one-line summary of a check for wrapper scripts, written to
+// VERDICT_OUTPUT independently of OUTPUT.
+type Verdict struct {
+  DeviceID   string  `json:"device_id"`
+  Healthy    bool    `json:"healthy"`
+  Action     string  `json:"action"`
+  Reason     string  `json:"reason,omitempty"`
+  Score      float64 `json:"score"`
+  DurationMS int64   `json:"duration_ms"`
+  ExitCode   int     `json:"exit_code"`
+  Error      string  `json:"error,omitempty"`
+}
+
+// openVerdictOutput resolves VERDICT_OUTPUT: stdout, stderr or the number of
+// a file descriptor opened by the caller, e.g. 3 for `3>verdict.json`.
+func openVerdictOutput(s string) (*os.File, error) {
+  switch s {
+  case "":
+    return nil, nil
+  case "stdout":
+    return os.Stdout, nil
+  case "stderr":
+    return os.Stderr, nil
+  }
+  fd, err := strconv.Atoi(s)
+  if err != nil || fd < 0 {
+    return nil, fmt.Errorf("%s (valid: stdout, stderr or a file descriptor number)", s)
+  }
+  f := os.NewFile(uintptr(fd), "verdict")
+  if f == nil {
+    return nil, fmt.Errorf("file descriptor %d is not open", fd)
+  }
+  if _, err := f.Stat(); err != nil {
+    return nil, fmt.Errorf("file descriptor %d is not open", fd)
+  }
+  return f, nil
+}
+
+func printVerdict(cfg *Config, result *CheckResult, err error) {
+  if cfg.VerdictOutput == nil {
+    return
+  }
+  verdict := Verdict{
+    DeviceID:   result.DeviceID,
+    Healthy:    err == nil && !result.NeedsReset,
+    Action:     result.Action,
+    Reason:     result.Reason,
+    Score:      result.Score,
+    DurationMS: time.Since(result.Time).Milliseconds(),
+    ExitCode:   checkExitCode(cfg, result, err),
+  }
+  if err != nil {
+    verdict.Error = err.Error()
+  }
+  _ = json.NewEncoder(cfg.VerdictOutput).Encode(verdict)
+}
+
+func printCheckResult(result *CheckResult, err error) {
+  if err != nil {
+    result.Error = err.Error()
+  }
+  _ = printJSON(result)
+}
+
+func statusTable(cfg *Config, status map[string]interface{}) *Table {
+  codes := make([]string, 0, len(status))
+  for code := range status {
+    codes = append(codes, code)
+  }
+  sort.Strings(codes)
+
+  table := newTable(trHeaders(cfg, "CODE", "NAME", "VALUE", "TYPE")...)
+  for _, code := range codes {
+    value := status[code]
+    shown := fmt.Sprint(value)
+    if code == "fault" {
+      if names := detect.DecodeFaults(cfg.Preset.FaultNames, value); len(names) > 0 {
+        shown += " (" + strings.Join(names, ", ") + ")"
+      }
+    }
+    table.AddRow(code, cfg.Preset.DPNames[code], shown, fmt.Sprintf("%T", value))
+  }
+  return table
+}
+
+func printCheckTable(cfg *Config, result *CheckResult, err error) {
+  color := useColor()
+  _ = statusTable(cfg, result.Status).Render(os.Stdout, color)
+  fmt.Println()
+
+  summary := newTable(trHeaders(cfg, "DEVICE", "ONLINE", "SCORE", "NEEDS RESET", "REASON", "ACTION")...)
+  summary.AddRow(result.DeviceID, fmt.Sprint(result.Online), detect.FormatScore(result.Score), fmt.Sprint(result.NeedsReset), result.Reason, result.Action)
+  summary.SetColor(1, boolColor(result.Online))
+  summary.SetColor(3, boolColor(!result.NeedsReset))
+  switch {
+  case err != nil:
+    summary.SetColor(5, colorRed)
+  case result.Action == actionNone:
+    summary.SetColor(5, colorGreen)
+  default:
+    summary.SetColor(5, historyKindColor(result.Action))
+  }
+  _ = summary.Render(os.Stdout, color)
+
+  if len(result.Overrides) > 0 {
+    fmt.Println()
+  }
+  for _, o := range result.Overrides {
+    fmt.Print(tr(cfg, "Manual override: %s %s", o.Kind, describeUntil(cfg, o)))
+    if o.Note != "" {
+      fmt.Printf(" (%s)", o.Note)
+    }
+    fmt.Println()
+  }
+}
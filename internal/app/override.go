@@ -0,0 +1,266 @@
+package app
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "os"
+  "sort"
+  "time"
+)
+
+// Manual override kinds.
+const (
+  overrideNeverReset = "never-reset"
+  overrideOfflineOK  = "offline-ok"
+)
+
+// Override pins a device to a manual decision, e.g. no resets while it is
+// being repaired. Overrides without Until stay until they are cleared.
+type Override struct {
+  Kind    string    `json:"kind"`
+  Until   time.Time `json:"until,omitzero"`
+  Note    string    `json:"note,omitempty"`
+  Created time.Time `json:"created"`
+}
+
+func (o Override) active(now time.Time) bool {
+  return o.Until.IsZero() || now.Before(o.Until)
+}
+
+// overrideState holds the overrides per device ID.
+type overrideState map[string][]Override
+
+func overridePath(cfg *Config) (string, error) {
+  return statePath(cfg, "overrides.json")
+}
+
+func loadOverrides(cfg *Config) (overrideState, error) {
+  path, err := overridePath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return overrideState{}, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  state := overrideState{}
+  if err := json.Unmarshal(data, &state); err != nil {
+    return nil, err
+  }
+  return state, nil
+}
+
+// saveOverrides drops expired overrides and writes the rest.
+func saveOverrides(cfg *Config, state overrideState) error {
+  now := time.Now()
+  for deviceID, overrides := range state {
+    kept := overrides[:0]
+    for _, o := range overrides {
+      if o.active(now) {
+        kept = append(kept, o)
+      }
+    }
+    if len(kept) == 0 {
+      delete(state, deviceID)
+    } else {
+      state[deviceID] = kept
+    }
+  }
+
+  path, err := overridePath(cfg)
+  if err != nil {
+    return err
+  }
+  return saveStateFile(path, state)
+}
+
+// activeOverrides returns the overrides of the device that have not expired.
+func activeOverrides(cfg *Config, deviceID string) ([]Override, error) {
+  state, err := loadOverrides(cfg)
+  if err != nil {
+    return nil, err
+  }
+  var active []Override
+  now := time.Now()
+  for _, o := range state[deviceID] {
+    if o.active(now) {
+      active = append(active, o)
+    }
+  }
+  return active, nil
+}
+
+func hasOverride(overrides []Override, kind string) bool {
+  for _, o := range overrides {
+    if o.Kind == kind {
+      return true
+    }
+  }
+  return false
+}
+
+// parseUntil accepts a date or time in TIMEZONE (2006-01-02, 2006-01-02
+// 15:04, RFC 3339) or a duration from now such as 12h or 3d.
+func parseUntil(cfg *Config, s string) (time.Time, error) {
+  if d, err := parseSince(s); err == nil {
+    return time.Now().Add(d), nil
+  }
+  if t, err := time.Parse(time.RFC3339, s); err == nil {
+    return t, nil
+  }
+  for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+    if t, err := time.ParseInLocation(layout, s, cfg.TimeFormat.Location); err == nil {
+      return t, nil
+    }
+  }
+  return time.Time{}, fmt.Errorf("invalid time %q (use e.g. 2026-12-24, \"2026-12-24 18:00\" or 3d)", s)
+}
+
+func runOverride(cfg *Config, args []string) error {
+  sub := "list"
+  if len(args) > 0 {
+    sub, args = args[0], args[1:]
+  }
+
+  fs := flag.NewFlagSet("override "+sub, flag.ContinueOnError)
+  deviceID := fs.String("device", cfg.DeviceID, "device to pin")
+
+  switch sub {
+  case "list":
+    fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text, json or table")
+    if err := fs.Parse(args); err != nil {
+      return err
+    }
+    if err := validateOutput(cfg.Output); err != nil {
+      return fmt.Errorf("invalid --output: %w", err)
+    }
+    return listOverrides(cfg)
+
+  case "set":
+    until := fs.String("until", "", "expiry, e.g. 2026-12-24 or 3d (default: until cleared)")
+    note := fs.String("note", "", "why the override was set")
+    if len(args) == 0 {
+      return fmt.Errorf("usage: override set %s|%s [--until time] [--note text]", overrideNeverReset, overrideOfflineOK)
+    }
+    kind := args[0]
+    if kind != overrideNeverReset && kind != overrideOfflineOK {
+      return fmt.Errorf("unknown override: %s (valid: %s, %s)", kind, overrideNeverReset, overrideOfflineOK)
+    }
+    if err := fs.Parse(args[1:]); err != nil {
+      return err
+    }
+    o := Override{Kind: kind, Note: *note, Created: time.Now()}
+    if *until != "" {
+      t, err := parseUntil(cfg, *until)
+      if err != nil {
+        return err
+      }
+      if !t.After(time.Now()) {
+        return fmt.Errorf("--until %s is in the past", *until)
+      }
+      o.Until = t
+    }
+
+    state, err := loadOverrides(cfg)
+    if err != nil {
+      return err
+    }
+    overrides := []Override{}
+    for _, existing := range state[*deviceID] {
+      if existing.Kind != kind {
+        overrides = append(overrides, existing)
+      }
+    }
+    state[*deviceID] = append(overrides, o)
+    if err := saveOverrides(cfg, state); err != nil {
+      return err
+    }
+    fmt.Printf("Set %s on %s %s\n", kind, *deviceID, describeUntil(cfg, o))
+    return nil
+
+  case "clear":
+    kind := ""
+    if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+      kind, args = args[0], args[1:]
+    }
+    if err := fs.Parse(args); err != nil {
+      return err
+    }
+    state, err := loadOverrides(cfg)
+    if err != nil {
+      return err
+    }
+    overrides := []Override{}
+    for _, existing := range state[*deviceID] {
+      if kind != "" && existing.Kind != kind {
+        overrides = append(overrides, existing)
+      }
+    }
+    cleared := len(state[*deviceID]) - len(overrides)
+    state[*deviceID] = overrides
+    if err := saveOverrides(cfg, state); err != nil {
+      return err
+    }
+    fmt.Printf("Cleared %d override(s) on %s\n", cleared, *deviceID)
+    return nil
+  }
+
+  return fmt.Errorf("unknown override command: %s (valid: list, set, clear)", sub)
+}
+
+func describeUntil(cfg *Config, o Override) string {
+  if o.Until.IsZero() {
+    return "until cleared"
+  }
+  return "until " + cfg.TimeFormat.Format(o.Until)
+}
+
+func listOverrides(cfg *Config) error {
+  state, err := loadOverrides(cfg)
+  if err != nil {
+    return err
+  }
+  now := time.Now()
+  for deviceID, overrides := range state {
+    active := []Override{}
+    for _, o := range overrides {
+      if o.active(now) {
+        active = append(active, o)
+      }
+    }
+    state[deviceID] = active
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(state)
+  }
+
+  deviceIDs := make([]string, 0, len(state))
+  for deviceID := range state {
+    deviceIDs = append(deviceIDs, deviceID)
+  }
+  sort.Strings(deviceIDs)
+
+  table := newTable("DEVICE", "OVERRIDE", "UNTIL", "NOTE")
+  rows := 0
+  for _, deviceID := range deviceIDs {
+    for _, o := range state[deviceID] {
+      until := "cleared"
+      if !o.Until.IsZero() {
+        until = cfg.TimeFormat.Format(o.Until)
+      }
+      table.AddRow(deviceID, o.Kind, until, o.Note)
+      rows++
+    }
+  }
+  if rows == 0 {
+    fmt.Println("No manual overrides set")
+    return nil
+  }
+  return table.Render(os.Stdout, useColor())
+}
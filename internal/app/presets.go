@@ -0,0 +1,127 @@
+package app
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/actions"
+)
+
+type Preset struct {
+  Name           string
+  Description    string
+  ResetOnOffline bool
+  // ProbeCode is a DP that can safely be re-sent with its current value to
+  // test whether the device accepts commands.
+  ProbeCode   string
+  StuckValues []string
+  // CleanValues are log values that mark a clean cycle, for stats.
+  CleanValues []string
+  // VisitCodes are DP codes the device reports once per cat visit.
+  VisitCodes    []string
+  ResetSequence []actions.Step
+  // VerifyRule decides whether a reset worked, defaults to device.online.
+  VerifyRule string
+  // DrawerFullRule holds while the waste drawer is full. It only notifies,
+  // a reset does not empty the drawer.
+  DrawerFullRule string
+  DPNames        map[string]string
+  // FaultNames names the bits of the fault DP's bitmap, bit 0 first, for
+  // devices whose manufacturer documents them.
+  FaultNames map[int]string
+}
+
+// mspDPNames names the DP codes of Tuya's standard instruction set for cat
+// toilets (category msp). Devices with vendor-specific DPs show the bare
+// codes.
+var mspDPNames = map[string]string{
+  "switch":              "Power",
+  "manual_clean":        "Manual clean",
+  "auto_clean":          "Auto clean",
+  "delay_clean_time":    "Clean delay",
+  "sleep":               "Sleep mode",
+  "deodorization":       "Deodorization",
+  "cat_weight":          "Cat weight",
+  "excretion_times_day": "Visits today",
+  "excretion_time_day":  "Time in box today",
+  "fault":               "Fault",
+  "full_fault_alarm":    "Drawer full",
+}
+
+// The presets are not per model: both use the standard msp DP codes and
+// differ only in whether the box can be power-cycled remotely. The meaning
+// of the fault bits is up to the manufacturer, so no preset names them.
+var presets = map[string]Preset{
+  "generic": {
+    Name:           "generic",
+    Description:    "Tuya cat toilet (msp) with power switch, power-cycles and starts a manual clean on Clean_Pause",
+    ResetOnOffline: true,
+    ProbeCode:      "switch",
+    StuckValues:    []string{"Clean_Pause"},
+    CleanValues:    []string{"cleaning"},
+    VisitCodes:     []string{"cat_weight"},
+    ResetSequence: []actions.Step{
+      {Code: "switch", Value: false, Wait: 1 * time.Second},
+      {Code: "switch", Value: true, Wait: 2 * time.Second},
+      {Code: "manual_clean", Value: true},
+    },
+    DrawerFullRule: `status["full_fault_alarm"] == true`,
+    DPNames:        mspDPNames,
+  },
+  "clean-only": {
+    Name:           "clean-only",
+    Description:    "Tuya cat toilet (msp) without a remote power switch, only restarts the clean cycle on Clean_Pause",
+    ResetOnOffline: false,
+    StuckValues:    []string{"Clean_Pause"},
+    CleanValues:    []string{"cleaning"},
+    VisitCodes:     []string{"cat_weight"},
+    ResetSequence: []actions.Step{
+      {Code: "manual_clean", Value: true},
+    },
+    DrawerFullRule: `status["full_fault_alarm"] == true`,
+    DPNames:        mspDPNames,
+  },
+}
+
+func presetNames() []string {
+  names := make([]string, 0, len(presets))
+  for name := range presets {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+func printPresets() {
+  for _, name := range presetNames() {
+    preset := presets[name]
+    fmt.Printf("%-12s %s\n", preset.Name, preset.Description)
+    fmt.Printf("%-12s stuck values: %s\n", "", strings.Join(preset.StuckValues, ", "))
+    fmt.Printf("%-12s clean values: %s\n", "", strings.Join(preset.CleanValues, ", "))
+    fmt.Printf("%-12s visit codes: %s\n", "", strings.Join(preset.VisitCodes, ", "))
+    if preset.DrawerFullRule != "" {
+      fmt.Printf("%-12s drawer full: %s\n", "", preset.DrawerFullRule)
+    }
+    if len(preset.FaultNames) > 0 {
+      bits := make([]int, 0, len(preset.FaultNames))
+      for bit := range preset.FaultNames {
+        bits = append(bits, bit)
+      }
+      sort.Ints(bits)
+      faults := make([]string, 0, len(bits))
+      for _, bit := range bits {
+        faults = append(faults, fmt.Sprintf("%d=%s", bit, preset.FaultNames[bit]))
+      }
+      fmt.Printf("%-12s faults: %s\n", "", strings.Join(faults, ", "))
+    }
+  }
+}
+
+func (p Preset) dpLabel(code string) string {
+  if name, ok := p.DPNames[code]; ok {
+    return fmt.Sprintf("%s (%s)", code, name)
+  }
+  return code
+}
@@ -0,0 +1,218 @@
+package app
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "os/exec"
+  "os/signal"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// isProfilesFlag reports whether a command line argument is the boolean
+// flag name, e.g. --all-profiles, which the commands run per profile must
+// not see again.
+func isProfilesFlag(arg, name string) bool {
+  arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+  return arg == name || arg == name+"=true"
+}
+
+// configSetting looks up a setting for --all-profiles, which runs before
+// the config is loaded: from the environment, else the top level of the
+// config files.
+func configSetting(configPaths []string, key string) (string, error) {
+  if value, ok := os.LookupEnv(key); ok {
+    return value, nil
+  }
+  values, err := parseConfigFiles(configPaths, "")
+  if err != nil {
+    return "", err
+  }
+  return values[key], nil
+}
+
+// copyPrefixed copies the output of a child process line by line, marked
+// with the name of its profile or resource: in front of text lines, and as
+// the first attribute of JSON log lines so they stay JSON. mu keeps the
+// lines of the children from interleaving.
+func copyPrefixed(r io.Reader, w io.Writer, attr, name string, mu *sync.Mutex) {
+  field, _ := json.Marshal(attr)
+  value, _ := json.Marshal(name)
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    line := scanner.Text()
+    mu.Lock()
+    if rest, ok := strings.CutPrefix(line, "{"); ok && rest != "}" && strings.HasSuffix(rest, "}") {
+      fmt.Fprintf(w, "{%s:%s,%s\n", field, value, rest)
+    } else {
+      fmt.Fprintf(w, "[%s] %s\n", name, line)
+    }
+    mu.Unlock()
+  }
+}
+
+// runAllProfiles runs the command once per profile of the config file, e.g.
+// one watcher per device with its own preset, rules and notifications. Each
+// runs in its own process, as the fixer keeps its configuration in the
+// environment; their output is prefixed with the profile name. Watchers
+// all run at the same time, other commands up to WORKERS at a time, and
+// TUYA_RATE_LIMIT is split between the processes running at once. Shutdown
+// signals are passed on, and the highest exit code is returned.
+func runAllProfiles(configPaths []string, globalArgs, commandArgs []string) (int, error) {
+  if os.Getenv("PROFILE") != "" {
+    return 0, fmt.Errorf("--all-profiles cannot be combined with PROFILE")
+  }
+  configPath := yamlConfigFile(configPaths)
+  if configPath == "" {
+    return 0, fmt.Errorf("--all-profiles needs a YAML config file with profiles")
+  }
+  names, err := configProfiles(configPath)
+  if err != nil {
+    return 0, err
+  }
+  executable, err := os.Executable()
+  if err != nil {
+    return 0, err
+  }
+
+  workers := len(names)
+  if len(commandArgs) == 0 || (commandArgs[0] != "watch" && commandArgs[0] != "serve") {
+    s, err := configSetting(configPaths, "WORKERS")
+    if err != nil {
+      return 0, err
+    }
+    n, err := parseWorkers(s)
+    if err != nil {
+      return 0, err
+    }
+    workers = min(workers, n)
+  }
+  var env []string
+  s, err := configSetting(configPaths, "TUYA_RATE_LIMIT")
+  if err != nil {
+    return 0, err
+  }
+  if limit, err := parseRateLimit(s); err != nil {
+    return 0, err
+  } else if limit > 0 {
+    env = append(env, "TUYA_RATE_LIMIT="+strconv.FormatFloat(limit/float64(workers), 'g', -1, 64))
+  }
+  if noColor {
+    env = append(env, "NO_COLOR=1")
+  }
+
+  var args []string
+  for _, arg := range globalArgs {
+    if !isProfilesFlag(arg, "all-profiles") {
+      args = append(args, arg)
+    }
+  }
+  // The children find the same config files, or get the same --config.
+  args = append(args, commandArgs...)
+
+  // The running processes, for passing on signals.
+  var mu sync.Mutex
+  running := map[*exec.Cmd]bool{}
+  stopping := false
+  signals := make(chan os.Signal, 2)
+  signal.Notify(signals, shutdownSignals...)
+  defer signal.Stop(signals)
+  go func() {
+    for sig := range signals {
+      mu.Lock()
+      stopping = true
+      for cmd := range running {
+        if err := cmd.Process.Signal(sig); err != nil {
+          cmd.Process.Kill()
+        }
+      }
+      mu.Unlock()
+    }
+  }()
+
+  var outputMu sync.Mutex
+  prefixOutput := func(r io.Reader, w io.Writer, name string, done *sync.WaitGroup) {
+    defer done.Done()
+    copyPrefixed(r, w, "profile", name, &outputMu)
+  }
+
+  // Runs one profile to the end, its exit code or an error when it could
+  // not be started.
+  runProfile := func(name string) (int, error) {
+    cmd := exec.Command(executable, args...)
+    cmd.Env = append(append(os.Environ(), "PROFILE="+name), env...)
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+      return 0, err
+    }
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+      return 0, err
+    }
+    mu.Lock()
+    if stopping {
+      mu.Unlock()
+      return 0, nil
+    }
+    err = cmd.Start()
+    if err == nil {
+      running[cmd] = true
+    }
+    mu.Unlock()
+    if err != nil {
+      return 0, err
+    }
+    slog.Info("Started profile", "profile", name, "pid", cmd.Process.Pid)
+
+    var output sync.WaitGroup
+    output.Add(2)
+    go prefixOutput(stdout, os.Stdout, name, &output)
+    go prefixOutput(stderr, os.Stderr, name, &output)
+    // The output has to be read to the end before Wait closes the pipes.
+    output.Wait()
+    err = cmd.Wait()
+    mu.Lock()
+    delete(running, cmd)
+    mu.Unlock()
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) {
+      return exitErr.ExitCode(), nil
+    }
+    return 0, err
+  }
+
+  // A profile that exits is reported right away, the others keep running.
+  codes := make([]int, len(names))
+  sem := make(chan struct{}, workers)
+  var wg sync.WaitGroup
+  for i, name := range names {
+    sem <- struct{}{}
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      defer func() { <-sem }()
+
+      code, err := runProfile(name)
+      switch {
+      case err != nil:
+        codes[i] = 1
+        slog.Error("Profile failed", "profile", name, "error", err)
+      case code != 0:
+        codes[i] = code
+        slog.Warn("Profile exited", "profile", name, "code", code)
+      }
+    }()
+  }
+  wg.Wait()
+  code := 0
+  for _, c := range codes {
+    code = max(code, c)
+  }
+  return code, nil
+}
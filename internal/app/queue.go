@@ -0,0 +1,61 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "net/http"
+  "net/url"
+  "os"
+  "time"
+
+  "shitbox-fixer/pkg/actions"
+)
+
+// deviceCommands queues the commands of all devices this process manages.
+var deviceCommands = actions.NewQueue()
+
+// runQueue lists the commands the running daemon has queued. Without a
+// daemon nothing can be queued, as the CLI runs its own commands directly.
+func runQueue(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("queue", flag.ContinueOnError)
+  deviceID := fs.String("device", "", "only list the commands of this device")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+
+  path := "/api/queue"
+  if *deviceID != "" {
+    path += "?device_id=" + url.QueryEscape(*deviceID)
+  }
+  var jobs []actions.Job
+  err := daemonRequest(ctx, cfg, http.MethodGet, path, nil, &jobs)
+  if errors.Is(err, errNoDaemon) {
+    return fmt.Errorf("no running daemon for %s, start `watch` or `serve` first", cfg.DeviceID)
+  }
+  if err != nil {
+    return err
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(jobs)
+  }
+  if len(jobs) == 0 {
+    fmt.Println("No commands queued")
+    return nil
+  }
+  table := newTable("ID", "DEVICE", "SOURCE", "STATE", "ENQUEUED")
+  for _, job := range jobs {
+    state := "pending"
+    if !job.Started.IsZero() {
+      state = "running for " + time.Since(job.Started).Truncate(time.Second).String()
+    }
+    table.AddRow(fmt.Sprint(job.ID), job.DeviceID, job.Source, state, job.Enqueued.Local().Format(time.DateTime))
+  }
+  return table.Render(os.Stdout, useColor())
+}
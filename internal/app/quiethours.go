@@ -0,0 +1,62 @@
+package app
+
+import (
+  "fmt"
+  "strings"
+  "time"
+)
+
+type clockWindow struct {
+  start time.Duration
+  end   time.Duration
+}
+
+// QuietHours is a set of daily windows such as "22:00-07:00", evaluated in
+// the time zone of the given time. Windows may wrap around midnight.
+type QuietHours []clockWindow
+
+func parseClock(s string) (time.Duration, error) {
+  t, err := time.Parse("15:04", strings.TrimSpace(s))
+  if err != nil {
+    return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+  }
+  return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseQuietHours(s string) (QuietHours, error) {
+  var windows QuietHours
+  for _, part := range strings.Split(s, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+    bounds := strings.SplitN(part, "-", 2)
+    if len(bounds) != 2 {
+      return nil, fmt.Errorf("invalid window %q (expected HH:MM-HH:MM)", part)
+    }
+    start, err := parseClock(bounds[0])
+    if err != nil {
+      return nil, err
+    }
+    end, err := parseClock(bounds[1])
+    if err != nil {
+      return nil, err
+    }
+    windows = append(windows, clockWindow{start: start, end: end})
+  }
+  return windows, nil
+}
+
+func (q QuietHours) Contains(t time.Time) bool {
+  offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+  for _, w := range q {
+    if w.start <= w.end {
+      if offset >= w.start && offset < w.end {
+        return true
+      }
+    } else if offset >= w.start || offset < w.end {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+  "context"
+  "fmt"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// rateLimiter spaces out the Tuya API requests of the whole process to
+// TUYA_RATE_LIMIT per second, however many devices are worked on at once.
+// A nil limiter does not limit.
+type rateLimiter struct {
+  mu       sync.Mutex
+  interval time.Duration
+  next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+  if perSecond <= 0 {
+    return nil
+  }
+  return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until the next request may be sent. Requests get their turn
+// in the order they asked for it.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+  if l == nil {
+    return nil
+  }
+  l.mu.Lock()
+  now := time.Now()
+  at := l.next
+  if at.Before(now) {
+    at = now
+  }
+  l.next = at.Add(l.interval)
+  l.mu.Unlock()
+
+  if wait := at.Sub(now); wait > 0 {
+    return sleepContext(ctx, wait)
+  }
+  return nil
+}
+
+// parseRateLimit parses TUYA_RATE_LIMIT, requests per second; 0 or empty
+// does not limit.
+func parseRateLimit(s string) (float64, error) {
+  if s == "" {
+    return 0, nil
+  }
+  limit, err := strconv.ParseFloat(s, 64)
+  if err != nil || limit < 0 {
+    return 0, fmt.Errorf("invalid TUYA_RATE_LIMIT: %s (expected requests per second, e.g. 5 or 0.5)", s)
+  }
+  return limit, nil
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// detectedRegion is the data center found by --detect-region. It is kept
+// per access ID, so new credentials are not sent to the old data center.
+type detectedRegion struct {
+  AccessID   string    `json:"access_id"`
+  Region     string    `json:"region"`
+  DetectedAt time.Time `json:"detected_at"`
+}
+
+// storedRegion returns the data center detected earlier for accessID, if any.
+func storedRegion(stateDir, accessID string) string {
+  var stored detectedRegion
+  if err := loadStateFile(filepath.Join(stateDir, "region.json"), &stored); err != nil || stored.AccessID != accessID {
+    return ""
+  }
+  if _, ok := regionConfig[stored.Region]; !ok {
+    return ""
+  }
+  return stored.Region
+}
+
+// detectRegion logs in to each data center in turn, starting with first,
+// and returns the one that accepts the credentials and knows deviceID, or
+// any device when deviceID is empty. Each attempt replaces the Tuya
+// client, so the caller has to set it up again for the region it uses.
+func detectRegion(ctx context.Context, first, accessID, accessKey, deviceID string, httpClient *http.Client, logger *slog.Logger) (string, error) {
+  regions := []string{}
+  if _, ok := regionConfig[first]; ok {
+    regions = append(regions, first)
+  }
+  for _, name := range regionNames() {
+    if name != first {
+      regions = append(regions, name)
+    }
+  }
+
+  for _, region := range regions {
+    // A single attempt each: a data center that does not know the cloud
+    // project rejects it right away.
+    initTuya(regionConfig[region].ApiHost, accessID, accessKey, httpClient, 1, logger)
+    err := probeRegion(ctx, deviceID)
+    if err == nil {
+      return region, nil
+    }
+    if ctx.Err() != nil {
+      return "", ctx.Err()
+    }
+    logger.Debug("Data center does not match", "region", region, "error", err)
+  }
+  if deviceID != "" {
+    return "", fmt.Errorf("no data center accepts the credentials and knows device %s (check TUYA_ACCESS_ID, TUYA_ACCESS_KEY and TUYA_DEVICE_ID)", deviceID)
+  }
+  return "", fmt.Errorf("no data center accepts the credentials and lists a device (check TUYA_ACCESS_ID and TUYA_ACCESS_KEY and that the app account is linked)")
+}
+
+func probeRegion(ctx context.Context, deviceID string) error {
+  if _, err := tuya.AccessToken(ctx, true); err != nil {
+    return err
+  }
+  if deviceID != "" {
+    responseCache.Invalidate("status/" + deviceID)
+    _, err := getDeviceStatus(ctx, deviceID)
+    return err
+  }
+  devices, err := getDevices(ctx)
+  if err != nil {
+    return err
+  }
+  if len(devices) == 0 {
+    return fmt.Errorf("no devices")
+  }
+  return nil
+}
+
+// applyDetectedRegion runs --detect-region for the loaded config and stores
+// the result, which later runs use while TUYA_REGION is not set.
+func applyDetectedRegion(ctx context.Context, cfg *Config, appLog *slog.Logger) error {
+  if os.Getenv("TUYA_API_HOST") != "" {
+    return fmt.Errorf("--detect-region cannot be combined with TUYA_API_HOST")
+  }
+  region, err := detectRegion(ctx, cfg.Region, cfg.AccessID, cfg.AccessKey, cfg.DeviceID, newHTTPClient(cfg.HTTPConnectTimeout, cfg.HTTPTimeout, cfg.TuyaProxyURL), appLog)
+  if err != nil {
+    return err
+  }
+  appLog.Info("Detected data center", "region", region)
+  cfg.Region = region
+  cfg.APIHost, cfg.MsgHost = regionConfig[region].ApiHost, regionConfig[region].MsgHost
+
+  path, err := statePath(cfg, "region.json")
+  if err != nil {
+    return err
+  }
+  return saveStateFile(path, detectedRegion{AccessID: cfg.AccessID, Region: region, DetectedAt: time.Now()})
+}
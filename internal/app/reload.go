@@ -0,0 +1,231 @@
+package app
+
+import (
+  "log/slog"
+  "maps"
+  "os"
+  "sort"
+  "strings"
+  "sync/atomic"
+)
+
+// restartEnvVars only take effect after a restart: they identify the
+// device and account, or set up resources that live as long as the process.
+var restartEnvVars = map[string]bool{
+  "PROFILE":                            true,
+  "TUYA_ACCESS_ID":                     true,
+  "TUYA_ACCESS_KEY":                    true,
+  "TUYA_ACCESS_ID_FILE":                true,
+  "TUYA_ACCESS_KEY_FILE":               true,
+  "AGE_IDENTITY_FILE":                  true,
+  "VAULT_ADDR":                         true,
+  "VAULT_PATH":                         true,
+  "VAULT_NAMESPACE":                    true,
+  "VAULT_AUTH":                         true,
+  "VAULT_TOKEN":                        true,
+  "VAULT_TOKEN_FILE":                   true,
+  "VAULT_ROLE_ID":                      true,
+  "VAULT_SECRET_ID":                    true,
+  "VAULT_SECRET_ID_FILE":               true,
+  "TUYA_REGION":                        true,
+  "TUYA_API_HOST":                      true,
+  "TUYA_MSG_HOST":                      true,
+  "TUYA_DEVICE_ID":                     true,
+  "OUTPUT":                             true,
+  "VERDICT_OUTPUT":                     true,
+  "STATE_DIR":                          true,
+  "WATCHDOG_FACTOR":                    true,
+  "SERVE_ADDRESS":                      true,
+  "HEALTH_ADDRESS":                     true,
+  "SERVE_TLS_CERT":                     true,
+  "SERVE_TLS_KEY":                      true,
+  "SERVE_TLS_CLIENT_CA":                true,
+  "API_READ_TOKEN":                     true,
+  "API_READ_TOKEN_FILE":                true,
+  "API_CONTROL_TOKEN":                  true,
+  "API_CONTROL_TOKEN_FILE":             true,
+  "AUDIT_LOG":                          true,
+  "CONTROL_SOCKET":                     true,
+  "OTEL_EXPORTER_OTLP_ENDPOINT":        true,
+  "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": true,
+  "OTEL_EXPORTER_OTLP_PROTOCOL":        true,
+  "OTEL_EXPORTER_OTLP_HEADERS":         true,
+  "OTEL_EXPORTER_OTLP_HEADERS_FILE":    true,
+  "OTEL_SERVICE_NAME":                  true,
+  "INSTANCE_LOCK":                      true,
+  "LEADER_LOCK":                        true,
+  "LEADER_ID":                          true,
+  "LEADER_LEASE":                       true,
+  "HTTP_CONNECT_TIMEOUT":               true,
+  "HTTP_TIMEOUT":                       true,
+  "TUYA_MAX_ATTEMPTS":                  true,
+  "TUYA_RATE_LIMIT":                    true,
+  "TUYA_PROXY_URL":                     true,
+  "TUYA_PROXY_URL_FILE":                true,
+  "DEBUG":                              true,
+  "LOG_LEVEL":                          true,
+  "LOG_FORMAT":                         true,
+  "LOG_OUTPUT":                         true,
+  "SYSLOG_ADDRESS":                     true,
+}
+
+func isSecretEnvVar(env string) bool {
+  for _, secret := range secretEnvVars {
+    if env == secret {
+      return true
+    }
+  }
+  return false
+}
+
+func describeEnvValue(env, value string, set bool) string {
+  switch {
+  case !set:
+    return "(default)"
+  case isSecretEnvVar(env):
+    return "(secret)"
+  default:
+    return value
+  }
+}
+
+// configEnvSnapshot captures the config variables, to diff them on reload.
+func configEnvSnapshot() map[string]string {
+  snapshot := map[string]string{}
+  for _, env := range configEnvVars {
+    if value, ok := os.LookupEnv(env); ok {
+      snapshot[env] = value
+    }
+  }
+  return snapshot
+}
+
+func restoreConfigEnv(snapshot map[string]string) {
+  for _, env := range configEnvVars {
+    if value, ok := snapshot[env]; ok {
+      os.Setenv(env, value)
+    } else {
+      os.Unsetenv(env)
+    }
+  }
+}
+
+// liveConfig is the config of a watcher. A reload publishes a new Config
+// instead of changing the one in use, so the API handlers, the watchdog and
+// a cycle abandoned by it never see a half-applied reload.
+type liveConfig struct {
+  current atomic.Pointer[Config]
+}
+
+func newLiveConfig(cfg *Config) *liveConfig {
+  live := &liveConfig{}
+  live.current.Store(cfg)
+  return live
+}
+
+// Load returns the current config. Callers must not modify it.
+func (c *liveConfig) Load() *Config {
+  return c.current.Load()
+}
+
+// reloadConfig reads the config file again and applies the settings that can
+// change while watching: detection, verification, schedules, notifications
+// and alerts. The Tuya session, vault login and poll loop are kept. An
+// invalid config is logged and leaves the running config untouched.
+func reloadConfig(live *liveConfig, appLog *slog.Logger) {
+  current := live.Load()
+  before, fileEnv := configEnvSnapshot(), maps.Clone(configFileEnv)
+  if err := reloadConfigFiles(); err != nil {
+    appLog.Error("Config reload failed, keeping the current config", "paths", strings.Join(configFilePaths, ","), "error", err)
+    return
+  }
+  next, err := readConfig(current)
+  if err != nil {
+    restoreConfigEnv(before)
+    configFileEnv = fileEnv
+    appLog.Error("Config reload failed, keeping the current config", "paths", strings.Join(configFilePaths, ","), "error", err)
+    return
+  }
+  after := configEnvSnapshot()
+
+  var changed, restart []string
+  for _, env := range configEnvVars {
+    old, hadOld := before[env]
+    value, hasValue := after[env]
+    if old == value && hadOld == hasValue {
+      continue
+    }
+    if restartEnvVars[env] {
+      restart = append(restart, env)
+      continue
+    }
+    changed = append(changed, env)
+    appLog.Info("Config changed", "setting", env, "from", describeEnvValue(env, old, hadOld), "to", describeEnvValue(env, value, hasValue))
+  }
+  if len(restart) > 0 {
+    sort.Strings(restart)
+    appLog.Warn("Config changes need a restart to take effect", "settings", strings.Join(restart, ","))
+  }
+  if len(changed) == 0 {
+    appLog.Info("Config reloaded, nothing changed", "paths", strings.Join(configFilePaths, ","))
+    return
+  }
+
+  cfg := *current
+  cfg.Preset = next.Preset
+  cfg.DetectRule = next.DetectRule
+  cfg.DetectWeights = next.DetectWeights
+  cfg.DetectOfflineRamp = next.DetectOfflineRamp
+  cfg.DetectOfflineGrace = next.DetectOfflineGrace
+  cfg.ResetExitCode = next.ResetExitCode
+  cfg.DetectNoClean = next.DetectNoClean
+  cfg.DetectStuckDuration = next.DetectStuckDuration
+  cfg.ResetThreshold = next.ResetThreshold
+  cfg.NotifyThreshold = next.NotifyThreshold
+  cfg.VerifyRule = next.VerifyRule
+  cfg.DrawerFullRule = next.DrawerFullRule
+  cfg.OccupiedRule = next.OccupiedRule
+  cfg.OccupiedWait = next.OccupiedWait
+  cfg.DeviceGroups = next.DeviceGroups
+  cfg.Workers = next.Workers
+  cfg.Consumables = next.Consumables
+  cfg.VerifyDelay = next.VerifyDelay
+  cfg.PollInterval = next.PollInterval
+  cfg.ShutdownDelay = next.ShutdownDelay
+  cfg.StatusCacheTTL = next.StatusCacheTTL
+  cfg.ColdStartCycles = next.ColdStartCycles
+  cfg.CircuitBreakerThreshold = next.CircuitBreakerThreshold
+  cfg.CircuitBreakerCoolOff = next.CircuitBreakerCoolOff
+  cfg.LogDPIDs = next.LogDPIDs
+  cfg.DataStorage = next.DataStorage
+  cfg.HistoryRetention = next.HistoryRetention
+  cfg.RollupRetention = next.RollupRetention
+  cfg.TimeFormat = next.TimeFormat
+  cfg.Language = next.Language
+  cfg.ActionQuietHours = next.ActionQuietHours
+  cfg.NotifyChannels = next.NotifyChannels
+  cfg.NotifyQuietBypass = next.NotifyQuietBypass
+  cfg.NotifyThrottle = next.NotifyThrottle
+  cfg.NotifyOnChange = next.NotifyOnChange
+  cfg.EscalateFailedResets = next.EscalateFailedResets
+  cfg.EscalateOffline = next.EscalateOffline
+  cfg.AlertmanagerURL = next.AlertmanagerURL
+  cfg.AlertmanagerWebhookURL = next.AlertmanagerWebhookURL
+  cfg.InfluxURL = next.InfluxURL
+  cfg.InfluxToken = next.InfluxToken
+  cfg.InfluxOrg = next.InfluxOrg
+  cfg.InfluxBucket = next.InfluxBucket
+  cfg.MetricsTextfile = next.MetricsTextfile
+  cfg.UptimeKumaURL = next.UptimeKumaURL
+  cfg.HeartbeatURL = next.HeartbeatURL
+  cfg.HeartbeatMethod = next.HeartbeatMethod
+  cfg.StatsMQTTURL = next.StatsMQTTURL
+  cfg.CaptureDuration = next.CaptureDuration
+  cfg.CaptureRate = next.CaptureRate
+
+  live.current.Store(&cfg)
+
+  responseCache.SetTTL(cfg.StatusCacheTTL)
+  capture.Configure(cfg.CaptureDuration, cfg.CaptureRate)
+  appLog.Info("Config reloaded", "paths", strings.Join(configFilePaths, ","), "changed", len(changed))
+}
@@ -0,0 +1,210 @@
+package app
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+const outputMarkdown = "markdown"
+
+var reportPeriods = map[string]int{"day": 1, "week": 7}
+
+// Report sums up the daily stats of a period. Cleans and visits are nil when
+// the device logs could not be read, AvgCleanInterval is in minutes.
+// PreviousVisits are the visits of the period before, a drop in visits may
+// mean the cat is unwell.
+type Report struct {
+  Period           string     `json:"period"`
+  From             string     `json:"from"`
+  To               string     `json:"to"`
+  DeviceID         string     `json:"device_id"`
+  Cleans           *int       `json:"cleans"`
+  Visits           *int       `json:"visits"`
+  PreviousVisits   *int       `json:"previous_visits"`
+  Resets           int        `json:"resets"`
+  FailedResets     int        `json:"failed_resets"`
+  OfflineMinutes   int        `json:"offline_minutes"`
+  AvgCleanInterval int        `json:"avg_clean_interval_minutes,omitempty"`
+  StuckState       string     `json:"stuck_state,omitempty"`
+  StuckCount       int        `json:"stuck_count,omitempty"`
+  Days             []DayStats `json:"days"`
+}
+
+func newReport(cfg *Config, period string, stats, previous []DayStats, haveCleans bool) Report {
+  report := Report{Period: period, From: stats[0].Day, To: stats[len(stats)-1].Day, DeviceID: cfg.DeviceID, Days: stats}
+  cleans, visits, previousVisits, intervals, intervalMinutes := 0, 0, 0, 0, 0
+  stuck := map[string]int{}
+  for _, s := range previous {
+    previousVisits += s.Visits
+  }
+  for _, s := range stats {
+    cleans += s.Cleans
+    visits += s.Visits
+    report.Resets += s.Resets
+    report.FailedResets += s.FailedResets
+    report.OfflineMinutes += s.OfflineMinutes
+    intervals += s.CleanIntervals
+    intervalMinutes += s.CleanIntervalMinutes
+    for value, count := range s.Stuck {
+      stuck[value] += count
+    }
+  }
+  if haveCleans {
+    report.Cleans, report.Visits, report.PreviousVisits = &cleans, &visits, &previousVisits
+  }
+  if intervals > 0 {
+    report.AvgCleanInterval = intervalMinutes / intervals
+  }
+
+  // Sorted first, so ties go to the same state every time.
+  values := make([]string, 0, len(stuck))
+  for value := range stuck {
+    values = append(values, value)
+  }
+  sort.Strings(values)
+  for _, value := range values {
+    if stuck[value] > report.StuckCount {
+      report.StuckState, report.StuckCount = value, stuck[value]
+    }
+  }
+  return report
+}
+
+// reportLines returns the report as label/value pairs for text and Markdown.
+func reportLines(cfg *Config, r Report) [][2]string {
+  cleans := "-"
+  if r.Cleans != nil {
+    cleans = fmt.Sprint(*r.Cleans)
+  }
+  visits := "-"
+  if r.Visits != nil {
+    visits = fmt.Sprint(*r.Visits)
+    if previous := *r.PreviousVisits; previous > 0 {
+      visits += tr(cfg, " (%+d%% compared to the period before)", (*r.Visits-previous)*100/previous)
+    }
+  }
+  resets := fmt.Sprint(r.Resets)
+  if r.FailedResets > 0 {
+    resets += tr(cfg, " (%d failed)", r.FailedResets)
+  }
+  interval := "-"
+  if r.AvgCleanInterval > 0 {
+    interval = strings.TrimSuffix((time.Duration(r.AvgCleanInterval) * time.Minute).String(), "0s")
+  }
+  stuck := tr(cfg, "none")
+  if r.StuckState != "" {
+    stuck = fmt.Sprintf("%s (%d×)", r.StuckState, r.StuckCount)
+  }
+  return [][2]string{
+    {tr(cfg, "Cleans"), cleans},
+    {tr(cfg, "Average time between cleans"), interval},
+    {tr(cfg, "Cat visits"), visits},
+    {tr(cfg, "Resets"), resets},
+    {tr(cfg, "Offline"), tr(cfg, "%d minutes", r.OfflineMinutes)},
+    {tr(cfg, "Most common stuck state"), stuck},
+  }
+}
+
+func printReport(w io.Writer, cfg *Config, r Report, output string) {
+  title := tr(cfg, "Report for %s, %s to %s", r.DeviceID, r.From, r.To)
+  if r.From == r.To {
+    title = tr(cfg, "Report for %s, %s", r.DeviceID, r.From)
+  }
+  lines := reportLines(cfg, r)
+
+  if output == outputMarkdown {
+    fmt.Fprintf(w, "## %s\n\n", title)
+    for _, line := range lines {
+      fmt.Fprintf(w, "- **%s:** %s\n", line[0], line[1])
+    }
+    return
+  }
+
+  width := 0
+  for _, line := range lines {
+    if n := len([]rune(line[0])); n > width {
+      width = n
+    }
+  }
+  fmt.Fprintln(w, title)
+  for _, line := range lines {
+    fmt.Fprintf(w, "%-*s %s\n", width+1, line[0]+":", line[1])
+  }
+}
+
+func runReport(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  fs := flag.NewFlagSet("report", flag.ContinueOnError)
+  period := fs.String("period", "week", "period to report on, up to today: day or week")
+  group := fs.String("group", "", "report on each device of a group, see send --group")
+  output := cfg.Output
+  if output == outputTable {
+    output = outputText
+  }
+  fs.StringVar(&output, "output", output, "output format: text, markdown or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if output != outputText && output != outputMarkdown && output != outputJSON {
+    return fmt.Errorf("invalid --output: %s (valid: text, markdown, json)", output)
+  }
+  days, ok := reportPeriods[*period]
+  if !ok {
+    return fmt.Errorf("invalid --period: %s (valid: day, week)", *period)
+  }
+
+  if *group == "" {
+    report, err := buildReport(ctx, cfg, appLog, *period, days)
+    if err != nil {
+      return err
+    }
+    if output == outputJSON {
+      return printJSON(report)
+    }
+    printReport(os.Stdout, cfg, report, output)
+    return nil
+  }
+
+  devices, err := selectDevices(ctx, cfg, *group)
+  if err != nil {
+    return err
+  }
+  if len(devices) == 0 {
+    return fmt.Errorf("no devices in group %s", *group)
+  }
+  reports := make([]Report, len(devices))
+  errs := make([]error, len(devices))
+  forEachDevice(devices, cfg.Workers, func(i int, device DeviceSummary) {
+    reports[i], errs[i] = buildReport(ctx, deviceConfig(cfg, device), appLog, *period, days)
+  })
+  for i, device := range devices {
+    if errs[i] != nil {
+      return fmt.Errorf("device %s: %w", device.ID, errs[i])
+    }
+  }
+  if output == outputJSON {
+    return printJSON(reports)
+  }
+  for i, report := range reports {
+    if i > 0 {
+      fmt.Println()
+    }
+    printReport(os.Stdout, cfg, report, output)
+  }
+  return nil
+}
+
+func buildReport(ctx context.Context, cfg *Config, appLog *slog.Logger, period string, days int) (Report, error) {
+  // Twice the period, to compare the visits with the period before.
+  stats, haveCleans, err := dailyStats(ctx, cfg, appLog, 2*days)
+  if err != nil {
+    return Report{}, err
+  }
+  return newReport(cfg, period, stats[days:], stats[:days], haveCleans), nil
+}
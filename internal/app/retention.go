@@ -0,0 +1,183 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "time"
+)
+
+// defaultRollupRetention keeps two years of rollups.
+const defaultRollupRetention = 2 * 365 * 24 * time.Hour
+
+// PruneRequest is the body of POST /api/history/prune. OlderThan overrides
+// HISTORY_RETENTION, e.g. "90d".
+type PruneRequest struct {
+  OlderThan string `json:"older_than,omitempty"`
+}
+
+// PruneResult is how much pruning removed.
+type PruneResult struct {
+  Entries    int `json:"entries"`
+  RollupDays int `json:"rollup_days"`
+}
+
+// parseRetention parses HISTORY_RETENTION and ROLLUP_RETENTION, e.g. 90d;
+// 0 keeps everything.
+func parseRetention(key, s string, fallback, minimum time.Duration) (time.Duration, error) {
+  if s == "" {
+    return fallback, nil
+  }
+  if s == "0" {
+    return 0, nil
+  }
+  d, err := parseSince(s)
+  if err != nil || d < minimum {
+    return 0, fmt.Errorf("invalid %s: %s (expected a duration of at least %dd like 90d, or 0 to keep everything)", key, s, int(minimum.Hours()/24))
+  }
+  return d, nil
+}
+
+// minHistoryRetention keeps the history of the days that still have to be
+// rolled up.
+const minHistoryRetention = (rollupBackfillDays + 1) * 24 * time.Hour
+
+// trimRollups drops the days before the rollup retention, oldest first.
+func trimRollups(cfg *Config, days []DayStats, now time.Time) []DayStats {
+  if cfg.RollupRetention <= 0 {
+    return days
+  }
+  first := localDay(cfg, now.Add(-cfg.RollupRetention)).Format("2006-01-02")
+  for i, day := range days {
+    if day.Day >= first {
+      return days[i:]
+    }
+  }
+  return nil
+}
+
+// pruneHistory removes the history entries older than historyRetention and
+// the rollups beyond ROLLUP_RETENTION, of all devices. A zero retention
+// keeps everything.
+func pruneHistory(cfg *Config, historyRetention time.Duration) (PruneResult, error) {
+  var result PruneResult
+  now := time.Now()
+  if historyRetention > 0 {
+    historyMu.Lock()
+    entries, err := readHistory(cfg)
+    if err == nil {
+      cutoff := now.Add(-historyRetention)
+      kept := make([]HistoryEntry, 0, len(entries))
+      for _, entry := range entries {
+        if entry.Time.Before(cutoff) {
+          continue
+        }
+        kept = append(kept, entry)
+      }
+      if result.Entries = len(entries) - len(kept); result.Entries > 0 {
+        err = writeHistory(cfg, kept)
+      }
+    }
+    historyMu.Unlock()
+    if err != nil {
+      return result, err
+    }
+  }
+
+  if cfg.RollupRetention > 0 {
+    store, err := loadRollups(cfg)
+    if err != nil {
+      return result, err
+    }
+    for device, days := range store {
+      trimmed := trimRollups(cfg, days, now)
+      result.RollupDays += len(days) - len(trimmed)
+      store[device] = trimmed
+    }
+    if result.RollupDays > 0 {
+      if err := saveRollups(cfg, store); err != nil {
+        return result, err
+      }
+    }
+  }
+  return result, nil
+}
+
+// pruneState remembers the last automatic pruning, so one-time checks run
+// every minute do not rewrite the history each time.
+type pruneState struct {
+  Last time.Time `json:"last"`
+}
+
+// pruneDaily applies HISTORY_RETENTION and ROLLUP_RETENTION once a day,
+// after a check.
+func pruneDaily(cfg *Config, appLog *slog.Logger) {
+  if cfg.DataStorage == dataStorageNone || (cfg.HistoryRetention <= 0 && cfg.RollupRetention <= 0) {
+    return
+  }
+  path, err := statePath(cfg, "prune.json")
+  if err != nil {
+    appLog.Warn("Failed to prune history", "error", err)
+    return
+  }
+  var state pruneState
+  if err := loadStateFile(path, &state); err != nil {
+    appLog.Warn("Failed to load prune state", "error", err)
+  }
+  if time.Since(state.Last) < 24*time.Hour {
+    return
+  }
+  result, err := pruneHistory(cfg, cfg.HistoryRetention)
+  if err != nil {
+    appLog.Warn("Failed to prune history", "error", err)
+    return
+  }
+  if result.Entries > 0 || result.RollupDays > 0 {
+    appLog.Info("Pruned history", "entries", result.Entries, "rollup_days", result.RollupDays)
+  }
+  if err := saveStateFile(path, pruneState{Last: time.Now()}); err != nil {
+    appLog.Warn("Failed to save prune state", "error", err)
+  }
+}
+
+func historyPrune(ctx context.Context, cfg *Config, args []string) error {
+  fs := flag.NewFlagSet("history prune", flag.ContinueOnError)
+  olderThan := fs.String("older-than", "", "remove entries older than this, e.g. 90d (default: HISTORY_RETENTION)")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+  retention := cfg.HistoryRetention
+  if *olderThan != "" {
+    d, err := parseRetention("--older-than", *olderThan, 0, minHistoryRetention)
+    if err != nil {
+      return err
+    }
+    retention = d
+  }
+  if retention <= 0 && cfg.RollupRetention <= 0 {
+    return fmt.Errorf("nothing to prune, set HISTORY_RETENTION or ROLLUP_RETENTION, or pass --older-than")
+  }
+
+  // The daemon owns the history while it runs.
+  var result PruneResult
+  err := daemonRequest(ctx, cfg, http.MethodPost, "/api/history/prune", PruneRequest{OlderThan: *olderThan}, &result)
+  if errors.Is(err, errNoDaemon) {
+    result, err = pruneHistory(cfg, retention)
+  }
+  if err != nil {
+    return err
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(result)
+  }
+  fmt.Printf("Pruned history: %d entries and %d rollup days removed\n", result.Entries, result.RollupDays)
+  return nil
+}
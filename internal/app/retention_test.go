@@ -0,0 +1,137 @@
+package app
+
+import (
+  "slices"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestParseRetention(t *testing.T) {
+  const day = 24 * time.Hour
+  tests := []struct {
+    value   string
+    want    time.Duration
+    wantErr bool
+  }{
+    {"", 365 * day, false},
+    {"0", 0, false},
+    {"90d", 90 * day, false},
+    {"2160h", 90 * day, false},
+    {"7d", 7 * day, false},
+    {"6d", 0, true},
+    {"1h", 0, true},
+    {"-90d", 0, true},
+    {"90", 0, true},
+    {"ninety days", 0, true},
+  }
+  for _, tt := range tests {
+    t.Run(tt.value, func(t *testing.T) {
+      got, err := parseRetention("HISTORY_RETENTION", tt.value, 365*day, 7*day)
+      if tt.wantErr {
+        if err == nil || !strings.Contains(err.Error(), "invalid HISTORY_RETENTION") {
+          t.Errorf("parseRetention(%q) error = %v, want invalid HISTORY_RETENTION", tt.value, err)
+        }
+        return
+      }
+      if err != nil || got != tt.want {
+        t.Errorf("parseRetention(%q) = %s, %v, want %s", tt.value, got, err, tt.want)
+      }
+    })
+  }
+}
+
+func TestPruneHistory(t *testing.T) {
+  const day = 24 * time.Hour
+  now := time.Now()
+  tests := []struct {
+    name            string
+    retention       time.Duration
+    rollupRetention time.Duration
+    wantEntries     []int
+    wantRollupDays  []string
+    want            PruneResult
+  }{
+    {
+      name:           "keep everything",
+      wantEntries:    []int{1, 2, 3, 4},
+      wantRollupDays: []string{"old", "recent"},
+      want:           PruneResult{},
+    },
+    {
+      name:           "history only",
+      retention:      30 * day,
+      wantEntries:    []int{3, 4},
+      wantRollupDays: []string{"old", "recent"},
+      want:           PruneResult{Entries: 2},
+    },
+    {
+      name:            "history and rollups",
+      retention:       90 * day,
+      rollupRetention: 365 * day,
+      wantEntries:     []int{2, 3, 4},
+      wantRollupDays:  []string{"recent"},
+      want:            PruneResult{Entries: 1, RollupDays: 1},
+    },
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      cfg := &Config{
+        StateDir:        t.TempDir(),
+        DeviceID:        "dev1",
+        RollupRetention: tt.rollupRetention,
+        TimeFormat:      TimeFormat{Location: time.UTC},
+      }
+      entries := []HistoryEntry{
+        {ID: 1, Time: now.Add(-400 * day), DeviceID: "dev1", Kind: actionReset},
+        {ID: 2, Time: now.Add(-60 * day), DeviceID: "dev2", Kind: actionReset},
+        {ID: 3, Time: now.Add(-10 * day), DeviceID: "dev1", Kind: historyNote},
+        {ID: 4, Time: now, DeviceID: "dev1", Kind: actionResetFailed},
+      }
+      if err := writeHistory(cfg, entries); err != nil {
+        t.Fatal(err)
+      }
+      old := now.Add(-500 * day).UTC().Format("2006-01-02")
+      recent := now.Add(-2 * day).UTC().Format("2006-01-02")
+      if err := saveRollups(cfg, rollupStore{"dev1": {{Day: old, Resets: 1}, {Day: recent, Resets: 2}}}); err != nil {
+        t.Fatal(err)
+      }
+
+      got, err := pruneHistory(cfg, tt.retention)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if got != tt.want {
+        t.Errorf("pruneHistory() = %+v, want %+v", got, tt.want)
+      }
+
+      kept, err := readHistory(cfg)
+      if err != nil {
+        t.Fatal(err)
+      }
+      var ids []int
+      for _, entry := range kept {
+        ids = append(ids, entry.ID)
+      }
+      if !slices.Equal(ids, tt.wantEntries) {
+        t.Errorf("history IDs = %v, want %v", ids, tt.wantEntries)
+      }
+
+      store, err := loadRollups(cfg)
+      if err != nil {
+        t.Fatal(err)
+      }
+      var days []string
+      for _, stats := range store["dev1"] {
+        name := "recent"
+        if stats.Day == old {
+          name = "old"
+        }
+        days = append(days, name)
+      }
+      if !slices.Equal(days, tt.wantRollupDays) {
+        t.Errorf("rollup days = %v, want %v", days, tt.wantRollupDays)
+      }
+    })
+  }
+}
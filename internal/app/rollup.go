@@ -0,0 +1,132 @@
+package app
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "log/slog"
+  "net/url"
+  "os"
+  "time"
+)
+
+// Completed days are rolled up while Tuya still has their logs, 7 days on
+// the free plan, and kept for ROLLUP_RETENTION.
+const rollupBackfillDays = 7
+
+// rollupStore holds the stats of completed days per device, oldest first.
+type rollupStore map[string][]DayStats
+
+func rollupsPath(cfg *Config) (string, error) {
+  return statePath(cfg, "rollups.json")
+}
+
+func loadRollups(cfg *Config) (rollupStore, error) {
+  store := rollupStore{}
+  path, err := rollupsPath(cfg)
+  if err != nil {
+    return nil, err
+  }
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return store, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  if err := json.Unmarshal(data, &store); err != nil {
+    return nil, err
+  }
+  return store, nil
+}
+
+func saveRollups(cfg *Config, store rollupStore) error {
+  path, err := rollupsPath(cfg)
+  if err != nil {
+    return err
+  }
+  return saveStateFile(path, store)
+}
+
+// updateRollups stores the stats of the days completed since the last
+// rollup, so stats and reports only count today themselves. Cleans are only
+// in the device logs, so days are not rolled up while the logs cannot be
+// read; the next check tries again.
+func updateRollups(ctx context.Context, cfg *Config, appLog *slog.Logger) {
+  if cfg.DataStorage == dataStorageNone {
+    return
+  }
+  store, err := loadRollups(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load rollups", "error", err)
+    return
+  }
+
+  today := localDay(cfg, time.Now())
+  start := today.AddDate(0, 0, -rollupBackfillDays)
+  if days := store[cfg.DeviceID]; len(days) > 0 {
+    last, err := time.ParseInLocation("2006-01-02", days[len(days)-1].Day, cfg.TimeFormat.Location)
+    if err == nil && !last.Before(start) {
+      start = last.AddDate(0, 0, 1)
+    }
+  }
+  if !start.Before(today) {
+    return
+  }
+
+  days := 0
+  for day := start; day.Before(today); day = day.AddDate(0, 0, 1) {
+    days++
+  }
+  // The watcher owns the history, no need to ask it over the control socket.
+  entries, err := readHistory(cfg)
+  if err != nil {
+    appLog.Warn("Failed to read history", "error", err)
+    return
+  }
+  stats, haveCleans, err := countStats(ctx, cfg, appLog, entries, start, days)
+  if err != nil || !haveCleans {
+    appLog.Debug("Failed to roll up stats, trying again on the next check", "error", err)
+    return
+  }
+
+  store[cfg.DeviceID] = trimRollups(cfg, append(store[cfg.DeviceID], stats...), time.Now())
+  if err := saveRollups(cfg, store); err != nil {
+    appLog.Warn("Failed to save rollups", "error", err)
+    return
+  }
+  appLog.Debug("Rolled up stats", "from", stats[0].Day, "days", days)
+  publishStats(ctx, cfg, appLog, stats[len(stats)-1])
+}
+
+// StatsMessage is published to STATS_MQTT_URL for every completed day.
+type StatsMessage struct {
+  DeviceID string `json:"device_id"`
+  DayStats
+}
+
+// publishStats publishes the stats of the last completed day as a retained
+// message, e.g. for a Home Assistant sensor of the cat's daily visits.
+func publishStats(ctx context.Context, cfg *Config, appLog *slog.Logger, day DayStats) {
+  if cfg.StatsMQTTURL == "" {
+    return
+  }
+  u, err := url.Parse(cfg.StatsMQTTURL)
+  if err != nil {
+    return
+  }
+  payload, err := json.Marshal(StatsMessage{DeviceID: cfg.DeviceID, DayStats: day})
+  if err != nil {
+    return
+  }
+  if err := publishMQTT(ctx, u, payload); err != nil {
+    // Leave out the URL, it may contain credentials.
+    var urlErr *url.Error
+    if errors.As(err, &urlErr) {
+      err = urlErr.Err
+    }
+    appLog.Warn("Failed to publish stats", "error", err)
+    return
+  }
+  appLog.Debug("Published stats", "day", day.Day)
+}
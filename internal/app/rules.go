@@ -0,0 +1,138 @@
+package app
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/detect"
+  "shitbox-fixer/pkg/rules"
+)
+
+const defaultVerifyRule = "device.online"
+
+func deviceStatusMap(deviceInfo *DeviceInfoResponse) map[string]interface{} {
+  status := map[string]interface{}{}
+  if statusArray, ok := deviceInfo.Result["status"].([]interface{}); ok {
+    for _, item := range statusArray {
+      if statusItem, ok := item.(map[string]interface{}); ok {
+        status[fmt.Sprint(statusItem["code"])] = statusItem["value"]
+      }
+    }
+  }
+  return status
+}
+
+// ruleEnv exposes the device state to rules as status (DP code to value),
+// device (online, id, name, category and offline_for, the seconds since an
+// offline device last reported), faults (names of the active faults) and
+// log_values (values of the recent log entries).
+func ruleEnv(preset Preset, deviceInfo *DeviceInfoResponse, lastLogs []interface{}) rules.Env {
+  logValues := []interface{}{}
+  for _, logEntry := range lastLogs {
+    if logMap, ok := logEntry.(map[string]interface{}); ok {
+      logValues = append(logValues, logMap["value"])
+    }
+  }
+
+  status := deviceStatusMap(deviceInfo)
+  faults := []interface{}{}
+  for _, name := range detect.DecodeFaults(preset.FaultNames, status["fault"]) {
+    faults = append(faults, name)
+  }
+
+  offlineFor := 0.0
+  if online, _ := deviceInfo.Result["online"].(bool); !online {
+    if lastSeen := deviceLastSeen(deviceInfo); !lastSeen.IsZero() {
+      offlineFor = time.Since(lastSeen).Seconds()
+    }
+  }
+
+  return rules.Env{
+    "status": status,
+    "device": map[string]interface{}{
+      "online":      deviceInfo.Result["online"],
+      "offline_for": offlineFor,
+      "id":          deviceInfo.Result["id"],
+      "name":        deviceInfo.Result["name"],
+      "category":    deviceInfo.Result["category"],
+    },
+    "faults":     faults,
+    "log_values": logValues,
+  }
+}
+
+// compileRule parses a rule and evaluates it once against an empty device,
+// so unknown identifiers are reported at startup instead of mid-reset.
+func compileRule(source string) (*rules.Rule, error) {
+  rule, err := rules.Parse(source)
+  if err != nil {
+    return nil, err
+  }
+  if _, err := rule.Eval(ruleEnv(Preset{}, &DeviceInfoResponse{}, nil)); err != nil {
+    return nil, err
+  }
+  return rule, nil
+}
+
+// compileDetectRule compiles DETECT_RULE, which can also read the strength
+// of the other detectors as detectors.<name>.
+func compileDetectRule(source string) (*rules.Rule, error) {
+  rule, err := rules.Parse(source)
+  if err != nil {
+    return nil, err
+  }
+  // The rule detector itself runs last and has no value yet.
+  names := detect.Names()
+  names = names[:len(names)-1]
+  for _, name := range rule.KeysOf("detectors") {
+    known := false
+    for _, n := range names {
+      if n == name {
+        known = true
+        break
+      }
+    }
+    if !known {
+      return nil, fmt.Errorf("unknown detector %q (valid: %s)", name, strings.Join(names, ", "))
+    }
+  }
+  env := ruleEnv(Preset{}, &DeviceInfoResponse{}, nil)
+  env["detectors"] = map[string]interface{}{}
+  if _, err := rule.Eval(env); err != nil {
+    return nil, err
+  }
+  return rule, nil
+}
+
+// checkRule fetches the current device status and evaluates rule against it.
+func checkRule(ctx context.Context, deviceID string, preset Preset, rule *rules.Rule) error {
+  responseCache.Invalidate("status/" + deviceID)
+  deviceStatus, err := getDeviceStatus(ctx, deviceID)
+  if err != nil {
+    return err
+  }
+  ok, err := rule.Eval(ruleEnv(preset, deviceStatus, nil))
+  if err != nil {
+    return fmt.Errorf("failed to evaluate rule %s: %w", rule, err)
+  }
+  if !ok {
+    return fmt.Errorf("rule %s does not hold", rule)
+  }
+  return nil
+}
+
+// verifyReset waits for the device to settle after a reset and checks that
+// it is healthy according to VERIFY_RULE.
+func verifyReset(ctx context.Context, cfg *Config, appLog *slog.Logger) (err error) {
+  ctx, span := startSpan(ctx, "verify reset", spanKindInternal, spanAttr("verify.rule", cfg.VerifyRule.Source), spanAttr("verify.delay", cfg.VerifyDelay.String()))
+  defer func() { span.End(err) }()
+
+  appLog.Debug("Verifying reset", "rule", cfg.VerifyRule.Source, "delay", cfg.VerifyDelay)
+  if err := sleepContext(ctx, cfg.VerifyDelay); err != nil {
+    return err
+  }
+  return checkRule(ctx, cfg.DeviceID, cfg.Preset, cfg.VerifyRule)
+}
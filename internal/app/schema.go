@@ -0,0 +1,169 @@
+package app
+
+import (
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "strings"
+  "sync"
+)
+
+// responseSchema lists the fields the code relies on for an endpoint, as
+// paths into the response ("result.logs[].event_time") with the JSON type
+// expected there: string, number, bool, array, object or any.
+type responseSchema struct {
+  pattern string
+  fields  map[string]string
+}
+
+var responseSchemas = []responseSchema{
+  {"/v1.0/token", map[string]string{
+    "result.access_token": "string",
+    "result.expire_time":  "number",
+  }},
+  {"/v1.0/iot-01/associated-users/devices", map[string]string{
+    "result.devices":            "array",
+    "result.devices[].id":       "string",
+    "result.devices[].name":     "string",
+    "result.devices[].category": "string",
+    "result.devices[].online":   "bool",
+    "result.has_more":           "bool",
+  }},
+  {"/v1.0/devices/{id}", map[string]string{
+    "result.online":         "bool",
+    "result.status":         "array",
+    "result.status[].code":  "string",
+    "result.status[].value": "any",
+  }},
+  {"/v1.0/devices/{id}/specifications", map[string]string{
+    "result.functions":        "array",
+    "result.functions[].code": "string",
+    "result.status":           "array",
+    "result.status[].code":    "string",
+  }},
+  {"/v2.0/cloud/thing/{id}/shadow/properties", map[string]string{
+    "result.properties":         "array",
+    "result.properties[].code":  "string",
+    "result.properties[].dp_id": "number",
+  }},
+  {"/v2.0/cloud/thing/{id}/logs", map[string]string{
+    "result.logs":              "array",
+    "result.logs[].code":       "string",
+    "result.logs[].value":      "any",
+    "result.logs[].event_time": "number",
+    "result.has_next":          "bool",
+  }},
+  {"/v1.0/devices/{id}/commands", map[string]string{
+    "result": "bool",
+  }},
+}
+
+func matchEndpoint(pattern, uri string) bool {
+  path, _, _ := strings.Cut(uri, "?")
+  want := strings.Split(pattern, "/")
+  got := strings.Split(path, "/")
+  if len(want) != len(got) {
+    return false
+  }
+  for i := range want {
+    if want[i] != "{id}" && want[i] != got[i] {
+      return false
+    }
+  }
+  return true
+}
+
+func jsonType(v interface{}) string {
+  switch v.(type) {
+  case nil:
+    return "null"
+  case string:
+    return "string"
+  case float64:
+    return "number"
+  case bool:
+    return "bool"
+  case []interface{}:
+    return "array"
+  case map[string]interface{}:
+    return "object"
+  }
+  return fmt.Sprintf("%T", v)
+}
+
+// checkField walks path through value and reports where it is missing or
+// has another type than want. Array elements ("[]") are checked one by one.
+func checkField(value interface{}, path []string, fullPath, want string, problems map[string]string) {
+  if len(path) == 0 {
+    if got := jsonType(value); want != "any" && got != want {
+      problems[fullPath] = fmt.Sprintf("expected %s, got %s", want, got)
+    }
+    return
+  }
+
+  key, each := strings.CutSuffix(path[0], "[]")
+  object, ok := value.(map[string]interface{})
+  if !ok {
+    return
+  }
+  child, ok := object[key]
+  if !ok {
+    problems[fullPath] = "missing"
+    return
+  }
+  if !each {
+    checkField(child, path[1:], fullPath, want, problems)
+    return
+  }
+  items, ok := child.([]interface{})
+  if !ok {
+    return
+  }
+  for _, item := range items {
+    checkField(item, path[1:], fullPath, want, problems)
+  }
+}
+
+// validateResponse compares a successful response with the schema of its
+// endpoint. Failed responses often lack a result and are not checked.
+func validateResponse(uri string, data []byte) map[string]string {
+  var schema *responseSchema
+  for i := range responseSchemas {
+    if matchEndpoint(responseSchemas[i].pattern, uri) {
+      schema = &responseSchemas[i]
+      break
+    }
+  }
+  if schema == nil {
+    return nil
+  }
+
+  var body map[string]interface{}
+  if err := json.Unmarshal(data, &body); err != nil {
+    return nil
+  }
+  if success, _ := body["success"].(bool); !success {
+    return nil
+  }
+
+  problems := map[string]string{}
+  for path, want := range schema.fields {
+    checkField(body, strings.Split(path, "."), path, want, problems)
+  }
+  return problems
+}
+
+var reportedDrift sync.Map
+
+// reportDrift warns about each changed field once per process, so a
+// drifted API does not flood the log on every poll.
+func reportDrift(logger *slog.Logger, uri string, data []byte) {
+  for field, problem := range validateResponse(uri, data) {
+    path, _, _ := strings.Cut(uri, "?")
+    key := path + " " + field + " " + problem
+    if _, seen := reportedDrift.LoadOrStore(key, true); seen {
+      continue
+    }
+    logger.Warn("Tuya API response drift", "uri", path, "field", field, "problem", problem)
+  }
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+  "log/slog"
+  "os"
+  "strconv"
+  "time"
+)
+
+// sdWatchdogInterval returns how often systemd expects WATCHDOG=1 when the
+// unit has WatchdogSec set, or 0.
+func sdWatchdogInterval() time.Duration {
+  usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+  if err != nil || usec <= 0 {
+    return 0
+  }
+  // The variables are inherited by child processes, which must not ping.
+  if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+    return 0
+  }
+  return time.Duration(usec) * time.Microsecond
+}
+
+// notifySystemd tells systemd about the service state, e.g. READY=1, when
+// it was started with Type=notify. Failures are only logged: systemd kills
+// a service that never becomes ready anyway.
+func notifySystemd(appLog *slog.Logger, state string) {
+  if err := sdNotify(state); err != nil {
+    appLog.Debug("Failed to notify systemd", "state", state, "error", err)
+  }
+}
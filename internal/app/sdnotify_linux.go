@@ -0,0 +1,26 @@
+//go:build linux
+
+package app
+
+import (
+  "net"
+  "os"
+)
+
+const sdNotifySupported = true
+
+// sdNotify sends a state to the socket in NOTIFY_SOCKET. It does nothing
+// when the process was not started by systemd with Type=notify.
+func sdNotify(state string) error {
+  socket := os.Getenv("NOTIFY_SOCKET")
+  if socket == "" {
+    return nil
+  }
+  conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  _, err = conn.Write([]byte(state))
+  return err
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package app
+
+const sdNotifySupported = false
+
+func sdNotify(state string) error {
+  return nil
+}
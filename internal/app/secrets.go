@@ -0,0 +1,56 @@
+package app
+
+import (
+  "fmt"
+  "os"
+  "strings"
+)
+
+// secretEnvVars can also be read from a file named by the variable with a
+// _FILE suffix, e.g. TUYA_ACCESS_KEY_FILE=/run/secrets/tuya_key, so secrets
+// mounted by Docker or Kubernetes never appear in the environment.
+var secretEnvVars = []string{
+  "TUYA_ACCESS_ID",
+  "TUYA_ACCESS_KEY",
+  "NOTIFY_WEBHOOK_URL",
+  "NOTIFY_ESCALATION_URL",
+  "PAGERDUTY_ROUTING_KEY",
+  "OPSGENIE_API_KEY",
+  "ALERTMANAGER_URL",
+  "ALERTMANAGER_WEBHOOK_URL",
+  "INFLUXDB_TOKEN",
+  "UPTIME_KUMA_PUSH_URL",
+  "HEARTBEAT_URL",
+  "STATS_MQTT_URL",
+  "TUYA_PROXY_URL",
+  "VAULT_TOKEN",
+  "VAULT_SECRET_ID",
+  "API_READ_TOKEN",
+  "API_CONTROL_TOKEN",
+  "OTEL_EXPORTER_OTLP_HEADERS",
+}
+
+// secretsFromFiles tracks the variables set by loadSecretFiles, which reads
+// them again when the config is reloaded.
+var secretsFromFiles = map[string]bool{}
+
+// loadSecretFiles sets each secret variable from its _FILE variant. Setting
+// both is an error, as it is unclear which one is meant.
+func loadSecretFiles() error {
+  for _, env := range secretEnvVars {
+    path := os.Getenv(env + "_FILE")
+    if path == "" {
+      continue
+    }
+    if _, ok := os.LookupEnv(env); ok && !secretsFromFiles[env] {
+      return fmt.Errorf("both %s and %s_FILE are set", env, env)
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+      return fmt.Errorf("failed to read %s_FILE: %w", env, err)
+    }
+    os.Setenv(env, strings.TrimRight(string(data), "\r\n"))
+    secretsFromFiles[env] = true
+  }
+  return nil
+}
@@ -0,0 +1,254 @@
+package app
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os"
+  "path"
+  "strings"
+
+  "shitbox-fixer/pkg/actions"
+)
+
+// parseCommandValue interprets the value as JSON so that `true`, `3` and
+// `"text"` keep their types, falling back to a plain string.
+func parseCommandValue(raw string) interface{} {
+  var value interface{}
+  if err := json.Unmarshal([]byte(raw), &value); err != nil {
+    return raw
+  }
+  return value
+}
+
+type sendRequest struct {
+  Commands    []actions.Command
+  Group       string
+  Devices     string
+  Concurrency int
+}
+
+func parseSendArgs(cfg *Config, args []string) (*sendRequest, error) {
+  req := &sendRequest{}
+  fs := flag.NewFlagSet("send", flag.ContinueOnError)
+  fs.StringVar(&req.Group, "group", "", "send to a group of devices: all, online, category:<category>, name:<pattern> or a DEVICE_GROUPS group")
+  fs.StringVar(&req.Devices, "devices", "", "comma-separated device IDs to send to")
+  fs.IntVar(&req.Concurrency, "concurrency", cfg.Workers, "number of devices to send to at once")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  code := fs.String("code", "", "DP code to send, e.g. manual_clean")
+  value := fs.String("value", "", "value to send, parsed as JSON when possible (true, 3, \"text\")")
+  batch := fs.String("json", "", `JSON array of commands, e.g. '[{"code":"switch","value":false}]'`)
+  if err := fs.Parse(args); err != nil {
+    return nil, err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return nil, fmt.Errorf("invalid --output: %w", err)
+  }
+  if req.Group != "" && req.Devices != "" {
+    return nil, fmt.Errorf("use either --group or --devices, not both")
+  }
+  if req.Concurrency < 1 {
+    return nil, fmt.Errorf("invalid --concurrency: must be at least 1")
+  }
+
+  if *batch != "" {
+    if *code != "" {
+      return nil, fmt.Errorf("use either --code/--value or --json, not both")
+    }
+    var commands []actions.Command
+    if err := json.Unmarshal([]byte(*batch), &commands); err != nil {
+      return nil, fmt.Errorf("invalid --json: %w", err)
+    }
+    if len(commands) == 0 {
+      return nil, fmt.Errorf("invalid --json: no commands")
+    }
+    for _, command := range commands {
+      if command.Code == "" {
+        return nil, fmt.Errorf("invalid --json: every command needs a code")
+      }
+    }
+    req.Commands = commands
+    return req, nil
+  }
+
+  if *code == "" || *value == "" {
+    return nil, fmt.Errorf("--code and --value are required")
+  }
+  req.Commands = []actions.Command{{Code: *code, Value: parseCommandValue(*value)}}
+  return req, nil
+}
+
+// selectDevices resolves a --group selector or a DEVICE_GROUPS group
+// against the devices of the cloud project.
+func selectDevices(ctx context.Context, cfg *Config, group string) ([]DeviceSummary, error) {
+  devices, err := getDevices(ctx)
+  if err != nil {
+    return nil, err
+  }
+  if members, ok := cfg.DeviceGroups[group]; ok {
+    return groupMembers(devices, group, members)
+  }
+
+  kind, arg, _ := strings.Cut(group, ":")
+  var match func(DeviceSummary) bool
+  switch kind {
+  case "all":
+    match = func(DeviceSummary) bool { return true }
+  case "online":
+    match = func(d DeviceSummary) bool { return d.Online }
+  case "category":
+    match = func(d DeviceSummary) bool { return d.Category == arg }
+  case "name":
+    if _, err := path.Match(arg, ""); err != nil {
+      return nil, fmt.Errorf("invalid --group pattern %q: %w", arg, err)
+    }
+    match = func(d DeviceSummary) bool {
+      ok, _ := path.Match(arg, d.Name)
+      return ok
+    }
+  default:
+    valid := append([]string{"all", "online", "category:<category>", "name:<pattern>"}, groupNames(cfg.DeviceGroups)...)
+    return nil, fmt.Errorf("invalid --group: %s (valid: %s)", group, strings.Join(valid, ", "))
+  }
+
+  selected := []DeviceSummary{}
+  for _, device := range devices {
+    if match(device) {
+      selected = append(selected, device)
+    }
+  }
+  return selected, nil
+}
+
+type SendResult struct {
+  DeviceID string `json:"device_id"`
+  Name     string `json:"name,omitempty"`
+  Sent     bool   `json:"sent"`
+  Error    string `json:"error,omitempty"`
+}
+
+type CommandsRequest struct {
+  Commands []actions.Command `json:"commands"`
+}
+
+// sendDevice sends the commands to cfg.DeviceID. The running daemon of the
+// device sends them, so they are queued behind its own commands, e.g. the
+// steps of a reset sequence. Without a daemon they are sent from here under
+// the instance lock, like a manual reset.
+func sendDevice(ctx context.Context, cfg *Config, appLog *slog.Logger, commands []actions.Command) error {
+  var result SendResult
+  err := daemonRequest(ctx, cfg, http.MethodPost, "/api/devices/"+url.PathEscape(cfg.DeviceID)+"/commands", CommandsRequest{Commands: commands}, &result)
+  if !errors.Is(err, errNoDaemon) {
+    if err == nil {
+      appLog.Debug("Commands sent by the running daemon", "device_id", cfg.DeviceID)
+    }
+    return err
+  }
+  if err := acquireInstanceLock(ctx, cfg, appLog); err != nil {
+    return err
+  }
+  return deviceCommands.Do(ctx, cfg.DeviceID, "send", func(ctx context.Context) error {
+    return sendCommands(ctx, cfg.DeviceID, commands)
+  })
+}
+
+// sendBatch sends the commands to every device, at most concurrency at a
+// time. Results are in the order of devices.
+func sendBatch(ctx context.Context, cfg *Config, appLog *slog.Logger, devices []DeviceSummary, commands []actions.Command, concurrency int) []SendResult {
+  results := make([]SendResult, len(devices))
+  forEachDevice(devices, concurrency, func(i int, device DeviceSummary) {
+    err := sendDevice(ctx, deviceConfig(cfg, device), appLog.With("device_id", device.ID), commands)
+    results[i] = SendResult{DeviceID: device.ID, Name: device.Name, Sent: err == nil}
+    if err != nil {
+      results[i].Error = err.Error()
+    }
+  })
+  return results
+}
+
+func runSendBatch(ctx context.Context, cfg *Config, appLog *slog.Logger, req *sendRequest) error {
+  var devices []DeviceSummary
+  if req.Group != "" {
+    selected, err := selectDevices(ctx, cfg, req.Group)
+    if err != nil {
+      return err
+    }
+    devices = selected
+  } else {
+    for _, id := range strings.Split(req.Devices, ",") {
+      if id = strings.TrimSpace(id); id != "" {
+        devices = append(devices, DeviceSummary{ID: id})
+      }
+    }
+  }
+  if len(devices) == 0 {
+    return fmt.Errorf("no devices selected")
+  }
+
+  results := sendBatch(ctx, cfg, appLog, devices, req.Commands, req.Concurrency)
+  failed := 0
+  for _, result := range results {
+    if !result.Sent {
+      failed++
+    }
+  }
+
+  if cfg.Output == outputJSON {
+    if err := printJSON(map[string]interface{}{
+      "commands": req.Commands,
+      "results":  results,
+      "sent":     len(results) - failed,
+      "failed":   failed,
+    }); err != nil {
+      return err
+    }
+  } else {
+    table := newTable("DEVICE", "NAME", "SENT", "ERROR")
+    for _, result := range results {
+      table.AddRow(result.DeviceID, result.Name, fmt.Sprint(result.Sent), result.Error)
+      table.SetColor(2, boolColor(result.Sent))
+    }
+    if err := table.Render(os.Stdout, useColor()); err != nil {
+      return err
+    }
+    fmt.Printf("\nSent to %d of %d devices\n", len(results)-failed, len(results))
+  }
+
+  if failed > 0 {
+    return fmt.Errorf("%d of %d devices failed", failed, len(results))
+  }
+  return nil
+}
+
+func runSend(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  req, err := parseSendArgs(cfg, args)
+  if err != nil {
+    return err
+  }
+  ctx = withAuditTrigger(ctx, auditTriggerSend, "", localUser())
+  if req.Group != "" || req.Devices != "" {
+    return runSendBatch(ctx, cfg, appLog, req)
+  }
+  if cfg.DeviceID == "" {
+    return fmt.Errorf("missing TUYA_DEVICE_ID, or use --group or --devices")
+  }
+  commands := req.Commands
+
+  if err := sendDevice(ctx, cfg, appLog, commands); err != nil {
+    return err
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(map[string]interface{}{
+      "device_id": cfg.DeviceID,
+      "commands":  commands,
+    })
+  }
+  appLog.Info("Command sent successfully")
+  return nil
+}
@@ -0,0 +1,470 @@
+package app
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "log/slog"
+  "net"
+  "net/http"
+  "os"
+  "slices"
+  "strconv"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/actions"
+)
+
+const defaultServeAddress = "127.0.0.1:8080"
+
+// apiServer exposes the fixer over HTTP for dashboards and home automation.
+// Its context is the shutdown context, not the request's, so a reset keeps
+// running when the client disconnects. Source names the server in the
+// history, e.g. "API" or "CLI".
+type apiServer struct {
+  ctx    context.Context
+  cfg    *liveConfig
+  appLog *slog.Logger
+  auth   apiAuth
+  source string
+  // triggers asks the poll loop for a check, only set on the control
+  // socket.
+  triggers chan<- struct{}
+}
+
+type apiError struct {
+  Error string `json:"error"`
+}
+
+type DeviceStatus struct {
+  DeviceID string                 `json:"device_id"`
+  Online   bool                   `json:"online"`
+  Status   map[string]interface{} `json:"status"`
+}
+
+// CheckRequest confirms that the watcher will check the device right away.
+type CheckRequest struct {
+  DeviceID string `json:"device_id"`
+  PID      int    `json:"pid"`
+}
+
+type ResetResult struct {
+  DeviceID string            `json:"device_id"`
+  Action   string            `json:"action"`
+  Commands []actions.Command `json:"commands"`
+  Error    string            `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  _ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+  writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+func (s *apiServer) routes() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("GET /api/devices", s.require(roleRead, s.handleDevices))
+  mux.HandleFunc("GET /api/devices/{id}/status", s.require(roleRead, s.handleStatus))
+  mux.HandleFunc("POST /api/devices/{id}/reset", s.require(roleControl, s.handleReset))
+  mux.HandleFunc("POST /api/devices/{id}/commands", s.require(roleControl, s.handleSendCommands))
+  mux.HandleFunc("POST /api/devices/{id}/firmware/{type}", s.require(roleControl, s.handleFirmwareUpgrade))
+  if s.triggers != nil {
+    mux.HandleFunc("POST /api/devices/{id}/check", s.require(roleControl, s.handleCheck))
+  }
+  mux.HandleFunc("GET /api/queue", s.require(roleRead, s.handleQueue))
+  mux.HandleFunc("GET /api/history", s.require(roleRead, s.handleHistory))
+  mux.HandleFunc("POST /api/history", s.require(roleControl, s.handleAddNote))
+  mux.HandleFunc("POST /api/history/{id}/annotations", s.require(roleControl, s.handleAnnotate))
+  mux.HandleFunc("POST /api/history/prune", s.require(roleControl, s.handlePrune))
+  mux.HandleFunc("GET /api/events", s.require(roleRead, s.handleEvents))
+  healthRoutes(mux)
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    s.appLog.Debug("API request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+    if isGRPCRequest(r) {
+      s.serveGRPC(w, r)
+      return
+    }
+    mux.ServeHTTP(w, r)
+  })
+}
+
+func (s *apiServer) handleDevices(w http.ResponseWriter, r *http.Request) {
+  devices, err := getDevices(r.Context())
+  if err != nil {
+    writeError(w, http.StatusBadGateway, err)
+    return
+  }
+  if devices == nil {
+    devices = []DeviceSummary{}
+  }
+  writeJSON(w, http.StatusOK, devices)
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+  deviceID := r.PathValue("id")
+  deviceStatus, err := getDeviceStatus(r.Context(), deviceID)
+  if err != nil {
+    writeError(w, http.StatusBadGateway, err)
+    return
+  }
+  online, _ := deviceStatus.Result["online"].(bool)
+  writeJSON(w, http.StatusOK, DeviceStatus{DeviceID: deviceID, Online: online, Status: deviceStatusMap(deviceStatus)})
+}
+
+// handleCheck asks the poll loop to check the device right away. The check
+// runs in the loop, the response does not wait for it.
+func (s *apiServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+  deviceID := r.PathValue("id")
+  if deviceID != s.cfg.Load().DeviceID {
+    writeError(w, http.StatusNotFound, errNotManaged(deviceID))
+    return
+  }
+  select {
+  case s.triggers <- struct{}{}:
+  default:
+    // A check is already pending.
+  }
+  s.appLog.Info("Check requested, checking now", "source", s.source)
+  writeJSON(w, http.StatusAccepted, CheckRequest{DeviceID: deviceID, PID: os.Getpid()})
+}
+
+// handleReset runs the preset's reset sequence and verifies it, like a check
+// that found the device stuck. The preset only applies to TUYA_DEVICE_ID.
+func (s *apiServer) handleReset(w http.ResponseWriter, r *http.Request) {
+  deviceID := r.PathValue("id")
+  if deviceID != s.cfg.Load().DeviceID {
+    writeError(w, http.StatusNotFound, errNotManaged(deviceID))
+    return
+  }
+  result := s.reset(r.RemoteAddr)
+  status := http.StatusOK
+  if result.Error != "" {
+    status = http.StatusBadGateway
+  }
+  writeJSON(w, status, result)
+}
+
+func errNotManaged(deviceID string) error {
+  return fmt.Errorf("device %s is not managed by this instance", deviceID)
+}
+
+func (s *apiServer) reset(remote string) ResetResult {
+  s.appLog.Info("Reset requested via "+s.source, "remote", remote)
+  trigger := auditTriggerAPI
+  if s.source == "CLI" {
+    trigger = auditTriggerCLI
+  }
+  ctx := withAuditTrigger(s.ctx, trigger, "manual reset via "+s.source, remote)
+  return manualReset(ctx, s.cfg.Load(), s.appLog, s.source)
+}
+
+// manualReset runs and verifies the reset sequence of the managed device on
+// request, records it in the history and publishes the outcome.
+func manualReset(ctx context.Context, cfg *Config, appLog *slog.Logger, source string) ResetResult {
+  release := shutdown.protect()
+  defer release()
+  ctx, span := startSpan(ctx, "manual reset", spanKindInternal, spanAttr("device.id", cfg.DeviceID), spanAttr("reset.source", source))
+
+  deviceID := cfg.DeviceID
+  result := ResetResult{DeviceID: deviceID, Action: actionReset, Commands: []actions.Command{}}
+  for _, step := range cfg.Preset.ResetSequence {
+    result.Commands = append(result.Commands, actions.Command{Code: step.Code, Value: step.Value})
+  }
+
+  err := controlDevice(ctx, cfg, appLog)
+  if err != nil {
+    err = fmt.Errorf("failed to control device: %w", err)
+  } else if err = verifyReset(ctx, cfg, appLog); err != nil {
+    err = fmt.Errorf("reset verification failed: %w", err)
+  }
+
+  span.End(err)
+
+  entry := HistoryEntry{Kind: actionReset, Reason: "manual reset via " + source}
+  if err != nil {
+    result.Action, result.Error = actionResetFailed, err.Error()
+    entry.Kind, entry.Message = actionResetFailed, err.Error()
+    appLog.Error("Reset via "+source+" failed", "error", err)
+  } else {
+    appLog.Info("Reset verified", "rule", cfg.VerifyRule.Source)
+  }
+  if cfg.DataStorage != dataStorageNone {
+    if _, err := appendHistory(cfg, entry); err != nil {
+      appLog.Warn("Failed to record history", "error", err)
+    }
+  }
+  events.Publish(Event{Time: time.Now(), Type: eventReset, DeviceID: deviceID, Action: result.Action, Reason: entry.Reason, Error: result.Error})
+  return result
+}
+
+// handleSendCommands sends commands to the managed device through the
+// command queue, so they never reach it between the steps of a reset.
+func (s *apiServer) handleSendCommands(w http.ResponseWriter, r *http.Request) {
+  deviceID := r.PathValue("id")
+  if deviceID != s.cfg.Load().DeviceID {
+    writeError(w, http.StatusNotFound, errNotManaged(deviceID))
+    return
+  }
+  var req CommandsRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Commands) == 0 || slices.ContainsFunc(req.Commands, func(c actions.Command) bool { return c.Code == "" }) {
+    writeError(w, http.StatusBadRequest, fmt.Errorf("expected {\"commands\": [{\"code\": \"...\", \"value\": ...}]}"))
+    return
+  }
+  s.appLog.Info("Commands requested via "+s.source, "remote", r.RemoteAddr, "commands", len(req.Commands))
+  trigger := auditTriggerAPI
+  if s.source == "CLI" {
+    trigger = auditTriggerSend
+  }
+  ctx := withAuditTrigger(s.ctx, trigger, "commands via "+s.source, r.RemoteAddr)
+  err := deviceCommands.Do(ctx, deviceID, "send", func(ctx context.Context) error {
+    return sendCommands(ctx, deviceID, req.Commands)
+  })
+  if err != nil {
+    writeError(w, http.StatusBadGateway, err)
+    return
+  }
+  writeJSON(w, http.StatusOK, SendResult{DeviceID: deviceID, Sent: true})
+}
+
+// handleFirmwareUpgrade starts the OTA upgrade of a module through the
+// command queue; `firmware upgrade` polls its progress itself.
+func (s *apiServer) handleFirmwareUpgrade(w http.ResponseWriter, r *http.Request) {
+  deviceID := r.PathValue("id")
+  if deviceID != s.cfg.Load().DeviceID {
+    writeError(w, http.StatusNotFound, errNotManaged(deviceID))
+    return
+  }
+  module, err := strconv.Atoi(r.PathValue("type"))
+  if err != nil {
+    writeError(w, http.StatusBadRequest, fmt.Errorf("invalid module type: %s", r.PathValue("type")))
+    return
+  }
+  s.appLog.Info("Firmware upgrade requested via "+s.source, "remote", r.RemoteAddr, "module", module)
+  trigger := auditTriggerAPI
+  if s.source == "CLI" {
+    trigger = auditTriggerFirmware
+  }
+  ctx := withAuditTrigger(s.ctx, trigger, "firmware upgrade via "+s.source, r.RemoteAddr)
+  if err := startUpgrade(ctx, s.cfg.Load().Preset, deviceID, FirmwareModule{Type: module}); err != nil {
+    writeError(w, http.StatusBadGateway, err)
+    return
+  }
+  writeJSON(w, http.StatusOK, FirmwareUpgrade{DeviceID: deviceID, Module: module})
+}
+
+// handleQueue lists the running and pending command jobs, e.g. to see what
+// a reset is waiting for.
+func (s *apiServer) handleQueue(w http.ResponseWriter, r *http.Request) {
+  writeJSON(w, http.StatusOK, deviceCommands.Snapshot(r.URL.Query().Get("device_id")))
+}
+
+func (s *apiServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+  query := r.URL.Query()
+  var cutoff time.Time
+  if since := query.Get("since"); since != "" {
+    d, err := parseSince(since)
+    if err != nil {
+      writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since: %w", err))
+      return
+    }
+    cutoff = time.Now().Add(-d)
+  }
+
+  entries, err := readHistory(s.cfg.Load())
+  if err != nil {
+    writeError(w, http.StatusInternalServerError, err)
+    return
+  }
+  writeJSON(w, http.StatusOK, filterHistory(entries, query.Get("tag"), query.Get("kind"), cutoff))
+}
+
+type NoteRequest struct {
+  Text string   `json:"text"`
+  Tags []string `json:"tags,omitempty"`
+}
+
+func (s *apiServer) handleAddNote(w http.ResponseWriter, r *http.Request) {
+  var req NoteRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+    writeError(w, http.StatusBadRequest, fmt.Errorf("expected {\"text\": \"...\", \"tags\": [...]}"))
+    return
+  }
+  entry, err := appendHistory(s.cfg.Load(), HistoryEntry{Kind: historyNote, Message: strings.TrimSpace(req.Text), Tags: req.Tags})
+  if err != nil {
+    writeError(w, http.StatusInternalServerError, err)
+    return
+  }
+  writeJSON(w, http.StatusCreated, entry)
+}
+
+func (s *apiServer) handleAnnotate(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.Atoi(r.PathValue("id"))
+  if err != nil {
+    writeError(w, http.StatusBadRequest, fmt.Errorf("invalid history ID: %s", r.PathValue("id")))
+    return
+  }
+  var req NoteRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Text == "" && len(req.Tags) == 0) {
+    writeError(w, http.StatusBadRequest, fmt.Errorf("expected {\"text\": \"...\", \"tags\": [...]}"))
+    return
+  }
+  entry, err := annotateHistory(s.cfg.Load(), id, req.Text, req.Tags)
+  if errors.Is(err, errHistoryNotFound) {
+    writeError(w, http.StatusNotFound, err)
+    return
+  }
+  if err != nil {
+    writeError(w, http.StatusInternalServerError, err)
+    return
+  }
+  writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *apiServer) handlePrune(w http.ResponseWriter, r *http.Request) {
+  var req PruneRequest
+  if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+    writeError(w, http.StatusBadRequest, fmt.Errorf("expected {\"older_than\": \"90d\"}"))
+    return
+  }
+  cfg := s.cfg.Load()
+  retention := cfg.HistoryRetention
+  if req.OlderThan != "" {
+    d, err := parseRetention("older_than", req.OlderThan, 0, minHistoryRetention)
+    if err != nil {
+      writeError(w, http.StatusBadRequest, err)
+      return
+    }
+    retention = d
+  }
+  result, err := pruneHistory(cfg, retention)
+  if err != nil {
+    writeError(w, http.StatusInternalServerError, err)
+    return
+  }
+  writeJSON(w, http.StatusOK, result)
+}
+
+// handleEvents streams events as Server-Sent Events, named after the event
+// type, e.g. for a dashboard using EventSource.
+func (s *apiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+  deviceID := r.URL.Query().Get("device_id")
+  ch, cancel := events.Subscribe()
+  defer cancel()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.WriteHeader(http.StatusOK)
+  rc := http.NewResponseController(w)
+  if err := rc.Flush(); err != nil {
+    return
+  }
+
+  // Comments keep proxies from closing an idle stream.
+  keepalive := time.NewTicker(30 * time.Second)
+  defer keepalive.Stop()
+  for {
+    select {
+    case <-r.Context().Done():
+      return
+    case <-keepalive.C:
+      if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+        return
+      }
+    case event := <-ch:
+      if deviceID != "" && event.DeviceID != deviceID {
+        continue
+      }
+      data, err := json.Marshal(event)
+      if err != nil {
+        continue
+      }
+      if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+        return
+      }
+    }
+    if err := rc.Flush(); err != nil {
+      return
+    }
+  }
+}
+
+// runServe watches the device like `watch` and serves the API alongside.
+func runServe(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+  listen := fs.String("listen", cfg.ServeAddress, "address to listen on, or unix:<path> for a Unix socket")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+
+  live := newLiveConfig(cfg)
+  api := &apiServer{ctx: ctx, cfg: live, appLog: appLog, source: "API", auth: apiAuth{
+    readToken:    cfg.APIReadToken,
+    controlToken: cfg.APIControlToken,
+    clientCA:     cfg.ServeTLSClientCA != "",
+  }}
+  server := &http.Server{
+    Handler:           api.routes(),
+    ReadHeaderTimeout: 10 * time.Second,
+    BaseContext:       func(net.Listener) context.Context { return ctx },
+    Protocols:         new(http.Protocols),
+  }
+  server.Protocols.SetHTTP1(true)
+  // A Unix socket, e.g. of a tenant, is only reached through the server in
+  // front of it, which does TLS itself.
+  socket, unix := strings.CutPrefix(*listen, "unix:")
+  if cfg.ServeTLSCert != "" && !unix {
+    tlsConfig, err := serveTLSConfig(cfg)
+    if err != nil {
+      return err
+    }
+    server.TLSConfig = tlsConfig
+    server.Protocols.SetHTTP2(true)
+  } else {
+    // gRPC clients connect with HTTP/2 without TLS on the same address.
+    server.Protocols.SetUnencryptedHTTP2(true)
+  }
+
+  var listener net.Listener
+  var err error
+  if unix {
+    listener, err = listenSocket(socket)
+  } else {
+    listener, err = net.Listen("tcp", *listen)
+  }
+  if err != nil {
+    return err
+  }
+  if !api.auth.enabled() && !unix && !isLoopback(listener.Addr()) {
+    listener.Close()
+    return fmt.Errorf("refusing to serve the API without authentication on %s, set API_CONTROL_TOKEN or listen on localhost", listener.Addr())
+  }
+
+  // Serve sets up the TLS config for HTTP/2, read it before.
+  useTLS := server.TLSConfig != nil
+  go func() {
+    var err error
+    if useTLS {
+      err = server.ServeTLS(listener, "", "")
+    } else {
+      err = server.Serve(listener)
+    }
+    if err != nil && !errors.Is(err, http.ErrServerClosed) {
+      appLog.Error("API server failed", "error", err)
+    }
+  }()
+  appLog.Info("Serving API", "address", listener.Addr().String(), "tls", useTLS, "authentication", api.auth.enabled())
+
+  runWatch(ctx, live, appLog)
+
+  shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+  defer cancel()
+  return server.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+  "context"
+  "log/slog"
+  "os"
+  "os/signal"
+  "sync"
+)
+
+// shutdownGuard cancels the root context on SIGINT or SIGTERM. A reset
+// sequence in progress is finished and verified first, so the device is
+// never left switched off; a second signal cancels it anyway.
+type shutdownGuard struct {
+  mu        sync.Mutex
+  protected int
+  pending   bool
+  cancelled bool
+  cancel    context.CancelFunc
+  log       *slog.Logger
+}
+
+var shutdown = &shutdownGuard{}
+
+func shutdownContext(appLog *slog.Logger) context.Context {
+  ctx, cancel := context.WithCancel(context.Background())
+  shutdown.cancel, shutdown.log = cancel, appLog
+
+  signals := make(chan os.Signal, 2)
+  signal.Notify(signals, shutdownSignals...)
+  go func() {
+    for sig := range signals {
+      shutdown.signal(sig)
+    }
+  }()
+  return ctx
+}
+
+func (g *shutdownGuard) signal(sig os.Signal) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+
+  switch {
+  case g.cancelled:
+    g.log.Warn("Received another signal, exiting immediately", "signal", sig.String())
+    os.Exit(1)
+  case g.pending:
+    g.log.Warn("Received another signal, interrupting the reset sequence", "signal", sig.String())
+    g.cancelLocked()
+  case g.protected > 0:
+    g.log.Info("Shutting down after the reset sequence has finished, send the signal again to interrupt it", "signal", sig.String())
+    g.pending = true
+  default:
+    g.log.Info("Shutting down", "signal", sig.String())
+    g.cancelLocked()
+  }
+}
+
+func (g *shutdownGuard) cancelLocked() {
+  g.cancelled = true
+  if g.cancel != nil {
+    g.cancel()
+  }
+}
+
+// protect postpones a graceful shutdown until release is called.
+func (g *shutdownGuard) protect() (release func()) {
+  g.mu.Lock()
+  g.protected++
+  g.mu.Unlock()
+
+  var once sync.Once
+  return func() {
+    once.Do(func() {
+      g.mu.Lock()
+      defer g.mu.Unlock()
+      g.protected--
+      if g.protected == 0 && g.pending && !g.cancelled {
+        g.cancelLocked()
+      }
+    })
+  }
+}
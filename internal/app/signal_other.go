@@ -0,0 +1,18 @@
+//go:build windows || plan9
+
+package app
+
+import (
+  "log/slog"
+  "os"
+)
+
+const signalsSupported = false
+
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+func handleCaptureSignal(appLog *slog.Logger) {}
+
+func handleReloadSignal(appLog *slog.Logger, reloads chan<- struct{}) {}
+
+func handleTriggerSignal(appLog *slog.Logger, triggers chan<- struct{}) {}
@@ -0,0 +1,56 @@
+//go:build !windows && !plan9
+
+package app
+
+import (
+  "log/slog"
+  "os"
+  "os/signal"
+  "syscall"
+)
+
+const signalsSupported = true
+
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// handleCaptureSignal toggles the payload capture on SIGUSR2.
+func handleCaptureSignal(appLog *slog.Logger) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGUSR2)
+  go func() {
+    for range signals {
+      capture.Toggle(appLog)
+    }
+  }()
+}
+
+// handleTriggerSignal requests an immediate check on SIGUSR1.
+func handleTriggerSignal(appLog *slog.Logger, triggers chan<- struct{}) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGUSR1)
+  go func() {
+    for range signals {
+      appLog.Info("Received SIGUSR1, checking now")
+      select {
+      case triggers <- struct{}{}:
+      default:
+      }
+    }
+  }()
+}
+
+// handleReloadSignal requests a config reload on SIGHUP. Reloads are applied
+// by the poll loop between checks.
+func handleReloadSignal(appLog *slog.Logger, reloads chan<- struct{}) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGHUP)
+  go func() {
+    for range signals {
+      appLog.Info("Received SIGHUP, reloading config")
+      select {
+      case reloads <- struct{}{}:
+      default:
+      }
+    }
+  }()
+}
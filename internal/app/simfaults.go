@@ -0,0 +1,106 @@
+package app
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log/slog"
+  "math/rand/v2"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// simFaults injects failures into the simulated Tuya API, so retries, the
+// circuit breaker and escalations can be exercised: a share of the requests
+// is dropped without a response, every response is delayed, and commands
+// matching failCommands are answered with success=false.
+type simFaults struct {
+  dropPercent  int
+  delay        time.Duration
+  failCommands []string
+  logger       *slog.Logger
+}
+
+// parseFailCommands parses a comma-separated list of DP codes, each
+// optionally with the value to fail on, e.g. "switch=true,manual_clean".
+func parseFailCommands(s string) ([]string, error) {
+  if s == "" {
+    return nil, nil
+  }
+  var commands []string
+  for _, c := range strings.Split(s, ",") {
+    c = strings.TrimSpace(c)
+    if code, _, _ := strings.Cut(c, "="); code == "" {
+      return nil, fmt.Errorf("invalid --fail-command %q (expected comma-separated codes, each optionally with =value)", s)
+    }
+    commands = append(commands, c)
+  }
+  return commands, nil
+}
+
+func (f *simFaults) enabled() bool {
+  return f.dropPercent > 0 || f.delay > 0 || len(f.failCommands) > 0
+}
+
+// failsCommand reports whether a command is one to fail.
+func (f *simFaults) failsCommand(code string, value interface{}) bool {
+  for _, c := range f.failCommands {
+    wantCode, wantValue, hasValue := strings.Cut(c, "=")
+    if wantCode == code && (!hasValue || wantValue == fmt.Sprint(value)) {
+      return true
+    }
+  }
+  return false
+}
+
+func (f *simFaults) wrap(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if f.delay > 0 {
+      select {
+      case <-time.After(f.delay):
+      case <-r.Context().Done():
+        return
+      }
+    }
+
+    if f.dropPercent > 0 && rand.IntN(100) < f.dropPercent {
+      f.logger.Info("Injected fault: dropping request", "method", r.Method, "uri", r.URL.Path)
+      if hijacker, ok := w.(http.Hijacker); ok {
+        if conn, _, err := hijacker.Hijack(); err == nil {
+          conn.Close()
+          return
+        }
+      }
+      // Without hijacking, the closest to a dropped connection.
+      w.WriteHeader(http.StatusBadGateway)
+      return
+    }
+
+    if len(f.failCommands) > 0 && r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/commands") {
+      body, err := io.ReadAll(r.Body)
+      if err != nil {
+        return
+      }
+      r.Body = io.NopCloser(bytes.NewReader(body))
+      var payload struct {
+        Commands []struct {
+          Code  string      `json:"code"`
+          Value interface{} `json:"value"`
+        } `json:"commands"`
+      }
+      if json.Unmarshal(body, &payload) == nil {
+        for _, c := range payload.Commands {
+          if f.failsCommand(c.Code, c.Value) {
+            f.logger.Info("Injected fault: failing command", "code", c.Code, "value", c.Value)
+            simError(w, 500, "system error, please try again later")
+            return
+          }
+        }
+      }
+    }
+
+    next.ServeHTTP(w, r)
+  })
+}
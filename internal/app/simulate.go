@@ -0,0 +1,499 @@
+package app
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net"
+  "net/http"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// simStep changes the simulated device After the simulator started. DPs
+// that change are logged like a real device reports them.
+type simStep struct {
+  After  string                 `json:"after"`
+  Online *bool                  `json:"online,omitempty"`
+  DPs    map[string]interface{} `json:"dps,omitempty"`
+
+  after time.Duration
+}
+
+// simScenario scripts the simulated litter box. A manual_clean command runs
+// a clean cycle of CleanTime; it ends in standby when RecoverOnReset is set
+// and back at the status it started from otherwise.
+type simScenario struct {
+  Description    string    `json:"description"`
+  Steps          []simStep `json:"steps"`
+  RecoverOnReset bool      `json:"recover_on_reset"`
+  CleanTime      string    `json:"clean_time,omitempty"`
+
+  cleanTime time.Duration
+}
+
+func simBool(b bool) *bool {
+  return &b
+}
+
+var simScenarios = map[string]simScenario{
+  "healthy": {
+    Description: "stays in standby",
+  },
+  "stuck": {
+    Description: "reports Clean_Pause after 30s, recovers after a reset",
+    Steps: []simStep{
+      {After: "30s", DPs: map[string]interface{}{"status": "Clean_Pause"}},
+    },
+    RecoverOnReset: true,
+  },
+  "stuck-forever": {
+    Description: "reports Clean_Pause after 30s, a reset does not help",
+    Steps: []simStep{
+      {After: "30s", DPs: map[string]interface{}{"status": "Clean_Pause"}},
+    },
+  },
+  "offline": {
+    Description: "goes offline after 30s and comes back 2m later",
+    Steps: []simStep{
+      {After: "30s", Online: simBool(false)},
+      {After: "2m30s", Online: simBool(true)},
+    },
+  },
+  "fault": {
+    Description: "reports fault bit 0 after 30s, recovers after a reset",
+    Steps: []simStep{
+      {After: "30s", DPs: map[string]interface{}{"fault": 1, "status": "Clean_Pause"}},
+    },
+    RecoverOnReset: true,
+  },
+  "drawer-full": {
+    Description: "reports a full waste drawer after 30s",
+    Steps: []simStep{
+      {After: "30s", DPs: map[string]interface{}{"full_fault_alarm": true}},
+    },
+  },
+}
+
+func simScenarioNames() []string {
+  names := make([]string, 0, len(simScenarios))
+  for name := range simScenarios {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// loadSimScenario reads a scenario file, see simScenario.
+func loadSimScenario(path string) (simScenario, error) {
+  var scenario simScenario
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return scenario, err
+  }
+  if err := json.Unmarshal(data, &scenario); err != nil {
+    return scenario, fmt.Errorf("invalid scenario %s: %w", path, err)
+  }
+  return scenario, nil
+}
+
+func (s *simScenario) parse() error {
+  for i := range s.Steps {
+    d, err := time.ParseDuration(s.Steps[i].After)
+    if err != nil {
+      return fmt.Errorf("invalid after of step %d: %q", i+1, s.Steps[i].After)
+    }
+    s.Steps[i].after = d
+  }
+  sort.SliceStable(s.Steps, func(i, j int) bool { return s.Steps[i].after < s.Steps[j].after })
+  s.cleanTime = 10 * time.Second
+  if s.CleanTime != "" {
+    d, err := time.ParseDuration(s.CleanTime)
+    if err != nil || d <= 0 {
+      return fmt.Errorf("invalid clean_time: %q", s.CleanTime)
+    }
+    s.cleanTime = d
+  }
+  return nil
+}
+
+type simLog struct {
+  Code  string
+  Value interface{}
+  Time  time.Time
+}
+
+// simDevice is the state of the simulated litter box.
+type simDevice struct {
+  mu       sync.Mutex
+  id       string
+  scenario simScenario
+  started  time.Time
+  applied  int
+  online   bool
+  dps      map[string]interface{}
+  logs     []simLog
+  // cleanUntil is the end of a running clean cycle, resumeStatus the status
+  // it ends in.
+  cleanUntil   time.Time
+  resumeStatus string
+  logger       *slog.Logger
+}
+
+// simDPs are the DPs of the simulated device, in the order of the
+// specification, with their DP IDs.
+var simDPs = []struct {
+  Code     string
+  DPID     int
+  Type     string
+  Writable bool
+}{
+  {"switch", 1, "Boolean", true},
+  {"manual_clean", 2, "Boolean", true},
+  {"status", 3, "Enum", false},
+  {"fault", 4, "Bitmap", false},
+  {"full_fault_alarm", 5, "Boolean", false},
+  {"cat_weight", 6, "Integer", false},
+}
+
+func newSimDevice(id string, scenario simScenario, logger *slog.Logger) *simDevice {
+  d := &simDevice{
+    id:       id,
+    scenario: scenario,
+    started:  time.Now(),
+    online:   true,
+    dps: map[string]interface{}{
+      "switch":           true,
+      "manual_clean":     false,
+      "status":           "standby",
+      "fault":            0,
+      "full_fault_alarm": false,
+      "cat_weight":       0,
+    },
+    logger: logger,
+  }
+  // A finished clean cycle an hour ago, so the device does not look idle.
+  d.logs = append(d.logs, simLog{"status", "Clean_Finish", d.started.Add(-time.Hour)})
+  return d
+}
+
+// setLocked changes a DP and logs the change.
+func (d *simDevice) setLocked(code string, value interface{}, now time.Time) {
+  if fmt.Sprint(d.dps[code]) == fmt.Sprint(value) {
+    return
+  }
+  d.dps[code] = value
+  d.logs = append(d.logs, simLog{code, value, now})
+  d.logger.Info("Simulated device changed", "code", code, "value", value)
+}
+
+// advanceLocked applies the scenario steps and ends clean cycles that are due.
+func (d *simDevice) advanceLocked(now time.Time) {
+  for d.applied < len(d.scenario.Steps) && now.Sub(d.started) >= d.scenario.Steps[d.applied].after {
+    step := d.scenario.Steps[d.applied]
+    d.applied++
+    if step.Online != nil && *step.Online != d.online {
+      d.online = *step.Online
+      d.logger.Info("Simulated device changed", "online", d.online)
+    }
+    keys := make([]string, 0, len(step.DPs))
+    for code := range step.DPs {
+      keys = append(keys, code)
+    }
+    sort.Strings(keys)
+    for _, code := range keys {
+      d.setLocked(code, step.DPs[code], now)
+    }
+  }
+  if !d.cleanUntil.IsZero() && !now.Before(d.cleanUntil) {
+    d.cleanUntil = time.Time{}
+    if d.resumeStatus == "standby" {
+      d.setLocked("status", "Clean_Finish", now)
+      d.setLocked("fault", 0, now)
+    }
+    d.setLocked("status", d.resumeStatus, now)
+    d.setLocked("manual_clean", false, now)
+  }
+}
+
+// commandLocked applies a command the way the device would. It reports
+// false for a code or value the device does not accept.
+func (d *simDevice) commandLocked(code string, value interface{}, now time.Time) bool {
+  switch code {
+  case "switch":
+    on, ok := value.(bool)
+    if !ok {
+      return false
+    }
+    d.setLocked("switch", on, now)
+  case "manual_clean":
+    start, ok := value.(bool)
+    if !ok {
+      return false
+    }
+    if !start || d.dps["switch"] != true || !d.cleanUntil.IsZero() {
+      return true
+    }
+    d.resumeStatus = fmt.Sprint(d.dps["status"])
+    if d.scenario.RecoverOnReset {
+      d.resumeStatus = "standby"
+    }
+    d.cleanUntil = now.Add(d.scenario.cleanTime)
+    d.setLocked("manual_clean", true, now)
+    d.setLocked("status", "cleaning", now)
+  default:
+    return false
+  }
+  return true
+}
+
+func (d *simDevice) statusList() []interface{} {
+  list := make([]interface{}, 0, len(simDPs))
+  for _, dp := range simDPs {
+    list = append(list, map[string]interface{}{"code": dp.Code, "value": d.dps[dp.Code]})
+  }
+  return list
+}
+
+func simReply(w http.ResponseWriter, result interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  _ = json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "code": 0, "t": time.Now().UnixMilli(), "result": result})
+}
+
+func simError(w http.ResponseWriter, code int, msg string) {
+  w.Header().Set("Content-Type", "application/json")
+  _ = json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "code": code, "msg": msg, "t": time.Now().UnixMilli()})
+}
+
+// ServeHTTP answers the Tuya API endpoints the fixer uses. Requests are not
+// signed or checked; any credentials work.
+func (d *simDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  now := time.Now()
+  d.advanceLocked(now)
+  d.logger.Debug("Simulator request", "method", r.Method, "uri", r.URL.RequestURI())
+
+  path := r.URL.Path
+  if path == "/v1.0/token" {
+    simReply(w, map[string]interface{}{"access_token": "simulated", "refresh_token": "simulated", "expire_time": 7200, "uid": "simulator"})
+    return
+  }
+  if path == "/v1.0/iot-01/associated-users/devices" {
+    device := map[string]interface{}{"id": d.id, "name": "Simulated litter box", "category": "msp", "product_name": "Simulated cat toilet", "online": d.online}
+    simReply(w, map[string]interface{}{"devices": []interface{}{device}, "has_more": false, "last_row_key": ""})
+    return
+  }
+
+  var rest string
+  var ok bool
+  if rest, ok = strings.CutPrefix(path, "/v1.0/devices/"); !ok {
+    if rest, ok = strings.CutPrefix(path, "/v2.0/cloud/thing/"); !ok {
+      simError(w, 1108, "uri path invalid")
+      return
+    }
+  }
+  id, endpoint, _ := strings.Cut(rest, "/")
+  if id != d.id {
+    simError(w, 1106, "permission deny")
+    return
+  }
+
+  switch {
+  case endpoint == "" && r.Method == http.MethodGet:
+    simReply(w, map[string]interface{}{
+      "id":          d.id,
+      "name":        "Simulated litter box",
+      "category":    "msp",
+      "online":      d.online,
+      "time_zone":   formatZoneOffset(zoneOffset(now)),
+      "update_time": d.started.Unix(),
+      "status":      d.statusList(),
+    })
+  case endpoint == "specifications":
+    var functions, status []interface{}
+    for _, dp := range simDPs {
+      f := map[string]interface{}{"code": dp.Code, "dp_id": dp.DPID, "type": dp.Type, "values": "{}"}
+      status = append(status, f)
+      if dp.Writable {
+        functions = append(functions, f)
+      }
+    }
+    simReply(w, map[string]interface{}{"category": "msp", "functions": functions, "status": status})
+  case endpoint == "shadow/properties":
+    var properties []interface{}
+    for _, dp := range simDPs {
+      properties = append(properties, map[string]interface{}{"code": dp.Code, "dp_id": dp.DPID, "value": d.dps[dp.Code], "time": now.UnixMilli()})
+    }
+    simReply(w, map[string]interface{}{"properties": properties})
+  case endpoint == "logs":
+    start, _ := strconv.ParseInt(r.URL.Query().Get("start_time"), 10, 64)
+    end, err := strconv.ParseInt(r.URL.Query().Get("end_time"), 10, 64)
+    if err != nil {
+      end = now.UnixMilli()
+    }
+    size, err := strconv.Atoi(r.URL.Query().Get("size"))
+    if err != nil || size <= 0 {
+      size = maxLogPageSize
+    }
+    logs := []interface{}{}
+    for i := len(d.logs) - 1; i >= 0 && len(logs) < size; i-- {
+      entry := d.logs[i]
+      if t := entry.Time.UnixMilli(); t >= start && t <= end {
+        logs = append(logs, map[string]interface{}{"code": entry.Code, "value": fmt.Sprint(entry.Value), "event_time": entry.Time.UnixMilli()})
+      }
+    }
+    simReply(w, map[string]interface{}{"logs": logs, "has_next": false})
+  case endpoint == "commands" && r.Method == http.MethodPost:
+    if !d.online {
+      simError(w, 2001, "device is offline")
+      return
+    }
+    var body struct {
+      Commands []struct {
+        Code  string      `json:"code"`
+        Value interface{} `json:"value"`
+      } `json:"commands"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+      simError(w, 1109, "param is illegal")
+      return
+    }
+    for _, c := range body.Commands {
+      if !d.commandLocked(c.Code, c.Value, now) {
+        simError(w, 2008, "command or value not support")
+        return
+      }
+    }
+    simReply(w, true)
+  case endpoint == "upgrade-info":
+    simReply(w, []interface{}{
+      map[string]interface{}{"type": 9, "type_desc": "wifi", "current_version": "1.0.0", "version": "1.0.0", "upgrade_status": 0},
+      map[string]interface{}{"type": 0, "type_desc": "mcu", "current_version": "1.0.0", "version": "1.0.0", "upgrade_status": 0},
+    })
+  default:
+    simError(w, 1108, "uri path invalid")
+  }
+}
+
+func zoneOffset(t time.Time) int {
+  _, offset := t.Zone()
+  return offset
+}
+
+// runSimulate serves a simulated litter box on a local Tuya API. With a
+// command after the flags, it runs that command against the simulator and
+// exits with its status; otherwise it prints the settings to use and serves
+// until interrupted. Runs before the config is loaded, like init.
+func runSimulate(ctx context.Context, args []string) (int, error) {
+  fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+  scenarioName := fs.String("scenario", "stuck", "built-in scenario: "+strings.Join(simScenarioNames(), ", "))
+  file := fs.String("file", "", "scenario file to run instead of a built-in one")
+  listen := fs.String("listen", "127.0.0.1:18090", "address to serve the simulated Tuya API on")
+  deviceID := fs.String("device", "simulated-litter-box", "ID of the simulated device")
+  list := fs.Bool("list", false, "list the built-in scenarios")
+  faults := &simFaults{logger: slog.Default()}
+  fs.IntVar(&faults.dropPercent, "drop", 0, "percentage of API requests to drop without a response")
+  fs.DurationVar(&faults.delay, "delay", 0, "delay every API response by this long")
+  failCommands := fs.String("fail-command", "", "answer commands with success=false, e.g. switch=true,manual_clean")
+  if err := fs.Parse(args); err != nil {
+    return 0, err
+  }
+  if faults.dropPercent < 0 || faults.dropPercent > 100 {
+    return 0, fmt.Errorf("invalid --drop: %d (expected a percentage from 0 to 100)", faults.dropPercent)
+  }
+  if faults.delay < 0 {
+    return 0, fmt.Errorf("invalid --delay: %s", faults.delay)
+  }
+  var err error
+  if faults.failCommands, err = parseFailCommands(*failCommands); err != nil {
+    return 0, err
+  }
+  if *list {
+    for _, name := range simScenarioNames() {
+      fmt.Printf("%-14s %s\n", name, simScenarios[name].Description)
+    }
+    return 0, nil
+  }
+
+  scenario, ok := simScenarios[*scenarioName]
+  if *file != "" {
+    if scenario, err = loadSimScenario(*file); err != nil {
+      return 0, err
+    }
+  } else if !ok {
+    return 0, fmt.Errorf("unknown scenario %q (valid: %s)", *scenarioName, strings.Join(simScenarioNames(), ", "))
+  }
+  // The built-in scenarios share their steps.
+  scenario.Steps = append([]simStep(nil), scenario.Steps...)
+  if err := scenario.parse(); err != nil {
+    return 0, err
+  }
+
+  listener, err := net.Listen("tcp", *listen)
+  if err != nil {
+    return 0, fmt.Errorf("failed to listen on %s: %w", *listen, err)
+  }
+  var handler http.Handler = newSimDevice(*deviceID, scenario, slog.Default())
+  if faults.enabled() {
+    handler = faults.wrap(handler)
+  }
+  server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+  go func() {
+    if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+      slog.Error("Simulator failed", "error", err)
+    }
+  }()
+  defer server.Close()
+
+  // The simulated device gets its own state, so it does not mix with the
+  // history of a real one.
+  env := []string{
+    "TUYA_API_HOST=http://" + listener.Addr().String(),
+    "TUYA_REGION=simulator",
+    "TUYA_ACCESS_ID=simulator",
+    "TUYA_ACCESS_KEY=simulator",
+    "TUYA_DEVICE_ID=" + *deviceID,
+    "STATE_DIR=" + filepath.Join(os.TempDir(), "shitbox-fixer-simulator"),
+  }
+
+  if fs.NArg() == 0 {
+    fmt.Printf("Simulating a litter box on %s", listener.Addr())
+    if scenario.Description != "" {
+      fmt.Printf(" that %s", scenario.Description)
+    }
+    fmt.Print(". Point shitbox-fixer at it with:\n\n")
+    for _, kv := range env {
+      fmt.Printf("  %s\n", kv)
+    }
+    fmt.Println()
+    <-ctx.Done()
+    return 0, nil
+  }
+
+  executable, err := os.Executable()
+  if err != nil {
+    return 0, err
+  }
+  // Not tied to ctx: the command gets the same signals and shuts down on
+  // its own.
+  cmd := exec.Command(executable, fs.Args()...)
+  // Later entries win, so the simulator overrides the real device.
+  cmd.Env = append(os.Environ(), env...)
+  cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+  err = cmd.Run()
+  var exitErr *exec.ExitError
+  if errors.As(err, &exitErr) {
+    return exitErr.ExitCode(), nil
+  }
+  return 0, err
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+  "bytes"
+  "fmt"
+  "os"
+  "os/exec"
+  "strings"
+)
+
+// readConfigFile returns the contents of a config file, decrypting it first
+// when it was encrypted with SOPS (any key type, e.g. age) or age.
+// Decryption uses the sops and age binaries, so their usual key lookup
+// applies: SOPS_AGE_KEY_FILE for sops, AGE_IDENTITY_FILE for age.
+func readConfigFile(path string) ([]byte, error) {
+  if strings.HasSuffix(path, ".age") {
+    identity := os.Getenv("AGE_IDENTITY_FILE")
+    if identity == "" {
+      return nil, fmt.Errorf("%s is age encrypted, set AGE_IDENTITY_FILE to the identity to decrypt it with", path)
+    }
+    return decryptWith("age", "--decrypt", "--identity", identity, path)
+  }
+
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  format := "dotenv"
+  if isYAMLConfig(path) {
+    format = "yaml"
+  }
+  if isSopsFile(data, format) {
+    return decryptWith("sops", "--decrypt", "--input-type", format, "--output-type", format, path)
+  }
+  return data, nil
+}
+
+// isSopsFile looks for the metadata SOPS adds to encrypted files.
+func isSopsFile(data []byte, format string) bool {
+  for _, line := range strings.Split(string(data), "\n") {
+    if format == "dotenv" && strings.HasPrefix(strings.TrimSpace(line), "sops_mac=") {
+      return true
+    }
+    if format == "yaml" && strings.TrimRight(line, " \r") == "sops:" {
+      return true
+    }
+  }
+  return false
+}
+
+func decryptWith(name string, args ...string) ([]byte, error) {
+  if _, err := exec.LookPath(name); err != nil {
+    return nil, fmt.Errorf("%s is needed to decrypt %s but was not found in PATH", name, args[len(args)-1])
+  }
+  var stderr bytes.Buffer
+  cmd := exec.Command(name, args...)
+  cmd.Stderr = &stderr
+  out, err := cmd.Output()
+  if err != nil {
+    return nil, fmt.Errorf("failed to decrypt %s with %s: %w: %s", args[len(args)-1], name, err, strings.TrimSpace(stderr.String()))
+  }
+  return out, nil
+}
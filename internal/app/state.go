@@ -0,0 +1,70 @@
+package app
+
+import (
+  "encoding/json"
+  "errors"
+  "os"
+  "path/filepath"
+)
+
+func defaultStateDir() string {
+  if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+    return filepath.Join(dir, "shitbox-fixer")
+  }
+  if home, err := os.UserHomeDir(); err == nil {
+    return filepath.Join(home, ".local", "state", "shitbox-fixer")
+  }
+  return ".shitbox-fixer"
+}
+
+func statePath(cfg *Config, name string) (string, error) {
+  if err := os.MkdirAll(cfg.StateDir, 0o700); err != nil {
+    return "", err
+  }
+  return filepath.Join(cfg.StateDir, name), nil
+}
+
+// loadStateFile reads a JSON state file into v, leaving v alone when the file
+// does not exist yet.
+func loadStateFile(path string, v interface{}) error {
+  data, err := os.ReadFile(path)
+  if errors.Is(err, os.ErrNotExist) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  return json.Unmarshal(data, v)
+}
+
+// saveStateFile writes v as JSON to a temporary file next to path and
+// renames it into place, so a crash never leaves a truncated state file.
+func saveStateFile(path string, v interface{}) error {
+  data, err := json.Marshal(v)
+  if err != nil {
+    return err
+  }
+  return writeStateFile(path, data)
+}
+
+// writeStateFile atomically replaces path with data.
+func writeStateFile(path string, data []byte) error {
+  tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+  if err != nil {
+    return err
+  }
+  _, err = tmp.Write(data)
+  if err == nil {
+    err = tmp.Sync()
+  }
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Rename(tmp.Name(), path)
+  }
+  if err != nil {
+    os.Remove(tmp.Name())
+  }
+  return err
+}
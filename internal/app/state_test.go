@@ -0,0 +1,49 @@
+package app
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestSaveStateFile(t *testing.T) {
+  dir := t.TempDir()
+  path := filepath.Join(dir, "state.json")
+  for _, want := range []string{"first", "second"} {
+    if err := saveStateFile(path, map[string]string{"value": want}); err != nil {
+      t.Fatal(err)
+    }
+    got := map[string]string{}
+    if err := loadStateFile(path, &got); err != nil {
+      t.Fatal(err)
+    }
+    if got["value"] != want {
+      t.Errorf("loadStateFile() = %q, want %q", got["value"], want)
+    }
+  }
+
+  files, err := os.ReadDir(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(files) != 1 {
+    t.Errorf("state dir has %d files, want only state.json", len(files))
+  }
+  info, err := os.Stat(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if perm := info.Mode().Perm(); perm != 0o600 {
+    t.Errorf("state file mode = %o, want 600", perm)
+  }
+}
+
+func TestLoadStateFileMissing(t *testing.T) {
+  got := map[string]string{"value": "default"}
+  if err := loadStateFile(filepath.Join(t.TempDir(), "missing.json"), &got); err != nil {
+    t.Fatal(err)
+  }
+  if got["value"] != "default" {
+    t.Errorf("loadStateFile() changed v to %q for a missing file", got["value"])
+  }
+}
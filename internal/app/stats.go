@@ -0,0 +1,367 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Tuya keeps device logs for a limited time, 7 days on the free plan, so
+// cleans can only be counted that far back.
+const statsLogLimit = 5000
+
+const statsChartWidth = 40
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// DayStats counts what happened on one day in TIMEZONE.
+type DayStats struct {
+  Day            string         `json:"day"`
+  Cleans         int            `json:"cleans"`
+  Visits         int            `json:"visits"`
+  Resets         int            `json:"resets"`
+  FailedResets   int            `json:"failed_resets"`
+  OfflineMinutes int            `json:"offline_minutes"`
+  Stuck          map[string]int `json:"stuck,omitempty"`
+
+  // The sum of the intervals ending with a clean that day, so averages over
+  // several days stay exact.
+  CleanIntervals       int `json:"clean_intervals,omitempty"`
+  CleanIntervalMinutes int `json:"clean_interval_minutes,omitempty"`
+}
+
+// isCleanEvent reports whether a device log entry marks a clean cycle.
+func isCleanEvent(preset Preset, logMap map[string]interface{}) bool {
+  value, ok := logMap["value"].(string)
+  if !ok {
+    return false
+  }
+  for _, clean := range preset.CleanValues {
+    if strings.EqualFold(value, clean) {
+      return true
+    }
+  }
+  return false
+}
+
+// isVisitEvent reports whether a device log entry marks a cat visit.
+func isVisitEvent(preset Preset, logMap map[string]interface{}) bool {
+  code, ok := logMap["code"].(string)
+  if !ok {
+    return false
+  }
+  for _, visit := range preset.VisitCodes {
+    if code == visit {
+      return true
+    }
+  }
+  return false
+}
+
+// stuckEvent returns the stuck value of a device log entry, if any.
+func stuckEvent(preset Preset, logMap map[string]interface{}) (string, bool) {
+  value, ok := logMap["value"].(string)
+  if !ok {
+    return "", false
+  }
+  for _, stuck := range preset.StuckValues {
+    if value == stuck {
+      return value, true
+    }
+  }
+  return "", false
+}
+
+// localDay returns the start of the day of t in TIMEZONE.
+func localDay(cfg *Config, t time.Time) time.Time {
+  t = t.In(cfg.TimeFormat.Location)
+  return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, cfg.TimeFormat.Location)
+}
+
+// dailyStats returns the stats of the last days, oldest first. Completed
+// days come from the rollups when the watcher stored them, the rest is
+// counted from the history and device logs. The second result is false when
+// the logs could not be read, so cleans are unknown rather than zero.
+func dailyStats(ctx context.Context, cfg *Config, appLog *slog.Logger, days int) ([]DayStats, bool, error) {
+  start := localDay(cfg, time.Now()).AddDate(0, 0, -(days - 1))
+
+  rollups, err := loadRollups(cfg)
+  if err != nil {
+    return nil, false, err
+  }
+  rolled := map[string]DayStats{}
+  for _, s := range rollups[cfg.DeviceID] {
+    rolled[s.Day] = s
+  }
+  var stats []DayStats
+  for len(stats) < days {
+    s, ok := rolled[start.AddDate(0, 0, len(stats)).Format("2006-01-02")]
+    if !ok {
+      break
+    }
+    stats = append(stats, s)
+  }
+
+  // The daemon owns the history while it runs.
+  var entries []HistoryEntry
+  err = daemonRequest(ctx, cfg, http.MethodGet, "/api/history?"+url.Values{"since": {strconv.Itoa(days-len(stats)) + "d"}}.Encode(), nil, &entries)
+  if errors.Is(err, errNoDaemon) {
+    entries, err = readHistory(cfg)
+  }
+  if err != nil {
+    return nil, false, err
+  }
+  counted, haveCleans, err := countStats(ctx, cfg, appLog, entries, start.AddDate(0, 0, len(stats)), days-len(stats))
+  if err != nil {
+    return nil, false, err
+  }
+  // Days before the first rollup may be followed by rolled up ones.
+  for i, s := range counted {
+    if r, ok := rolled[s.Day]; ok {
+      counted[i] = r
+    }
+  }
+  return append(stats, counted...), haveCleans, nil
+}
+
+// countStats counts cleans, visits and stuck states from the device logs, and resets
+// and offline time from the history entries, for the days from start.
+func countStats(ctx context.Context, cfg *Config, appLog *slog.Logger, entries []HistoryEntry, start time.Time, days int) ([]DayStats, bool, error) {
+  stats := make([]DayStats, days)
+  if days == 0 {
+    return stats, true, nil
+  }
+  index := map[string]int{}
+  for i := range stats {
+    stats[i].Day = start.AddDate(0, 0, i).Format("2006-01-02")
+    index[stats[i].Day] = i
+  }
+  day := func(t time.Time) (*DayStats, bool) {
+    i, ok := index[localDay(cfg, t).Format("2006-01-02")]
+    if !ok {
+      return nil, false
+    }
+    return &stats[i], true
+  }
+
+  outage, err := loadOutage(cfg)
+  if err != nil {
+    return nil, false, err
+  }
+  if outage != nil && outage.DeviceID == cfg.DeviceID {
+    until := time.Now()
+    entries = append(entries, HistoryEntry{Time: outage.Since, DeviceID: outage.DeviceID, Kind: historyOffline, Until: &until})
+  }
+
+  for _, entry := range entries {
+    if entry.DeviceID != "" && entry.DeviceID != cfg.DeviceID {
+      continue
+    }
+    if entry.Kind == historyOffline && entry.Until != nil {
+      // Split the period at midnight.
+      for i := range stats {
+        dayStart := start.AddDate(0, 0, i)
+        from, to := entry.Time, *entry.Until
+        if from.Before(dayStart) {
+          from = dayStart
+        }
+        if dayEnd := dayStart.AddDate(0, 0, 1); to.After(dayEnd) {
+          to = dayEnd
+        }
+        if to.After(from) {
+          stats[i].OfflineMinutes += int(to.Sub(from).Minutes())
+        }
+      }
+      continue
+    }
+    if s, ok := day(entry.Time); ok {
+      switch entry.Kind {
+      case actionReset:
+        s.Resets++
+      case actionResetFailed:
+        s.FailedResets++
+      }
+    }
+  }
+
+  logs, err := queryDeviceLogs(ctx, cfg.DeviceID, LogQuery{Since: time.Since(start), DPIDs: logDPIDs(ctx, cfg), Limit: statsLogLimit})
+  if err != nil {
+    appLog.Warn("Failed to read device logs, cleans are not counted", "error", err)
+    return stats, false, nil
+  }
+  // Logs come newest first, intervals need the cleans in order.
+  var cleans []time.Time
+  for _, logEntry := range logs {
+    logMap, ok := logEntry.(map[string]interface{})
+    if !ok {
+      continue
+    }
+    eventTime, _ := logMap["event_time"].(float64)
+    t := time.UnixMilli(int64(eventTime))
+    s, ok := day(t)
+    if !ok {
+      continue
+    }
+    if isCleanEvent(cfg.Preset, logMap) {
+      s.Cleans++
+      cleans = append(cleans, t)
+    }
+    if isVisitEvent(cfg.Preset, logMap) {
+      s.Visits++
+    }
+    if value, ok := stuckEvent(cfg.Preset, logMap); ok {
+      if s.Stuck == nil {
+        s.Stuck = map[string]int{}
+      }
+      s.Stuck[value]++
+    }
+  }
+  sort.Slice(cleans, func(i, j int) bool { return cleans[i].Before(cleans[j]) })
+  for i := 1; i < len(cleans); i++ {
+    s, _ := day(cleans[i])
+    s.CleanIntervals++
+    s.CleanIntervalMinutes += int(cleans[i].Sub(cleans[i-1]).Minutes())
+  }
+  return stats, true, nil
+}
+
+func sparkline(values []int) string {
+  max := 0
+  for _, v := range values {
+    if v > max {
+      max = v
+    }
+  }
+  var b strings.Builder
+  for _, v := range values {
+    if max == 0 {
+      b.WriteRune(sparkBlocks[0])
+      continue
+    }
+    b.WriteRune(sparkBlocks[v*(len(sparkBlocks)-1)/max])
+  }
+  return b.String()
+}
+
+// barWidth scales value to the chart width, keeping at least one block for
+// anything above zero.
+func barWidth(value, max int) int {
+  if value == 0 || max == 0 {
+    return 0
+  }
+  if width := value * statsChartWidth / max; width > 0 {
+    return width
+  }
+  return 1
+}
+
+func colorize(s, color string, enabled bool) string {
+  if !enabled || color == "" || s == "" {
+    return s
+  }
+  return "\033[" + color + "m" + s + "\033[0m"
+}
+
+// printBars draws a bar per day of one value.
+func printBars(title string, stats []DayStats, value func(DayStats) int, color string, enabled bool) {
+  max := 0
+  for _, s := range stats {
+    if value(s) > max {
+      max = value(s)
+    }
+  }
+  fmt.Printf("\n%s per day\n", title)
+  for _, s := range stats {
+    fmt.Printf("%s  %s %d\n", s.Day[5:], colorize(strings.Repeat("█", barWidth(value(s), max)), color, enabled), value(s))
+  }
+}
+
+// printStatsChart draws sparklines of the whole period and a bar per day.
+func printStatsChart(stats []DayStats, haveCleans bool) {
+  color := useColor()
+  var cleans, visits, resets []int
+  maxResets := 0
+  for _, s := range stats {
+    cleans = append(cleans, s.Cleans)
+    visits = append(visits, s.Visits)
+    resets = append(resets, s.Resets+s.FailedResets)
+    if s.Resets+s.FailedResets > maxResets {
+      maxResets = s.Resets + s.FailedResets
+    }
+  }
+
+  fmt.Printf("%s to %s\n", stats[0].Day, stats[len(stats)-1].Day)
+  if haveCleans {
+    fmt.Printf("cleans  %s\n", colorize(sparkline(cleans), colorGreen, color))
+    fmt.Printf("visits  %s\n", colorize(sparkline(visits), colorCyan, color))
+  }
+  fmt.Printf("resets  %s\n", colorize(sparkline(resets), colorYellow, color))
+
+  if haveCleans {
+    printBars("Cleans", stats, func(s DayStats) int { return s.Cleans }, colorGreen, color)
+    printBars("Visits", stats, func(s DayStats) int { return s.Visits }, colorCyan, color)
+  }
+  fmt.Println("\nResets per day")
+  for _, s := range stats {
+    // Failed resets continue the bar in red.
+    resetWidth := barWidth(s.Resets, maxResets)
+    failedWidth := barWidth(s.Resets+s.FailedResets, maxResets) - resetWidth
+    line := colorize(strings.Repeat("█", resetWidth), colorYellow, color) + colorize(strings.Repeat("█", failedWidth), colorRed, color)
+    count := strconv.Itoa(s.Resets)
+    if s.FailedResets > 0 {
+      count += fmt.Sprintf(" (+%d failed)", s.FailedResets)
+    }
+    fmt.Printf("%s  %s %s\n", s.Day[5:], line, count)
+  }
+}
+
+func runStats(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+  days := fs.Int("days", 14, "number of days to show, up to today")
+  chart := fs.Bool("chart", false, "draw a chart of cleans, visits and resets per day")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+  if *days <= 0 {
+    return fmt.Errorf("--days must be positive")
+  }
+
+  stats, haveCleans, err := dailyStats(ctx, cfg, appLog, *days)
+  if err != nil {
+    return err
+  }
+
+  if cfg.Output == outputJSON {
+    return printJSON(stats)
+  }
+  if *chart {
+    printStatsChart(stats, haveCleans)
+    return nil
+  }
+
+  table := newTable("DAY", "CLEANS", "VISITS", "RESETS", "FAILED")
+  for _, s := range stats {
+    cleans, visits := "-", "-"
+    if haveCleans {
+      cleans, visits = strconv.Itoa(s.Cleans), strconv.Itoa(s.Visits)
+    }
+    table.AddRow(s.Day, cleans, visits, strconv.Itoa(s.Resets), strconv.Itoa(s.FailedResets))
+    if s.FailedResets > 0 {
+      table.SetColor(4, colorRed)
+    }
+  }
+  return table.Render(os.Stdout, useColor())
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "time"
+
+  "shitbox-fixer/pkg/detect"
+)
+
+const historyStuck = "stuck"
+
+// StuckPeriod is the paused or fault state the device is in, kept until it
+// leaves it and the period is recorded in the history.
+type StuckPeriod struct {
+  DeviceID string `json:"device_id"`
+  detect.Period
+}
+
+func loadStuckPeriod(cfg *Config) (*StuckPeriod, error) {
+  path, err := statePath(cfg, "stuck.json")
+  if err != nil {
+    return nil, err
+  }
+  var period *StuckPeriod
+  if err := loadStateFile(path, &period); err != nil {
+    return nil, err
+  }
+  if period != nil && period.DeviceID != cfg.DeviceID {
+    return nil, nil
+  }
+  return period, nil
+}
+
+func saveStuckPeriod(cfg *Config, period *StuckPeriod) error {
+  path, err := statePath(cfg, "stuck.json")
+  if err != nil {
+    return err
+  }
+  if period == nil {
+    err := os.Remove(path)
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  return saveStateFile(path, period)
+}
+
+// trackStuck follows the stuck state across checks for
+// DETECT_STUCK_DURATION and returns the period the device is stuck in, nil
+// when it is not. A period ends once a check sees a value that is not
+// stuck, and is then recorded in the history like an outage. Only the
+// owner of the state, the check of the leader, saves it; a standby only
+// reads it.
+func trackStuck(cfg *Config, appLog *slog.Logger, in *detect.Input, now time.Time, owner bool) *StuckPeriod {
+  period, err := loadStuckPeriod(cfg)
+  if err != nil {
+    appLog.Warn("Failed to load stuck state", "error", err)
+  }
+  var open *detect.Period
+  if period != nil {
+    open = &period.Period
+  }
+  current, known := detect.CurrentlyStuck(in, open)
+
+  switch {
+  case current != nil && period == nil:
+    if current.Since.IsZero() || current.Since.After(now) {
+      current.Since = now
+    }
+    period = &StuckPeriod{DeviceID: cfg.DeviceID, Period: *current}
+    if !owner {
+      break
+    }
+    appLog.Debug("Device is stuck", "since", period.Since, "reason", period.Reason)
+    if err := saveStuckPeriod(cfg, period); err != nil {
+      appLog.Warn("Failed to save stuck state", "error", err)
+    }
+  case current == nil && period != nil && !known:
+    appLog.Debug("Stuck state unknown, keeping it", "code", period.Code, "since", period.Since)
+  case current == nil && period != nil && !owner:
+    return nil
+  case current == nil && period != nil:
+    if cfg.DataStorage != dataStorageNone {
+      entry := HistoryEntry{
+        Time:     period.Since,
+        DeviceID: period.DeviceID,
+        Kind:     historyStuck,
+        Message:  fmt.Sprintf("stuck for %s (%s)", now.Sub(period.Since).Truncate(time.Second), period.Reason),
+        Until:    &now,
+      }
+      if _, err := appendHistory(cfg, entry); err != nil {
+        appLog.Warn("Failed to record history", "error", err)
+      }
+    }
+    if err := saveStuckPeriod(cfg, nil); err != nil {
+      appLog.Warn("Failed to save stuck state", "error", err)
+    }
+    return nil
+  }
+  return period
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+
+package app
+
+import "fmt"
+
+const syslogSupported = false
+
+func newSyslogSink(address string) (logSink, error) {
+  return nil, fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,49 @@
+//go:build !windows && !plan9
+
+package app
+
+import (
+  "fmt"
+  "log/slog"
+  "log/syslog"
+  "net/url"
+)
+
+const syslogSupported = true
+
+type syslogSink struct {
+  w *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog daemon, or to a remote one when
+// address is set, e.g. udp://logs.lan:514.
+func newSyslogSink(address string) (logSink, error) {
+  network, raddr := "", ""
+  if address != "" {
+    u, err := url.Parse(address)
+    if err != nil || u.Host == "" || (u.Scheme != "udp" && u.Scheme != "tcp") {
+      return nil, fmt.Errorf("invalid syslog address %q (expected udp://host:port or tcp://host:port)", address)
+    }
+    network, raddr = u.Scheme, u.Host
+  }
+
+  w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+  if err != nil {
+    return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+  }
+  return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Send(level slog.Level, msg string, attrs []slog.Attr) error {
+  line := formatLogLine(msg, attrs)
+  switch {
+  case level >= slog.LevelError:
+    return s.w.Err(line)
+  case level >= slog.LevelWarn:
+    return s.w.Warning(line)
+  case level >= slog.LevelInfo:
+    return s.w.Info(line)
+  default:
+    return s.w.Debug(line)
+  }
+}
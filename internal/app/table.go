@@ -0,0 +1,120 @@
+package app
+
+import (
+  "fmt"
+  "io"
+  "os"
+  "strings"
+)
+
+const (
+  colorRed    = "31"
+  colorGreen  = "32"
+  colorYellow = "33"
+  colorCyan   = "36"
+)
+
+type tableCell struct {
+  text  string
+  color string
+}
+
+type Table struct {
+  headers []string
+  rows    [][]tableCell
+}
+
+func newTable(headers ...string) *Table {
+  return &Table{headers: headers}
+}
+
+func (t *Table) AddRow(cells ...string) {
+  row := make([]tableCell, len(cells))
+  for i, cell := range cells {
+    row[i] = tableCell{text: cell}
+  }
+  t.rows = append(t.rows, row)
+}
+
+// SetColor colors a cell of the last added row.
+func (t *Table) SetColor(column int, color string) {
+  if len(t.rows) == 0 {
+    return
+  }
+  row := t.rows[len(t.rows)-1]
+  if column < len(row) {
+    row[column].color = color
+  }
+}
+
+// Render writes the table with aligned columns. Widths are computed from the
+// plain text so color escapes don't break the alignment.
+func (t *Table) Render(w io.Writer, color bool) error {
+  widths := make([]int, len(t.headers))
+  for i, header := range t.headers {
+    widths[i] = len([]rune(header))
+  }
+  for _, row := range t.rows {
+    for i, cell := range row {
+      if i < len(widths) && len([]rune(cell.text)) > widths[i] {
+        widths[i] = len([]rune(cell.text))
+      }
+    }
+  }
+
+  writeRow := func(cells []tableCell) error {
+    var b strings.Builder
+    for i, cell := range cells {
+      if i >= len(widths) {
+        break
+      }
+      text := cell.text
+      if color && cell.color != "" {
+        text = "\033[" + cell.color + "m" + text + "\033[0m"
+      }
+      b.WriteString(text)
+      if i < len(cells)-1 {
+        b.WriteString(strings.Repeat(" ", widths[i]-len([]rune(cell.text))+2))
+      }
+    }
+    _, err := fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+    return err
+  }
+
+  headerCells := make([]tableCell, len(t.headers))
+  for i, header := range t.headers {
+    headerCells[i] = tableCell{text: header}
+  }
+  if err := writeRow(headerCells); err != nil {
+    return err
+  }
+  for _, row := range t.rows {
+    if err := writeRow(row); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func isTerminal(f *os.File) bool {
+  info, err := f.Stat()
+  if err != nil {
+    return false
+  }
+  return info.Mode()&os.ModeCharDevice != 0
+}
+
+// useColor reports whether tables on stdout should be colored.
+// noColor is set by --no-color.
+var noColor bool
+
+func useColor() bool {
+  return !noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+}
+
+func boolColor(ok bool) string {
+  if ok {
+    return colorGreen
+  }
+  return colorRed
+}
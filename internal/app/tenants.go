@@ -0,0 +1,578 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "log/slog"
+  "maps"
+  "net"
+  "net/http"
+  "net/http/httputil"
+  "os"
+  "os/exec"
+  "regexp"
+  "slices"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// A tenant whose process exits on its own is started again after 1s, 2s,
+// 4s and so on, up to a minute.
+const (
+  tenantRestartDelay    = time.Second
+  tenantMaxRestartDelay = time.Minute
+)
+
+// Tenant names end up in URLs and socket file names.
+var tenantNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tenant is a profile of the config file served by its own `serve` process
+// behind the tenant server, with its own credentials, devices,
+// notifications, API tokens and STATE_DIR. The process listens on a Unix
+// socket only the tenant server talks to.
+type tenant struct {
+  name    string
+  socket  string
+  proxy   *httputil.ReverseProxy
+  stop    chan struct{}
+  restart chan struct{}
+  done    chan struct{}
+
+  mu sync.Mutex
+  // values is the config of the profile, to tell whether a reload changed
+  // it.
+  values    map[string]string
+  cmd       *exec.Cmd
+  startedAt time.Time
+  restarts  int
+  lastError string
+}
+
+type TenantStatus struct {
+  Name      string     `json:"name"`
+  Running   bool       `json:"running"`
+  PID       int        `json:"pid,omitempty"`
+  StartedAt *time.Time `json:"started_at,omitempty"`
+  Restarts  int        `json:"restarts"`
+  LastError string     `json:"last_error,omitempty"`
+}
+
+func (t *tenant) status() TenantStatus {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  status := TenantStatus{Name: t.name, Restarts: t.restarts, LastError: t.lastError}
+  if t.cmd != nil {
+    startedAt := t.startedAt
+    status.Running, status.PID, status.StartedAt = true, t.cmd.Process.Pid, &startedAt
+  }
+  return status
+}
+
+// requestRestart restarts the process of the tenant, e.g. to pick up a
+// changed profile.
+func (t *tenant) requestRestart() {
+  select {
+  case t.restart <- struct{}{}:
+  default:
+  }
+}
+
+// tenantServer serves every profile of the config file as a tenant: the
+// API of tenant alice under /tenants/alice/, and an admin API to list,
+// restart and reload the tenants.
+type tenantServer struct {
+  configPaths []string
+  executable  string
+  // args is the command line of a tenant process, without --listen.
+  args      []string
+  socketDir string
+  adminAuth apiAuth
+  appLog    *slog.Logger
+  outputMu  sync.Mutex
+
+  mu      sync.Mutex
+  tenants map[string]*tenant
+}
+
+// tenantSecret returns a secret setting of a profile, or the file named by
+// its _FILE variant.
+func tenantSecret(values map[string]string, key string) (string, error) {
+  path := values[key+"_FILE"]
+  if path == "" {
+    return values[key], nil
+  }
+  if values[key] != "" {
+    return "", fmt.Errorf("both %s and %s_FILE are set", key, key)
+  }
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return "", fmt.Errorf("failed to read %s_FILE: %w", key, err)
+  }
+  return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// loadTenants reads the profiles of the config file. Every tenant needs an
+// API_CONTROL_TOKEN and a STATE_DIR of its own, as the tokens are all that
+// keeps their APIs apart; a token in the environment would apply to all of
+// them.
+func loadTenants(configPaths []string, adminToken string) (map[string]map[string]string, error) {
+  for _, key := range []string{"API_READ_TOKEN", "API_CONTROL_TOKEN"} {
+    if os.Getenv(key) != "" || os.Getenv(key+"_FILE") != "" {
+      return nil, fmt.Errorf("%s must be set per profile with --tenants, not in the environment", key)
+    }
+  }
+  configPath := yamlConfigFile(configPaths)
+  if configPath == "" {
+    return nil, fmt.Errorf("--tenants needs a YAML config file with profiles")
+  }
+  names, err := configProfiles(configPath)
+  if err != nil {
+    return nil, err
+  }
+
+  tenants := map[string]map[string]string{}
+  owners := map[string]string{}
+  stateDirs := map[string]string{}
+  if adminToken != "" {
+    owners[adminToken] = "API_ADMIN_TOKEN"
+  }
+  for _, name := range names {
+    if !tenantNameRE.MatchString(name) {
+      return nil, fmt.Errorf("invalid tenant name %q, use letters, digits, - and _", name)
+    }
+    values, err := parseConfigFiles(configPaths, name)
+    if err != nil {
+      return nil, fmt.Errorf("tenant %s: %w", name, err)
+    }
+    for _, key := range []string{"API_READ_TOKEN", "API_CONTROL_TOKEN"} {
+      token, err := tenantSecret(values, key)
+      if err != nil {
+        return nil, fmt.Errorf("tenant %s: %w", name, err)
+      }
+      if token == "" {
+        if key == "API_CONTROL_TOKEN" {
+          return nil, fmt.Errorf("tenant %s needs its own API_CONTROL_TOKEN", name)
+        }
+        continue
+      }
+      if owner, ok := owners[token]; ok {
+        return nil, fmt.Errorf("tenant %s shares its %s with %s", name, key, owner)
+      }
+      owners[token] = "tenant " + name
+    }
+    // Without STATE_DIR each profile gets a directory of its own.
+    stateDir := values["STATE_DIR"]
+    if env, ok := os.LookupEnv("STATE_DIR"); ok {
+      stateDir = env
+    }
+    if stateDir != "" {
+      if owner, ok := stateDirs[stateDir]; ok {
+        return nil, fmt.Errorf("tenant %s shares its STATE_DIR with tenant %s", name, owner)
+      }
+      stateDirs[stateDir] = name
+    }
+    tenants[name] = values
+  }
+  return tenants, nil
+}
+
+func (s *tenantServer) newTenant(name string, values map[string]string) *tenant {
+  t := &tenant{
+    name:    name,
+    socket:  s.socketDir + string(os.PathSeparator) + name + ".sock",
+    values:  values,
+    stop:    make(chan struct{}),
+    restart: make(chan struct{}, 1),
+    done:    make(chan struct{}),
+  }
+  // HTTP/2 without TLS, so gRPC calls get through as well.
+  transport := &http.Transport{
+    DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+      var dialer net.Dialer
+      return dialer.DialContext(ctx, "unix", t.socket)
+    },
+    Protocols: new(http.Protocols),
+  }
+  transport.Protocols.SetUnencryptedHTTP2(true)
+  t.proxy = &httputil.ReverseProxy{
+    Rewrite: func(r *httputil.ProxyRequest) {
+      r.Out.URL.Scheme = "http"
+      r.Out.URL.Host = name
+      if !isGRPCRequest(r.In) {
+        r.Out.URL.Path, r.Out.URL.RawPath = "/"+r.In.PathValue("path"), ""
+      }
+      r.SetXForwarded()
+    },
+    Transport: transport,
+    ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+      s.appLog.Debug("Tenant request failed", "tenant", name, "error", err)
+      writeError(w, http.StatusServiceUnavailable, fmt.Errorf("tenant %s is not available", name))
+    },
+  }
+  return t
+}
+
+// supervise runs the process of the tenant until it is stopped, starting
+// it again when it exits.
+func (s *tenantServer) supervise(t *tenant) {
+  defer close(t.done)
+  delay := tenantRestartDelay
+  for {
+    requested, err := s.runTenant(t)
+    select {
+    case <-t.stop:
+      return
+    default:
+    }
+
+    t.mu.Lock()
+    t.restarts++
+    if !requested {
+      t.lastError = err.Error()
+    }
+    t.mu.Unlock()
+    if requested {
+      s.appLog.Info("Restarting tenant", "tenant", t.name)
+      delay = tenantRestartDelay
+      continue
+    }
+    s.appLog.Warn("Tenant exited, restarting it", "tenant", t.name, "error", err, "delay", delay)
+    select {
+    case <-t.stop:
+      return
+    case <-t.restart:
+    case <-time.After(delay):
+    }
+    delay = min(delay*2, tenantMaxRestartDelay)
+  }
+}
+
+// runTenant runs the process of the tenant once. requested is set when it
+// was stopped or restarted on purpose, err tells why it exited otherwise.
+func (s *tenantServer) runTenant(t *tenant) (requested bool, err error) {
+  args := append(slices.Clone(s.args), "--listen", "unix:"+t.socket)
+  cmd := exec.Command(s.executable, args...)
+  cmd.Env = append(os.Environ(), "PROFILE="+t.name)
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    return false, err
+  }
+  stderr, err := cmd.StderrPipe()
+  if err != nil {
+    return false, err
+  }
+  if err := cmd.Start(); err != nil {
+    return false, err
+  }
+  t.mu.Lock()
+  t.cmd, t.startedAt = cmd, time.Now()
+  t.mu.Unlock()
+  s.appLog.Info("Started tenant", "tenant", t.name, "pid", cmd.Process.Pid)
+
+  exited := make(chan struct{})
+  stopped := make(chan bool, 1)
+  go func() {
+    select {
+    case <-exited:
+      stopped <- false
+      return
+    case <-t.stop:
+    case <-t.restart:
+    }
+    stopped <- true
+    if err := cmd.Process.Signal(os.Interrupt); err != nil {
+      cmd.Process.Kill()
+    }
+  }()
+
+  var output sync.WaitGroup
+  output.Add(2)
+  for _, pipe := range []struct {
+    r io.Reader
+    w io.Writer
+  }{{stdout, os.Stdout}, {stderr, os.Stderr}} {
+    go func() {
+      defer output.Done()
+      copyPrefixed(pipe.r, pipe.w, "tenant", t.name, &s.outputMu)
+    }()
+  }
+  // The output has to be read to the end before Wait closes the pipes.
+  output.Wait()
+  err = cmd.Wait()
+  close(exited)
+
+  t.mu.Lock()
+  t.cmd = nil
+  t.mu.Unlock()
+  if err == nil {
+    err = errors.New("exited")
+  }
+  return <-stopped, err
+}
+
+func (s *tenantServer) start(t *tenant) {
+  s.tenants[t.name] = t
+  go s.supervise(t)
+}
+
+// stopAll stops the processes of all tenants and waits for them to exit.
+func (s *tenantServer) stopAll() {
+  s.mu.Lock()
+  tenants := make([]*tenant, 0, len(s.tenants))
+  for _, t := range s.tenants {
+    close(t.stop)
+    tenants = append(tenants, t)
+  }
+  s.tenants = map[string]*tenant{}
+  s.mu.Unlock()
+  for _, t := range tenants {
+    <-t.done
+  }
+}
+
+// reload reads the profiles again: tenants that were added are started,
+// removed ones stopped and changed ones restarted.
+func (s *tenantServer) reload() error {
+  tenants, err := loadTenants(s.configPaths, s.adminAuth.controlToken)
+  if err != nil {
+    return err
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for name, t := range s.tenants {
+    if _, ok := tenants[name]; !ok {
+      s.appLog.Info("Stopping removed tenant", "tenant", name)
+      close(t.stop)
+      delete(s.tenants, name)
+    }
+  }
+  for name, values := range tenants {
+    t, ok := s.tenants[name]
+    if !ok {
+      s.start(s.newTenant(name, values))
+      continue
+    }
+    t.mu.Lock()
+    changed := !maps.Equal(t.values, values)
+    t.values = values
+    t.mu.Unlock()
+    if changed {
+      t.requestRestart()
+    }
+  }
+  return nil
+}
+
+func (s *tenantServer) tenant(name string) *tenant {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return s.tenants[name]
+}
+
+func (s *tenantServer) statuses() []TenantStatus {
+  s.mu.Lock()
+  tenants := make([]*tenant, 0, len(s.tenants))
+  for _, t := range s.tenants {
+    tenants = append(tenants, t)
+  }
+  s.mu.Unlock()
+
+  statuses := make([]TenantStatus, 0, len(tenants))
+  for _, t := range tenants {
+    statuses = append(statuses, t.status())
+  }
+  sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+  return statuses
+}
+
+func (s *tenantServer) routes() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("GET /admin/tenants", requireRole(s.adminAuth, roleControl, s.handleTenants))
+  mux.HandleFunc("POST /admin/tenants/{name}/restart", requireRole(s.adminAuth, roleControl, s.handleTenantRestart))
+  mux.HandleFunc("POST /admin/reload", requireRole(s.adminAuth, roleControl, s.handleTenantReload))
+  // The process of the tenant checks the tokens of the tenant.
+  mux.HandleFunc("/tenants/{name}/{path...}", s.handleTenantProxy)
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    s.appLog.Debug("API request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+    // gRPC paths name the method, the tenant metadata names the tenant.
+    if isGRPCRequest(r) {
+      r.SetPathValue("name", r.Header.Get("tenant"))
+      s.handleTenantProxy(w, r)
+      return
+    }
+    mux.ServeHTTP(w, r)
+  })
+}
+
+func (s *tenantServer) handleTenants(w http.ResponseWriter, r *http.Request) {
+  writeJSON(w, http.StatusOK, s.statuses())
+}
+
+func (s *tenantServer) handleTenantRestart(w http.ResponseWriter, r *http.Request) {
+  t := s.tenant(r.PathValue("name"))
+  if t == nil {
+    writeError(w, http.StatusNotFound, fmt.Errorf("unknown tenant: %s", r.PathValue("name")))
+    return
+  }
+  t.requestRestart()
+  writeJSON(w, http.StatusAccepted, t.status())
+}
+
+func (s *tenantServer) handleTenantReload(w http.ResponseWriter, r *http.Request) {
+  if err := s.reload(); err != nil {
+    writeError(w, http.StatusBadRequest, err)
+    return
+  }
+  writeJSON(w, http.StatusOK, s.statuses())
+}
+
+func (s *tenantServer) handleTenantProxy(w http.ResponseWriter, r *http.Request) {
+  t := s.tenant(r.PathValue("name"))
+  if t == nil {
+    writeError(w, http.StatusNotFound, fmt.Errorf("unknown tenant: %s", r.PathValue("name")))
+    return
+  }
+  t.proxy.ServeHTTP(w, r)
+}
+
+// runTenants serves every profile of the config file as a tenant, each
+// with its own `serve` process behind one API. The settings of the server
+// itself, SERVE_ADDRESS, API_ADMIN_TOKEN and TLS, come from the top level
+// of the config file or the environment.
+func runTenants(ctx context.Context, configPaths, globalArgs, args []string) error {
+  if os.Getenv("PROFILE") != "" {
+    return fmt.Errorf("--tenants cannot be combined with PROFILE")
+  }
+  setting := func(key string) string {
+    value, err := configSetting(configPaths, key)
+    if err != nil {
+      slog.Warn("Failed to read setting", "key", key, "error", err)
+    }
+    return value
+  }
+  address := setting("SERVE_ADDRESS")
+  if address == "" {
+    address = defaultServeAddress
+  }
+  fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+  listen := fs.String("listen", address, "address to listen on")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if setting("SERVE_TLS_CLIENT_CA") != "" {
+    return fmt.Errorf("SERVE_TLS_CLIENT_CA is not supported with --tenants, a client certificate does not name a tenant")
+  }
+  adminToken := setting("API_ADMIN_TOKEN")
+  if path := setting("API_ADMIN_TOKEN_FILE"); path != "" && adminToken == "" {
+    data, err := os.ReadFile(path)
+    if err != nil {
+      return fmt.Errorf("failed to read API_ADMIN_TOKEN_FILE: %w", err)
+    }
+    adminToken = strings.TrimRight(string(data), "\r\n")
+  }
+
+  tenants, err := loadTenants(configPaths, adminToken)
+  if err != nil {
+    return err
+  }
+  executable, err := os.Executable()
+  if err != nil {
+    return err
+  }
+  socketDir, err := os.MkdirTemp("", "shitbox-fixer-tenants-")
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(socketDir)
+
+  var childArgs []string
+  for _, arg := range globalArgs {
+    if !isProfilesFlag(arg, "tenants") {
+      childArgs = append(childArgs, arg)
+    }
+  }
+  s := &tenantServer{
+    configPaths: configPaths,
+    executable:  executable,
+    args:        append(childArgs, "serve"),
+    socketDir:   socketDir,
+    adminAuth:   apiAuth{controlToken: adminToken},
+    appLog:      slog.Default(),
+    tenants:     map[string]*tenant{},
+  }
+
+  server := &http.Server{
+    Handler:           s.routes(),
+    ReadHeaderTimeout: 10 * time.Second,
+    BaseContext:       func(net.Listener) context.Context { return ctx },
+    Protocols:         new(http.Protocols),
+  }
+  server.Protocols.SetHTTP1(true)
+  if cert := setting("SERVE_TLS_CERT"); cert != "" {
+    tlsConfig, err := serveTLSConfig(&Config{ServeTLSCert: cert, ServeTLSKey: setting("SERVE_TLS_KEY")})
+    if err != nil {
+      return err
+    }
+    server.TLSConfig = tlsConfig
+    server.Protocols.SetHTTP2(true)
+  } else {
+    server.Protocols.SetUnencryptedHTTP2(true)
+  }
+
+  listener, err := net.Listen("tcp", *listen)
+  if err != nil {
+    return err
+  }
+  if !s.adminAuth.enabled() && !isLoopback(listener.Addr()) {
+    listener.Close()
+    return fmt.Errorf("refusing to serve the admin API without authentication on %s, set API_ADMIN_TOKEN or listen on localhost", listener.Addr())
+  }
+
+  s.mu.Lock()
+  for name, values := range tenants {
+    s.start(s.newTenant(name, values))
+  }
+  s.mu.Unlock()
+
+  reloads := make(chan struct{}, 1)
+  handleReloadSignal(s.appLog, reloads)
+  go func() {
+    for {
+      select {
+      case <-ctx.Done():
+        return
+      case <-reloads:
+        if err := s.reload(); err != nil {
+          s.appLog.Error("Failed to reload tenants", "error", err)
+        }
+      }
+    }
+  }()
+
+  // Serve sets up the TLS config for HTTP/2, read it before.
+  useTLS := server.TLSConfig != nil
+  go func() {
+    var err error
+    if useTLS {
+      err = server.ServeTLS(listener, "", "")
+    } else {
+      err = server.Serve(listener)
+    }
+    if err != nil && !errors.Is(err, http.ErrServerClosed) {
+      s.appLog.Error("API server failed", "error", err)
+    }
+  }()
+  s.appLog.Info("Serving tenants", "address", listener.Addr().String(), "tls", useTLS, "tenants", len(tenants))
+
+  <-ctx.Done()
+  shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+  defer cancel()
+  err = server.Shutdown(shutdownCtx)
+  s.stopAll()
+  return err
+}
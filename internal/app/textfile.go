@@ -0,0 +1,107 @@
+package app
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promBool(b bool) int {
+  if b {
+    return 1
+  }
+  return 0
+}
+
+// metricsText renders the outcome of a check in the Prometheus text format.
+// Reset counts and the time of the last reset come from the history, so
+// they survive between one-shot runs. restarts is negative when the
+// process does not watch.
+func metricsText(cfg *Config, result *CheckResult, checkErr error, history []HistoryEntry, restarts int) string {
+  var b strings.Builder
+  device := fmt.Sprintf(`device_id="%s"`, promLabelEscaper.Replace(result.DeviceID))
+  metric := func(name, help, kind, labels string, value interface{}) {
+    fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %v\n", name, help, name, kind, name, labels, value)
+  }
+
+  metric("shitbox_fixer_build_info", "Version of the fixer.", "gauge", fmt.Sprintf(`version="%s"`, promLabelEscaper.Replace(Version)), 1)
+  metric("shitbox_fixer_last_run_timestamp_seconds", "When the last check started.", "gauge", device, result.Time.Unix())
+  metric("shitbox_fixer_last_run_duration_seconds", "How long the last check took, including a reset.", "gauge", device, time.Since(result.Time).Seconds())
+  metric("shitbox_fixer_last_run_success", "Whether the last check completed without errors.", "gauge", device, promBool(checkErr == nil))
+  metric("shitbox_fixer_device_online", "Whether the device was online at the last check.", "gauge", device, promBool(result.Online))
+  metric("shitbox_fixer_detection_score", "Confidence that the device is stuck at the last check.", "gauge", device, result.Score)
+  metric("shitbox_fixer_needs_reset", "Whether the last check found the device stuck.", "gauge", device, promBool(result.NeedsReset))
+  if restarts >= 0 {
+    metric("shitbox_watchdog_restarts_total", "Poll loop restarts by the watchdog since the watcher started.", "counter", device, restarts)
+  }
+
+  resets := map[string]int{actionReset: 0, actionResetFailed: 0}
+  var lastReset time.Time
+  for _, entry := range history {
+    if entry.DeviceID != result.DeviceID {
+      continue
+    }
+    if _, ok := resets[entry.Kind]; ok {
+      resets[entry.Kind]++
+    }
+    if entry.Kind == actionReset && entry.Time.After(lastReset) {
+      lastReset = entry.Time
+    }
+  }
+  if cfg.DataStorage != dataStorageNone {
+    fmt.Fprintf(&b, "# HELP shitbox_fixer_resets_total Resets recorded in the history, by result.\n# TYPE shitbox_fixer_resets_total counter\n")
+    for _, kind := range []string{actionReset, actionResetFailed} {
+      fmt.Fprintf(&b, "shitbox_fixer_resets_total{%s,result=\"%s\"} %d\n", device, kind, resets[kind])
+    }
+    if !lastReset.IsZero() {
+      metric("shitbox_fixer_last_reset_timestamp_seconds", "When the device was last reset successfully.", "gauge", device, lastReset.Unix())
+    }
+  }
+  return b.String()
+}
+
+// writeMetricsTextfile writes the metrics for node_exporter's textfile
+// collector. The file is replaced atomically, so the collector never reads
+// a partial file.
+func writeMetricsTextfile(cfg *Config, appLog *slog.Logger, result *CheckResult, checkErr error) {
+  if cfg.MetricsTextfile == "" {
+    return
+  }
+
+  var history []HistoryEntry
+  if cfg.DataStorage != dataStorageNone {
+    var err error
+    if history, err = readHistory(cfg); err != nil {
+      appLog.Warn("Failed to read history for metrics", "error", err)
+    }
+  }
+
+  tmp, err := os.CreateTemp(filepath.Dir(cfg.MetricsTextfile), "."+filepath.Base(cfg.MetricsTextfile)+".*")
+  if err != nil {
+    appLog.Warn("Failed to write metrics", "path", cfg.MetricsTextfile, "error", err)
+    return
+  }
+  restarts, watching := health.restarts()
+  if !watching {
+    restarts = -1
+  }
+  _, err = tmp.WriteString(metricsText(cfg, result, checkErr, history, restarts))
+  if err == nil {
+    err = tmp.Chmod(0o644)
+  }
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err == nil {
+    err = os.Rename(tmp.Name(), cfg.MetricsTextfile)
+  }
+  if err != nil {
+    os.Remove(tmp.Name())
+    appLog.Warn("Failed to write metrics", "path", cfg.MetricsTextfile, "error", err)
+  }
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+  "fmt"
+  "sort"
+  "time"
+)
+
+const (
+  timeStyleAbsolute = "absolute"
+  timeStyleRelative = "relative"
+  timeStyleBoth     = "both"
+)
+
+var timeLayouts = map[string]string{
+  "iso":   "2006-01-02 15:04:05",
+  "en-US": "01/02/2006 3:04:05 PM",
+  "en-GB": "02/01/2006 15:04:05",
+  "de":    "02.01.2006 15:04:05",
+  "fr":    "02/01/2006 15:04:05",
+  "nl":    "02-01-2006 15:04:05",
+}
+
+var clockLayouts = map[string]string{
+  "en-US": "3:04 PM",
+}
+
+// TimeFormat renders timestamps for humans in the configured time zone and
+// locale. JSON output keeps machine-readable timestamps.
+type TimeFormat struct {
+  Location *time.Location
+  Locale   string
+  Style    string
+}
+
+func timeLocales() []string {
+  locales := make([]string, 0, len(timeLayouts))
+  for locale := range timeLayouts {
+    locales = append(locales, locale)
+  }
+  sort.Strings(locales)
+  return locales
+}
+
+func (f TimeFormat) clockLayout() string {
+  if layout, ok := clockLayouts[f.Locale]; ok {
+    return layout
+  }
+  return "15:04"
+}
+
+func (f TimeFormat) Absolute(t time.Time) string {
+  return t.In(f.Location).Format(timeLayouts[f.Locale])
+}
+
+// Relative renders t relative to now, e.g. "4m ago" or "yesterday 23:12".
+// Anything older than a week falls back to the absolute time.
+func (f TimeFormat) Relative(t, now time.Time) string {
+  t = t.In(f.Location)
+  now = now.In(f.Location)
+  d := now.Sub(t)
+
+  switch {
+  case d < 0:
+    return f.Absolute(t)
+  case d < time.Minute:
+    return "just now"
+  case d < time.Hour:
+    return fmt.Sprintf("%dm ago", int(d/time.Minute))
+  }
+
+  today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, f.Location)
+  switch {
+  case !t.Before(today):
+    return fmt.Sprintf("%dh ago", int(d/time.Hour))
+  case !t.Before(today.AddDate(0, 0, -1)):
+    return "yesterday " + t.Format(f.clockLayout())
+  case !t.Before(today.AddDate(0, 0, -6)):
+    return t.Format("Monday ") + t.Format(f.clockLayout())
+  default:
+    return f.Absolute(t)
+  }
+}
+
+func (f TimeFormat) Format(t time.Time) string {
+  switch f.Style {
+  case timeStyleRelative:
+    return f.Relative(t, time.Now())
+  case timeStyleBoth:
+    relative := f.Relative(t, time.Now())
+    absolute := f.Absolute(t)
+    if relative == absolute {
+      return absolute
+    }
+    return fmt.Sprintf("%s (%s)", absolute, relative)
+  default:
+    return f.Absolute(t)
+  }
+}
+
+// Now returns the current time in the configured time zone, which is also
+// the zone quiet hours are evaluated in.
+func (f TimeFormat) Now() time.Time {
+  return time.Now().In(f.Location)
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+  "bytes"
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Only the JSON encoding of OTLP over HTTP is supported, which needs no
+// protobuf or gRPC dependencies and is accepted by the OpenTelemetry
+// Collector, Jaeger, Tempo and most tracing backends.
+const otlpProtocolJSON = "http/json"
+
+const (
+  spanKindInternal = 1
+  spanKindClient   = 3
+
+  spanStatusOK    = 1
+  spanStatusError = 2
+
+  // Spans are sent in batches, at least this often.
+  traceFlushInterval = 5 * time.Second
+  traceBatchSize     = 256
+)
+
+type otlpValue struct {
+  StringValue *string  `json:"stringValue,omitempty"`
+  BoolValue   *bool    `json:"boolValue,omitempty"`
+  IntValue    *string  `json:"intValue,omitempty"`
+  DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+  Key   string    `json:"key"`
+  Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+  Code    int    `json:"code"`
+  Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+  TraceID           string         `json:"traceId"`
+  SpanID            string         `json:"spanId"`
+  ParentSpanID      string         `json:"parentSpanId,omitempty"`
+  Name              string         `json:"name"`
+  Kind              int            `json:"kind"`
+  StartTimeUnixNano string         `json:"startTimeUnixNano"`
+  EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+  Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+  Status            otlpStatus     `json:"status"`
+}
+
+func spanAttr(key string, value interface{}) otlpKeyValue {
+  kv := otlpKeyValue{Key: key}
+  switch v := value.(type) {
+  case bool:
+    kv.Value.BoolValue = &v
+  case int:
+    s := strconv.Itoa(v)
+    kv.Value.IntValue = &s
+  case float64:
+    kv.Value.DoubleValue = &v
+  default:
+    s := fmt.Sprint(v)
+    kv.Value.StringValue = &s
+  }
+  return kv
+}
+
+// Span is an operation being traced. A nil span, as returned while tracing
+// is disabled, ignores all calls.
+type Span struct {
+  span  otlpSpan
+  start time.Time
+}
+
+type spanKey struct{}
+
+// traceExporter batches finished spans and posts them to the OTLP endpoint.
+type traceExporter struct {
+  endpoint string
+  headers  map[string]string
+  resource []otlpKeyValue
+  client   *http.Client
+  logger   *slog.Logger
+
+  mu      sync.Mutex
+  pending []otlpSpan
+  sending sync.Mutex
+}
+
+var tracer *traceExporter
+
+// parseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS, e.g.
+// "authorization=Bearer%20abc,x-scope-orgid=home".
+func parseOTLPHeaders(s string) (map[string]string, error) {
+  headers := map[string]string{}
+  for _, pair := range strings.Split(s, ",") {
+    if strings.TrimSpace(pair) == "" {
+      continue
+    }
+    key, value, ok := strings.Cut(pair, "=")
+    if !ok || strings.TrimSpace(key) == "" {
+      return nil, fmt.Errorf("invalid header %q (expected key=value)", pair)
+    }
+    decoded, err := url.PathUnescape(strings.TrimSpace(value))
+    if err != nil {
+      return nil, fmt.Errorf("invalid header %q: %w", pair, err)
+    }
+    headers[strings.TrimSpace(key)] = decoded
+  }
+  return headers, nil
+}
+
+// initTracing starts exporting spans when an OTLP endpoint is configured.
+func initTracing(cfg *Config, appLog *slog.Logger) {
+  if cfg.TraceEndpoint == "" {
+    return
+  }
+  tracer = &traceExporter{
+    endpoint: cfg.TraceEndpoint,
+    headers:  cfg.TraceHeaders,
+    resource: []otlpKeyValue{
+      spanAttr("service.name", cfg.TraceServiceName),
+      spanAttr("service.version", Version),
+    },
+    client: &http.Client{Timeout: 10 * time.Second},
+    logger: appLog,
+  }
+  go func() {
+    for range time.Tick(traceFlushInterval) {
+      tracer.flush()
+    }
+  }()
+  appLog.Debug("Exporting traces", "endpoint", cfg.TraceEndpoint)
+}
+
+// flushTraces sends the spans that are still pending, e.g. before exiting.
+func flushTraces() {
+  if tracer != nil {
+    tracer.flush()
+  }
+}
+
+func randomHexID(size int) string {
+  id := make([]byte, size)
+  _, _ = rand.Read(id)
+  return hex.EncodeToString(id)
+}
+
+// startSpan starts a span as a child of the span in ctx, or of a new trace.
+func startSpan(ctx context.Context, name string, kind int, attrs ...otlpKeyValue) (context.Context, *Span) {
+  if tracer == nil {
+    return ctx, nil
+  }
+  s := &Span{start: time.Now(), span: otlpSpan{
+    SpanID:     randomHexID(8),
+    Name:       name,
+    Kind:       kind,
+    Attributes: attrs,
+  }}
+  if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+    s.span.TraceID = parent.span.TraceID
+    s.span.ParentSpanID = parent.span.SpanID
+  } else {
+    s.span.TraceID = randomHexID(16)
+  }
+  return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+  if s != nil {
+    s.span.Attributes = append(s.span.Attributes, spanAttr(key, value))
+  }
+}
+
+// End finishes the span, marking it failed when err is set.
+func (s *Span) End(err error) {
+  if s == nil {
+    return
+  }
+  s.span.StartTimeUnixNano = strconv.FormatInt(s.start.UnixNano(), 10)
+  s.span.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+  s.span.Status = otlpStatus{Code: spanStatusOK}
+  if err != nil {
+    s.span.Status = otlpStatus{Code: spanStatusError, Message: err.Error()}
+  }
+
+  tracer.mu.Lock()
+  tracer.pending = append(tracer.pending, s.span)
+  full := len(tracer.pending) >= traceBatchSize
+  tracer.mu.Unlock()
+  if full {
+    go tracer.flush()
+  }
+}
+
+func (t *traceExporter) flush() {
+  // A flush before exiting waits for the batch that is being sent.
+  t.sending.Lock()
+  defer t.sending.Unlock()
+
+  t.mu.Lock()
+  spans := t.pending
+  t.pending = nil
+  t.mu.Unlock()
+  if len(spans) == 0 {
+    return
+  }
+
+  payload, err := json.Marshal(map[string]interface{}{
+    "resourceSpans": []interface{}{map[string]interface{}{
+      "resource": map[string]interface{}{"attributes": t.resource},
+      "scopeSpans": []interface{}{map[string]interface{}{
+        "scope": map[string]string{"name": "shitbox-fixer", "version": Version},
+        "spans": spans,
+      }},
+    }},
+  })
+  if err != nil {
+    t.logger.Warn("Failed to encode traces", "error", err)
+    return
+  }
+
+  req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(payload))
+  if err != nil {
+    t.logger.Warn("Failed to export traces", "error", err)
+    return
+  }
+  req.Header.Set("Content-Type", "application/json")
+  for key, value := range t.headers {
+    req.Header.Set(key, value)
+  }
+  resp, err := t.client.Do(req)
+  if err != nil {
+    t.logger.Warn("Failed to export traces", "spans", len(spans), "error", err)
+    return
+  }
+  resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    t.logger.Warn("Failed to export traces", "spans", len(spans), "status", resp.Status)
+  }
+}
@@ -0,0 +1,28 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/url"
+)
+
+// runTrigger asks the watcher of the device to check right away, e.g. after
+// the box was untangled by hand. It goes through the control socket, so it
+// only ever reaches the watcher itself.
+func runTrigger(ctx context.Context, cfg *Config, args []string) error {
+  if len(args) > 0 {
+    return fmt.Errorf("trigger takes no arguments")
+  }
+  var check CheckRequest
+  err := daemonRequest(ctx, cfg, http.MethodPost, "/api/devices/"+url.PathEscape(cfg.DeviceID)+"/check", nil, &check)
+  if errors.Is(err, errNoDaemon) {
+    return fmt.Errorf("no running watcher found for device %s (is CONTROL_SOCKET the same on both sides?)", cfg.DeviceID)
+  }
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Triggered a check in the running watcher (pid %d)\n", check.PID)
+  return nil
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+  "bufio"
+  "context"
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "strings"
+  "time"
+)
+
+// Status codes some Tuya devices use to report Wi-Fi signal strength.
+var signalCodes = []string{"rssi", "wifi_signal", "signal"}
+
+type troubleshooter struct {
+  ctx    context.Context
+  cfg    *Config
+  appLog *slog.Logger
+  in     *bufio.Reader
+  yes    bool
+  step   int
+}
+
+func (t *troubleshooter) ask(question string) {
+  t.step++
+  fmt.Printf("\n[%d] %s\n", t.step, question)
+}
+
+func (t *troubleshooter) answer(format string, args ...interface{}) {
+  fmt.Printf("    %s\n", fmt.Sprintf(format, args...))
+}
+
+// confirm asks a yes/no question. Without a terminal on stdin it only
+// proceeds with --yes, so the command never acts unattended by accident.
+func (t *troubleshooter) confirm(question string) bool {
+  if t.yes {
+    fmt.Printf("    %s [y/N] y (--yes)\n", question)
+    return true
+  }
+  if !isTerminal(os.Stdin) {
+    fmt.Printf("    %s [y/N] skipped, stdin is not a terminal (use --yes)\n", question)
+    return false
+  }
+  fmt.Printf("    %s [y/N] ", question)
+  line, _ := t.in.ReadString('\n')
+  line = strings.ToLower(strings.TrimSpace(line))
+  return line == "y" || line == "yes"
+}
+
+func (t *troubleshooter) recommend(format string, args ...interface{}) {
+  fmt.Printf("\nRecommendation: %s\n", fmt.Sprintf(format, args...))
+}
+
+func (t *troubleshooter) offerReset() error {
+  if !t.confirm("Run the reset sequence of the " + t.cfg.Preset.Name + " preset now?") {
+    return nil
+  }
+  ctx := withAuditTrigger(t.ctx, auditTriggerTroubleshoot, "manual reset from troubleshoot", localUser())
+  if err := controlDevice(ctx, t.cfg, t.appLog); err != nil {
+    return fmt.Errorf("failed to control device: %w", err)
+  }
+  fmt.Println("    Reset sequence sent")
+  if t.cfg.DataStorage == dataStorageNone {
+    return nil
+  }
+  if _, err := appendHistory(t.cfg, HistoryEntry{Kind: actionReset, Reason: "manual reset from troubleshoot"}); err != nil {
+    t.appLog.Warn("Failed to record history", "error", err)
+  }
+  return nil
+}
+
+func runTroubleshoot(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  fs := flag.NewFlagSet("troubleshoot", flag.ContinueOnError)
+  yes := fs.Bool("yes", false, "answer yes to all questions, including running the reset")
+  since := fs.Duration("since", time.Hour, "how far back to look for faults in the device logs")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+
+  t := &troubleshooter{ctx: ctx, cfg: cfg, appLog: appLog, in: bufio.NewReader(os.Stdin), yes: *yes}
+  fmt.Printf("Troubleshooting device %s (preset %s)\n", cfg.DeviceID, cfg.Preset.Name)
+
+  t.ask("Is the device online?")
+  responseCache.Invalidate("status/" + cfg.DeviceID)
+  deviceStatus, err := getDeviceStatus(ctx, cfg.DeviceID)
+  if err != nil {
+    t.answer("Could not reach the Tuya API: %v", err)
+    t.recommend("check the credentials, TUYA_REGION and your internet connection, then run `capabilities`.")
+    return nil
+  }
+
+  status := deviceStatusMap(deviceStatus)
+
+  online, _ := deviceStatus.Result["online"].(bool)
+  if !online {
+    t.answer("No, the Tuya cloud reports the device as offline.")
+    if cfg.Preset.ResetOnOffline {
+      t.recommend("check that the device has power and is in Wi-Fi range. The %s preset power-cycles offline devices, which only helps when the cloud state is stale.", cfg.Preset.Name)
+      return t.offerReset()
+    }
+    t.recommend("check that the device has power and is in Wi-Fi range. Commands cannot reach an offline device.")
+    return nil
+  }
+  t.answer("Yes.")
+
+  t.ask("Does the device respond to a harmless command?")
+  probe := cfg.Preset.ProbeCode
+  value, ok := status[probe]
+  switch {
+  case probe == "":
+    t.answer("Skipped, the %s preset has no harmless data point to test with.", cfg.Preset.Name)
+  case !ok:
+    t.answer("Skipped, the device does not report %s.", cfg.Preset.dpLabel(probe))
+  case t.confirm(fmt.Sprintf("Send %s=%v (its current value) to test?", probe, value)):
+    probeCtx := withAuditTrigger(ctx, auditTriggerTroubleshoot, "probe command", localUser())
+    err := deviceCommands.Do(probeCtx, cfg.DeviceID, "troubleshoot probe", func(ctx context.Context) error {
+      return sendCommand(ctx, cfg.DeviceID, probe, value)
+    })
+    if err != nil {
+      t.answer("No: %v", err)
+      t.recommend("the cloud sees the device but it does not accept commands. Unplug it for 10 seconds and try again.")
+      return nil
+    }
+    t.answer("Yes, the command was accepted.")
+  default:
+    t.answer("Skipped.")
+  }
+
+  t.ask("Does the device report faults?")
+  if fault, ok := status["fault"]; ok && fmt.Sprint(fault) != "0" {
+    t.answer("Yes, %s is %v.", cfg.Preset.dpLabel("fault"), fault)
+    t.recommend("the device reports a hardware fault. Check the drum, waste bin and sensors; a reset does not clear hardware faults.")
+    return nil
+  }
+
+  logs, err := queryDeviceLogs(ctx, cfg.DeviceID, LogQuery{Since: *since, DPIDs: logDPIDs(ctx, cfg), Limit: 100})
+  if err != nil {
+    t.answer("Could not query the device logs: %v", err)
+  }
+  stuckAt := time.Time{}
+  stuckValue := ""
+  for _, logEntry := range logs {
+    logMap, ok := logEntry.(map[string]interface{})
+    if !ok {
+      continue
+    }
+    value, _ := logMap["value"].(string)
+    for _, stuck := range cfg.Preset.StuckValues {
+      if value == stuck {
+        eventTime, _ := logMap["event_time"].(float64)
+        if at := time.UnixMilli(int64(eventTime)); at.After(stuckAt) {
+          stuckAt = at
+          stuckValue = value
+        }
+      }
+    }
+  }
+  if stuckValue != "" {
+    t.answer("Yes, the logs show %s at %s.", stuckValue, cfg.TimeFormat.Format(stuckAt))
+  } else {
+    t.answer("No faults in the status or in the logs of the last %s.", *since)
+  }
+
+  t.ask("Is the Wi-Fi signal weak?")
+  weak := false
+  reported := false
+  for _, code := range signalCodes {
+    signal, ok := status[code].(float64)
+    if !ok {
+      continue
+    }
+    reported = true
+    // RSSI is reported in dBm, other codes as a percentage.
+    if signal <= -75 || (signal >= 0 && signal < 40) {
+      weak = true
+    }
+    t.answer("%s is %v.", cfg.Preset.dpLabel(code), signal)
+  }
+  if !reported {
+    t.answer("Unknown, the device does not report its signal strength.")
+  }
+
+  switch {
+  case stuckValue != "":
+    t.recommend("the device is stuck in %s. The %s preset fixes this with its reset sequence.", stuckValue, cfg.Preset.Name)
+    return t.offerReset()
+  case weak:
+    t.recommend("the Wi-Fi signal is weak, which causes dropped commands and offline periods. Move the device or the access point closer.")
+  default:
+    t.recommend("no problems found, the device looks healthy.")
+  }
+  return nil
+}
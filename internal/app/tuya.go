@@ -0,0 +1,122 @@
+package app
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "net"
+  "net/http"
+  "net/url"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/tuyaclient"
+)
+
+// tuya is the client of the cloud project, set up by initTuya.
+var tuya *tuyaclient.Client
+
+// Default HTTP_CONNECT_TIMEOUT and HTTP_TIMEOUT.
+const (
+  defaultHTTPConnectTimeout = 10 * time.Second
+  defaultHTTPTimeout        = 30 * time.Second
+)
+
+// newHTTPClient returns a client that gives up on connecting (including the
+// TLS handshake) after connectTimeout and on a whole request, reading the
+// response included, after timeout. Zero disables a timeout. Without proxy,
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY apply. With --record-http or
+// --replay-http, requests go through the cassette.
+func newHTTPClient(connectTimeout, timeout time.Duration, proxy *url.URL) *http.Client {
+  transport := http.DefaultTransport.(*http.Transport).Clone()
+  transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+  transport.TLSHandshakeTimeout = connectTimeout
+  if proxy != nil {
+    transport.Proxy = http.ProxyURL(proxy)
+  }
+  if httpCassette != nil {
+    return &http.Client{Transport: httpCassette.wrap(transport), Timeout: timeout}
+  }
+  return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// parseAPIHost validates TUYA_API_HOST, e.g. https://openapi.tuyaeu.com,
+// and drops a trailing slash.
+func parseAPIHost(s string) (string, error) {
+  u, err := url.Parse(s)
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+    return "", fmt.Errorf("invalid TUYA_API_HOST (expected an https:// URL without a path, e.g. https://openapi.tuyaeu.com)")
+  }
+  return strings.TrimSuffix(s, "/"), nil
+}
+
+// parseProxyURL parses TUYA_PROXY_URL, nil when it is not set.
+func parseProxyURL(s string) (*url.URL, error) {
+  if s == "" {
+    return nil, nil
+  }
+  u, err := url.Parse(s)
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+    return nil, fmt.Errorf("invalid TUYA_PROXY_URL (expected an http://, https:// or socks5:// URL, e.g. http://proxy.lan:3128)")
+  }
+  return u, nil
+}
+
+// tuyaOptions sets up the client with the hooks of the fixer: tracing, the
+// HTTP dump, payload capture and drift reports.
+func tuyaOptions(apiHost, accessID, accessKey string, httpClient *http.Client, maxAttempts int, logger *slog.Logger) tuyaclient.Options {
+  return tuyaclient.Options{
+    APIHost:     apiHost,
+    AccessID:    accessID,
+    AccessKey:   accessKey,
+    HTTPClient:  httpClient,
+    MaxAttempts: maxAttempts,
+    Logger:      logger,
+    Tracer:      spanTracer(spanKindClient),
+    ErrorHints:  tuyaErrorHints,
+    Hooks: tuyaclient.Hooks{
+      Exchange: func(req *http.Request, toSign string, body []byte, resp *http.Response, data []byte, err error) {
+        if httpDump != nil {
+          httpDump.Record(req, toSign, body, resp, data, err)
+        }
+      },
+      Response: func(method, uri, status string, body, data []byte) {
+        capture.Record(logger, method, uri, status, body, data)
+        reportDrift(logger, uri, data)
+      },
+    },
+  }
+}
+
+func initTuya(apiHost, accessID, accessKey string, httpClient *http.Client, maxAttempts int, logger *slog.Logger) {
+  tuya = tuyaclient.New(tuyaOptions(apiHost, accessID, accessKey, httpClient, maxAttempts, logger))
+}
+
+func tuyaGet(ctx context.Context, uri string, resp interface{}) error {
+  return tuya.Get(ctx, uri, resp)
+}
+
+func tuyaPost(ctx context.Context, uri string, payload []byte, resp interface{}) error {
+  return tuya.Post(ctx, uri, payload, resp)
+}
+
+// spanTracer traces the calls of the packages under pkg/ as spans of its
+// kind, e.g. the Tuya API calls as client spans.
+type spanTracer int
+
+func (kind spanTracer) Start(ctx context.Context, name string) (context.Context, tuyaclient.Span) {
+  return startSpan(ctx, name, int(kind))
+}
+
+// stateTokenStore keeps the access token in a file of STATE_DIR.
+type stateTokenStore string
+
+func (path stateTokenStore) Load() (tuyaclient.Token, error) {
+  var token tuyaclient.Token
+  err := loadStateFile(string(path), &token)
+  return token, err
+}
+
+func (path stateTokenStore) Save(token tuyaclient.Token) error {
+  return saveStateFile(string(path), token)
+}
@@ -0,0 +1,27 @@
+package app
+
+import "shitbox-fixer/pkg/tuyaclient"
+
+// tuyaErrorHints explains the Tuya error codes new setups run into most,
+// with what to do about them. The messages Tuya returns for these, such as
+// "permission deny", do not say which setting is wrong.
+var tuyaErrorHints = map[int]string{
+  1001:     "the access secret is invalid, check TUYA_ACCESS_KEY",
+  1004:     "the request signature is invalid, check TUYA_ACCESS_ID and TUYA_ACCESS_KEY and that the system clock is correct",
+  1005:     "the access ID is unknown, check TUYA_ACCESS_ID and that TUYA_REGION matches the data center of the cloud project",
+  1010:     "the access token is invalid or expired, it is refreshed automatically; if this persists, check the credentials",
+  1011:     "the access token is invalid, check that TUYA_REGION matches the data center of the cloud project",
+  1013:     "the request time is off, sync the system clock (e.g. with NTP)",
+  1106:     "the cloud project may not access this device, link the Smart Life or Tuya app account under Devices > Link App Account in the Tuya IoT platform and check TUYA_DEVICE_ID",
+  1108:     "the API path is unknown, check that TUYA_REGION matches the data center of the cloud project",
+  2001:     "the device is offline",
+  2008:     "the device does not support this command or value, check the reset sequence of the preset (see `presets` and `check`)",
+  28841002: "the trial of the cloud project's IoT Core service has expired, extend it under Cloud > Cloud Services in the Tuya IoT platform",
+  28841101: "the API is not enabled for the cloud project, subscribe to the IoT Core service under Cloud > Cloud Services in the Tuya IoT platform",
+  28841105: "the cloud project is not subscribed to this API, subscribe to the IoT Core and Device Log services under Cloud > Cloud Services in the Tuya IoT platform",
+}
+
+// tuyaError returns the error of a success=false response, with its hint.
+func tuyaError(code int, msg string) error {
+  return &tuyaclient.APIError{Code: code, Msg: msg, Hint: tuyaErrorHints[code]}
+}
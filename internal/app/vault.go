@@ -0,0 +1,234 @@
+package app
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log/slog"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Vault auth methods, see VAULT_AUTH.
+const (
+  vaultAuthToken   = "token"
+  vaultAuthAppRole = "approle"
+)
+
+// vaultClient reads the Tuya credentials from a KV secret in HashiCorp Vault
+// through its HTTP API. The secret holds access_id and access_key.
+type vaultClient struct {
+  addr      string
+  path      string
+  namespace string
+  auth      string
+  roleID    string
+  secretID  string
+
+  mu        sync.Mutex
+  token     string
+  loggedIn  bool
+  ttl       time.Duration
+  renewable bool
+}
+
+type vaultAuthResponse struct {
+  Auth struct {
+    ClientToken   string `json:"client_token"`
+    LeaseDuration int    `json:"lease_duration"`
+    Renewable     bool   `json:"renewable"`
+  } `json:"auth"`
+}
+
+type vaultSecretResponse struct {
+  Data map[string]interface{} `json:"data"`
+}
+
+type vaultTokenResponse struct {
+  Data struct {
+    TTL       int  `json:"ttl"`
+    Renewable bool `json:"renewable"`
+  } `json:"data"`
+}
+
+func newVaultClient(addr, path, namespace, auth, token, roleID, secretID string) (*vaultClient, error) {
+  if path == "" {
+    return nil, fmt.Errorf("VAULT_PATH is required with VAULT_ADDR")
+  }
+  switch auth {
+  case vaultAuthToken:
+    if token == "" {
+      return nil, fmt.Errorf("VAULT_TOKEN is required with VAULT_AUTH=token")
+    }
+  case vaultAuthAppRole:
+    if roleID == "" || secretID == "" {
+      return nil, fmt.Errorf("VAULT_ROLE_ID and VAULT_SECRET_ID are required with VAULT_AUTH=approle")
+    }
+  default:
+    return nil, fmt.Errorf("invalid VAULT_AUTH: %s (valid: token, approle)", auth)
+  }
+  return &vaultClient{
+    addr:      strings.TrimSuffix(addr, "/"),
+    path:      strings.Trim(path, "/"),
+    namespace: namespace,
+    auth:      auth,
+    token:     token,
+    roleID:    roleID,
+    secretID:  secretID,
+  }, nil
+}
+
+func (v *vaultClient) do(ctx context.Context, method, uri string, body interface{}, resp interface{}) error {
+  var reader io.Reader
+  if body != nil {
+    data, err := json.Marshal(body)
+    if err != nil {
+      return err
+    }
+    reader = bytes.NewReader(data)
+  }
+  req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+uri, reader)
+  if err != nil {
+    return err
+  }
+  if v.token != "" {
+    req.Header.Set("X-Vault-Token", v.token)
+  }
+  if v.namespace != "" {
+    req.Header.Set("X-Vault-Namespace", v.namespace)
+  }
+
+  res, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+  data, err := io.ReadAll(res.Body)
+  if err != nil {
+    return err
+  }
+  if res.StatusCode/100 != 2 {
+    var errResp struct {
+      Errors []string `json:"errors"`
+    }
+    _ = json.Unmarshal(data, &errResp)
+    if len(errResp.Errors) > 0 {
+      return fmt.Errorf("vault returned %s: %s", res.Status, strings.Join(errResp.Errors, "; "))
+    }
+    return fmt.Errorf("vault returned %s", res.Status)
+  }
+  return json.Unmarshal(data, resp)
+}
+
+// login obtains a token for AppRole auth, or looks up the TTL of the given
+// token.
+func (v *vaultClient) login(ctx context.Context) error {
+  if v.auth == vaultAuthAppRole {
+    v.token = ""
+    resp := &vaultAuthResponse{}
+    err := v.do(ctx, http.MethodPost, "auth/approle/login", map[string]string{"role_id": v.roleID, "secret_id": v.secretID}, resp)
+    if err != nil {
+      return fmt.Errorf("failed to log in to vault: %w", err)
+    }
+    v.token = resp.Auth.ClientToken
+    v.ttl = time.Duration(resp.Auth.LeaseDuration) * time.Second
+    v.renewable = resp.Auth.Renewable
+    v.loggedIn = true
+    return nil
+  }
+
+  resp := &vaultTokenResponse{}
+  if err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, resp); err != nil {
+    return fmt.Errorf("failed to look up vault token: %w", err)
+  }
+  v.ttl = time.Duration(resp.Data.TTL) * time.Second
+  v.renewable = resp.Data.Renewable
+  v.loggedIn = true
+  return nil
+}
+
+func (v *vaultClient) renew(ctx context.Context) error {
+  resp := &vaultAuthResponse{}
+  if err := v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{}, resp); err != nil {
+    return fmt.Errorf("failed to renew vault token: %w", err)
+  }
+  v.ttl = time.Duration(resp.Auth.LeaseDuration) * time.Second
+  return nil
+}
+
+// Credentials logs in if needed and reads the access ID and key.
+func (v *vaultClient) Credentials(ctx context.Context) (string, string, error) {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+
+  if !v.loggedIn {
+    if err := v.login(ctx); err != nil {
+      return "", "", err
+    }
+  }
+
+  resp := &vaultSecretResponse{}
+  if err := v.do(ctx, http.MethodGet, v.path, nil, resp); err != nil {
+    return "", "", fmt.Errorf("failed to read %s from vault: %w", v.path, err)
+  }
+  // KV version 2 nests the secret in another data object.
+  data := resp.Data
+  if nested, ok := data["data"].(map[string]interface{}); ok {
+    data = nested
+  }
+  accessID, _ := data["access_id"].(string)
+  accessKey, _ := data["access_key"].(string)
+  if accessID == "" || accessKey == "" {
+    return "", "", fmt.Errorf("vault secret %s has no access_id and access_key", v.path)
+  }
+  return accessID, accessKey, nil
+}
+
+// refreshInterval is half the token TTL, or an hour for tokens that do not
+// expire.
+func (v *vaultClient) refreshInterval() time.Duration {
+  v.mu.Lock()
+  defer v.mu.Unlock()
+  if v.ttl <= 0 {
+    return time.Hour
+  }
+  return max(v.ttl/2, 10*time.Second)
+}
+
+// Maintain keeps the token alive in watch mode and applies rotated
+// credentials to the Tuya client. A token that can no longer be renewed is
+// replaced by logging in again with AppRole.
+func (v *vaultClient) Maintain(ctx context.Context, appLog *slog.Logger) {
+  for {
+    if err := sleepContext(ctx, v.refreshInterval()); err != nil {
+      return
+    }
+
+    v.mu.Lock()
+    var err error
+    if v.renewable {
+      err = v.renew(ctx)
+    }
+    if (err != nil || !v.renewable) && v.auth == vaultAuthAppRole {
+      err = v.login(ctx)
+    }
+    v.mu.Unlock()
+    if err != nil {
+      appLog.Warn("Failed to renew vault token", "error", err)
+      continue
+    }
+
+    accessID, accessKey, err := v.Credentials(ctx)
+    if err != nil {
+      appLog.Warn("Failed to refresh credentials from vault", "error", err)
+      continue
+    }
+    if tuya.SetCredentials(accessID, accessKey) {
+      appLog.Info("Tuya credentials changed in vault, using the new ones")
+    }
+  }
+}
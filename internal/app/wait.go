@@ -0,0 +1,98 @@
+package app
+
+import (
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "log/slog"
+  "strings"
+  "time"
+)
+
+// WaitResult is the JSON output of the wait command.
+type WaitResult struct {
+  DeviceID string  `json:"device_id"`
+  State    string  `json:"state"`
+  Waited   float64 `json:"waited_seconds"`
+}
+
+// runWait polls the device until its work state DP has one of the given
+// values, e.g. to chain actions after a reset in a script. Running into the
+// timeout is an error, so the command exits non-zero.
+func runWait(ctx context.Context, cfg *Config, appLog *slog.Logger, args []string) error {
+  fs := flag.NewFlagSet("wait", flag.ContinueOnError)
+  states := fs.String("state", "", "comma-separated work states to wait for, e.g. standby")
+  code := fs.String("code", "status", "DP that reports the work state")
+  timeout := fs.Duration("timeout", 5*time.Minute, "how long to wait")
+  interval := fs.Duration("interval", 5*time.Second, "how often to poll the status")
+  deviceID := fs.String("device", cfg.DeviceID, "device to wait for")
+  fs.StringVar(&cfg.Output, "output", cfg.Output, "output format: text or json")
+  if err := fs.Parse(args); err != nil {
+    return err
+  }
+  if err := validateOutput(cfg.Output); err != nil {
+    return fmt.Errorf("invalid --output: %w", err)
+  }
+  var want []string
+  for _, s := range strings.Split(*states, ",") {
+    if s = strings.TrimSpace(s); s != "" {
+      want = append(want, s)
+    }
+  }
+  if len(want) == 0 {
+    return fmt.Errorf("--state is required")
+  }
+  if *timeout <= 0 || *interval <= 0 {
+    return fmt.Errorf("--timeout and --interval must be positive")
+  }
+
+  start := time.Now()
+  ctx, cancel := context.WithTimeout(ctx, *timeout)
+  defer cancel()
+  last := ""
+  for {
+    responseCache.Invalidate("status/" + *deviceID)
+    deviceStatus, err := getDeviceStatus(ctx, *deviceID)
+    switch {
+    case errors.Is(ctx.Err(), context.DeadlineExceeded):
+      // Reported below.
+    case err != nil:
+      // A device that restarts after a reset may briefly not answer.
+      appLog.Warn("Failed to get device status", "error", err)
+    default:
+      state := "offline"
+      if online, _ := deviceStatus.Result["online"].(bool); online {
+        value, ok := deviceStatusMap(deviceStatus)[*code]
+        if !ok {
+          return fmt.Errorf("device does not report DP %s, pick the work state DP with --code", *code)
+        }
+        state = fmt.Sprint(value)
+      }
+      if state != last {
+        appLog.Info("Device state", "state", state)
+        last = state
+      }
+      for _, w := range want {
+        if state == w {
+          result := WaitResult{DeviceID: *deviceID, State: state, Waited: time.Since(start).Seconds()}
+          if cfg.Output == outputJSON {
+            return printJSON(result)
+          }
+          fmt.Printf("Device is %s after %s\n", state, time.Since(start).Truncate(time.Second))
+          return nil
+        }
+      }
+    }
+
+    if err := sleepContext(ctx, *interval); err != nil {
+      if errors.Is(err, context.DeadlineExceeded) {
+        if last == "" {
+          return fmt.Errorf("device did not reach %s within %s", strings.Join(want, " or "), *timeout)
+        }
+        return fmt.Errorf("device did not reach %s within %s, it is %s", strings.Join(want, " or "), *timeout, last)
+      }
+      return err
+    }
+  }
+}
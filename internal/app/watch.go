@@ -0,0 +1,325 @@
+package app
+
+import (
+  "context"
+  "log/slog"
+  "runtime"
+  "sync"
+  "time"
+
+  "shitbox-fixer/pkg/notify"
+)
+
+const notifyEventWatchdog = "watchdog"
+
+type loopStatus struct {
+  mu            sync.Mutex
+  deadline      time.Duration
+  checkEvery    time.Duration
+  generation    int
+  phase         string
+  cycleStarted  time.Time
+  lastCompleted time.Time
+  lastCycle     time.Time
+  // pausedUntil is the end of a circuit breaker cool-off, no check is due
+  // before.
+  pausedUntil time.Time
+  cycles      int
+  restarts    int
+}
+
+type loopRun struct {
+  status     *loopStatus
+  generation int
+}
+
+type loopRunKey struct{}
+
+// setPhase records what the current poll cycle is doing so a stalled loop can
+// be diagnosed. It is a no-op outside of watch mode.
+func setPhase(ctx context.Context, phase string) {
+  run, ok := ctx.Value(loopRunKey{}).(*loopRun)
+  if !ok {
+    return
+  }
+  run.status.mu.Lock()
+  defer run.status.mu.Unlock()
+  if run.status.generation == run.generation {
+    run.status.phase = phase
+  }
+}
+
+func (s *loopStatus) begin() int {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.generation++
+  s.phase = "idle"
+  s.lastCompleted = time.Now()
+  return s.generation
+}
+
+func (s *loopStatus) startCycle(generation int) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.generation == generation {
+    s.phase = "starting"
+    s.cycleStarted = time.Now()
+  }
+}
+
+func (s *loopStatus) completeCycle(generation int) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.generation == generation {
+    s.phase = "idle"
+    s.lastCompleted = time.Now()
+    s.lastCycle = s.lastCompleted
+    s.cycles++
+  }
+}
+
+// healthy reports whether checks still complete, for systemd's watchdog,
+// and how long ago the last one did. Unlike the stall detection it ignores
+// loop restarts, so systemd restarts the process when a restarted loop
+// stalls again.
+func (s *loopStatus) healthy() (bool, time.Duration) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  ago := time.Since(s.lastCycle)
+  return time.Since(s.pausedUntil) <= 2*s.deadline || ago <= 2*s.deadline, ago
+}
+
+func (s *loopStatus) pause(generation int, until time.Time) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.generation == generation {
+    s.phase = "circuit breaker open"
+    s.pausedUntil = until
+  }
+}
+
+// watchdogDeadline is how long a cycle may take before the loop counts as
+// stalled. It follows POLL_INTERVAL when the config is reloaded.
+func watchdogDeadline(cfg *Config) time.Duration {
+  return cfg.PollInterval * time.Duration(cfg.WatchdogFactor)
+}
+
+// watchdogCheckInterval is how often the watchdog checks for a stalled loop,
+// twice per poll interval but at most once a second.
+func watchdogCheckInterval(cfg *Config) time.Duration {
+  return max(cfg.PollInterval/2, time.Second)
+}
+
+// waitForNextCycle sleeps for the poll interval, or the cool-off when pause
+// is set, or until a check is triggered. Config reloads requested in the
+// meantime are applied right away, so they never race with a check.
+func waitForNextCycle(ctx context.Context, live *liveConfig, appLog *slog.Logger, status *loopStatus, loop loopChannels, pause time.Duration) error {
+  started := time.Now()
+  for {
+    wait := live.Load().PollInterval
+    if pause > 0 {
+      wait = pause
+    }
+    timer := time.NewTimer(time.Until(started.Add(wait)))
+    select {
+    case <-timer.C:
+      return nil
+    case <-ctx.Done():
+      timer.Stop()
+      return ctx.Err()
+    case <-loop.triggers:
+      timer.Stop()
+      return nil
+    case <-loop.reloads:
+      timer.Stop()
+      reloadConfig(live, appLog)
+      status.mu.Lock()
+      status.deadline = watchdogDeadline(live.Load())
+      status.checkEvery = watchdogCheckInterval(live.Load())
+      status.mu.Unlock()
+    }
+  }
+}
+
+// loopChannels carry requests from signal handlers to the poll loop.
+type loopChannels struct {
+  reloads  chan struct{}
+  triggers chan struct{}
+}
+
+// startLoop runs the poll loop until ctx is cancelled or the returned cancel
+// function is called. done is closed when the loop has returned.
+func startLoop(parent context.Context, live *liveConfig, appLog *slog.Logger, status *loopStatus, loop loopChannels) (cancel context.CancelFunc, done <-chan struct{}) {
+  ctx, cancel := context.WithCancel(parent)
+  finished := make(chan struct{})
+  generation := status.begin()
+  ctx = context.WithValue(ctx, loopRunKey{}, &loopRun{status: status, generation: generation})
+
+  go func() {
+    defer close(finished)
+    var previous *CheckResult
+    var breaker circuitBreaker
+    for {
+      // A cycle sticks to one config, a reload applies from the next one.
+      cfg := live.Load()
+      status.startCycle(generation)
+      result, err := runCheck(ctx, cfg, appLog)
+      if err != nil && ctx.Err() != nil {
+        return
+      }
+      reportCheckResult(cfg, appLog, result, err)
+      if err == nil {
+        sendHeartbeat(ctx, cfg, appLog, result)
+      }
+      if !result.Standby {
+        updateRollups(ctx, cfg, appLog)
+        checkFirmware(ctx, cfg, appLog, result)
+      }
+      if cfg.Output == outputJSON {
+        printCheckResult(result, err)
+      }
+      if cfg.Output == outputTable {
+        printCheckTable(cfg, result, err)
+      }
+      printVerdict(cfg, result, err)
+      events.Publish(checkEvent(result, err))
+      if err == nil {
+        if statusChanged(previous, result) {
+          events.Publish(statusEvent(result))
+        }
+        previous = result
+      }
+      if err != nil {
+        appLog.Error("Check failed", "error", err)
+      }
+      status.completeCycle(generation)
+      health.recordCheck(err)
+      pause := breaker.record(cfg, appLog, result, err)
+      if pause > 0 {
+        status.pause(generation, time.Now().Add(pause))
+      }
+
+      if err := waitForNextCycle(ctx, live, appLog, status, loop, pause); err != nil {
+        return
+      }
+    }
+  }()
+
+  return cancel, finished
+}
+
+func runWatch(ctx context.Context, live *liveConfig, appLog *slog.Logger) {
+  // Only for settings that need a restart, the rest may be reloaded.
+  cfg := live.Load()
+  deadline := watchdogDeadline(cfg)
+  appLog.Info("Watching device", "poll_interval", cfg.PollInterval, "watchdog_deadline", deadline)
+
+  handleCaptureSignal(appLog)
+  loop := loopChannels{reloads: make(chan struct{}, 1), triggers: make(chan struct{}, 1)}
+  handleReloadSignal(appLog, loop.reloads)
+  handleTriggerSignal(appLog, loop.triggers)
+
+  stopControl := serveControl(ctx, live, appLog, loop.triggers)
+  stopHealth := serveHealth(ctx, cfg, appLog)
+
+  if cfg.Vault != nil {
+    go cfg.Vault.Maintain(ctx, appLog)
+  }
+
+  checkEvery := watchdogCheckInterval(cfg)
+  status := &loopStatus{deadline: deadline, checkEvery: checkEvery, lastCycle: time.Now()}
+  health.watch(status)
+  cancel, done := startLoop(ctx, live, appLog, status, loop)
+  notifySystemd(appLog, "READY=1\nSTATUS=Watching device "+cfg.DeviceID)
+
+  var watchdogTick <-chan time.Time
+  if interval := sdWatchdogInterval(); interval > 0 {
+    appLog.Debug("Notifying the systemd watchdog", "interval", interval/2)
+    watchdogTicker := time.NewTicker(interval / 2)
+    defer watchdogTicker.Stop()
+    watchdogTick = watchdogTicker.C
+  }
+  watchdogStopped := false
+
+  ticker := time.NewTicker(checkEvery)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-watchdogTick:
+      healthy, ago := status.healthy()
+      if healthy {
+        notifySystemd(appLog, "WATCHDOG=1")
+        watchdogStopped = false
+      } else if !watchdogStopped {
+        appLog.Error("Watchdog: poll loop did not recover, leaving the restart to systemd", "last_check_ago", ago.Round(time.Second))
+        watchdogStopped = true
+      }
+      continue
+    case <-ctx.Done():
+      notifySystemd(appLog, "STOPPING=1")
+      <-done
+      if cfg.Leader != nil {
+        cfg.Leader.Release(appLog)
+      }
+      stopControl()
+      stopHealth()
+      appLog.Info("Stopped watching device")
+      return
+    }
+
+    status.mu.Lock()
+    deadline = status.deadline
+    if status.checkEvery != checkEvery {
+      checkEvery = status.checkEvery
+      ticker.Reset(checkEvery)
+    }
+    stalled := time.Since(status.lastCompleted) > deadline && time.Since(status.pausedUntil) > deadline
+    phase := status.phase
+    cycleStarted := status.cycleStarted
+    lastCompleted := status.lastCompleted
+    cycles := status.cycles
+    if stalled {
+      status.restarts++
+    }
+    restarts := status.restarts
+    status.mu.Unlock()
+
+    if !stalled {
+      continue
+    }
+
+    cancel()
+
+    appLog.Warn("Watchdog: poll loop stalled",
+      "phase", phase,
+      "cycle_started_ago", since(cycleStarted),
+      "last_completed_ago", since(lastCompleted),
+      "cycles", cycles,
+      "goroutines", runtime.NumGoroutine(),
+      "queued_commands", len(deviceCommands.Snapshot(cfg.DeviceID)))
+    if appLog.Enabled(context.Background(), slog.LevelDebug) {
+      buf := make([]byte, 1<<20)
+      n := runtime.Stack(buf, true)
+      appLog.Debug("Watchdog: goroutine dump", "stack", string(buf[:n]))
+    }
+
+    cancel, done = startLoop(ctx, live, appLog, status, loop)
+    appLog.Info("Watchdog: poll loop restarted", "restarts", restarts)
+    current := live.Load()
+    sendNotification(current, appLog, notify.Notification{
+      Level:   notify.LevelWarning,
+      Event:   notifyEventWatchdog,
+      Title:   tr(current, "Poll loop restarted"),
+      Message: tr(current, "No check completed for %s (phase: %s), the watchdog restarted the poll loop (restart #%d)", since(lastCompleted), phase, restarts),
+    })
+  }
+}
+
+func since(t time.Time) time.Duration {
+  if t.IsZero() {
+    return 0
+  }
+  return time.Since(t).Round(time.Second)
+}
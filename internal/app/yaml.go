@@ -0,0 +1,113 @@
+package app
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+// parseYAML reads the subset of YAML used by config files: nested mappings
+// with plain, single or double quoted scalar values and comments. Lists,
+// anchors and multi-line strings are not supported.
+func parseYAML(data string) (map[string]interface{}, error) {
+  type level struct {
+    indent int
+    m      map[string]interface{}
+  }
+  root := map[string]interface{}{}
+  stack := []level{{0, root}}
+  // pending is a key without a value, whose mapping starts on the next
+  // more indented line.
+  var pending map[string]interface{}
+
+  for n, raw := range strings.Split(data, "\n") {
+    lineNo := n + 1
+    line := strings.TrimRight(stripYAMLComment(raw), " \r")
+    trimmed := strings.TrimLeft(line, " ")
+    if trimmed == "" || trimmed == "---" {
+      continue
+    }
+    if strings.HasPrefix(trimmed, "\t") {
+      return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+    }
+    if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+      return nil, fmt.Errorf("line %d: lists are not supported", lineNo)
+    }
+    indent := len(line) - len(trimmed)
+
+    if pending != nil {
+      if indent > stack[len(stack)-1].indent {
+        stack = append(stack, level{indent, pending})
+      }
+      pending = nil
+    }
+    for indent < stack[len(stack)-1].indent {
+      stack = stack[:len(stack)-1]
+    }
+    if indent != stack[len(stack)-1].indent {
+      return nil, fmt.Errorf("line %d: unexpected indentation", lineNo)
+    }
+    current := stack[len(stack)-1].m
+
+    key, value, ok := strings.Cut(trimmed, ":")
+    if !ok || (value != "" && value[0] != ' ') {
+      return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+    }
+    key = strings.TrimSpace(key)
+    if _, exists := current[key]; exists {
+      return nil, fmt.Errorf("line %d: duplicate key %s", lineNo, key)
+    }
+    value = strings.TrimSpace(value)
+    if value == "" {
+      child := map[string]interface{}{}
+      current[key] = child
+      pending = child
+      continue
+    }
+    scalar, err := parseYAMLScalar(value)
+    if err != nil {
+      return nil, fmt.Errorf("line %d: %w", lineNo, err)
+    }
+    current[key] = scalar
+  }
+  return root, nil
+}
+
+func stripYAMLComment(line string) string {
+  quote := byte(0)
+  for i := 0; i < len(line); i++ {
+    c := line[i]
+    switch {
+    case quote != 0:
+      if c == quote {
+        quote = 0
+      } else if c == '\\' && quote == '"' {
+        i++
+      }
+    case c == '"' || c == '\'':
+      quote = c
+    case c == '#' && (i == 0 || line[i-1] == ' '):
+      return line[:i]
+    }
+  }
+  return line
+}
+
+func parseYAMLScalar(value string) (string, error) {
+  switch value[0] {
+  case '"':
+    s, err := strconv.Unquote(value)
+    if err != nil {
+      return "", fmt.Errorf("invalid double quoted string %s", value)
+    }
+    return s, nil
+  case '\'':
+    if len(value) < 2 || value[len(value)-1] != '\'' {
+      return "", fmt.Errorf("invalid single quoted string %s", value)
+    }
+    return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+  case '[', '{', '&', '*', '|', '>':
+    return "", fmt.Errorf("unsupported value %s, quote it", value)
+  }
+  return value, nil
+}
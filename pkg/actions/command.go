@@ -0,0 +1,74 @@
+// Package actions changes devices: it sends commands through the Tuya cloud
+// API, runs reset sequences step by step and queues the commands per
+// device, so that the steps of a sequence never interleave with other
+// writes.
+package actions
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "strings"
+
+  "shitbox-fixer/pkg/tuyaclient"
+)
+
+// Command sets a DP of a device to a value.
+type Command struct {
+  Code  string      `json:"code"`
+  Value interface{} `json:"value"`
+}
+
+// CommandResponse is Tuya's response to a command.
+type CommandResponse struct {
+  Code    int    `json:"code"`
+  Msg     string `json:"msg"`
+  Success bool   `json:"success"`
+  Result  bool   `json:"result"`
+  T       int64  `json:"t"`
+}
+
+// Sender sends commands to a device.
+type Sender interface {
+  Send(ctx context.Context, deviceID string, commands []Command) error
+}
+
+// Client sends commands through the Tuya cloud API.
+type Client struct {
+  Tuya *tuyaclient.Client
+  // Hints explain Tuya error codes in the error of a failed command.
+  Hints map[int]string
+  // Sent is called after every call that changes a device, with the
+  // response and the error, e.g. to keep an audit log.
+  Sent func(ctx context.Context, deviceID string, commands []Command, resp *CommandResponse, err error)
+}
+
+// Send sends commands to the device in one call.
+func (c *Client) Send(ctx context.Context, deviceID string, commands []Command) error {
+  codes := make([]string, 0, len(commands))
+  for _, command := range commands {
+    codes = append(codes, command.Code)
+  }
+  name := strings.Join(codes, "+")
+
+  payload, _ := json.Marshal(map[string]interface{}{
+    "commands": commands,
+  })
+  return c.Post(ctx, deviceID, fmt.Sprintf("/v1.0/devices/%s/commands", deviceID), payload, name, commands)
+}
+
+// Post makes an API call that changes the device, e.g. a firmware upgrade.
+// name describes it in errors, commands is what Sent is told was sent.
+func (c *Client) Post(ctx context.Context, deviceID, uri string, payload []byte, name string, commands []Command) error {
+  resp := &CommandResponse{}
+  err := c.Tuya.Post(ctx, uri, payload, resp)
+  if err != nil {
+    err = fmt.Errorf("failed to send %s command: %w", name, err)
+  } else if !resp.Success {
+    err = fmt.Errorf("%s command failed: %w", name, &tuyaclient.APIError{Code: resp.Code, Msg: resp.Msg, Hint: c.Hints[resp.Code]})
+  }
+  if c.Sent != nil {
+    c.Sent(ctx, deviceID, commands, resp, err)
+  }
+  return err
+}
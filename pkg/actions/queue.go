@@ -0,0 +1,136 @@
+package actions
+
+import (
+  "context"
+  "sort"
+  "sync"
+  "time"
+)
+
+// Job is a unit of work against one device, e.g. a whole reset sequence.
+// Jobs for the same device run one at a time in FIFO order.
+type Job struct {
+  ID       int       `json:"id"`
+  DeviceID string    `json:"device_id"`
+  Source   string    `json:"source"`
+  Enqueued time.Time `json:"enqueued"`
+  Started  time.Time `json:"started,omitzero"`
+
+  ctx  context.Context
+  run  func(ctx context.Context) error
+  done chan error
+}
+
+func (j *Job) info() Job {
+  return Job{ID: j.ID, DeviceID: j.DeviceID, Source: j.Source, Enqueued: j.Enqueued, Started: j.Started}
+}
+
+type deviceQueue struct {
+  running *Job
+  pending []*Job
+}
+
+// Queue serializes commands per device so that reset sequences and other
+// writes never interleave, e.g. when a poll loop is restarted while an
+// abandoned cycle is still resetting the device.
+type Queue struct {
+  mu     sync.Mutex
+  nextID int
+  queues map[string]*deviceQueue
+}
+
+// NewQueue returns an empty queue.
+func NewQueue() *Queue {
+  return &Queue{queues: make(map[string]*deviceQueue)}
+}
+
+// Do queues run for the device and waits for it to finish. A job whose ctx
+// is cancelled before it starts is dropped from the queue.
+func (q *Queue) Do(ctx context.Context, deviceID, source string, run func(ctx context.Context) error) error {
+  q.mu.Lock()
+  q.nextID++
+  job := &Job{
+    ID:       q.nextID,
+    DeviceID: deviceID,
+    Source:   source,
+    Enqueued: time.Now(),
+    ctx:      ctx,
+    run:      run,
+    done:     make(chan error, 1),
+  }
+  dq, ok := q.queues[deviceID]
+  if !ok {
+    dq = &deviceQueue{}
+    q.queues[deviceID] = dq
+  }
+  dq.pending = append(dq.pending, job)
+  if !ok {
+    go q.work(deviceID, dq)
+  }
+  q.mu.Unlock()
+
+  select {
+  case err := <-job.done:
+    return err
+  case <-ctx.Done():
+  }
+
+  q.mu.Lock()
+  for i, pending := range dq.pending {
+    if pending == job {
+      dq.pending = append(dq.pending[:i], dq.pending[i+1:]...)
+      q.mu.Unlock()
+      return ctx.Err()
+    }
+  }
+  q.mu.Unlock()
+
+  // Already running, it sees the same cancelled ctx.
+  return <-job.done
+}
+
+func (q *Queue) work(deviceID string, dq *deviceQueue) {
+  for {
+    q.mu.Lock()
+    if len(dq.pending) == 0 {
+      dq.running = nil
+      delete(q.queues, deviceID)
+      q.mu.Unlock()
+      return
+    }
+    job := dq.pending[0]
+    dq.pending = dq.pending[1:]
+    job.Started = time.Now()
+    dq.running = job
+    q.mu.Unlock()
+
+    job.done <- job.run(job.ctx)
+  }
+}
+
+// Snapshot returns the running job followed by the pending ones, for all
+// devices when deviceID is empty, ordered by device.
+func (q *Queue) Snapshot(deviceID string) []Job {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  ids := make([]string, 0, len(q.queues))
+  for id := range q.queues {
+    if deviceID == "" || id == deviceID {
+      ids = append(ids, id)
+    }
+  }
+  sort.Strings(ids)
+
+  jobs := []Job{}
+  for _, id := range ids {
+    dq := q.queues[id]
+    if dq.running != nil {
+      jobs = append(jobs, dq.running.info())
+    }
+    for _, job := range dq.pending {
+      jobs = append(jobs, job.info())
+    }
+  }
+  return jobs
+}
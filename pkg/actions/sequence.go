@@ -0,0 +1,108 @@
+package actions
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log/slog"
+  "time"
+
+  "shitbox-fixer/pkg/rules"
+  "shitbox-fixer/pkg/tuyaclient"
+)
+
+// Step is one command of a reset sequence.
+type Step struct {
+  Code  string
+  Value interface{}
+  Wait  time.Duration
+  // Verify is an optional rule checked after Wait; the sequence is aborted
+  // when it does not hold.
+  Verify string
+}
+
+// Runner runs reset sequences.
+type Runner struct {
+  Sender Sender
+  // Verify checks the verify rule of a step against the current state of
+  // the device and returns why it does not hold. It is required for
+  // sequences with verify rules.
+  Verify func(ctx context.Context, deviceID string, rule *rules.Rule) error
+  // Logger and Tracer are optional.
+  Logger *slog.Logger
+  Tracer tuyaclient.Tracer
+}
+
+// Run sends the steps to the device one after the other and stops at the
+// first that fails or is not verified. It does not queue them, run it
+// within Queue.Do so that no other command reaches the device between the
+// steps.
+func (r *Runner) Run(ctx context.Context, deviceID string, steps []Step) (err error) {
+  ctx, span := r.startSpan(ctx, "reset sequence")
+  span.SetAttr("device.id", deviceID)
+  span.SetAttr("reset.steps", len(steps))
+  defer func() { span.End(err) }()
+
+  for _, step := range steps {
+    if err := r.runStep(ctx, deviceID, step); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// runStep sends one command of a reset sequence, waits and verifies it.
+func (r *Runner) runStep(ctx context.Context, deviceID string, step Step) (err error) {
+  ctx, span := r.startSpan(ctx, fmt.Sprintf("step %s=%v", step.Code, step.Value))
+  span.SetAttr("step.code", step.Code)
+  span.SetAttr("step.value", step.Value)
+  defer func() { span.End(err) }()
+
+  if err := r.Sender.Send(ctx, deviceID, []Command{{Code: step.Code, Value: step.Value}}); err != nil {
+    return err
+  }
+
+  logger := r.Logger
+  if logger == nil {
+    logger = slog.New(slog.DiscardHandler)
+  }
+  logger.Debug("Sent command", "code", step.Code, "value", step.Value)
+
+  if step.Wait > 0 {
+    logger.Debug("Waiting", "duration", step.Wait)
+    timer := time.NewTimer(step.Wait)
+    select {
+    case <-ctx.Done():
+      timer.Stop()
+      return ctx.Err()
+    case <-timer.C:
+    }
+  }
+
+  if step.Verify != "" {
+    rule, err := rules.Parse(step.Verify)
+    if err != nil {
+      return err
+    }
+    if r.Verify == nil {
+      return errors.New("no Verify func for the verify rule " + step.Verify)
+    }
+    if err := r.Verify(ctx, deviceID, rule); err != nil {
+      return fmt.Errorf("step %s=%v not verified: %w", step.Code, step.Value, err)
+    }
+  }
+  return nil
+}
+
+func (r *Runner) startSpan(ctx context.Context, name string) (context.Context, tuyaclient.Span) {
+  if r.Tracer == nil {
+    return ctx, noSpan{}
+  }
+  return r.Tracer.Start(ctx, name)
+}
+
+type noSpan struct{}
+
+func (noSpan) SetAttr(string, interface{}) {}
+
+func (noSpan) End(error) {}
@@ -0,0 +1,105 @@
+package actions
+
+import (
+  "context"
+  "errors"
+  "slices"
+  "strings"
+  "testing"
+  "time"
+
+  "shitbox-fixer/pkg/rules"
+)
+
+type recordingSender struct {
+  sent   []string
+  failOn string
+}
+
+func (s *recordingSender) Send(ctx context.Context, deviceID string, commands []Command) error {
+  for _, command := range commands {
+    if command.Code == s.failOn {
+      return errors.New("device offline")
+    }
+    s.sent = append(s.sent, command.Code)
+  }
+  return nil
+}
+
+func TestRunnerRun(t *testing.T) {
+  steps := []Step{
+    {Code: "switch", Value: false, Wait: time.Millisecond},
+    {Code: "switch", Value: true, Verify: `status["switch"] == true`},
+    {Code: "manual_clean", Value: true},
+  }
+  tests := []struct {
+    name     string
+    failOn   string
+    verified bool
+    wantSent []string
+    wantErr  string
+  }{
+    {name: "all steps", verified: true, wantSent: []string{"switch", "switch", "manual_clean"}},
+    {name: "send fails", failOn: "manual_clean", verified: true, wantSent: []string{"switch", "switch"}, wantErr: "device offline"},
+    {name: "not verified", wantSent: []string{"switch", "switch"}, wantErr: "step switch=true not verified"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      sender := &recordingSender{failOn: tt.failOn}
+      r := &Runner{
+        Sender: sender,
+        Verify: func(ctx context.Context, deviceID string, rule *rules.Rule) error {
+          ok, err := rule.Eval(rules.Env{"status": map[string]interface{}{"switch": tt.verified}})
+          if err != nil || !ok {
+            return errors.New("rule does not hold")
+          }
+          return nil
+        },
+      }
+      err := r.Run(context.Background(), "dev1", steps)
+      if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+        t.Errorf("Run() error = %v, want %q", err, tt.wantErr)
+      }
+      if !slices.Equal(sender.sent, tt.wantSent) {
+        t.Errorf("sent %v, want %v", sender.sent, tt.wantSent)
+      }
+    })
+  }
+}
+
+func TestQueueSerializesDevice(t *testing.T) {
+  q := NewQueue()
+  started := make(chan struct{})
+  release := make(chan struct{})
+  go q.Do(context.Background(), "dev1", "reset sequence", func(ctx context.Context) error {
+    close(started)
+    <-release
+    return nil
+  })
+  <-started
+
+  done := make(chan error, 1)
+  go func() {
+    done <- q.Do(context.Background(), "dev1", "send", func(ctx context.Context) error { return nil })
+  }()
+  deadline := time.Now().Add(time.Second)
+  for len(q.Snapshot("dev1")) < 2 && time.Now().Before(deadline) {
+    time.Sleep(time.Millisecond)
+  }
+  jobs := q.Snapshot("")
+  if len(jobs) != 2 || jobs[0].Source != "reset sequence" || jobs[0].Started.IsZero() || !jobs[1].Started.IsZero() {
+    t.Fatalf("Snapshot() = %+v, want the running reset sequence and the pending send", jobs)
+  }
+
+  // A job cancelled while pending is dropped without running.
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  if err := q.Do(ctx, "dev1", "probe", func(ctx context.Context) error { return errors.New("ran") }); !errors.Is(err, context.Canceled) {
+    t.Errorf("Do() with a cancelled ctx = %v, want context.Canceled", err)
+  }
+
+  close(release)
+  if err := <-done; err != nil {
+    t.Errorf("queued Do() = %v", err)
+  }
+}
@@ -0,0 +1,181 @@
+// Package detect decides how strongly a device needs a reset. Detectors
+// each look at the device state of one check and report a value between 0
+// and 1; Run weighs and adds them up to a confidence score.
+//
+// The package keeps no state between checks: the stuck period, since when
+// the device is offline and whether it cleaned recently are tracked by the
+// caller and passed in with the Input.
+package detect
+
+import (
+  "fmt"
+  "log/slog"
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "shitbox-fixer/pkg/rules"
+)
+
+// Settings configure the detectors, from the device preset and the
+// DETECT_* settings.
+type Settings struct {
+  // ResetOnOffline makes being offline enough for a reset on its own.
+  ResetOnOffline bool
+  // StuckValues are DP values the device shows while it is stuck.
+  StuckValues []string
+  // FaultNames names the bits of the fault DP's bitmap, bit 0 first.
+  FaultNames map[int]string
+  // OfflineGrace is how long a device may be offline before the offline
+  // detector fires, OfflineRamp how long it takes to reach full strength.
+  OfflineGrace time.Duration
+  OfflineRamp  time.Duration
+  // NoCleanWindow is the period without a clean cycle that sets
+  // Input.NoClean, for the reason only.
+  NoCleanWindow time.Duration
+  // StuckDuration is how long the device has to be stuck before stuck_log
+  // and fault count.
+  StuckDuration time.Duration
+  // Rule is DETECT_RULE, nil without one.
+  Rule *rules.Rule
+  // Weights are the detectors' weights by name, see DefaultWeights.
+  Weights map[string]float64
+}
+
+// Log is a device log entry with its value as Tuya reports it.
+type Log struct {
+  Code  string
+  Value string
+  Time  time.Time
+}
+
+// Input is what detectors decide on: the device state of the current check
+// and what the caller tracks across checks.
+type Input struct {
+  Settings Settings
+  DeviceID string
+  Online   bool
+  // LastSeen is when the device last reported to the cloud, zero when
+  // Tuya does not say.
+  LastSeen time.Time
+  // OfflineSince is since when an offline device is known to be offline,
+  // zero when that is not known yet.
+  OfflineSince time.Time
+  Status       map[string]interface{}
+  // Logs are the recent log entries, newest first.
+  Logs []Log
+  // OfflineOK is set while a manual override treats an offline device as
+  // ok, NoClean when no clean cycle was seen within Settings.NoCleanWindow.
+  OfflineOK bool
+  NoClean   bool
+  // Stuck is the paused or fault state the device is in, tracked across
+  // checks, nil when it is not in one.
+  Stuck *Period
+  // Env is what Settings.Rule is evaluated against; Run adds the values
+  // of the other detectors as detectors.
+  Env rules.Env
+  // Values holds the strength of each detector that ran before this one.
+  Values map[string]float64
+}
+
+// Contribution is what one detector added to the score.
+type Contribution struct {
+  Name   string  `json:"name"`
+  Value  float64 `json:"value"`
+  Weight float64 `json:"weight"`
+  Reason string  `json:"reason"`
+}
+
+// Detection is the outcome of Run.
+type Detection struct {
+  Score  float64
+  Reason string
+  Inputs []Contribution
+}
+
+// DefaultWeights reproduce the preset's yes/no detection: every input it
+// knows about is enough for a reset on its own, fault codes only count when
+// weighted explicitly.
+func DefaultWeights(s Settings) map[string]float64 {
+  weights := map[string]float64{}
+  for _, d := range detectors {
+    weights[d.Name()] = d.DefaultWeight(s)
+  }
+  return weights
+}
+
+// ParseWeights applies DETECT_WEIGHTS, e.g. "offline=0.5,fault=0.4", on top
+// of weights.
+func ParseWeights(s string, weights map[string]float64) error {
+  for _, part := range strings.Split(s, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+    name, value, ok := strings.Cut(part, "=")
+    name = strings.TrimSpace(name)
+    if !ok {
+      return fmt.Errorf("%q (expected input=weight)", part)
+    }
+    if _, known := weights[name]; !known {
+      return fmt.Errorf("unknown input %q (valid: %s)", name, strings.Join(Names(), ", "))
+    }
+    weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+    if err != nil || weight < 0 {
+      return fmt.Errorf("invalid weight %q for %s", value, name)
+    }
+    weights[name] = weight
+  }
+  return nil
+}
+
+// ParseThreshold parses a score threshold such as RESET_THRESHOLD.
+func ParseThreshold(s string) (float64, error) {
+  threshold, err := strconv.ParseFloat(s, 64)
+  if err != nil || threshold <= 0 || threshold > 1 {
+    return 0, fmt.Errorf("%s (expected a number above 0 and at most 1)", s)
+  }
+  return threshold, nil
+}
+
+// FormatScore formats a score for logs and messages.
+func FormatScore(score float64) string {
+  return strconv.FormatFloat(score, 'f', 2, 64)
+}
+
+// Run runs the detectors and combines their values into a confidence score
+// between 0 and 1. The reason is taken from the input contributing the
+// most. A detector that fails is logged and skipped.
+func Run(in *Input, logger *slog.Logger) Detection {
+  if in.Values == nil {
+    in.Values = map[string]float64{}
+  }
+  var detection Detection
+  for _, d := range detectors {
+    value, reason, err := d.Detect(in)
+    if err != nil {
+      logger.Warn("Detector failed", "detector", d.Name(), "error", err)
+      continue
+    }
+    value = math.Max(0, value)
+    in.Values[d.Name()] = math.Min(1, value)
+    if value > 0 {
+      detection.Inputs = append(detection.Inputs, Contribution{Name: d.Name(), Value: math.Min(1, value), Weight: in.Settings.Weights[d.Name()], Reason: reason})
+    }
+  }
+
+  sort.SliceStable(detection.Inputs, func(i, j int) bool {
+    a, b := detection.Inputs[i], detection.Inputs[j]
+    return a.Value*a.Weight > b.Value*b.Weight
+  })
+  for _, input := range detection.Inputs {
+    detection.Score += input.Value * input.Weight
+  }
+  detection.Score = math.Min(1, detection.Score)
+  if detection.Score > 0 {
+    detection.Reason = detection.Inputs[0].Reason
+  }
+  return detection
+}
@@ -0,0 +1,186 @@
+package detect
+
+import (
+  "log/slog"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "shitbox-fixer/pkg/rules"
+)
+
+func TestRun(t *testing.T) {
+  settings := Settings{
+    ResetOnOffline: true,
+    StuckValues:    []string{"paused"},
+    FaultNames:     map[int]string{1: "drawer missing"},
+  }
+  settings.Weights = DefaultWeights(settings)
+  detectRule, err := rules.Parse(`detectors.offline > 0 && status["switch"] == false as "switched off"`)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    name       string
+    in         Input
+    rule       *rules.Rule
+    weights    string
+    wantScore  float64
+    wantReason string
+  }{
+    {
+      name:      "healthy",
+      in:        Input{Online: true, Status: map[string]interface{}{"work_state": "standby"}},
+      wantScore: 0,
+    },
+    {
+      name:       "offline",
+      in:         Input{LastSeen: time.Now().Add(-time.Hour)},
+      wantScore:  1,
+      wantReason: "device offline for 1h0m0s",
+    },
+    {
+      name:      "offline within grace",
+      in:        Input{Settings: Settings{OfflineGrace: 2 * time.Hour}, LastSeen: time.Now().Add(-time.Hour)},
+      wantScore: 0,
+    },
+    {
+      name:      "offline but overridden",
+      in:        Input{OfflineOK: true},
+      wantScore: 0,
+    },
+    {
+      name:       "stuck value in logs",
+      in:         Input{Online: true, Logs: []Log{{Code: "work_state", Value: "paused"}}},
+      wantScore:  1,
+      wantReason: "log value paused",
+    },
+    {
+      name:      "fault not weighted by default",
+      in:        Input{Online: true, Status: map[string]interface{}{"fault": 2.0}},
+      wantScore: 0,
+    },
+    {
+      name:       "weighted fault",
+      in:         Input{Online: true, Status: map[string]interface{}{"fault": 2.0}},
+      weights:    "fault=0.4",
+      wantScore:  0.4,
+      wantReason: "fault: drawer missing",
+    },
+    {
+      name:       "weights add up",
+      in:         Input{Online: true, Status: map[string]interface{}{"fault": 1.0}, NoClean: true, Settings: Settings{NoCleanWindow: 24 * time.Hour}},
+      weights:    "fault=0.3,no_clean=0.5",
+      wantScore:  0.8,
+      wantReason: "no clean within 24h0m0s",
+    },
+    {
+      name: "rule reads detector values",
+      in: Input{
+        LastSeen: time.Now().Add(-time.Hour),
+        Env:      rules.Env{"status": map[string]interface{}{"switch": false}},
+      },
+      rule:       detectRule,
+      weights:    "offline=0.2",
+      wantScore:  1,
+      wantReason: "rule: switched off",
+    },
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      in := tt.in
+      s := settings
+      s.OfflineGrace = in.Settings.OfflineGrace
+      s.NoCleanWindow = in.Settings.NoCleanWindow
+      s.Rule = tt.rule
+      s.Weights = DefaultWeights(settings)
+      if err := ParseWeights(tt.weights, s.Weights); err != nil {
+        t.Fatal(err)
+      }
+      in.Settings = s
+      got := Run(&in, slog.New(slog.DiscardHandler))
+      if FormatScore(got.Score) != FormatScore(tt.wantScore) || got.Reason != tt.wantReason {
+        t.Errorf("Run() = %s %q, want %s %q", FormatScore(got.Score), got.Reason, FormatScore(tt.wantScore), tt.wantReason)
+      }
+    })
+  }
+}
+
+func TestParseWeights(t *testing.T) {
+  weights := DefaultWeights(Settings{})
+  if err := ParseWeights(" offline = 0.5, fault=0.25 ", weights); err != nil {
+    t.Fatal(err)
+  }
+  want := map[string]float64{"offline": 0.5, "stuck_log": 1, "fault": 0.25, "no_clean": 1, "rule": 1}
+  if !reflect.DeepEqual(weights, want) {
+    t.Errorf("ParseWeights() = %v, want %v", weights, want)
+  }
+
+  for _, s := range []string{"offline", "unknown=1", "fault=-1", "fault=x"} {
+    if err := ParseWeights(s, DefaultWeights(Settings{})); err == nil {
+      t.Errorf("ParseWeights(%q) succeeded, want an error", s)
+    }
+  }
+}
+
+func TestCurrentlyStuck(t *testing.T) {
+  start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+  settings := Settings{StuckValues: []string{"paused"}}
+  tests := []struct {
+    name      string
+    in        Input
+    open      *Period
+    want      *Period
+    wantKnown bool
+  }{
+    {
+      name:      "not stuck",
+      in:        Input{Status: map[string]interface{}{"work_state": "standby"}},
+      wantKnown: true,
+    },
+    {
+      name: "status value dated by its log entry",
+      in: Input{
+        Status: map[string]interface{}{"work_state": "paused"},
+        Logs:   []Log{{Code: "work_state", Value: "paused", Time: start}},
+      },
+      want:      &Period{Since: start, Reason: "status value paused", Code: "work_state"},
+      wantKnown: true,
+    },
+    {
+      name:      "newer log entry ended it",
+      in:        Input{Logs: []Log{{Code: "work_state", Value: "standby"}, {Code: "work_state", Value: "paused"}}},
+      wantKnown: true,
+    },
+    {
+      name:      "fault",
+      in:        Input{Status: map[string]interface{}{"fault": true}},
+      want:      &Period{Reason: "fault reported", Code: "fault"},
+      wantKnown: true,
+    },
+    {
+      name:      "open period outside status and logs",
+      in:        Input{Status: map[string]interface{}{"switch": true}},
+      open:      &Period{Since: start, Reason: "log value paused", Code: "work_state"},
+      wantKnown: false,
+    },
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      tt.in.Settings = settings
+      got, known := CurrentlyStuck(&tt.in, tt.open)
+      if !reflect.DeepEqual(got, tt.want) || known != tt.wantKnown {
+        t.Errorf("CurrentlyStuck() = %+v, %v, want %+v, %v", got, known, tt.want, tt.wantKnown)
+      }
+    })
+  }
+}
+
+func TestDecodeFaults(t *testing.T) {
+  got := strings.Join(DecodeFaults(map[int]string{0: "motor"}, 5.0), ", ")
+  if want := "motor, bit 2"; got != want {
+    t.Errorf("DecodeFaults() = %q, want %q", got, want)
+  }
+}
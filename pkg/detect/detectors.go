@@ -0,0 +1,217 @@
+package detect
+
+import (
+  "fmt"
+  "math"
+  "strings"
+  "time"
+)
+
+// Detector is one input of the confidence score. Detect returns how
+// strongly the device needs a reset, between 0 and 1, and why; the score
+// adds it up with the detector's weight from Settings.Weights. An error is
+// logged and the detector skipped for that check.
+type Detector interface {
+  // Name is used in DETECT_WEIGHTS, the check result and history.
+  Name() string
+  // DefaultWeight is the weight without DETECT_WEIGHTS.
+  DefaultWeight(s Settings) float64
+  Detect(in *Input) (float64, string, error)
+}
+
+// detectors are the registered detectors, in the order they are run. The
+// rule detector stays last, since DETECT_RULE can use the others' values.
+var detectors = []Detector{
+  offlineDetector{},
+  stuckLogDetector{},
+  faultDetector{},
+  noCleanDetector{},
+  ruleDetector{},
+}
+
+// Register adds a detector, e.g. from the init function of the package that
+// implements it. It runs before the rule detector. Names must be unique.
+func Register(d Detector) {
+  for _, existing := range detectors {
+    if existing.Name() == d.Name() {
+      panic("detector registered twice: " + d.Name())
+    }
+  }
+  last := len(detectors) - 1
+  detectors = append(detectors[:last], d, detectors[last])
+}
+
+// Names returns the names of the registered detectors, in the order they
+// are run.
+func Names() []string {
+  names := make([]string, 0, len(detectors))
+  for _, d := range detectors {
+    names = append(names, d.Name())
+  }
+  return names
+}
+
+type offlineDetector struct{}
+
+func (offlineDetector) Name() string { return "offline" }
+
+func (offlineDetector) DefaultWeight(s Settings) float64 {
+  if s.ResetOnOffline {
+    return 1
+  }
+  return 0
+}
+
+// Detect grows from 0 to 1 over OfflineRamp, measured from the last time
+// the device reported to the cloud. Within OfflineGrace it does not fire at
+// all.
+func (offlineDetector) Detect(in *Input) (float64, string, error) {
+  if in.Online || in.OfflineOK {
+    return 0, "", nil
+  }
+  if grace := in.Settings.OfflineGrace; grace > 0 {
+    since := in.OfflineSince
+    if since.IsZero() {
+      since = in.LastSeen
+    }
+    if since.IsZero() || time.Since(since) < grace {
+      return 0, "", nil
+    }
+  }
+  if in.LastSeen.IsZero() {
+    return 1, "device offline", nil
+  }
+  offline := time.Since(in.LastSeen).Truncate(time.Second)
+  reason := fmt.Sprintf("device offline for %s", offline)
+  if in.Settings.OfflineRamp <= 0 {
+    return 1, reason, nil
+  }
+  return math.Min(1, math.Max(0, float64(offline)/float64(in.Settings.OfflineRamp))), reason, nil
+}
+
+// DecodeFaults names the bits set in a fault bitmap, using names and "bit
+// N" for bits it does not know.
+func DecodeFaults(names map[int]string, value interface{}) []string {
+  bits, ok := value.(float64)
+  if !ok || bits <= 0 {
+    return nil
+  }
+  var faults []string
+  for bit := 0; bit < 64; bit++ {
+    if uint64(bits)&(1<<bit) == 0 {
+      continue
+    }
+    name, ok := names[bit]
+    if !ok {
+      name = fmt.Sprintf("bit %d", bit)
+    }
+    faults = append(faults, name)
+  }
+  return faults
+}
+
+type faultDetector struct{}
+
+func (faultDetector) Name() string { return "fault" }
+
+func (faultDetector) DefaultWeight(Settings) float64 { return 0 }
+
+// Detect reports whether the device raises a fault DP, with StuckDuration
+// applied.
+func (faultDetector) Detect(in *Input) (float64, string, error) {
+  value, reason := activeFault(in)
+  value, reason = stuckLongEnough(in, value, reason)
+  return value, reason, nil
+}
+
+// activeFault reports whether the device raises a fault DP. Tuya uses a
+// bitmap, so anything but 0 means at least one fault is active.
+func activeFault(in *Input) (float64, string) {
+  switch value := in.Status["fault"].(type) {
+  case float64:
+    if names := DecodeFaults(in.Settings.FaultNames, value); len(names) > 0 {
+      return 1, "fault: " + strings.Join(names, ", ")
+    }
+    if value != 0 {
+      return 1, fmt.Sprintf("fault code %v", value)
+    }
+  case bool:
+    if value {
+      return 1, "fault reported"
+    }
+  case string:
+    if value != "" && value != "0" {
+      return 1, "fault " + value
+    }
+  }
+  return 0, ""
+}
+
+// stuckLogDetector looks for the stuck values in the logs, and in the stuck
+// state tracked across checks, which outlasts the recent logs.
+type stuckLogDetector struct{}
+
+func (stuckLogDetector) Name() string { return "stuck_log" }
+
+func (stuckLogDetector) DefaultWeight(Settings) float64 { return 1 }
+
+func (stuckLogDetector) Detect(in *Input) (float64, string, error) {
+  for _, log := range in.Logs {
+    if isStuckValue(in.Settings, log.Value) {
+      value, reason := stuckLongEnough(in, 1, fmt.Sprintf("log value %s", log.Value))
+      return value, reason, nil
+    }
+  }
+  if in.Stuck != nil && in.Stuck.Code != "fault" {
+    value, reason := stuckLongEnough(in, 1, in.Stuck.Reason)
+    return value, reason, nil
+  }
+  return 0, "", nil
+}
+
+type noCleanDetector struct{}
+
+func (noCleanDetector) Name() string { return "no_clean" }
+
+func (noCleanDetector) DefaultWeight(Settings) float64 { return 1 }
+
+func (noCleanDetector) Detect(in *Input) (float64, string, error) {
+  if !in.NoClean {
+    return 0, "", nil
+  }
+  return 1, fmt.Sprintf("no clean within %s", in.Settings.NoCleanWindow), nil
+}
+
+// ruleDetector checks Settings.Rule.
+type ruleDetector struct{}
+
+func (ruleDetector) Name() string { return "rule" }
+
+func (ruleDetector) DefaultWeight(Settings) float64 { return 1 }
+
+func (ruleDetector) Detect(in *Input) (float64, string, error) {
+  rule := in.Settings.Rule
+  if rule == nil {
+    return 0, "", nil
+  }
+  env := make(map[string]interface{}, len(in.Env)+1)
+  for name, value := range in.Env {
+    env[name] = value
+  }
+  values := map[string]interface{}{}
+  for name, value := range in.Values {
+    values[name] = value
+  }
+  env["detectors"] = values
+  matched, labels, err := rule.Explain(env)
+  if err != nil {
+    return 0, "", fmt.Errorf("failed to evaluate DETECT_RULE %s: %w", rule.Source, err)
+  }
+  if !matched {
+    return 0, "", nil
+  }
+  if len(labels) > 0 {
+    return 1, "rule: " + strings.Join(labels, ", "), nil
+  }
+  return 1, "rule " + rule.Source, nil
+}
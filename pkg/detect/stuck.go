@@ -0,0 +1,85 @@
+package detect
+
+import (
+  "fmt"
+  "slices"
+  "sort"
+  "time"
+)
+
+// Period is a paused or fault state the device is in.
+type Period struct {
+  Since  time.Time `json:"since"`
+  Reason string    `json:"reason"`
+  // Code is the DP that holds the stuck value, or fault.
+  Code string `json:"code,omitempty"`
+}
+
+func isStuckValue(s Settings, value string) bool {
+  return slices.Contains(s.StuckValues, value)
+}
+
+// CurrentlyStuck reports the stuck state the device is in right now: a
+// status DP or the newest log entry of a DP carries one of the stuck
+// values, or the fault DP is set. It returns nil when the device is not
+// stuck, and known is false when that cannot be told: the DP of the open
+// period is neither in the status nor in the logs, which only cover the
+// last minutes. Since is zero when the status does not tell.
+func CurrentlyStuck(in *Input, open *Period) (period *Period, known bool) {
+  // Logs are newest first, so the first entry per code is its current value.
+  latest := map[string]Log{}
+  for _, log := range in.Logs {
+    if _, ok := latest[log.Code]; !ok {
+      latest[log.Code] = log
+    }
+  }
+
+  codes := make([]string, 0, len(in.Status))
+  for code := range in.Status {
+    codes = append(codes, code)
+  }
+  sort.Strings(codes)
+  for _, code := range codes {
+    value := fmt.Sprint(in.Status[code])
+    if !isStuckValue(in.Settings, value) {
+      continue
+    }
+    // The status has no timestamps, the log entry tells when it began.
+    var since time.Time
+    if log, ok := latest[code]; ok && log.Value == value {
+      since = log.Time
+    }
+    return &Period{Since: since, Reason: "status value " + value, Code: code}, true
+  }
+  for _, log := range in.Logs {
+    if latest[log.Code] == log && isStuckValue(in.Settings, log.Value) {
+      return &Period{Since: log.Time, Reason: "log value " + log.Value, Code: log.Code}, true
+    }
+  }
+  if value, reason := activeFault(in); value > 0 {
+    return &Period{Reason: reason, Code: "fault"}, true
+  }
+
+  if open == nil || open.Code == "" {
+    return nil, true
+  }
+  _, inStatus := in.Status[open.Code]
+  _, inLogs := latest[open.Code]
+  return nil, inStatus || inLogs
+}
+
+// stuckLongEnough applies Settings.StuckDuration to a stuck_log or fault
+// input: it only counts once the device has been stuck for that long.
+func stuckLongEnough(in *Input, value float64, reason string) (float64, string) {
+  if value == 0 || in.Settings.StuckDuration <= 0 {
+    return value, reason
+  }
+  if in.Stuck == nil {
+    return 0, ""
+  }
+  stuckFor := time.Since(in.Stuck.Since).Truncate(time.Second)
+  if stuckFor < in.Settings.StuckDuration {
+    return 0, ""
+  }
+  return value, fmt.Sprintf("%s for %s", reason, stuckFor)
+}
@@ -0,0 +1,224 @@
+// Package notify formats notifications about a device and delivers them to
+// a channel: a webhook that receives them as JSON, PagerDuty or Opsgenie.
+// Queueing during quiet hours, deduplication and the inbox are left to the
+// caller, which keeps their state.
+package notify
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "slices"
+  "strings"
+  "text/template"
+  "time"
+)
+
+// Notification levels, lowest first.
+const (
+  LevelInfo    = "info"
+  LevelWarning = "warning"
+  LevelError   = "error"
+
+  // Critical notifications are escalations.
+  LevelCritical = "critical"
+)
+
+// LevelRank orders the levels, unknown levels rank as info.
+func LevelRank(level string) int {
+  switch level {
+  case LevelCritical:
+    return 3
+  case LevelError:
+    return 2
+  case LevelWarning:
+    return 1
+  default:
+    return 0
+  }
+}
+
+// Events that end the device's problem: PagerDuty and Opsgenie resolve the
+// device's alert on them.
+const (
+  EventReset     = "reset"
+  EventRecovered = "recovered"
+)
+
+type Notification struct {
+  ID       int       `json:"id,omitempty"`
+  Time     time.Time `json:"time"`
+  Level    string    `json:"level"`
+  Event    string    `json:"event,omitempty"`
+  DeviceID string    `json:"device_id"`
+  Title    string    `json:"title"`
+  Message  string    `json:"message"`
+
+  // Check is the check that raised the notification, for templates and
+  // the details of alerts, nil when none did.
+  Check *Check `json:"-"`
+}
+
+// Check is what a notification tells about the check that raised it.
+type Check struct {
+  DeviceName string
+  Online     bool
+  Status     map[string]interface{}
+  Reason     string
+  Score      float64
+  Logs       []interface{}
+}
+
+// Channel kinds; a webhook receives the notification as JSON, the others
+// are converted to the receiver's API.
+const (
+  KindWebhook   = "webhook"
+  KindPagerDuty = "pagerduty"
+  KindOpsgenie  = "opsgenie"
+)
+
+type Channel struct {
+  Name     string
+  Kind     string
+  URL      string
+  Template *template.Template
+
+  // MinLevel skips notifications of lower levels.
+  MinLevel string
+
+  // Key and Levels are the API key and the mapping of notification levels
+  // of channels that are not webhooks.
+  Key    string
+  Levels map[string]string
+
+  // Client sends the requests, a client with a 10s timeout when nil.
+  Client *http.Client
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// templateData is what a template can refer to, e.g. {{.DeviceName}},
+// {{.Reason}} or {{index .Status "fault"}}, next to the fields of the
+// notification itself.
+type templateData struct {
+  Notification
+  DeviceName string
+  Online     bool
+  Status     map[string]interface{}
+  Reason     string
+  Score      float64
+  Logs       []interface{}
+}
+
+// ParseTemplate parses a message template, e.g. NOTIFY_TEMPLATE. Its
+// functions are time (formatted with formatTime), score, upper and lower.
+func ParseTemplate(name, text string, formatTime func(time.Time) string) (*template.Template, error) {
+  return template.New(name).Option("missingkey=zero").Funcs(template.FuncMap{
+    "time":  formatTime,
+    "score": formatScore,
+    "upper": strings.ToUpper,
+    "lower": strings.ToLower,
+  }).Parse(text)
+}
+
+func formatScore(score float64) string {
+  return fmt.Sprintf("%.2f", score)
+}
+
+// Render returns the notification with the message of the channel's
+// template. A template that fails keeps the default message, so the
+// notification is not lost.
+func (c Channel) Render(logger *slog.Logger, n Notification) Notification {
+  if c.Template == nil {
+    return n
+  }
+  data := templateData{Notification: n, Status: map[string]interface{}{}}
+  if n.Check != nil {
+    data.DeviceName = n.Check.DeviceName
+    data.Online = n.Check.Online
+    data.Status = n.Check.Status
+    data.Reason = n.Check.Reason
+    data.Score = n.Check.Score
+    data.Logs = n.Check.Logs
+  }
+  var b strings.Builder
+  if err := c.Template.Execute(&b, data); err != nil {
+    logger.Warn("Failed to render notification template", "channel", c.Name, "error", err)
+    return n
+  }
+  n.Message = b.String()
+  return n
+}
+
+// Deliver sends the notification to the channel.
+func (c Channel) Deliver(n Notification) error {
+  switch c.Kind {
+  case KindPagerDuty:
+    event := c.pagerDutyEvent(n)
+    if event == nil {
+      return nil
+    }
+    return PostJSON(c.client(), c.URL, event)
+  case KindOpsgenie:
+    return c.deliverOpsgenie(n)
+  default:
+    return PostJSON(c.client(), c.URL, n)
+  }
+}
+
+func (c Channel) client() *http.Client {
+  if c.Client == nil {
+    return defaultClient
+  }
+  return c.Client
+}
+
+// PostJSON posts body as JSON and fails unless the receiver answers with a
+// 2xx status.
+func PostJSON(client *http.Client, url string, body interface{}) error {
+  payload, err := json.Marshal(body)
+  if err != nil {
+    return err
+  }
+
+  resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return fmt.Errorf("unexpected status %s", resp.Status)
+  }
+  return nil
+}
+
+// ParseLevelMap parses a mapping of notification levels to the values of a
+// receiver, e.g. "warning=info,error=critical", on top of defaults.
+func ParseLevelMap(s string, defaults map[string]string, valid []string) (map[string]string, error) {
+  levels := map[string]string{}
+  for level, value := range defaults {
+    levels[level] = value
+  }
+  for _, part := range strings.Split(s, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+    level, value, ok := strings.Cut(part, "=")
+    level, value = strings.TrimSpace(level), strings.TrimSpace(value)
+    if !ok {
+      return nil, fmt.Errorf("%q (expected level=value)", part)
+    }
+    if _, known := defaults[level]; !known {
+      return nil, fmt.Errorf("unknown level %q (valid: warning, error, critical)", level)
+    }
+    if !slices.Contains(valid, value) {
+      return nil, fmt.Errorf("invalid value %q for %s (valid: %s)", value, level, strings.Join(valid, ", "))
+    }
+    levels[level] = value
+  }
+  return levels, nil
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+  "encoding/json"
+  "io"
+  "log/slog"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "testing"
+  "time"
+)
+
+func TestDeliver(t *testing.T) {
+  n := Notification{
+    Time:     time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+    Level:    LevelError,
+    Event:    "reset_failed",
+    DeviceID: "dev1",
+    Title:    "Reset failed",
+    Message:  "device offline",
+    Check:    &Check{DeviceName: "Litter box", Reason: "device offline", Score: 1},
+  }
+  tests := []struct {
+    name    string
+    channel Channel
+    n       Notification
+    want    map[string]interface{}
+  }{
+    {
+      name:    "webhook",
+      channel: Channel{Kind: KindWebhook},
+      n:       n,
+      want: map[string]interface{}{
+        "time": "2026-01-02T03:04:05Z", "level": "error", "event": "reset_failed",
+        "device_id": "dev1", "title": "Reset failed", "message": "device offline",
+      },
+    },
+    {
+      name:    "pagerduty trigger",
+      channel: Channel{Kind: KindPagerDuty, Key: "key", Levels: map[string]string{LevelError: "critical"}},
+      n:       n,
+      want: map[string]interface{}{
+        "routing_key": "key", "event_action": "trigger", "dedup_key": "shitbox-fixer/dev1",
+        "payload": map[string]interface{}{
+          "summary": "Reset failed: device offline", "source": "dev1", "severity": "critical",
+          "timestamp": "2026-01-02T03:04:05Z", "component": "shitbox-fixer",
+          "custom_details": map[string]interface{}{
+            "device_id": "dev1", "level": "error", "message": "device offline", "event": "reset_failed",
+            "device_name": "Litter box", "online": false, "reason": "device offline", "score": 1.0,
+          },
+        },
+      },
+    },
+    {
+      name:    "pagerduty resolve",
+      channel: Channel{Kind: KindPagerDuty, Key: "key"},
+      n:       Notification{Event: EventRecovered, DeviceID: "dev1"},
+      want:    map[string]interface{}{"routing_key": "key", "event_action": "resolve", "dedup_key": "shitbox-fixer/dev1"},
+    },
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      var got map[string]interface{}
+      server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        if err := json.Unmarshal(body, &got); err != nil {
+          t.Errorf("invalid JSON %s: %v", body, err)
+        }
+      }))
+      defer server.Close()
+      tt.channel.URL = server.URL
+      if err := tt.channel.Deliver(tt.n); err != nil {
+        t.Fatal(err)
+      }
+      if !reflect.DeepEqual(got, tt.want) {
+        t.Errorf("delivered %v, want %v", got, tt.want)
+      }
+    })
+  }
+}
+
+func TestDeliverSkipsUnmappedLevel(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    t.Error("notification delivered, want it skipped")
+  }))
+  defer server.Close()
+  channel := Channel{Kind: KindPagerDuty, URL: server.URL, Levels: map[string]string{LevelWarning: SeverityNone}}
+  if err := channel.Deliver(Notification{Level: LevelWarning, DeviceID: "dev1"}); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestRender(t *testing.T) {
+  tmpl, err := ParseTemplate("NOTIFY_TEMPLATE", `{{upper .Level}} {{.DeviceName}}: {{.Reason}} ({{score .Score}}, {{index .Status "fault"}})`, func(t time.Time) string { return t.Format(time.DateTime) })
+  if err != nil {
+    t.Fatal(err)
+  }
+  channel := Channel{Name: "webhook", Template: tmpl}
+  n := Notification{Level: LevelWarning, Message: "default", Check: &Check{DeviceName: "Litter box", Reason: "fault: bit 1", Score: 0.5, Status: map[string]interface{}{"fault": 2}}}
+  if got, want := channel.Render(slog.New(slog.DiscardHandler), n).Message, "WARNING Litter box: fault: bit 1 (0.50, 2)"; got != want {
+    t.Errorf("Render() = %q, want %q", got, want)
+  }
+}
+
+func TestParseLevelMap(t *testing.T) {
+  defaults := map[string]string{LevelWarning: "P3", LevelError: "P2", LevelCritical: "P1"}
+  got, err := ParseLevelMap("warning=none, error=P1", defaults, OpsgeniePriorities)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if want := map[string]string{LevelWarning: "none", LevelError: "P1", LevelCritical: "P1"}; !reflect.DeepEqual(got, want) {
+    t.Errorf("ParseLevelMap() = %v, want %v", got, want)
+  }
+  for _, s := range []string{"warning", "info=P1", "error=P9"} {
+    if _, err := ParseLevelMap(s, defaults, OpsgeniePriorities); err == nil {
+      t.Errorf("ParseLevelMap(%q) succeeded, want an error", s)
+    }
+  }
+}
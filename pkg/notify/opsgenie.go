@@ -0,0 +1,89 @@
+package notify
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/url"
+  "strings"
+)
+
+// OpsgenieAPIURL is the Opsgenie API, api.eu.opsgenie.com for EU accounts.
+const OpsgenieAPIURL = "https://api.opsgenie.com"
+
+// OpsgeniePriorities are the values for the Levels of an Opsgenie channel.
+var OpsgeniePriorities = []string{"P1", "P2", "P3", "P4", "P5", SeverityNone}
+
+type opsgenieAlert struct {
+  Message     string            `json:"message"`
+  Alias       string            `json:"alias"`
+  Description string            `json:"description,omitempty"`
+  Priority    string            `json:"priority"`
+  Source      string            `json:"source"`
+  Entity      string            `json:"entity"`
+  Tags        []string          `json:"tags,omitempty"`
+  Details     map[string]string `json:"details,omitempty"`
+}
+
+type opsgenieClose struct {
+  Source string `json:"source"`
+  Note   string `json:"note,omitempty"`
+}
+
+// deliverOpsgenie creates or closes the device's Opsgenie alert. Like
+// PagerDuty, every device has one alias, so Opsgenie deduplicates repeated
+// problems into one alert and a reset or recovery closes it.
+func (c Channel) deliverOpsgenie(n Notification) error {
+  // No slash, the alias is part of the URL to close the alert.
+  alias := "shitbox-fixer-" + n.DeviceID
+  if isResolution(n) {
+    return c.postOpsgenie("/v2/alerts/"+url.PathEscape(alias)+"/close?identifierType=alias", opsgenieClose{Source: "shitbox-fixer", Note: n.Title + ": " + n.Message})
+  }
+
+  priority := c.Levels[n.Level]
+  if priority == "" || priority == SeverityNone {
+    return nil
+  }
+  message := n.Title
+  if len(message) > 130 {
+    message = message[:127] + "..."
+  }
+  details := map[string]string{}
+  for key, value := range alertDetails(n) {
+    details[key] = fmt.Sprint(value)
+  }
+  return c.postOpsgenie("/v2/alerts", opsgenieAlert{
+    Message:     message,
+    Alias:       alias,
+    Description: n.Message,
+    Priority:    priority,
+    Source:      "shitbox-fixer",
+    Entity:      n.DeviceID,
+    Tags:        []string{n.Level},
+    Details:     details,
+  })
+}
+
+func (c Channel) postOpsgenie(path string, body interface{}) error {
+  payload, err := json.Marshal(body)
+  if err != nil {
+    return err
+  }
+  req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.URL, "/")+path, bytes.NewReader(payload))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("Authorization", "GenieKey "+c.Key)
+
+  resp, err := c.client().Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return fmt.Errorf("unexpected status %s", resp.Status)
+  }
+  return nil
+}
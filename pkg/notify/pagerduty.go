@@ -0,0 +1,89 @@
+package notify
+
+import "time"
+
+// PagerDutyEventsURL is the endpoint of the PagerDuty Events API v2.
+const PagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// SeverityNone as the severity or priority of a level keeps it from
+// raising an alert.
+const SeverityNone = "none"
+
+// PagerDutySeverities are the values for the Levels of a PagerDuty channel.
+var PagerDutySeverities = []string{"critical", "error", "warning", "info", SeverityNone}
+
+type pagerDutyPayload struct {
+  Summary       string                 `json:"summary"`
+  Source        string                 `json:"source"`
+  Severity      string                 `json:"severity"`
+  Timestamp     time.Time              `json:"timestamp"`
+  Component     string                 `json:"component"`
+  CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+type pagerDutyEvent struct {
+  RoutingKey  string            `json:"routing_key"`
+  EventAction string            `json:"event_action"`
+  DedupKey    string            `json:"dedup_key"`
+  Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// isResolution reports whether a notification ends the device's problem.
+func isResolution(n Notification) bool {
+  return n.Event == EventReset || n.Event == EventRecovered
+}
+
+func alertDedupKey(deviceID string) string {
+  return "shitbox-fixer/" + deviceID
+}
+
+func alertDetails(n Notification) map[string]interface{} {
+  details := map[string]interface{}{"device_id": n.DeviceID, "level": n.Level, "message": n.Message}
+  if n.Event != "" {
+    details["event"] = n.Event
+  }
+  if n.Check != nil {
+    if n.Check.DeviceName != "" {
+      details["device_name"] = n.Check.DeviceName
+    }
+    details["online"] = n.Check.Online
+    if n.Check.Reason != "" {
+      details["reason"] = n.Check.Reason
+      details["score"] = n.Check.Score
+    }
+  }
+  return details
+}
+
+// pagerDutyEvent turns a notification into an Events API v2 event. Every
+// device has one dedup key, so repeated problems update a single PagerDuty
+// incident and a reset or recovery resolves it. It returns nil for
+// notifications PagerDuty does not need.
+func (c Channel) pagerDutyEvent(n Notification) *pagerDutyEvent {
+  event := &pagerDutyEvent{RoutingKey: c.Key, DedupKey: alertDedupKey(n.DeviceID)}
+  if isResolution(n) {
+    event.EventAction = "resolve"
+    return event
+  }
+  severity := c.Levels[n.Level]
+  if severity == "" || severity == SeverityNone {
+    return nil
+  }
+  event.EventAction = "trigger"
+  summary := n.Title
+  if n.Message != "" {
+    summary += ": " + n.Message
+  }
+  if len(summary) > 1024 {
+    summary = summary[:1021] + "..."
+  }
+  event.Payload = &pagerDutyPayload{
+    Summary:       summary,
+    Source:        n.DeviceID,
+    Severity:      severity,
+    Timestamp:     n.Time,
+    Component:     "shitbox-fixer",
+    CustomDetails: alertDetails(n),
+  }
+  return event
+}
@@ -0,0 +1,636 @@
+// Package rules implements the rule language of DETECT_RULE, VERIFY_RULE
+// and the verify conditions of reset sequences: boolean expressions over
+// the device status, its logs and what the detectors found.
+package rules
+
+import (
+  "fmt"
+  "reflect"
+  "slices"
+  "strconv"
+  "strings"
+  "time"
+  "unicode"
+)
+
+// Rule is a boolean expression over the device state, used for detection and
+// verification, e.g.
+//
+//	status["work_state"] in ["standby", "cleaning"] && device.online
+//
+// Supported are string, number, boolean, null and list literals, durations
+// (10m, counted in seconds), identifiers, member access (device.online),
+// indexing (status["switch"]), the operators ! && || == != < <= > >= and in,
+// and parentheses. A condition can be labeled with as "label"; Explain
+// reports the labels of the conditions that made the rule hold.
+type Rule struct {
+  Source string
+  root   exprNode
+}
+
+// Env holds the values a rule can refer to by name, e.g. status and device.
+type Env map[string]interface{}
+
+type exprNode interface {
+  eval(env Env) (interface{}, error)
+}
+
+// Parse compiles source into a rule.
+func Parse(source string) (*Rule, error) {
+  tokens, err := tokenizeExpr(source)
+  if err != nil {
+    return nil, err
+  }
+  p := &exprParser{tokens: tokens}
+  root, err := p.parse(0)
+  if err != nil {
+    return nil, err
+  }
+  if tok := p.peek(); tok.kind != tokEOF {
+    return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+  }
+  return &Rule{Source: source, root: root}, nil
+}
+
+// Eval reports whether the rule holds for env.
+func (r *Rule) Eval(env Env) (bool, error) {
+  value, err := r.root.eval(env)
+  if err != nil {
+    return false, err
+  }
+  return truthy(value), nil
+}
+
+// Explain is Eval that also returns the labels of the conditions that made
+// the rule hold: for || the branch that was true, for && both sides.
+func (r *Rule) Explain(env Env) (bool, []string, error) {
+  value, labels, err := explainNode(r.root, env)
+  if err != nil || !truthy(value) {
+    return false, nil, err
+  }
+  return true, labels, nil
+}
+
+func explainNode(node exprNode, env Env) (interface{}, []string, error) {
+  switch n := node.(type) {
+  case *labelNode:
+    value, labels, err := explainNode(n.operand, env)
+    if err != nil || !truthy(value) {
+      return value, nil, err
+    }
+    return value, append([]string{n.label}, labels...), nil
+  case *binaryNode:
+    if n.op != "&&" && n.op != "||" {
+      break
+    }
+    left, leftLabels, err := explainNode(n.left, env)
+    if err != nil {
+      return nil, nil, err
+    }
+    if n.op == "||" && truthy(left) {
+      return true, leftLabels, nil
+    }
+    if n.op == "&&" && !truthy(left) {
+      return false, nil, nil
+    }
+    right, rightLabels, err := explainNode(n.right, env)
+    if err != nil || !truthy(right) {
+      return false, nil, err
+    }
+    if n.op == "&&" {
+      return true, append(leftLabels, rightLabels...), nil
+    }
+    return true, rightLabels, nil
+  }
+  // Labels under ! or inside comparisons do not explain anything.
+  value, err := node.eval(env)
+  return value, nil, err
+}
+
+func (r *Rule) String() string {
+  return r.Source
+}
+
+// StatusCodes returns the DP codes the rule reads with status["code"] or
+// status.code, sorted and without duplicates.
+func (r *Rule) StatusCodes() []string {
+  return r.KeysOf("status")
+}
+
+// KeysOf returns the literal keys the rule looks up in the map ident,
+// sorted and without duplicates.
+func (r *Rule) KeysOf(ident string) []string {
+  codes := []string{}
+  var walk func(node exprNode)
+  walk = func(node exprNode) {
+    switch n := node.(type) {
+    case *indexNode:
+      if object, ok := n.object.(*identNode); ok && object.name == ident {
+        if key, ok := n.key.(*literalNode); ok {
+          if code, ok := key.value.(string); ok {
+            if !slices.Contains(codes, code) {
+              codes = append(codes, code)
+            }
+          }
+        }
+      }
+      walk(n.object)
+      walk(n.key)
+    case *notNode:
+      walk(n.operand)
+    case *labelNode:
+      walk(n.operand)
+    case *binaryNode:
+      walk(n.left)
+      walk(n.right)
+    case *listNode:
+      for _, item := range n.items {
+        walk(item)
+      }
+    }
+  }
+  walk(r.root)
+  slices.Sort(codes)
+  return codes
+}
+
+// Tokenizer
+
+const (
+  tokEOF = iota
+  tokIdent
+  tokString
+  tokNumber
+  tokOp
+)
+
+type exprToken struct {
+  kind int
+  text string
+  pos  int
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+  var tokens []exprToken
+  i := 0
+  for i < len(s) {
+    c := rune(s[i])
+    switch {
+    case unicode.IsSpace(c):
+      i++
+    case c == '"' || c == '\'':
+      end := i + 1
+      for end < len(s) && rune(s[end]) != c {
+        if s[end] == '\\' {
+          end++
+        }
+        end++
+      }
+      if end >= len(s) {
+        return nil, fmt.Errorf("unterminated string at position %d", i)
+      }
+      raw := s[i : end+1]
+      if c == '\'' {
+        raw = strconv.Quote(strings.ReplaceAll(raw[1:len(raw)-1], `\'`, `'`))
+      }
+      text, err := strconv.Unquote(raw)
+      if err != nil {
+        return nil, fmt.Errorf("invalid string at position %d", i)
+      }
+      tokens = append(tokens, exprToken{tokString, text, i})
+      i = end + 1
+    case unicode.IsDigit(c) || (c == '-' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1]))):
+      end := i + 1
+      for end < len(s) && (unicode.IsDigit(rune(s[end])) || s[end] == '.') {
+        end++
+      }
+      if end < len(s) && unicode.IsLetter(rune(s[end])) {
+        // A duration such as 10m or 1h30m, in seconds.
+        for end < len(s) && (unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end])) || s[end] == '.') {
+          end++
+        }
+        seconds, err := parseExprDuration(s[i:end])
+        if err != nil {
+          return nil, fmt.Errorf("invalid duration %q at position %d", s[i:end], i)
+        }
+        tokens = append(tokens, exprToken{tokNumber, strconv.FormatFloat(seconds, 'f', -1, 64), i})
+        i = end
+        break
+      }
+      tokens = append(tokens, exprToken{tokNumber, s[i:end], i})
+      i = end
+    case unicode.IsLetter(c) || c == '_':
+      end := i + 1
+      for end < len(s) && (unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end])) || s[end] == '_') {
+        end++
+      }
+      tokens = append(tokens, exprToken{tokIdent, s[i:end], i})
+      i = end
+    default:
+      matched := false
+      for _, op := range exprOps {
+        if strings.HasPrefix(s[i:], op) {
+          tokens = append(tokens, exprToken{tokOp, op, i})
+          i += len(op)
+          matched = true
+          break
+        }
+      }
+      if !matched {
+        return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+      }
+    }
+  }
+  return append(tokens, exprToken{tokEOF, "end of expression", len(s)}), nil
+}
+
+// parseExprDuration parses a Go duration, or a number of days such as 2d,
+// into seconds.
+func parseExprDuration(s string) (float64, error) {
+  if days, ok := strings.CutSuffix(s, "d"); ok {
+    n, err := strconv.ParseFloat(days, 64)
+    if err != nil {
+      return 0, err
+    }
+    return n * 24 * 3600, nil
+  }
+  d, err := time.ParseDuration(s)
+  if err != nil {
+    return 0, err
+  }
+  return d.Seconds(), nil
+}
+
+// Parser
+
+type exprParser struct {
+  tokens []exprToken
+  pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+  return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+  tok := p.tokens[p.pos]
+  if tok.kind != tokEOF {
+    p.pos++
+  }
+  return tok
+}
+
+func (p *exprParser) expect(op string) error {
+  if tok := p.next(); tok.kind != tokOp || tok.text != op {
+    return fmt.Errorf("expected %q at position %d, got %q", op, tok.pos, tok.text)
+  }
+  return nil
+}
+
+// labelPrecedence binds as "label" looser than comparisons and tighter than
+// && and ||, so a > 1 as "x" || b labels a > 1.
+const labelPrecedence = 3
+
+func binaryPrecedence(tok exprToken) int {
+  switch {
+  case tok.kind == tokOp && tok.text == "||":
+    return 1
+  case tok.kind == tokOp && tok.text == "&&":
+    return 2
+  case tok.kind == tokOp && (tok.text == "==" || tok.text == "!="):
+    return 4
+  case tok.kind == tokOp && (tok.text == "<" || tok.text == "<=" || tok.text == ">" || tok.text == ">="):
+    return 5
+  case tok.kind == tokIdent && tok.text == "in":
+    return 5
+  }
+  return 0
+}
+
+func (p *exprParser) parse(minPrecedence int) (exprNode, error) {
+  left, err := p.parseUnary()
+  if err != nil {
+    return nil, err
+  }
+  for {
+    tok := p.peek()
+    if tok.kind == tokIdent && tok.text == "as" && labelPrecedence > minPrecedence {
+      p.next()
+      label := p.next()
+      if label.kind != tokString {
+        return nil, fmt.Errorf("expected label string after \"as\" at position %d", label.pos)
+      }
+      left = &labelNode{label: label.text, operand: left}
+      continue
+    }
+    precedence := binaryPrecedence(tok)
+    if precedence == 0 || precedence <= minPrecedence {
+      return left, nil
+    }
+    p.next()
+    right, err := p.parse(precedence)
+    if err != nil {
+      return nil, err
+    }
+    left = &binaryNode{op: tok.text, left: left, right: right}
+  }
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+  if tok := p.peek(); tok.kind == tokOp && tok.text == "!" {
+    p.next()
+    operand, err := p.parseUnary()
+    if err != nil {
+      return nil, err
+    }
+    return &notNode{operand: operand}, nil
+  }
+  return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+  node, err := p.parsePrimary()
+  if err != nil {
+    return nil, err
+  }
+  for {
+    tok := p.peek()
+    switch {
+    case tok.kind == tokOp && tok.text == ".":
+      p.next()
+      name := p.next()
+      if name.kind != tokIdent {
+        return nil, fmt.Errorf("expected field name at position %d", name.pos)
+      }
+      node = &indexNode{object: node, key: &literalNode{value: name.text}}
+    case tok.kind == tokOp && tok.text == "[":
+      p.next()
+      key, err := p.parse(0)
+      if err != nil {
+        return nil, err
+      }
+      if err := p.expect("]"); err != nil {
+        return nil, err
+      }
+      node = &indexNode{object: node, key: key}
+    default:
+      return node, nil
+    }
+  }
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+  tok := p.next()
+  switch tok.kind {
+  case tokString:
+    return &literalNode{value: tok.text}, nil
+  case tokNumber:
+    value, err := strconv.ParseFloat(tok.text, 64)
+    if err != nil {
+      return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+    }
+    return &literalNode{value: value}, nil
+  case tokIdent:
+    switch tok.text {
+    case "true":
+      return &literalNode{value: true}, nil
+    case "false":
+      return &literalNode{value: false}, nil
+    case "null":
+      return &literalNode{value: nil}, nil
+    case "in", "as":
+      return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+    }
+    return &identNode{name: tok.text}, nil
+  case tokOp:
+    switch tok.text {
+    case "(":
+      node, err := p.parse(0)
+      if err != nil {
+        return nil, err
+      }
+      return node, p.expect(")")
+    case "[":
+      list := &listNode{}
+      if next := p.peek(); next.kind == tokOp && next.text == "]" {
+        p.next()
+        return list, nil
+      }
+      for {
+        item, err := p.parse(0)
+        if err != nil {
+          return nil, err
+        }
+        list.items = append(list.items, item)
+        sep := p.next()
+        if sep.kind == tokOp && sep.text == "]" {
+          return list, nil
+        }
+        if sep.kind != tokOp || sep.text != "," {
+          return nil, fmt.Errorf("expected \",\" or \"]\" at position %d, got %q", sep.pos, sep.text)
+        }
+      }
+    }
+  }
+  return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// Evaluation
+
+type literalNode struct {
+  value interface{}
+}
+
+func (n *literalNode) eval(Env) (interface{}, error) {
+  return n.value, nil
+}
+
+type identNode struct {
+  name string
+}
+
+func (n *identNode) eval(env Env) (interface{}, error) {
+  value, ok := env[n.name]
+  if !ok {
+    return nil, fmt.Errorf("unknown identifier %q", n.name)
+  }
+  return value, nil
+}
+
+type listNode struct {
+  items []exprNode
+}
+
+func (n *listNode) eval(env Env) (interface{}, error) {
+  values := make([]interface{}, 0, len(n.items))
+  for _, item := range n.items {
+    value, err := item.eval(env)
+    if err != nil {
+      return nil, err
+    }
+    values = append(values, value)
+  }
+  return values, nil
+}
+
+// indexNode looks up a map key or list element. Missing keys are null, so
+// rules can test DPs that not every device reports.
+type indexNode struct {
+  object exprNode
+  key    exprNode
+}
+
+func (n *indexNode) eval(env Env) (interface{}, error) {
+  object, err := n.object.eval(env)
+  if err != nil {
+    return nil, err
+  }
+  key, err := n.key.eval(env)
+  if err != nil {
+    return nil, err
+  }
+  switch o := object.(type) {
+  case map[string]interface{}:
+    return o[fmt.Sprint(key)], nil
+  case []interface{}:
+    i, ok := key.(float64)
+    if !ok || i < 0 || int(i) >= len(o) {
+      return nil, nil
+    }
+    return o[int(i)], nil
+  case nil:
+    return nil, nil
+  }
+  return nil, fmt.Errorf("cannot index %T", object)
+}
+
+type notNode struct {
+  operand exprNode
+}
+
+func (n *notNode) eval(env Env) (interface{}, error) {
+  value, err := n.operand.eval(env)
+  if err != nil {
+    return nil, err
+  }
+  return !truthy(value), nil
+}
+
+// labelNode names a condition for Explain.
+type labelNode struct {
+  label   string
+  operand exprNode
+}
+
+func (n *labelNode) eval(env Env) (interface{}, error) {
+  return n.operand.eval(env)
+}
+
+type binaryNode struct {
+  op    string
+  left  exprNode
+  right exprNode
+}
+
+func (n *binaryNode) eval(env Env) (interface{}, error) {
+  left, err := n.left.eval(env)
+  if err != nil {
+    return nil, err
+  }
+
+  switch n.op {
+  case "&&":
+    if !truthy(left) {
+      return false, nil
+    }
+    right, err := n.right.eval(env)
+    return truthy(right), err
+  case "||":
+    if truthy(left) {
+      return true, nil
+    }
+    right, err := n.right.eval(env)
+    return truthy(right), err
+  }
+
+  right, err := n.right.eval(env)
+  if err != nil {
+    return nil, err
+  }
+
+  switch n.op {
+  case "==":
+    return exprEqual(left, right), nil
+  case "!=":
+    return !exprEqual(left, right), nil
+  case "in":
+    return exprContains(right, left), nil
+  }
+
+  if l, ok := left.(float64); ok {
+    if r, ok := right.(float64); ok {
+      return compareOrdered(n.op, l, r), nil
+    }
+  }
+  if l, ok := left.(string); ok {
+    if r, ok := right.(string); ok {
+      return compareOrdered(n.op, l, r), nil
+    }
+  }
+  return false, nil
+}
+
+func compareOrdered[T float64 | string](op string, l, r T) bool {
+  switch op {
+  case "<":
+    return l < r
+  case "<=":
+    return l <= r
+  case ">":
+    return l > r
+  default:
+    return l >= r
+  }
+}
+
+func truthy(value interface{}) bool {
+  switch v := value.(type) {
+  case nil:
+    return false
+  case bool:
+    return v
+  case float64:
+    return v != 0
+  case string:
+    return v != ""
+  case []interface{}:
+    return len(v) > 0
+  case map[string]interface{}:
+    return len(v) > 0
+  }
+  return true
+}
+
+func exprEqual(a, b interface{}) bool {
+  return reflect.DeepEqual(a, b)
+}
+
+func exprContains(container, item interface{}) bool {
+  switch c := container.(type) {
+  case []interface{}:
+    for _, element := range c {
+      if exprEqual(element, item) {
+        return true
+      }
+    }
+  case map[string]interface{}:
+    _, ok := c[fmt.Sprint(item)]
+    return ok
+  case string:
+    s, ok := item.(string)
+    return ok && strings.Contains(c, s)
+  }
+  return false
+}
@@ -0,0 +1,164 @@
+package rules
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestParseRuleErrors(t *testing.T) {
+  tests := []struct {
+    source string
+    want   string
+  }{
+    {`status["switch"`, `expected "]"`},
+    {`(device.online`, `expected ")"`},
+    {`device.online &&`, `unexpected "end of expression"`},
+    {`"unterminated`, "unterminated string"},
+    {`device.online device.online`, `unexpected "device"`},
+    {`10x > 1`, "invalid duration"},
+    {`device.`, "expected field name"},
+    {`[1, 2`, `expected "," or "]"`},
+    {`a as b`, "expected label string"},
+    {`in`, `unexpected "in"`},
+    {`a # b`, `unexpected '#'`},
+  }
+  for _, tt := range tests {
+    t.Run(tt.source, func(t *testing.T) {
+      _, err := Parse(tt.source)
+      if err == nil || !strings.Contains(err.Error(), tt.want) {
+        t.Errorf("Parse(%q) error = %v, want it to contain %q", tt.source, err, tt.want)
+      }
+    })
+  }
+}
+
+func TestRuleEval(t *testing.T) {
+  env := Env{
+    "status": map[string]interface{}{
+      "work_state":   "standby",
+      "battery":      float64(80),
+      "switch":       true,
+      "fault":        float64(0),
+      "pause_reason": "",
+    },
+    "device":  map[string]interface{}{"online": true, "name": "Litter box"},
+    "stuck":   float64(900),
+    "visits":  []interface{}{"cat", "cat"},
+    "nothing": nil,
+  }
+  tests := []struct {
+    source string
+    want   bool
+  }{
+    {`device.online`, true},
+    {`!device.online`, false},
+    {`status["work_state"] in ["standby", "cleaning"] && device.online`, true},
+    {`status["work_state"] in ["cleaning"]`, false},
+    {`status.work_state == 'standby'`, true},
+    {`status["work_state"] != "standby"`, false},
+    {`status["battery"] >= 80 && status["battery"] < 81`, true},
+    {`status["battery"] > 80`, false},
+    {`stuck > 10m`, true},
+    {`stuck >= 1h`, false},
+    {`stuck < 1d`, true},
+    {`-1 < 0`, true},
+    {`status["missing"] == null`, true},
+    {`status["missing"]`, false},
+    {`nothing.field == null`, true},
+    {`status["fault"]`, false},
+    {`status["pause_reason"]`, false},
+    {`"Litter" in device.name`, true},
+    {`"online" in device`, true},
+    {`visits[1] == "cat" && visits[5] == null`, true},
+    {`[]`, false},
+    {`"b" > "a"`, true},
+    {`"1" == 1`, false},
+    {`"10" > 9`, false},
+    {`device.online || unknown`, true},
+    {`!device.online && unknown`, false},
+    {`(status.switch || false) && !(stuck < 60)`, true},
+    {`false || true && false`, false},
+  }
+  for _, tt := range tests {
+    t.Run(tt.source, func(t *testing.T) {
+      rule, err := Parse(tt.source)
+      if err != nil {
+        t.Fatalf("Parse(%q): %v", tt.source, err)
+      }
+      got, err := rule.Eval(env)
+      if err != nil {
+        t.Fatalf("Eval(%q): %v", tt.source, err)
+      }
+      if got != tt.want {
+        t.Errorf("Eval(%q) = %v, want %v", tt.source, got, tt.want)
+      }
+    })
+  }
+}
+
+func TestRuleEvalErrors(t *testing.T) {
+  env := Env{"device": map[string]interface{}{"online": true}, "count": float64(1)}
+  tests := []struct {
+    source string
+    want   string
+  }{
+    {`unknown`, `unknown identifier "unknown"`},
+    {`device.online && unknown`, `unknown identifier "unknown"`},
+    {`count.field`, "cannot index float64"},
+  }
+  for _, tt := range tests {
+    t.Run(tt.source, func(t *testing.T) {
+      rule, err := Parse(tt.source)
+      if err != nil {
+        t.Fatalf("Parse(%q): %v", tt.source, err)
+      }
+      if _, err := rule.Eval(env); err == nil || !strings.Contains(err.Error(), tt.want) {
+        t.Errorf("Eval(%q) error = %v, want it to contain %q", tt.source, err, tt.want)
+      }
+    })
+  }
+}
+
+func TestRuleExplain(t *testing.T) {
+  env := Env{"a": true, "b": true, "c": false, "n": float64(5)}
+  tests := []struct {
+    source string
+    holds  bool
+    labels []string
+  }{
+    {`a as "first" || b as "second"`, true, []string{"first"}},
+    {`c as "first" || b as "second"`, true, []string{"second"}},
+    {`a as "first" && b as "second"`, true, []string{"first", "second"}},
+    {`a as "first" && c as "second"`, false, nil},
+    {`n > 1 as "many" || c`, true, []string{"many"}},
+    {`(a && b) as "both"`, true, []string{"both"}},
+    {`!(c as "inner")`, true, nil},
+  }
+  for _, tt := range tests {
+    t.Run(tt.source, func(t *testing.T) {
+      rule, err := Parse(tt.source)
+      if err != nil {
+        t.Fatalf("Parse(%q): %v", tt.source, err)
+      }
+      holds, labels, err := rule.Explain(env)
+      if err != nil {
+        t.Fatalf("Explain(%q): %v", tt.source, err)
+      }
+      if holds != tt.holds || !reflect.DeepEqual(labels, tt.labels) {
+        t.Errorf("Explain(%q) = %v, %q, want %v, %q", tt.source, holds, labels, tt.holds, tt.labels)
+      }
+    })
+  }
+}
+
+func TestRuleStatusCodes(t *testing.T) {
+  rule, err := Parse(`status["work_state"] in ["standby"] && (status.fault == 0 || status["work_state"] == device.state) && other["x"]`)
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := []string{"fault", "work_state"}
+  if got := rule.StatusCodes(); !reflect.DeepEqual(got, want) {
+    t.Errorf("StatusCodes() = %q, want %q", got, want)
+  }
+}
@@ -0,0 +1,420 @@
+// Package tuyaclient is a client for the Tuya cloud API: it signs requests,
+// keeps the access token and retries calls that failed for reasons that
+// may go away. Logging, tracing and recording of the exchanges are left to
+// the caller through Options.
+package tuyaclient
+
+import (
+  "bytes"
+  "context"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Tuya error code returned when the access token has expired.
+const codeTokenExpired = 1010
+
+// tokenExpiryMargin renews the access token this long before Tuya lets it
+// expire, so a request signed with it does not arrive after the expiry,
+// e.g. after retries or with a clock that drifts.
+const tokenExpiryMargin = 5 * time.Minute
+
+// Limiter spaces out requests, e.g. to stay below the rate limit of the
+// cloud project.
+type Limiter interface {
+  Wait(ctx context.Context) error
+}
+
+// Tracer starts a span for every request sent.
+type Tracer interface {
+  Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced request. End gets the error of the request, or of a
+// success=false response.
+type Span interface {
+  SetAttr(key string, value interface{})
+  End(err error)
+}
+
+// Hooks are called for every request sent.
+type Hooks struct {
+  // Exchange gets the request with the string that was signed, and the
+  // response or the error when none was read.
+  Exchange func(req *http.Request, toSign string, body []byte, resp *http.Response, data []byte, err error)
+  // Response gets every response that was read and is not retried.
+  Response func(method, uri, status string, body, data []byte)
+}
+
+// Options configure a Client. APIHost, AccessID and AccessKey are
+// required, the rest is optional.
+type Options struct {
+  // APIHost is the data center of the cloud project, e.g.
+  // https://openapi.tuyaeu.com.
+  APIHost   string
+  AccessID  string
+  AccessKey string
+
+  // HTTPClient defaults to http.DefaultClient.
+  HTTPClient *http.Client
+  // MaxAttempts is the number of tries per request, the first included,
+  // DefaultMaxAttempts when zero.
+  MaxAttempts int
+  // Logger gets the requests and retries at debug level.
+  Logger  *slog.Logger
+  Limiter Limiter
+  // TokenStore keeps the access token between runs.
+  TokenStore TokenStore
+  Tracer     Tracer
+  Hooks      Hooks
+  // ErrorHints explains Tuya error codes in the message of an APIError.
+  ErrorHints map[int]string
+}
+
+// Client makes signed calls to the Tuya cloud API. It is safe for
+// concurrent use.
+type Client struct {
+  apiHost     string
+  httpClient  *http.Client
+  maxAttempts int
+  logger      *slog.Logger
+  limiter     Limiter
+  store       TokenStore
+  tracer      Tracer
+  hooks       Hooks
+  hints       map[int]string
+
+  credMu    sync.RWMutex
+  accessID  string
+  accessKey string
+
+  mu        sync.Mutex
+  token     string
+  expiresAt time.Time
+}
+
+type response struct {
+  Code    int    `json:"code"`
+  Msg     string `json:"msg"`
+  Success bool   `json:"success"`
+  T       int64  `json:"t"`
+}
+
+type tokenResponse struct {
+  Code    int    `json:"code"`
+  Msg     string `json:"msg"`
+  Success bool   `json:"success"`
+  Result  struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    ExpireTime   int    `json:"expire_time"`
+    UID          string `json:"uid"`
+  } `json:"result"`
+  T int64 `json:"t"`
+}
+
+// New returns a client for the cloud project of opts.
+func New(opts Options) *Client {
+  c := &Client{
+    apiHost:     strings.TrimSuffix(opts.APIHost, "/"),
+    httpClient:  opts.HTTPClient,
+    maxAttempts: opts.MaxAttempts,
+    logger:      opts.Logger,
+    limiter:     opts.Limiter,
+    store:       opts.TokenStore,
+    tracer:      opts.Tracer,
+    hooks:       opts.Hooks,
+    hints:       opts.ErrorHints,
+    accessID:    opts.AccessID,
+    accessKey:   opts.AccessKey,
+  }
+  if c.httpClient == nil {
+    c.httpClient = http.DefaultClient
+  }
+  if c.maxAttempts <= 0 {
+    c.maxAttempts = DefaultMaxAttempts
+  }
+  if c.logger == nil {
+    c.logger = slog.New(slog.DiscardHandler)
+  }
+  return c
+}
+
+// Get calls the API and decodes the body into resp. A success=false body
+// is not an error here; callers inspect resp themselves, see Error.
+func (c *Client) Get(ctx context.Context, uri string, resp interface{}) error {
+  return c.request(ctx, http.MethodGet, uri, nil, resp)
+}
+
+// Post sends payload as the JSON body of the call, like Get otherwise.
+func (c *Client) Post(ctx context.Context, uri string, payload []byte, resp interface{}) error {
+  return c.request(ctx, http.MethodPost, uri, payload, resp)
+}
+
+// Error returns the APIError for a success=false response, with the hint
+// of ErrorHints for its code.
+func (c *Client) Error(code int, msg string) *APIError {
+  return &APIError{Code: code, Msg: msg, Hint: c.hints[code]}
+}
+
+func newNonce() string {
+  buf := make([]byte, 16)
+  _, _ = rand.Read(buf)
+  return hex.EncodeToString(buf)
+}
+
+// StringToSign follows Tuya's signature algorithm: method, body hash, signed
+// headers (none) and the path with the query parameters sorted by key.
+func StringToSign(method string, u *url.URL, body []byte) string {
+  sum := sha256.Sum256(body)
+
+  uri := u.Path
+  query := u.Query()
+  if len(query) > 0 {
+    keys := make([]string, 0, len(query))
+    for key := range query {
+      keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    pairs := make([]string, 0, len(keys))
+    for _, key := range keys {
+      pairs = append(pairs, key+"="+query.Get(key))
+    }
+    uri += "?" + strings.Join(pairs, "&")
+  }
+
+  return method + "\n" + hex.EncodeToString(sum[:]) + "\n" + "\n" + uri
+}
+
+// Sign returns the sign header of a request: the HMAC-SHA256 of the access
+// ID, token (empty for the token request), timestamp, nonce and the string
+// to sign, keyed with the access secret.
+func Sign(accessID, accessKey, token, timestamp, nonce, toSign string) string {
+  mac := hmac.New(sha256.New, []byte(accessKey))
+  mac.Write([]byte(accessID + token + timestamp + nonce + toSign))
+  return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Credentials returns the access ID and secret in use.
+func (c *Client) Credentials() (string, string) {
+  c.credMu.RLock()
+  defer c.credMu.RUnlock()
+  return c.accessID, c.accessKey
+}
+
+// SetCredentials replaces rotated credentials and drops the access token
+// issued for the old ones. It reports whether they changed.
+func (c *Client) SetCredentials(accessID, accessKey string) bool {
+  c.credMu.Lock()
+  changed := accessID != c.accessID || accessKey != c.accessKey
+  c.accessID, c.accessKey = accessID, accessKey
+  c.credMu.Unlock()
+
+  if changed {
+    c.mu.Lock()
+    c.token = ""
+    c.mu.Unlock()
+  }
+  return changed
+}
+
+// send makes an API call, retrying it with backoff when it failed for
+// reasons that may go away, see retryable.
+func (c *Client) send(ctx context.Context, method, uri string, body []byte, token string) ([]byte, error) {
+  for attempt := 1; ; attempt++ {
+    if c.limiter != nil {
+      if err := c.limiter.Wait(ctx); err != nil {
+        return nil, err
+      }
+    }
+    data, err := c.sendOnce(ctx, method, uri, body, token)
+    if err == nil || attempt >= c.maxAttempts || ctx.Err() != nil || !retryable(method, err) {
+      return data, err
+    }
+    delay := retryDelay(attempt, err)
+    path, _, _ := strings.Cut(uri, "?")
+    c.logger.Debug("Retrying Tuya API request", "method", method, "uri", path, "attempt", attempt, "delay", delay, "error", err)
+    if err := sleep(ctx, delay); err != nil {
+      return nil, err
+    }
+  }
+}
+
+func (c *Client) sendOnce(ctx context.Context, method, uri string, body []byte, token string) (data []byte, err error) {
+  path, _, _ := strings.Cut(uri, "?")
+  var span Span
+  // A success=false body fails the span, but not the call.
+  var apiErr error
+  if c.tracer != nil {
+    ctx, span = c.tracer.Start(ctx, "Tuya "+method+" "+path)
+    span.SetAttr("http.request.method", method)
+    span.SetAttr("url.path", path)
+    defer func() {
+      if err != nil {
+        span.End(err)
+      } else {
+        span.End(apiErr)
+      }
+    }()
+  }
+
+  req, err := http.NewRequestWithContext(ctx, method, c.apiHost+uri, bytes.NewReader(body))
+  if err != nil {
+    return nil, err
+  }
+  if span != nil {
+    span.SetAttr("server.address", req.URL.Host)
+  }
+
+  timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+  nonce := newNonce()
+
+  accessID, accessKey := c.Credentials()
+
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("client_id", accessID)
+  req.Header.Set("sign_method", "HMAC-SHA256")
+  req.Header.Set("t", timestamp)
+  req.Header.Set("nonce", nonce)
+  if token != "" {
+    req.Header.Set("access_token", token)
+  }
+  toSign := StringToSign(method, req.URL, body)
+  req.Header.Set("sign", Sign(accessID, accessKey, token, timestamp, nonce, toSign))
+
+  resp, err := c.httpClient.Do(req)
+  if err != nil {
+    if c.hooks.Exchange != nil {
+      c.hooks.Exchange(req, toSign, body, nil, nil, err)
+    }
+    return nil, err
+  }
+  defer resp.Body.Close()
+  if span != nil {
+    span.SetAttr("http.response.status_code", resp.StatusCode)
+  }
+
+  data, err = io.ReadAll(resp.Body)
+  if c.hooks.Exchange != nil {
+    c.hooks.Exchange(req, toSign, body, resp, data, err)
+  }
+  if err != nil {
+    return nil, err
+  }
+  if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+    c.logger.Debug("Tuya API request", "method", method, "uri", uri, "status", resp.Status, "body", string(data))
+    return nil, &StatusError{Status: resp.Status, StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+  }
+
+  var result response
+  if span != nil && json.Unmarshal(data, &result) == nil {
+    span.SetAttr("tuya.success", result.Success)
+    if !result.Success {
+      span.SetAttr("tuya.code", result.Code)
+      apiErr = c.Error(result.Code, result.Msg)
+    }
+  }
+
+  c.logger.Debug("Tuya API request", "method", method, "uri", uri, "status", resp.Status, "body", string(data))
+  if c.hooks.Response != nil {
+    c.hooks.Response(method, uri, resp.Status, body, data)
+  }
+  return data, nil
+}
+
+// AccessToken returns the access token, requesting a new one when there
+// is none yet, it is about to expire or refresh is set.
+func (c *Client) AccessToken(ctx context.Context, refresh bool) (string, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if !refresh && c.token == "" && c.store != nil {
+    c.loadStoredToken()
+  }
+  if !refresh && c.token != "" && time.Now().Before(c.expiresAt) {
+    return c.token, nil
+  }
+
+  data, err := c.send(ctx, http.MethodGet, "/v1.0/token?grant_type=1", nil, "")
+  if err != nil {
+    return "", fmt.Errorf("failed to get access token: %w", err)
+  }
+
+  resp := &tokenResponse{}
+  if err := json.Unmarshal(data, resp); err != nil {
+    return "", fmt.Errorf("failed to get access token: %w", err)
+  }
+  if !resp.Success {
+    return "", fmt.Errorf("failed to get access token: %w", c.Error(resp.Code, resp.Msg))
+  }
+
+  c.token = resp.Result.AccessToken
+  lifetime := time.Duration(resp.Result.ExpireTime) * time.Second
+  if lifetime > 2*tokenExpiryMargin {
+    lifetime -= tokenExpiryMargin
+  } else {
+    lifetime /= 2
+  }
+  c.expiresAt = time.Now().Add(lifetime)
+  if c.store != nil {
+    c.storeToken()
+  }
+  return c.token, nil
+}
+
+// request signs and sends an API call and decodes the body into resp.
+func (c *Client) request(ctx context.Context, method, uri string, body []byte, resp interface{}) error {
+  token, err := c.AccessToken(ctx, false)
+  if err != nil {
+    return err
+  }
+
+  data, err := c.send(ctx, method, uri, body, token)
+  if err != nil {
+    return err
+  }
+
+  var result response
+  if err := json.Unmarshal(data, &result); err != nil {
+    return fmt.Errorf("invalid response: %w", err)
+  }
+
+  if !result.Success && result.Code == codeTokenExpired {
+    token, err = c.AccessToken(ctx, true)
+    if err != nil {
+      return err
+    }
+    data, err = c.send(ctx, method, uri, body, token)
+    if err != nil {
+      return err
+    }
+  }
+
+  return json.Unmarshal(data, resp)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+  timer := time.NewTimer(d)
+  defer timer.Stop()
+
+  select {
+  case <-timer.C:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
@@ -0,0 +1,70 @@
+package tuyaclient
+
+import (
+  "net/url"
+  "testing"
+)
+
+func TestStringToSign(t *testing.T) {
+  tests := []struct {
+    name   string
+    method string
+    uri    string
+    body   string
+    want   string
+  }{
+    {
+      name:   "token request",
+      method: "GET",
+      uri:    "/v1.0/token?grant_type=1",
+      want:   "GET\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n\n/v1.0/token?grant_type=1",
+    },
+    {
+      name:   "query sorted by key",
+      method: "GET",
+      uri:    "/v2.0/apps/schema/users?page_size=50&page_no=1",
+      want:   "GET\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n\n/v2.0/apps/schema/users?page_no=1&page_size=50",
+    },
+    {
+      name:   "no query",
+      method: "GET",
+      uri:    "/v1.0/devices/bf123/status",
+      want:   "GET\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n\n/v1.0/devices/bf123/status",
+    },
+    {
+      name:   "body hashed",
+      method: "POST",
+      uri:    "/v1.0/devices/bf123/commands",
+      body:   `{"commands":[{"code":"switch","value":false}]}`,
+      want:   "POST\n8082799df2992787ad67e99f596599253d5b26b2981655d926244d056bdb668f\n\n/v1.0/devices/bf123/commands",
+    },
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      u, err := url.Parse("https://openapi.tuyaeu.com" + tt.uri)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if got := StringToSign(tt.method, u, []byte(tt.body)); got != tt.want {
+        t.Errorf("StringToSign() = %q, want %q", got, tt.want)
+      }
+    })
+  }
+}
+
+// The example of Tuya's signature documentation, a service API call with
+// an access token and two signed headers.
+func TestSign(t *testing.T) {
+  const (
+    accessID  = "1KAD46OrT9HafiKdsXeg"
+    accessKey = "4OHBOnWOqaEC1mWXOpVL3yV50s0qGSRC"
+    token     = "3f4eda2bdec17232f67c0b188af3eec1"
+    timestamp = "1588925778000"
+    nonce     = "5138cc3a9033d69856923fd07b491173"
+    toSign    = "GET\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\narea_id:29a33e8796834b1efa6\ncall_id:8afdb70ab2ed11eb85290242ac130003\n\n/v2.0/apps/schema/users?page_no=1&page_size=50"
+    want      = "AE4481C692AA80B25F3A7E12C3A5FD9BBF6251539DD78E565A1A72A508A88784"
+  )
+  if got := Sign(accessID, accessKey, token, timestamp, nonce, toSign); got != want {
+    t.Errorf("Sign() = %s, want %s", got, want)
+  }
+}
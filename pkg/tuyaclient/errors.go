@@ -0,0 +1,19 @@
+package tuyaclient
+
+import "fmt"
+
+// APIError is a success=false response of the Tuya API.
+type APIError struct {
+  Code int
+  Msg  string
+  // Hint says what to do about the error, see Options.ErrorHints.
+  Hint string
+}
+
+func (e *APIError) Error() string {
+  msg := fmt.Sprintf("Tuya API error %d: %s", e.Code, e.Msg)
+  if e.Hint != "" {
+    msg += " (" + e.Hint + ")"
+  }
+  return msg
+}
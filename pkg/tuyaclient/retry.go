@@ -0,0 +1,80 @@
+package tuyaclient
+
+import (
+  "errors"
+  "math/rand/v2"
+  "net"
+  "net/http"
+  "strconv"
+  "time"
+)
+
+// DefaultMaxAttempts is the number of tries per request, the first
+// included, when Options.MaxAttempts is not set.
+const DefaultMaxAttempts = 3
+
+// Retries wait 0.5s, 1s, 2s and so on, up to 10s, with jitter so several
+// instances hitting the same limit do not retry in lockstep. A Retry-After
+// header is honored up to a minute.
+const (
+  retryBaseDelay     = 500 * time.Millisecond
+  retryMaxDelay      = 10 * time.Second
+  retryMaxRetryAfter = time.Minute
+)
+
+// StatusError is a response that was rate limited or failed on the server
+// side.
+type StatusError struct {
+  Status     string
+  StatusCode int
+  RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+  return "Tuya API returned " + e.Status
+}
+
+func parseRetryAfter(s string) time.Duration {
+  if seconds, err := strconv.Atoi(s); err == nil && seconds > 0 {
+    return min(time.Duration(seconds)*time.Second, retryMaxRetryAfter)
+  }
+  if t, err := http.ParseTime(s); err == nil {
+    return min(max(time.Until(t), 0), retryMaxRetryAfter)
+  }
+  return 0
+}
+
+// retryable reports whether a failed request may succeed when sent again.
+// Reads are retried on rate limits, server errors and network errors.
+// Commands are only retried when they cannot have reached the device: on
+// rate limits, gateway errors and failed connections. A command that timed
+// out may have been carried out, sending it again could clean twice.
+func retryable(method string, err error) bool {
+  var statusErr *StatusError
+  if errors.As(err, &statusErr) {
+    switch statusErr.StatusCode {
+    case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+      return true
+    }
+    return method == http.MethodGet
+  }
+  var opErr *net.OpError
+  if errors.As(err, &opErr) && opErr.Op == "dial" {
+    return true
+  }
+  var dnsErr *net.DNSError
+  if errors.As(err, &dnsErr) {
+    return true
+  }
+  return method == http.MethodGet
+}
+
+// retryDelay returns how long to wait before the next attempt.
+func retryDelay(attempt int, err error) time.Duration {
+  var statusErr *StatusError
+  if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+    return statusErr.RetryAfter
+  }
+  delay := min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+  return delay/2 + rand.N(delay/2+1)
+}
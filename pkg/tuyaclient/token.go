@@ -0,0 +1,58 @@
+package tuyaclient
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "time"
+)
+
+// Token is an access token kept by a TokenStore. The fingerprint ties it
+// to the API host and credentials it was issued for without storing the
+// key.
+type Token struct {
+  Fingerprint string    `json:"fingerprint"`
+  AccessToken string    `json:"access_token"`
+  ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// TokenStore keeps the access token between runs, so a run from cron does
+// not log in to Tuya every minute. Load returns a zero Token when none is
+// stored.
+type TokenStore interface {
+  Load() (Token, error)
+  Save(Token) error
+}
+
+// tokenCacheMargin keeps a stored token from expiring during the run that
+// picks it up.
+const tokenCacheMargin = time.Minute
+
+func (c *Client) tokenFingerprint() string {
+  accessID, accessKey := c.Credentials()
+  sum := sha256.Sum256([]byte(c.apiHost + "\x00" + accessID + "\x00" + accessKey))
+  return hex.EncodeToString(sum[:])
+}
+
+// loadStoredToken picks up a token stored by an earlier run. Called with
+// c.mu held.
+func (c *Client) loadStoredToken() {
+  stored, err := c.store.Load()
+  if err != nil {
+    c.logger.Debug("Ignoring cached access token", "error", err)
+    return
+  }
+  if stored.AccessToken == "" || stored.Fingerprint != c.tokenFingerprint() || time.Until(stored.ExpiresAt) < tokenCacheMargin {
+    return
+  }
+  c.logger.Debug("Using cached access token", "expires_at", stored.ExpiresAt)
+  c.token, c.expiresAt = stored.AccessToken, stored.ExpiresAt
+}
+
+// storeToken stores the current token for later runs. Called with c.mu
+// held.
+func (c *Client) storeToken() {
+  stored := Token{Fingerprint: c.tokenFingerprint(), AccessToken: c.token, ExpiresAt: c.expiresAt}
+  if err := c.store.Save(stored); err != nil {
+    c.logger.Warn("Failed to cache access token", "error", err)
+  }
+}